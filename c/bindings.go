@@ -1,28 +1,116 @@
 package main
 
 /*
+#cgo CFLAGS: -I${SRCDIR}/../include
+#include <stdlib.h>
 #include <unistd.h>
 #include <stdint.h>
+#include "us_errors.h"
 typedef struct contract_t {
 	uint8_t hostKey[32];
 	uint8_t id[32];
 	uint8_t renterKey[32];
 } contract_t;
+
+// Information about a file or directory, as returned by us_fs_stat and
+// us_dir_next. It must be released with us_fileinfo_free.
+typedef struct us_fileinfo_t {
+	char *name;
+	int64_t size;
+	uint32_t mode;     // permission bits
+	int64_t mod_time;  // seconds since the Unix epoch
+	uint8_t is_dir;
+	int min_hosts;     // hosts required to download the file
+	int num_hosts;     // hosts storing the file
+	uint8_t *hosts;    // public keys of those hosts, 32 bytes each
+} us_fileinfo_t;
+
+// Optional limits on the prices paid to hosts, as passed to
+// us_client_set_limits and us_hostset_set_limits. Prices are strings such as
+// "100H" or "1SC"; NULL or an empty string means no limit.
+typedef struct us_limits_t {
+	const char *max_storage_price;   // per byte per block
+	const char *max_upload_price;    // per byte
+	const char *max_download_price;  // per byte
+	const char *max_contract_price;
+	double min_collateral_ratio;     // collateral per storage price; 0 means no limit
+} us_limits_t;
+
+// The settings of a host, as returned by us_client_scan_host and
+// us_client_scan_hosts. Prices are decimal strings, in hastings. It must be
+// released with us_hostinfo_free.
+typedef struct us_hostinfo_t {
+	uint8_t public_key[32];
+	char *net_address;
+	char *version;
+	uint8_t accepting_contracts;
+	uint64_t max_duration;             // blocks
+	uint64_t window_size;              // blocks
+	uint64_t remaining_storage;        // bytes
+	uint64_t total_storage;            // bytes
+	char *contract_price;
+	char *storage_price;               // per byte per block
+	char *collateral;                  // per byte per block
+	char *max_collateral;
+	char *upload_bandwidth_price;      // per byte
+	char *download_bandwidth_price;    // per byte
+	char *base_rpc_price;
+	char *sector_access_price;
+	double latency_ms;                 // milliseconds
+	us_errcode_t error_code;           // set by us_client_scan_hosts if the scan failed
+	char *error;
+} us_hostinfo_t;
+
+// The result of an asynchronous operation, as returned by us_cq_poll.
+typedef struct us_completion_t {
+	uint64_t op;       // ID returned by the *_async call
+	void *ctx;         // context passed to the *_async call
+	int64_t result;    // bytes transferred, 0 on success, or -1 on failure
+	void *handle;      // new File, for us_fs_create_async and us_fs_open_async
+	us_errcode_t error_code;
+	char *error;       // NULL on success; otherwise must be freed with us_free
+} us_completion_t;
+
+void set_thread_error(char *err, int code);
+char *get_thread_error(void);
+int get_thread_error_code(void);
 */
 import "C"
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/shard"
+	"lukechampine.com/us-bindings/internal/async"
+	"lukechampine.com/us-bindings/internal/contractfile"
+	"lukechampine.com/us-bindings/internal/errcode"
+	"lukechampine.com/us-bindings/internal/handles"
+	"lukechampine.com/us-bindings/internal/pricing"
+	"lukechampine.com/us-bindings/internal/walrus"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renter/renterutil"
+	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/wallet"
 )
 
 // cgo doesn't let us pass Go pointers to C code. This is annoying, because it
@@ -37,70 +125,168 @@ import (
 // the table and calls the appropriate method. We make the API slightly nicer by
 // using unsafe.Pointer as our index, which gives us 'nil/null' semantics, but
 // in reality it's just an integer.
-var (
-	ptrtab   = make(map[uintptr]interface{})
-	ptrIndex uintptr
-	ptrMu    sync.Mutex
-)
+//
+// Each entry in the table records the kind of object it holds and a generation
+// counter that is incremented whenever the entry is freed. The handle encodes
+// both the table index and the generation, so a stale handle (i.e. one that
+// has been closed, and whose index may have been reused) or a handle of the
+// wrong kind is detected and rejected with an error, rather than crashing the
+// process.
+//
+// Entries also track their dependencies: a FileSystem depends on its HostSet,
+// and a File or Directory depends on its FileSystem. An object cannot be freed while any of
+// its dependents are still open, or while an asynchronous operation on it is
+// pending.
+//
+// The table is implemented by package handles, which the Python bindings use
+// as well.
+var ptrs handles.Table
 
-func storePtr(v interface{}) unsafe.Pointer {
-	ptrMu.Lock()
-	defer ptrMu.Unlock()
-	if v == nil {
-		return nil
+// guardOf returns the guard of the host set that the object referenced by p
+// depends on, directly or indirectly, or nil if there is none. Host errors of
+// operations on the object are explained by that guard.
+func guardOf(p unsafe.Pointer, kind handles.Kind) *pricing.Guard {
+	if hs, ok := ptrs.Root(p, kind).(*hostSet); ok {
+		return hs.guard
+	}
+	return nil
+
+}
+func loadHostSet(p unsafe.Pointer) (*hostSet, error) {
+	v, err := ptrs.Load(p, handles.HostSet)
+	if err != nil {
+		return nil, err
 	}
-	ptrIndex++
-	ptrtab[ptrIndex] = v
-	return unsafe.Pointer(ptrIndex) // go vet complains about this, but it's fine
+	return v.(*hostSet), nil
 }
 
-func loadPtr(p unsafe.Pointer) interface{} {
-	ptrMu.Lock()
-	defer ptrMu.Unlock()
-	if p == nil {
-		return nil
+func loadClient(p unsafe.Pointer) (*client, error) {
+	v, err := ptrs.Load(p, handles.Client)
+	if err != nil {
+		return nil, err
 	}
-	return ptrtab[uintptr(p)]
+	return v.(*client), nil
 }
 
-func freePtr(p unsafe.Pointer) {
-	ptrMu.Lock()
-	defer ptrMu.Unlock()
-	if p != nil {
-		delete(ptrtab, uintptr(p))
+// A fileSystem is a PseudoFS along with its root directory, which some
+// operations (e.g. renaming a directory) need to access directly.
+type fileSystem struct {
+	*renterutil.PseudoFS
+	root string
+}
+
+var errOutsideRoot = fmt.Errorf("%w: path is outside the filesystem root", errcode.ErrInvalidArgument)
+
+// cleanName cleans name, which is interpreted relative to the root of a
+// fileSystem. PseudoFS joins names to its root without checking them, so names
+// that resolve outside of the root (e.g. "../foo") are rejected here.
+func cleanName(name string) (string, error) {
+	name = filepath.Clean(filepath.FromSlash(name))
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", errOutsideRoot
 	}
+	return name, nil
 }
 
-// It's also not easy to pass errors to C code, so we store a global error on
-// the Go side and make it accessible via a function. All functions that would
-// normally return an error return a 'falsey' value instead; the C code can then
-// call us_error to access the corresponding error.
-var (
-	us_err error
-	errMu  sync.Mutex
-)
+func loadFS(p unsafe.Pointer) (*fileSystem, error) {
+	v, err := ptrs.Load(p, handles.FS)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*fileSystem), nil
+}
 
-func setError(err error) bool {
+func loadFile(p unsafe.Pointer) (*renterutil.PseudoFile, error) {
+	v, err := ptrs.Load(p, handles.File)
 	if err != nil {
-		// get calling function name
-		pc, _, _, _ := runtime.Caller(1)
-		fnName := strings.TrimPrefix(runtime.FuncForPC(pc).Name(), "main.")
-		err = fmt.Errorf("%v: %v", fnName, err)
+		return nil, err
+	}
+	return v.(*renterutil.PseudoFile), nil
+}
+
+func loadDir(p unsafe.Pointer) (*dirIter, error) {
+	v, err := ptrs.Load(p, handles.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*dirIter), nil
+}
+
+// It's also not easy to pass errors to C code, so we store the most recent
+// error on the C side and make it accessible via a function. All functions that
+// would normally return an error return a 'falsey' value instead; the C code can
+// then call us_error to access the corresponding error.
+//
+// The error is stored in thread-local storage (see errors.c). An exported
+// function always runs on the thread that called it, so each thread sees only
+// the errors produced by its own calls; a failure on one thread cannot be
+// clobbered by a success on another.
+func setError(err error) bool {
+	if err == nil {
+		C.set_thread_error(nil, C.US_OK)
+		return false
+	}
+	C.set_thread_error(C.CString(fmt.Sprintf("%v: %v", exportName(), err)), C.int(errorCode(err)))
+	return true
+}
+
+// exportName returns the name of the exported function currently executing.
+func exportName() string {
+	pcs := make([]uintptr, 128)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		f, more := frames.Next()
+		if name := strings.TrimPrefix(f.Function, "main."); strings.HasPrefix(name, "us_") {
+			return name
+		} else if !more {
+			return "unknown"
+		}
 	}
-	errMu.Lock()
-	defer errMu.Unlock()
-	us_err = err
-	return us_err != nil
 }
 
+// A panic must never unwind into C code, since the Go runtime will abort the
+// whole process. Every exported function therefore defers recoverPanic, which
+// converts a panic into an ordinary error. If fail is non-nil, it is called to
+// set the function's return value to its error value; otherwise, the zero
+// value is returned.
+func recoverPanic(fail func()) {
+	if r := recover(); r != nil {
+		setError(fmt.Errorf("%w: %v\n%s", errcode.ErrPanic, r, debug.Stack()))
+		if fail != nil {
+			fail()
+		}
+	}
+}
+
+// errorCode classifies err, returning the us_errcode_t that best describes it.
+func errorCode(err error) C.us_errcode_t {
+	return C.us_errcode_t(errcode.Of(err))
+}
+
+// us_error returns the error produced by the most recent failing call on the
+// current thread, or NULL if the most recent call succeeded. The string is
+// owned by the library and remains valid until the next call on the same
+// thread.
+//
 //export us_error
 func us_error() *C.char {
-	errMu.Lock()
-	defer errMu.Unlock()
-	if us_err == nil {
-		return nil
-	}
-	return C.CString(us_err.Error())
+	return C.get_thread_error()
+}
+
+// us_error_code returns the us_errcode_t corresponding to us_error, or US_OK
+// if the most recent call on the current thread succeeded.
+//
+//export us_error_code
+func us_error_code() C.us_errcode_t {
+	return C.us_errcode_t(C.get_thread_error_code())
+}
+
+// us_free frees memory allocated by the library. It must be used (instead of
+// free) for any memory that the library hands over to the caller.
+//
+//export us_free
+func us_free(p unsafe.Pointer) {
+	C.free(p)
 }
 
 // goBytes is like C.GoBytes, but directly aliases the C memory instead of
@@ -114,109 +300,1900 @@ func goBytes(ptr unsafe.Pointer, n int) []byte {
 }
 
 //export us_contract_init
-func us_contract_init(contract *C.struct_contract_t, data *C.char) {
+func us_contract_init(contract *C.struct_contract_t, data *C.char) bool {
+	defer recoverPanic(nil)
+	if contract == nil || data == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
 	b := goBytes(unsafe.Pointer(data), 96)
 	copy(goBytes(unsafe.Pointer(&contract.hostKey), 32), b[:32])
 	copy(goBytes(unsafe.Pointer(&contract.id), 32), b[32:64])
 	copy(goBytes(unsafe.Pointer(&contract.renterKey), 32), b[64:96])
+	return !setError(nil)
+}
+
+// us_contract_load reads a contract file, as written by the user tool, into
+// contract.
+//
+//export us_contract_load
+func us_contract_load(contract *C.struct_contract_t, path *C.char) bool {
+	defer recoverPanic(nil)
+	if contract == nil || path == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	b, err := contractfile.Read(C.GoString(path))
+	if setError(err) {
+		return false
+	}
+	copy(goBytes(unsafe.Pointer(contract), 96), b)
+	return true
+}
+
+// us_contract_init_hex initializes contract from a 192-character hex string.
+//
+//export us_contract_init_hex
+func us_contract_init_hex(contract *C.struct_contract_t, str *C.char) bool {
+	defer recoverPanic(nil)
+	if contract == nil || str == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(C.GoString(str)))
+	if err != nil {
+		return !setError(fmt.Errorf("%w: %v", contractfile.ErrInvalid, err))
+	} else if len(b) != 96 {
+		return !setError(fmt.Errorf("%w: wrong size (%v bytes, expected 96)", contractfile.ErrInvalid, len(b)))
+	}
+	copy(goBytes(unsafe.Pointer(contract), 96), b)
+	return !setError(nil)
 }
 
 //export us_hostset_init
 func us_hostset_init(srv *C.char) unsafe.Pointer {
+	defer recoverPanic(nil)
 	sc := shard.NewClient(C.GoString(srv))
 	currentHeight, err := sc.ChainHeight()
 	if setError(err) {
 		return nil
 	}
-	hs := renterutil.NewHostSet(sc, currentHeight)
-	return storePtr(hs)
+	return ptrs.Store(handles.HostSet, newHostSet(sc, currentHeight))
+}
+
+// us_hostset_free closes all of the HostSet's sessions and frees it. It fails if
+// the HostSet is still in use by a filesystem.
+//
+//export us_hostset_free
+func us_hostset_free(hostset_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if hostset_p == nil {
+		return !setError(nil)
+	}
+	v, err := ptrs.Take(hostset_p, handles.HostSet)
+	if setError(err) {
+		return false
+	}
+	return !setError(v.(*hostSet).Close())
 }
 
 //export us_hostset_add
-func us_hostset_add(hostset_p unsafe.Pointer, contract *C.struct_contract_t) {
-	hs := loadPtr(hostset_p).(*renterutil.HostSet)
+func us_hostset_add(hostset_p unsafe.Pointer, contract *C.struct_contract_t) bool {
+	defer recoverPanic(nil)
+	hs, err := loadHostSet(hostset_p)
+	if setError(err) {
+		return false
+	} else if contract == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
 	c := renter.Contract{
 		HostKey:   hostdb.HostKeyFromPublicKey(C.GoBytes(unsafe.Pointer(&contract.hostKey), 32)),
 		RenterKey: ed25519.NewKeyFromSeed(C.GoBytes(unsafe.Pointer(&contract.renterKey), 32)),
 	}
 	copy(c.ID[:], C.GoBytes(unsafe.Pointer(&contract.id), 32))
 	hs.AddHost(c)
+	return true
+}
+
+// us_hostset_add_dir adds every contract file (i.e. every file with a
+// .contract extension) in dir to the host set, returning the number of
+// contracts added. If any file is invalid, no contracts are added.
+//
+//export us_hostset_add_dir
+func us_hostset_add_dir(hostset_p unsafe.Pointer, dir *C.char) (ret C.int) {
+	defer recoverPanic(func() { ret = -1 })
+	hs, err := loadHostSet(hostset_p)
+	if setError(err) {
+		return -1
+	} else if dir == nil {
+		setError(errcode.ErrNullArgument)
+		return -1
+	}
+	infos, err := ioutil.ReadDir(C.GoString(dir))
+	if setError(err) {
+		return -1
+	}
+	var contracts []renter.Contract
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".contract" {
+			continue
+		}
+		b, err := contractfile.Read(filepath.Join(C.GoString(dir), info.Name()))
+		if setError(err) {
+			return -1
+		}
+		contracts = append(contracts, contractfile.Decode(b))
+	}
+	for _, c := range contracts {
+		hs.AddHost(c)
+	}
+	return C.int(len(contracts))
+}
+
+// Clients
+//
+// A client manages contracts. It resolves hosts through a shard server and
+// funds transactions through a walrus server, signing them with keys derived
+// from a seed that never leaves this process.
+
+type client struct {
+	*shard.Client
+	*walrus.Wallet
+	guard *pricing.Guard
+}
+
+// us_client_init creates a client that uses the shard server at shard_addr
+// and the walrus server at walrus_addr, which must track the addresses of
+// seed (a 12-word phrase). It must be freed with us_client_free.
+//
+//export us_client_init
+func us_client_init(shard_addr, walrus_addr, seed *C.char) unsafe.Pointer {
+	defer recoverPanic(nil)
+	if shard_addr == nil || walrus_addr == nil || seed == nil {
+		setError(errcode.ErrNullArgument)
+		return nil
+	}
+	s, err := wallet.SeedFromPhrase(C.GoString(seed))
+	if setError(err) {
+		return nil
+	}
+	return ptrs.Store(handles.Client, &client{
+		Client: shard.NewClient(C.GoString(shard_addr)),
+		Wallet: walrus.NewWallet(C.GoString(walrus_addr), s),
+		guard:  new(pricing.Guard),
+	})
+}
+
+//export us_client_free
+func us_client_free(client_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if client_p == nil {
+		return !setError(nil)
+	}
+	_, err := ptrs.Take(client_p, handles.Client)
+	return !setError(err)
+}
+
+// us_client_renew_contract renews contract with its host, storing the new
+// contract in renewed (which may point to contract). funds is the amount to
+// allocate to the new contract, e.g. "10SC", and the new contract ends
+// duration blocks after the current height. The renter key is unchanged. The
+// data stored under the old contract is carried over, after which the old
+// contract can no longer be revised.
+//
+//export us_client_renew_contract
+func us_client_renew_contract(client_p unsafe.Pointer, contract *C.struct_contract_t, funds *C.char, duration C.uint32_t, renewed *C.struct_contract_t) bool {
+	defer recoverPanic(nil)
+	c, err := loadClient(client_p)
+	if setError(err) {
+		return false
+	} else if contract == nil || funds == nil || renewed == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	old := contractfile.Decode(C.GoBytes(unsafe.Pointer(contract), C.sizeof_struct_contract_t))
+	payout, err := pricing.ParseCurrency(C.GoString(funds))
+	if setError(err) {
+		return false
+	}
+	addr, err := c.ResolveHostKey(old.HostKey)
+	if setError(err) {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	host, err := hostdb.Scan(ctx, addr, old.HostKey)
+	if setError(err) {
+		return false
+	} else if setError(c.guard.Limits().Check(host.HostSettings)) {
+		return false
+	}
+	currentHeight, err := c.ChainHeight()
+	if setError(err) {
+		return false
+	}
+	rev, _, err := proto.RenewContract(c, c, old.ID, old.RenterKey, host, payout, currentHeight, currentHeight+types.BlockHeight(duration))
+	if setError(err) {
+		return false
+	}
+	copy(goBytes(unsafe.Pointer(&renewed.hostKey), 32), rev.HostKey().Ed25519())
+	copy(goBytes(unsafe.Pointer(&renewed.id), 32), rev.Revision.ParentID[:])
+	copy(goBytes(unsafe.Pointer(&renewed.renterKey), 32), old.RenterKey[:ed25519.SeedSize])
+	return true
+}
+
+// Price limits
+//
+// A client or HostSet can be given limits on the prices that it will pay.
+// Host settings are checked against the limits before renewing a contract and
+// whenever a HostSet connects to a host, so a host that violates them is
+// rejected before any money moves. The limits themselves are implemented by the
+// pricing package, which is shared with the other bindings.
+
+// goLimits converts limits to pricing.Limits. A NULL limits, or a NULL or empty
+// string within it, means no limit.
+func goLimits(limits *C.us_limits_t) (pricing.Limits, error) {
+	var l pricing.Limits
+	if limits == nil {
+		return l, nil
+	}
+	for _, p := range []struct {
+		s *C.char
+		c *types.Currency
+	}{
+		{limits.max_storage_price, &l.MaxStoragePrice},
+		{limits.max_upload_price, &l.MaxUploadPrice},
+		{limits.max_download_price, &l.MaxDownloadPrice},
+		{limits.max_contract_price, &l.MaxContractPrice},
+	} {
+		if p.s == nil || C.GoString(p.s) == "" {
+			continue
+		}
+		c, err := pricing.ParseCurrency(C.GoString(p.s))
+		if err != nil {
+			return pricing.Limits{}, fmt.Errorf("%w: %v", errcode.ErrInvalidLimits, err)
+		}
+		*p.c = c
+	}
+	l.MinCollateralRatio = float64(limits.min_collateral_ratio)
+	if l.MinCollateralRatio < 0 {
+		return pricing.Limits{}, fmt.Errorf("%w: collateral ratio must not be negative", errcode.ErrInvalidLimits)
+	}
+	return l, nil
+}
+
+// A hostSet is a renterutil.HostSet whose hosts are subject to price limits.
+type hostSet struct {
+	*renterutil.HostSet
+	guard *pricing.Guard
+}
+
+func newHostSet(hkr renter.HostKeyResolver, currentHeight types.BlockHeight) *hostSet {
+	guard := new(pricing.Guard)
+	set := renterutil.NewHostSet(hkr, currentHeight)
+	set.SetOnConnect(func(s *proto.Session) { guard.Admit(s) })
+	return &hostSet{
+		HostSet: set,
+		guard:   guard,
+	}
+}
+
+// us_client_set_limits sets the price limits of the client, replacing any
+// previous limits. Renewing a contract with a host whose settings violate them
+// fails with US_ERR_PRICE_EXCEEDED. If limits is NULL, the limits are removed.
+//
+//export us_client_set_limits
+func us_client_set_limits(client_p unsafe.Pointer, limits *C.us_limits_t) bool {
+	defer recoverPanic(nil)
+	c, err := loadClient(client_p)
+	if setError(err) {
+		return false
+	}
+	l, err := goLimits(limits)
+	if setError(err) {
+		return false
+	}
+	c.guard.SetLimits(l)
+	return true
+}
+
+// us_hostset_set_limits sets the price limits of the HostSet, replacing any
+// previous limits. The settings of each host are checked whenever the HostSet
+// connects to it, and an operation that would use a host whose settings
+// violate the limits fails with US_ERR_PRICE_EXCEEDED. If limits is NULL, the
+// limits are removed.
+//
+//export us_hostset_set_limits
+func us_hostset_set_limits(hostset_p unsafe.Pointer, limits *C.us_limits_t) bool {
+	defer recoverPanic(nil)
+	hs, err := loadHostSet(hostset_p)
+	if setError(err) {
+		return false
+	}
+	l, err := goLimits(limits)
+	if setError(err) {
+		return false
+	}
+	hs.guard.SetLimits(l)
+	return true
+}
+
+// Host scanning
+
+const (
+	defaultScanTimeout = 10 * time.Second
+	maxConcurrentScans = 32
+)
+
+// scanHosts resolves the host matching each key prefix and scans the hosts
+// concurrently, waiting at most timeout_ms milliseconds (or 10 seconds, if
+// timeout_ms is 0) for each. If a host cannot be resolved or scanned, the
+// corresponding error is set.
+func scanHosts(c *client, prefixes []string, timeout_ms C.uint32_t) ([]hostdb.ScannedHost, []error) {
+	timeout := defaultScanTimeout
+	if timeout_ms != 0 {
+		timeout = time.Duration(timeout_ms) * time.Millisecond
+	}
+	hosts := make([]hostdb.ScannedHost, len(prefixes))
+	errs := make([]error, len(prefixes))
+	sem := make(chan struct{}, maxConcurrentScans)
+	var wg sync.WaitGroup
+	for i := range prefixes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			hostKey, err := c.LookupHost(prefixes[i])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			addr, err := c.ResolveHostKey(hostKey)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			hosts[i], errs[i] = hostdb.Scan(ctx, addr, hostKey)
+		}(i)
+	}
+	wg.Wait()
+	return hosts, errs
+}
+
+// fillHostInfo populates info with the contents of h, or with err if it is
+// non-nil, allocating memory for the strings.
+func fillHostInfo(info *C.us_hostinfo_t, h hostdb.ScannedHost, err error) {
+	if err != nil {
+		*info = C.us_hostinfo_t{
+			error_code: errorCode(err),
+			error:      C.CString(err.Error()),
+		}
+		return
+	}
+	*info = C.us_hostinfo_t{
+		net_address:              C.CString(string(h.NetAddress)),
+		version:                  C.CString(h.Version),
+		max_duration:             C.uint64_t(h.MaxDuration),
+		window_size:              C.uint64_t(h.WindowSize),
+		remaining_storage:        C.uint64_t(h.RemainingStorage),
+		total_storage:            C.uint64_t(h.TotalStorage),
+		contract_price:           C.CString(h.ContractPrice.String()),
+		storage_price:            C.CString(h.StoragePrice.String()),
+		collateral:               C.CString(h.Collateral.String()),
+		max_collateral:           C.CString(h.MaxCollateral.String()),
+		upload_bandwidth_price:   C.CString(h.UploadBandwidthPrice.String()),
+		download_bandwidth_price: C.CString(h.DownloadBandwidthPrice.String()),
+		base_rpc_price:           C.CString(h.BaseRPCPrice.String()),
+		sector_access_price:      C.CString(h.SectorAccessPrice.String()),
+		latency_ms:               C.double(float64(h.Latency) / float64(time.Millisecond)),
+	}
+	copy(goBytes(unsafe.Pointer(&info.public_key), 32), h.PublicKey.Ed25519())
+	if h.AcceptingContracts {
+		info.accepting_contracts = 1
+	}
+}
+
+// us_client_scan_host resolves the host whose public key starts with host_key
+// and requests its settings, waiting at most timeout_ms milliseconds (or 10
+// seconds, if timeout_ms is 0). On success, info must be released with
+// us_hostinfo_free.
+//
+//export us_client_scan_host
+func us_client_scan_host(client_p unsafe.Pointer, host_key *C.char, timeout_ms C.uint32_t, info *C.us_hostinfo_t) bool {
+	defer recoverPanic(nil)
+	c, err := loadClient(client_p)
+	if setError(err) {
+		return false
+	} else if host_key == nil || info == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	hosts, errs := scanHosts(c, []string{C.GoString(host_key)}, timeout_ms)
+	if setError(errs[0]) {
+		return false
+	}
+	fillHostInfo(info, hosts[0], nil)
+	return true
+}
+
+// us_client_scan_hosts is like us_client_scan_host, but scans the n hosts in
+// host_keys concurrently, storing the results in the n elements of infos. If a
+// host could not be scanned, the error and error_code fields of its info are
+// set. It fails only if its arguments are invalid; otherwise, each element of
+// infos must be released with us_hostinfo_free.
+//
+//export us_client_scan_hosts
+func us_client_scan_hosts(client_p unsafe.Pointer, host_keys **C.char, n C.size_t, timeout_ms C.uint32_t, infos *C.us_hostinfo_t) bool {
+	defer recoverPanic(nil)
+	c, err := loadClient(client_p)
+	if setError(err) {
+		return false
+	} else if n > 0 && (host_keys == nil || infos == nil) {
+		return !setError(errcode.ErrNullArgument)
+	}
+	cstrs := unsafe.Slice(host_keys, int(n))
+	prefixes := make([]string, len(cstrs))
+	for i, s := range cstrs {
+		if s == nil {
+			return !setError(errcode.ErrNullArgument)
+		}
+		prefixes[i] = C.GoString(s)
+	}
+	hosts, errs := scanHosts(c, prefixes, timeout_ms)
+	out := unsafe.Slice(infos, int(n))
+	for i := range out {
+		fillHostInfo(&out[i], hosts[i], errs[i])
+	}
+	return true
+}
+
+// us_hostinfo_free frees the memory referenced by info. It does not free info
+// itself.
+//
+//export us_hostinfo_free
+func us_hostinfo_free(info *C.us_hostinfo_t) {
+	defer recoverPanic(nil)
+	if info == nil {
+		return
+	}
+	for _, s := range []*C.char{
+		info.net_address, info.version, info.contract_price, info.storage_price,
+		info.collateral, info.max_collateral, info.upload_bandwidth_price,
+		info.download_bandwidth_price, info.base_rpc_price,
+		info.sector_access_price, info.error,
+	} {
+		C.free(unsafe.Pointer(s))
+	}
+	*info = C.us_hostinfo_t{}
 }
 
 //export us_fs_init
-func us_fs_init(root *C.char, hs unsafe.Pointer) unsafe.Pointer {
-	pfs := renterutil.NewFileSystem(C.GoString(root), loadPtr(hs).(*renterutil.HostSet))
-	return storePtr(pfs)
+func us_fs_init(root *C.char, hs_p unsafe.Pointer) unsafe.Pointer {
+	defer recoverPanic(nil)
+	hs, err := loadHostSet(hs_p)
+	if setError(err) {
+		return nil
+	}
+	fs := &fileSystem{
+		PseudoFS: renterutil.NewFileSystem(C.GoString(root), hs.HostSet),
+		root:     C.GoString(root),
+	}
+	fs_p, err := ptrs.StoreChild(handles.FS, fs, hs_p, handles.HostSet)
+	if setError(err) {
+		return nil
+	}
+	return fs_p
 }
 
 //export us_fs_close
 func us_fs_close(fs_p unsafe.Pointer) bool {
-	if loadPtr(fs_p) == nil {
-		return true
+	defer recoverPanic(nil)
+	if fs_p == nil {
+		return !setError(nil)
+	}
+	guard := guardOf(fs_p, handles.FS)
+	v, err := ptrs.Take(fs_p, handles.FS)
+	if setError(err) {
+		return false
 	}
-	pfs := loadPtr(fs_p).(*renterutil.PseudoFS)
-	freePtr(fs_p)
-	return !setError(pfs.Close())
+	return !setError(guard.Explain(v.(*fileSystem).Close()))
 }
 
 //export us_fs_create
 func us_fs_create(fs_p unsafe.Pointer, name *C.char, minHosts int) unsafe.Pointer {
-	pfs := loadPtr(fs_p).(*renterutil.PseudoFS)
-	pf, err := pfs.Create(C.GoString(name), minHosts)
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
+	if setError(err) {
+		return nil
+	}
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		return nil
+	}
+	pf, err := pfs.Create(goname, minHosts)
+	if setError(err) {
+		return nil
+	}
+	file_p, err := ptrs.StoreChild(handles.File, pf, fs_p, handles.FS)
 	if setError(err) {
+		pf.Close()
 		return nil
 	}
-	return storePtr(pf)
+	return file_p
 }
 
 //export us_fs_open
 func us_fs_open(fs_p unsafe.Pointer, name *C.char) unsafe.Pointer {
-	pfs := loadPtr(fs_p).(*renterutil.PseudoFS)
-	pf, err := pfs.Open(C.GoString(name))
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
+	if setError(err) {
+		return nil
+	}
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		return nil
+	}
+	pf, err := pfs.Open(goname)
+	if setError(err) {
+		return nil
+	}
+	file_p, err := ptrs.StoreChild(handles.File, pf, fs_p, handles.FS)
 	if setError(err) {
+		pf.Close()
 		return nil
 	}
-	return storePtr(pf)
+	return file_p
 }
 
-//export us_file_read
-func us_file_read(file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) C.ssize_t {
-	pf := loadPtr(file_p).(*renterutil.PseudoFile)
-	n, err := pf.Read(goBytes(buf, int(count)))
+//export us_fs_mkdir
+func us_fs_mkdir(fs_p unsafe.Pointer, name *C.char, perm C.uint32_t) bool {
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
 	if setError(err) {
-		return -1
+		return false
 	}
-	return C.ssize_t(n)
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		return false
+	}
+	return !setError(pfs.Mkdir(goname, os.FileMode(perm)))
 }
 
-//export us_file_write
-func us_file_write(file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) C.ssize_t {
-	pf := loadPtr(file_p).(*renterutil.PseudoFile)
-	n, err := pf.Write(goBytes(buf, int(count)))
+//export us_fs_mkdirall
+func us_fs_mkdirall(fs_p unsafe.Pointer, path *C.char, perm C.uint32_t) bool {
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
 	if setError(err) {
-		return -1
+		return false
 	}
-	return C.ssize_t(n)
+	goname, err := cleanName(C.GoString(path))
+	if setError(err) {
+		return false
+	}
+	return !setError(pfs.MkdirAll(goname, os.FileMode(perm)))
 }
 
-//export us_file_seek
-func us_file_seek(file_p unsafe.Pointer, offset C.long, whence C.int) C.int {
-	pf := loadPtr(file_p).(*renterutil.PseudoFile)
-	n, err := pf.Seek(int64(offset), int(whence))
+//export us_fs_remove
+func us_fs_remove(fs_p unsafe.Pointer, name *C.char) bool {
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
 	if setError(err) {
-		return -1
+		return false
+	}
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		return false
 	}
-	return C.int(n)
+	return !setError(pfs.Remove(goname))
 }
 
-//export us_file_close
-func us_file_close(file_p unsafe.Pointer) bool {
-	if loadPtr(file_p) == nil {
-		return true
+//export us_fs_removeall
+func us_fs_removeall(fs_p unsafe.Pointer, path *C.char) bool {
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
+	if setError(err) {
+		return false
+	}
+	goname, err := cleanName(C.GoString(path))
+	if setError(err) {
+		return false
+	}
+	return !setError(pfs.RemoveAll(goname))
+}
+
+//export us_fs_rename
+func us_fs_rename(fs_p unsafe.Pointer, oldname, newname *C.char) bool {
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
+	if setError(err) {
+		return false
+	}
+	oldstr, err := cleanName(C.GoString(oldname))
+	if setError(err) {
+		return false
+	}
+	newstr, err := cleanName(C.GoString(newname))
+	if setError(err) {
+		return false
+	}
+	// PseudoFS.Rename treats any newname that is not an existing directory as
+	// a file, which would give a renamed directory a metafile extension; move
+	// directories ourselves instead.
+	if fi, err := pfs.Stat(oldstr); err == nil && fi.IsDir() {
+		err := os.Rename(filepath.Join(pfs.root, oldstr), filepath.Join(pfs.root, newstr))
+		return !setError(err)
+	}
+	return !setError(pfs.Rename(oldstr, newstr))
+}
+
+// fillFileInfo populates info with the contents of fi, allocating memory for
+// the name and host list.
+func fillFileInfo(info *C.us_fileinfo_t, fi os.FileInfo) {
+	*info = C.us_fileinfo_t{
+		name:     C.CString(fi.Name()),
+		size:     C.int64_t(fi.Size()),
+		mode:     C.uint32_t(fi.Mode().Perm()),
+		mod_time: C.int64_t(fi.ModTime().Unix()),
+	}
+	if fi.IsDir() {
+		info.is_dir = 1
+	}
+	if m, ok := fi.Sys().(renter.MetaIndex); ok {
+		info.min_hosts = C.int(m.MinShards)
+		info.num_hosts = C.int(len(m.Hosts))
+		if len(m.Hosts) > 0 {
+			info.hosts = (*C.uint8_t)(C.malloc(C.size_t(len(m.Hosts) * 32)))
+			hosts := goBytes(unsafe.Pointer(info.hosts), len(m.Hosts)*32)
+			for i, hostKey := range m.Hosts {
+				copy(hosts[i*32:], hostKey.Ed25519())
+			}
+		}
+	}
+}
+
+//export us_fs_stat
+func us_fs_stat(fs_p unsafe.Pointer, name *C.char, info *C.us_fileinfo_t) bool {
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
+	if setError(err) {
+		return false
+	} else if info == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		return false
+	}
+	fi, err := pfs.Stat(goname)
+	if setError(err) {
+		return false
+	}
+	fillFileInfo(info, fi)
+	return true
+}
+
+// us_fileinfo_free frees the memory referenced by info. It does not free info
+// itself.
+//
+//export us_fileinfo_free
+func us_fileinfo_free(info *C.us_fileinfo_t) {
+	defer recoverPanic(nil)
+	if info == nil {
+		return
+	}
+	C.free(unsafe.Pointer(info.name))
+	C.free(unsafe.Pointer(info.hosts))
+	*info = C.us_fileinfo_t{}
+}
+
+// A dirIter iterates over a snapshot of a directory's contents.
+type dirIter struct {
+	infos []os.FileInfo
+	mu    sync.Mutex
+}
+
+// us_fs_opendir returns an iterator over the contents of the named directory.
+// Entries are retrieved with us_dir_next, and the iterator must be freed with
+// us_dir_close.
+//
+//export us_fs_opendir
+func us_fs_opendir(fs_p unsafe.Pointer, name *C.char) unsafe.Pointer {
+	defer recoverPanic(nil)
+	pfs, err := loadFS(fs_p)
+	if setError(err) {
+		return nil
+	}
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		return nil
+	}
+	d, err := pfs.Open(goname)
+	if setError(err) {
+		return nil
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if setError(err) {
+		return nil
+	}
+	dir_p, err := ptrs.StoreChild(handles.Dir, &dirIter{infos: infos}, fs_p, handles.FS)
+	if setError(err) {
+		return nil
+	}
+	return dir_p
+}
+
+// us_dir_next fills info with the next entry in the directory, returning 1. If
+// there are no more entries, it returns 0.
+//
+//export us_dir_next
+func us_dir_next(dir_p unsafe.Pointer, info *C.us_fileinfo_t) (ret C.int) {
+	defer recoverPanic(func() { ret = -1 })
+	d, err := loadDir(dir_p)
+	if setError(err) {
+		return -1
+	} else if info == nil {
+		setError(errcode.ErrNullArgument)
+		return -1
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.infos) == 0 {
+		return 0
+	}
+	fillFileInfo(info, d.infos[0])
+	d.infos = d.infos[1:]
+	return 1
+}
+
+//export us_dir_close
+func us_dir_close(dir_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if dir_p == nil {
+		return !setError(nil)
+	}
+	_, err := ptrs.Take(dir_p, handles.Dir)
+	return !setError(err)
+}
+
+//export us_file_read
+func us_file_read(file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) (ret C.ssize_t) {
+	defer recoverPanic(func() { ret = -1 })
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return -1
+	} else if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return -1
+	}
+	n, err := pf.Read(goBytes(buf, int(count)))
+	if setError(guardOf(file_p, handles.File).Explain(err)) {
+		return -1
+	}
+	return C.ssize_t(n)
+}
+
+//export us_file_write
+func us_file_write(file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) (ret C.ssize_t) {
+	defer recoverPanic(func() { ret = -1 })
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return -1
+	} else if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return -1
+	}
+	n, err := pf.Write(goBytes(buf, int(count)))
+	if setError(guardOf(file_p, handles.File).Explain(err)) {
+		return -1
+	}
+	return C.ssize_t(n)
+}
+
+// us_file_read_at reads up to count bytes from the file at the specified
+// offset, without using or modifying the file's cursor; it is safe to call
+// concurrently on the same file. Like pread(2), it returns the number of bytes
+// read, which is less than count if the end of the file was reached, and 0 if
+// offset is at or past the end.
+//
+//export us_file_read_at
+func us_file_read_at(file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, offset C.int64_t) (ret C.ssize_t) {
+	defer recoverPanic(func() { ret = -1 })
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return -1
+	} else if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return -1
+	} else if offset < 0 {
+		setError(errcode.ErrNegative)
+		return -1
+	}
+	n, err := pf.ReadAt(goBytes(buf, int(count)), int64(offset))
+	if err == io.EOF {
+		err = nil
+	}
+	if setError(guardOf(file_p, handles.File).Explain(err)) {
+		return -1
+	}
+	return C.ssize_t(n)
+}
+
+// us_file_write_at writes count bytes to the file at the specified offset,
+// without using or modifying the file's cursor.
+//
+//export us_file_write_at
+func us_file_write_at(file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, offset C.int64_t) (ret C.ssize_t) {
+	defer recoverPanic(func() { ret = -1 })
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return -1
+	} else if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return -1
+	} else if offset < 0 {
+		setError(errcode.ErrNegative)
+		return -1
+	}
+	n, err := pf.WriteAt(goBytes(buf, int(count)), int64(offset))
+	if setError(guardOf(file_p, handles.File).Explain(err)) {
+		return -1
+	}
+	return C.ssize_t(n)
+}
+
+// seekFile is like pf.Seek, but interprets an offset relative to the end of
+// the file the way lseek(2) does; PseudoFile subtracts it from the size
+// instead.
+func seekFile(pf *renterutil.PseudoFile, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart, io.SeekCurrent:
+	case io.SeekEnd:
+		fi, err := pf.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset, whence = fi.Size()+offset, io.SeekStart
+	default:
+		return 0, errcode.ErrWhence
+	}
+	return pf.Seek(offset, whence)
+}
+
+// us_file_seek sets the file's cursor, interpreting offset according to whence
+// like lseek(2), and returns the new offset.
+//
+//export us_file_seek
+func us_file_seek(file_p unsafe.Pointer, offset C.int64_t, whence C.int) (ret C.int64_t) {
+	defer recoverPanic(func() { ret = -1 })
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return -1
+	}
+	n, err := seekFile(pf, int64(offset), int(whence))
+	if setError(err) {
+		return -1
+	}
+	return C.int64_t(n)
+}
+
+// us_file_size returns the current size of the file, including any
+// uncommitted writes.
+//
+//export us_file_size
+func us_file_size(file_p unsafe.Pointer) (ret C.int64_t) {
+	defer recoverPanic(func() { ret = -1 })
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return -1
+	}
+	fi, err := pf.Stat()
+	if setError(err) {
+		return -1
+	}
+	return C.int64_t(fi.Size())
+}
+
+// us_file_truncate changes the size of the file, which must not exceed its
+// current size. The file's cursor is not changed.
+//
+//export us_file_truncate
+func us_file_truncate(file_p unsafe.Pointer, size C.int64_t) bool {
+	defer recoverPanic(nil)
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return false
+	} else if size < 0 {
+		return !setError(errcode.ErrNegative)
+	}
+	return !setError(guardOf(file_p, handles.File).Explain(pf.Truncate(int64(size))))
+}
+
+// us_file_sync uploads any uncommitted writes to the file and updates its
+// metadata on disk.
+//
+//export us_file_sync
+func us_file_sync(file_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	pf, err := loadFile(file_p)
+	if setError(err) {
+		return false
+	}
+	return !setError(guardOf(file_p, handles.File).Explain(pf.Sync()))
+}
+
+//export us_file_close
+func us_file_close(file_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if file_p == nil {
+		return !setError(nil)
+	}
+	guard := guardOf(file_p, handles.File)
+	v, err := ptrs.Take(file_p, handles.File)
+	if setError(err) {
+		return false
+	}
+	return !setError(guard.Explain(v.(*renterutil.PseudoFile).Close()))
+}
+
+// Sessions
+//
+// A Session is a connection to a single host, through which whole sectors can
+// be uploaded and sections of them downloaded, without the bookkeeping of a
+// FileSystem. The caller is responsible for remembering the Merkle root of
+// each uploaded sector.
+
+// A session is a proto.Session along with its underlying connection. The
+// renter-host protocol has no way to abort an RPC, so the only way to
+// interrupt one is to close the connection, which also ends the session.
+type session struct {
+	*proto.Session
+	conn net.Conn
+	mu   sync.Mutex // serializes RPCs
+}
+
+// do calls fn with exclusive access to the session. If ctx is canceled before
+// fn returns, the session's connection is closed.
+func (s *session) do(ctx context.Context, fn func(*proto.Session) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil {
+		return errcode.ErrCanceled
+	}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.conn.Close()
+			case <-done:
+			}
+		}()
+	}
+	return fn(s.Session)
+}
+
+// newSession connects to the host of contract and locks it. It fails if the
+// host's settings violate the client's price limits.
+func newSession(c *client, contract renter.Contract) (*session, error) {
+	addr, err := c.ResolveHostKey(contract.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	currentHeight, err := c.ChainHeight()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", string(addr), 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	s, err := proto.NewUnlockedSessionFromConn(conn, contract.HostKey, currentHeight)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := s.Lock(contract.ID, contract.RenterKey, 10*time.Second); err != nil {
+		s.Close()
+		return nil, err
+	}
+	settings, err := s.Settings()
+	if err != nil {
+		s.Close()
+		return nil, err
+	} else if err := c.guard.Limits().Check(settings); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &session{Session: s, conn: conn}, nil
+}
+
+func loadSession(p unsafe.Pointer) (*session, error) {
+	v, err := ptrs.Load(p, handles.Session)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*session), nil
+}
+
+// us_ll_session_init connects to the host of contract, whose address is
+// resolved by client, and locks the contract. It fails with
+// US_ERR_PRICE_EXCEEDED if the host's settings violate the client's price
+// limits. The Session must be freed with us_ll_session_close.
+//
+//export us_ll_session_init
+func us_ll_session_init(client_p unsafe.Pointer, contract *C.struct_contract_t) unsafe.Pointer {
+	defer recoverPanic(nil)
+	c, err := loadClient(client_p)
+	if setError(err) {
+		return nil
+	} else if contract == nil {
+		setError(errcode.ErrNullArgument)
+		return nil
+	}
+	s, err := newSession(c, contractfile.Decode(C.GoBytes(unsafe.Pointer(contract), C.sizeof_struct_contract_t)))
+	if setError(err) {
+		return nil
+	}
+	return ptrs.Store(handles.Session, s)
+}
+
+// us_ll_upload uploads a sector, which must point to a full sector (4 MiB) of
+// data, storing its Merkle root in root, which must point to 32 bytes.
+//
+//export us_ll_upload
+func us_ll_upload(session_p, buf, root unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	sess, err := loadSession(session_p)
+	if setError(err) {
+		return false
+	} else if buf == nil || root == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	sector := new([renterhost.SectorSize]byte)
+	copy(sector[:], goBytes(buf, renterhost.SectorSize))
+	var h crypto.Hash
+	err = sess.do(context.Background(), func(s *proto.Session) (err error) {
+		h, err = s.Append(sector)
+		return
+	})
+	if setError(err) {
+		return false
+	}
+	copy(goBytes(root, crypto.HashSize), h[:])
+	return true
+}
+
+// us_ll_download downloads length bytes, starting at offset, of the sector
+// with the given Merkle root into buf. offset and length must be multiples of
+// 64 bytes.
+//
+//export us_ll_download
+func us_ll_download(session_p, root, buf unsafe.Pointer, offset, length C.uint32_t) bool {
+	defer recoverPanic(nil)
+	sess, err := loadSession(session_p)
+	if setError(err) {
+		return false
+	} else if root == nil || (buf == nil && length > 0) {
+		return !setError(errcode.ErrNullArgument)
+	}
+	var h crypto.Hash
+	copy(h[:], goBytes(root, crypto.HashSize))
+	b := goBytes(buf, int(length))
+	return !setError(sess.do(context.Background(), func(s *proto.Session) error {
+		return downloadSection(s, h, uint32(offset), b)
+	}))
+}
+
+// downloadSection downloads len(buf) bytes of the sector with the given root,
+// starting at offset.
+func downloadSection(s *proto.Session, root crypto.Hash, offset uint32, buf []byte) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	// buf has exactly enough capacity for the section, so the Buffer writes
+	// the data in place
+	return s.Read(bytes.NewBuffer(buf[:0]), []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     offset,
+		Length:     uint32(len(buf)),
+	}})
+}
+
+//export us_ll_session_close
+func us_ll_session_close(session_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if session_p == nil {
+		return !setError(nil)
+	}
+	v, err := ptrs.Take(session_p, handles.Session)
+	if setError(err) {
+		return false
+	}
+	return !setError(v.(*session).Close())
+}
+
+// Asynchronous operations
+//
+// Each *_async function starts an operation on a new goroutine and returns
+// immediately with a nonzero operation ID, or 0 if the operation could not be
+// started (in which case us_error describes why). When the operation finishes,
+// its result is posted to the completion queue passed to the call.
+//
+// A completion queue exposes a file descriptor that is readable whenever
+// completions are waiting, so it can be registered with epoll, kqueue, libuv,
+// etc. When the descriptor becomes readable, call us_cq_poll until it returns
+// 0; the descriptor must not be read directly.
+//
+// Buffers passed to an asynchronous operation must remain valid until its
+// completion is delivered, even if the operation is canceled. The handles it uses cannot be closed until then
+// either; closing them fails with US_ERR_BUSY. Operations on the same file
+// may run concurrently and complete in any order, so a caller that relies on
+// the file cursor should wait for one read or write to complete before
+// issuing the next.
+
+// releaseFile closes the File created by an operation whose completion was
+// never polled, so that its FileSystem can still be freed.
+func releaseFile(p unsafe.Pointer) {
+	if v, err := ptrs.Take(p, handles.File); err == nil {
+		v.(*renterutil.PseudoFile).Close()
+	}
+}
+
+func loadQueue(p unsafe.Pointer) (*async.Queue, error) {
+	v, err := ptrs.Load(p, handles.Queue)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*async.Queue), nil
+}
+
+// startAsync submits fn to the queue referenced by cq_p, pinning the handles
+// in pinned for the duration of the operation. It reports any error via
+// setError and returns the ID of the new operation, or 0 on failure.
+func startAsync(cq_p, ctx unsafe.Pointer, pinned []unsafe.Pointer, fn func(context.Context) (int64, unsafe.Pointer, error)) C.uint64_t {
+	cq, err := loadQueue(cq_p)
+	if setError(err) {
+		for _, p := range pinned {
+			ptrs.Unpin(p)
+		}
+		return 0
+	}
+	op, err := cq.Submit(ctx, exportName(), pinned, fn)
+	if setError(err) {
+		for _, p := range pinned {
+			ptrs.Unpin(p)
+		}
+		return 0
+	}
+	return C.uint64_t(op)
+}
+
+// us_cq_init creates a completion queue for asynchronous operations. It must
+// be freed with us_cq_free.
+//
+//export us_cq_init
+func us_cq_init() unsafe.Pointer {
+	defer recoverPanic(nil)
+	cq, err := async.NewQueue(&ptrs)
+	if setError(err) {
+		return nil
+	}
+	return ptrs.Store(handles.Queue, cq)
+}
+
+// us_cq_fd returns a file descriptor that is readable whenever completions
+// are waiting in the queue.
+//
+//export us_cq_fd
+func us_cq_fd(cq_p unsafe.Pointer) (ret C.int) {
+	defer recoverPanic(func() { ret = -1 })
+	cq, err := loadQueue(cq_p)
+	if setError(err) {
+		return -1
+	}
+	return C.int(cq.Fd())
+}
+
+// us_cq_poll removes a completion from the queue and stores it in c,
+// returning 1. If the queue is empty, it returns 0 without blocking.
+//
+//export us_cq_poll
+func us_cq_poll(cq_p unsafe.Pointer, c *C.us_completion_t) (ret C.int) {
+	defer recoverPanic(func() { ret = -1 })
+	cq, err := loadQueue(cq_p)
+	if setError(err) {
+		return -1
+	} else if c == nil {
+		setError(errcode.ErrNullArgument)
+		return -1
+	}
+	comp, ok := cq.Poll()
+	if !ok {
+		return 0
+	}
+	*c = C.us_completion_t{
+		op:         C.uint64_t(comp.Op),
+		ctx:        comp.Ctx,
+		result:     C.int64_t(comp.Result),
+		handle:     comp.Handle,
+		error_code: errorCode(comp.Err),
+	}
+	if comp.Err != nil {
+		c.error = C.CString(fmt.Sprintf("%v: %v", comp.Name, comp.Err))
+	}
+	return 1
+}
+
+// us_cq_cancel requests that a pending operation be canceled. Its completion
+// is still delivered; if the operation was interrupted, it fails with
+// US_ERR_CANCELED. Operations on a Session are interrupted by closing the
+// session's connection, so the Session cannot be used afterwards. File reads
+// and writes stop at the next chunk boundary (see async.ChunkSize), so some of
+// the data may already have been transferred. The remaining filesystem
+// operations (opening, creating, syncing, and closing) cannot be interrupted
+// once they have started. Canceling an operation that has already completed
+// has no effect.
+//
+//export us_cq_cancel
+func us_cq_cancel(cq_p unsafe.Pointer, op C.uint64_t) bool {
+	defer recoverPanic(nil)
+	cq, err := loadQueue(cq_p)
+	if setError(err) {
+		return false
+	}
+	cq.Cancel(uint64(op))
+	return true
+}
+
+// us_cq_free frees a completion queue. It fails with US_ERR_BUSY if any
+// operations using the queue are still pending. Completions that have been
+// posted but not polled are discarded, and any File they created is closed.
+//
+//export us_cq_free
+func us_cq_free(cq_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if cq_p == nil {
+		return !setError(nil)
+	}
+	cq, err := loadQueue(cq_p)
+	if setError(err) {
+		return false
+	}
+	done, err := cq.Close()
+	if setError(err) {
+		return false
+	}
+	if _, err := ptrs.Take(cq_p, handles.Queue); setError(err) {
+		return false
+	}
+	for _, c := range done {
+		if c.Handle != nil {
+			releaseFile(c.Handle)
+		}
+	}
+	cq.Release()
+	return true
+}
+
+// us_fs_create_async is the asynchronous version of us_fs_create. The new
+// File is stored in the handle field of the completion.
+//
+//export us_fs_create_async
+func us_fs_create_async(cq_p, fs_p unsafe.Pointer, name *C.char, minHosts int, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	v, err := ptrs.Pin(fs_p, handles.FS)
+	if setError(err) {
+		return 0
+	}
+	pfs := v.(*fileSystem)
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		ptrs.Unpin(fs_p)
+		return 0
+	}
+	return startAsync(cq_p, ctx, []unsafe.Pointer{fs_p}, func(context.Context) (int64, unsafe.Pointer, error) {
+		pf, err := pfs.Create(goname, minHosts)
+		if err != nil {
+			return 0, nil, err
+		}
+		file_p, err := ptrs.StoreChild(handles.File, pf, fs_p, handles.FS)
+		if err != nil {
+			pf.Close()
+			return 0, nil, err
+		}
+		return 0, file_p, nil
+	})
+}
+
+// us_fs_open_async is the asynchronous version of us_fs_open. The new File is
+// stored in the handle field of the completion.
+//
+//export us_fs_open_async
+func us_fs_open_async(cq_p, fs_p unsafe.Pointer, name *C.char, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	v, err := ptrs.Pin(fs_p, handles.FS)
+	if setError(err) {
+		return 0
+	}
+	pfs := v.(*fileSystem)
+	goname, err := cleanName(C.GoString(name))
+	if setError(err) {
+		ptrs.Unpin(fs_p)
+		return 0
+	}
+	return startAsync(cq_p, ctx, []unsafe.Pointer{fs_p}, func(context.Context) (int64, unsafe.Pointer, error) {
+		pf, err := pfs.Open(goname)
+		if err != nil {
+			return 0, nil, err
+		}
+		file_p, err := ptrs.StoreChild(handles.File, pf, fs_p, handles.FS)
+		if err != nil {
+			pf.Close()
+			return 0, nil, err
+		}
+		return 0, file_p, nil
+	})
+}
+
+// us_fs_close_async is the asynchronous version of us_fs_close. The handle is
+// invalidated immediately; the completion reports whether the filesystem's
+// pending data was flushed successfully.
+//
+//export us_fs_close_async
+func us_fs_close_async(cq_p, fs_p, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if _, err := loadQueue(cq_p); setError(err) {
+		return 0
+	}
+	guard := guardOf(fs_p, handles.FS)
+	v, err := ptrs.Take(fs_p, handles.FS)
+	if setError(err) {
+		return 0
+	}
+	pfs := v.(*fileSystem)
+	op := startAsync(cq_p, ctx, nil, func(context.Context) (int64, unsafe.Pointer, error) {
+		return 0, nil, guard.Explain(pfs.Close())
+	})
+	if op == 0 {
+		// the handle is already gone, so close the filesystem anyway
+		pfs.Close()
+	}
+	return op
+}
+
+// startFileOp pins the file referenced by file_p and runs fn on it
+// asynchronously.
+func startFileOp(cq_p, file_p, ctx unsafe.Pointer, fn func(context.Context, *renterutil.PseudoFile) (int, error)) C.uint64_t {
+	v, err := ptrs.Pin(file_p, handles.File)
+	if setError(err) {
+		return 0
+	}
+	pf := v.(*renterutil.PseudoFile)
+	guard := guardOf(file_p, handles.File)
+	return startAsync(cq_p, ctx, []unsafe.Pointer{file_p}, func(opCtx context.Context) (int64, unsafe.Pointer, error) {
+		n, err := fn(opCtx, pf)
+		return int64(n), nil, guard.Explain(err)
+	})
+}
+
+// us_file_read_async is the asynchronous version of us_file_read.
+//
+//export us_file_read_async
+func us_file_read_async(cq_p, file_p, buf unsafe.Pointer, count C.size_t, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return 0
+	}
+	b := goBytes(buf, int(count))
+	return startFileOp(cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+		return async.TransferChunks(opCtx, b, 0, func(chunk []byte, _ int64) (int, error) {
+			return pf.Read(chunk)
+		})
+	})
+}
+
+// us_file_write_async is the asynchronous version of us_file_write.
+//
+//export us_file_write_async
+func us_file_write_async(cq_p, file_p, buf unsafe.Pointer, count C.size_t, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return 0
+	}
+	b := goBytes(buf, int(count))
+	return startFileOp(cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+		return async.TransferChunks(opCtx, b, 0, func(chunk []byte, _ int64) (int, error) {
+			return pf.Write(chunk)
+		})
+	})
+}
+
+// us_file_read_at_async is the asynchronous version of us_file_read_at.
+//
+//export us_file_read_at_async
+func us_file_read_at_async(cq_p, file_p, buf unsafe.Pointer, count C.size_t, offset C.int64_t, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return 0
+	} else if offset < 0 {
+		setError(errcode.ErrNegative)
+		return 0
+	}
+	b := goBytes(buf, int(count))
+	return startFileOp(cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+		n, err := async.TransferChunks(opCtx, b, int64(offset), pf.ReadAt)
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	})
+}
+
+// us_file_write_at_async is the asynchronous version of us_file_write_at.
+//
+//export us_file_write_at_async
+func us_file_write_at_async(cq_p, file_p, buf unsafe.Pointer, count C.size_t, offset C.int64_t, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if buf == nil && count > 0 {
+		setError(errcode.ErrNullArgument)
+		return 0
+	} else if offset < 0 {
+		setError(errcode.ErrNegative)
+		return 0
+	}
+	b := goBytes(buf, int(count))
+	return startFileOp(cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+		return async.TransferChunks(opCtx, b, int64(offset), pf.WriteAt)
+	})
+}
+
+// us_file_sync_async is the asynchronous version of us_file_sync.
+//
+//export us_file_sync_async
+func us_file_sync_async(cq_p, file_p, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	return startFileOp(cq_p, file_p, ctx, func(_ context.Context, pf *renterutil.PseudoFile) (int, error) {
+		return 0, pf.Sync()
+	})
+}
+
+// us_file_close_async is the asynchronous version of us_file_close. The handle
+// is invalidated immediately; the completion reports whether the file's
+// contents were flushed successfully.
+//
+//export us_file_close_async
+func us_file_close_async(cq_p, file_p, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if _, err := loadQueue(cq_p); setError(err) {
+		return 0
+	}
+	guard := guardOf(file_p, handles.File)
+	v, err := ptrs.Take(file_p, handles.File)
+	if setError(err) {
+		return 0
+	}
+	pf := v.(*renterutil.PseudoFile)
+	op := startAsync(cq_p, ctx, nil, func(context.Context) (int64, unsafe.Pointer, error) {
+		return 0, nil, guard.Explain(pf.Close())
+	})
+	if op == 0 {
+		// the handle is already gone, so close the file anyway
+		pf.Close()
+	}
+	return op
+}
+
+// startSessionOp pins the session referenced by session_p and runs fn on it
+// asynchronously. Canceling the operation closes the session's connection.
+func startSessionOp(cq_p, session_p, ctx unsafe.Pointer, fn func(*proto.Session) (int64, error)) C.uint64_t {
+	v, err := ptrs.Pin(session_p, handles.Session)
+	if setError(err) {
+		return 0
+	}
+	sess := v.(*session)
+	return startAsync(cq_p, ctx, []unsafe.Pointer{session_p}, func(opCtx context.Context) (n int64, _ unsafe.Pointer, err error) {
+		err = sess.do(opCtx, func(s *proto.Session) (err error) {
+			n, err = fn(s)
+			return
+		})
+		return n, nil, err
+	})
+}
+
+// us_ll_upload_async is the asynchronous version of us_ll_upload. The sector
+// is copied before the call returns, but root must remain valid until the
+// operation completes.
+//
+//export us_ll_upload_async
+func us_ll_upload_async(cq_p, session_p, buf, root, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if buf == nil || root == nil {
+		setError(errcode.ErrNullArgument)
+		return 0
+	}
+	sector := new([renterhost.SectorSize]byte)
+	copy(sector[:], goBytes(buf, renterhost.SectorSize))
+	rootBuf := goBytes(root, crypto.HashSize)
+	return startSessionOp(cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+		h, err := s.Append(sector)
+		if err != nil {
+			return 0, err
+		}
+		copy(rootBuf, h[:])
+		return 0, nil
+	})
+}
+
+// us_ll_download_async is the asynchronous version of us_ll_download. The
+// result of the completion is the number of bytes downloaded.
+//
+//export us_ll_download_async
+func us_ll_download_async(cq_p, session_p, root, buf unsafe.Pointer, offset, length C.uint32_t, ctx unsafe.Pointer) C.uint64_t {
+	defer recoverPanic(nil)
+	if root == nil || (buf == nil && length > 0) {
+		setError(errcode.ErrNullArgument)
+		return 0
+	}
+	var h crypto.Hash
+	copy(h[:], goBytes(root, crypto.HashSize))
+	b := goBytes(buf, int(length))
+	return startSessionOp(cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+		if err := downloadSection(s, h, uint32(offset), b); err != nil {
+			return 0, err
+		}
+		return int64(len(b)), nil
+	})
+}
+
+// Wallets
+//
+// Seeds and transactions work like their gomobile counterparts. Amounts are
+// strings denominated in hastings, and inputs are signed in the order they
+// were added, so every binding produces identical transactions.
+
+func parseAddr(addr string) (types.UnlockHash, error) {
+	var uh types.UnlockHash
+	if err := uh.LoadString(addr); err != nil {
+		return types.UnlockHash{}, fmt.Errorf("%w: invalid address %q: %v", errcode.ErrInvalidArgument, addr, err)
+	}
+	return uh, nil
+}
+
+func parseAmount(value string) (types.Currency, error) {
+	var c types.Currency
+	if _, err := fmt.Sscan(value, &c); err != nil {
+		return types.Currency{}, fmt.Errorf("%w: invalid amount %q: %v", errcode.ErrInvalidArgument, value, err)
+	}
+	return c, nil
+}
+
+// A txnBuilder builds a transaction that sends siacoins from addresses derived
+// from a seed.
+type txnBuilder struct {
+	mu         sync.Mutex
+	txn        types.Transaction
+	feePerByte types.Currency
+	inputSum   types.Currency
+	outputSum  types.Currency
+	keys       []uint64 // key index of each input
+}
+
+func (t *txnBuilder) addOutput(addr, amount string) error {
+	uh, err := parseAddr(addr)
+	if err != nil {
+		return err
+	}
+	value, err := parseAmount(amount)
+	if err != nil {
+		return err
+	}
+	t.txn.SiacoinOutputs = append(t.txn.SiacoinOutputs, types.SiacoinOutput{
+		UnlockHash: uh,
+		Value:      value,
+	})
+	t.outputSum = t.outputSum.Add(value)
+	return nil
+}
+
+func (t *txnBuilder) calcFee() types.Currency {
+	size := t.txn.MarshalSiaSize() + 100*len(t.txn.SiacoinInputs)
+	return t.feePerByte.Mul64(uint64(size))
+}
+
+// addInput adds an input and reports whether the inputs now cover the outputs
+// and the fee.
+func (t *txnBuilder) addInput(id, value, publicKey string, keyIndex uint64) (bool, error) {
+	var scoid crypto.Hash
+	if err := scoid.LoadString(id); err != nil {
+		return false, fmt.Errorf("%w: invalid output ID %q: %v", errcode.ErrInvalidArgument, id, err)
+	}
+	var pk types.SiaPublicKey
+	if pk.LoadString(publicKey); pk.Algorithm != types.SignatureEd25519 {
+		return false, fmt.Errorf("%w: invalid public key %q", errcode.ErrInvalidArgument, publicKey)
+	}
+	amount, err := parseAmount(value)
+	if err != nil {
+		return false, err
+	}
+	t.txn.SiacoinInputs = append(t.txn.SiacoinInputs, types.SiacoinInput{
+		ParentID:         types.SiacoinOutputID(scoid),
+		UnlockConditions: wallet.StandardUnlockConditions(pk),
+	})
+	t.keys = append(t.keys, keyIndex)
+	t.inputSum = t.inputSum.Add(amount)
+	return t.inputSum.Cmp(t.outputSum.Add(t.calcFee())) >= 0, nil
+}
+
+// finalize sets the miner fee and sends any change to changeAddr.
+func (t *txnBuilder) finalize(changeAddr string) error {
+	if t.inputSum.Cmp(t.outputSum) < 0 {
+		return errcode.ErrInsufficientInputs
+	}
+	fee := t.calcFee()
+	change := t.inputSum.Sub(t.outputSum)
+	if change.Cmp(fee) < 0 {
+		fee = change
+	}
+	change = change.Sub(fee)
+	if !change.IsZero() {
+		if err := t.addOutput(changeAddr, change.String()); err != nil {
+			return err
+		}
+	}
+	t.txn.MinerFees = []types.Currency{fee}
+	return nil
+}
+
+// sign replaces any existing signatures with a signature for each input, in
+// order.
+func (t *txnBuilder) sign(seed wallet.Seed) {
+	t.txn.TransactionSignatures = nil
+	for i, in := range t.txn.SiacoinInputs {
+		sig := wallet.StandardTransactionSignature(crypto.Hash(in.ParentID))
+		wallet.AppendTransactionSignature(&t.txn, sig, seed.SecretKey(t.keys[i]))
+	}
+}
+
+func loadSeed(p unsafe.Pointer) (wallet.Seed, error) {
+	v, err := ptrs.Load(p, handles.Seed)
+	if err != nil {
+		return wallet.Seed{}, err
+	}
+	return v.(wallet.Seed), nil
+}
+
+func loadTxn(p unsafe.Pointer) (*txnBuilder, error) {
+	v, err := ptrs.Load(p, handles.Txn)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*txnBuilder), nil
+}
+
+// us_seed_init generates a new random seed. It must be freed with
+// us_seed_free.
+//
+//export us_seed_init
+func us_seed_init() unsafe.Pointer {
+	defer recoverPanic(nil)
+	setError(nil)
+	return ptrs.Store(handles.Seed, wallet.NewSeed())
+}
+
+// us_seed_from_phrase returns the seed encoded by a 12-word phrase. It must be
+// freed with us_seed_free.
+//
+//export us_seed_from_phrase
+func us_seed_from_phrase(phrase *C.char) unsafe.Pointer {
+	defer recoverPanic(nil)
+	if phrase == nil {
+		setError(errcode.ErrNullArgument)
+		return nil
+	}
+	s, err := wallet.SeedFromPhrase(C.GoString(phrase))
+	if err != nil {
+		setError(fmt.Errorf("%w: %v", errcode.ErrInvalidArgument, err))
+		return nil
+	}
+	setError(nil)
+	return ptrs.Store(handles.Seed, s)
+}
+
+// us_seed_phrase returns the 12-word phrase encoding the seed. The returned
+// string must be freed with us_free.
+//
+//export us_seed_phrase
+func us_seed_phrase(seed_p unsafe.Pointer) *C.char {
+	defer recoverPanic(nil)
+	s, err := loadSeed(seed_p)
+	if setError(err) {
+		return nil
+	}
+	return C.CString(s.String())
+}
+
+// us_seed_public_key returns the public key at the given index, in the form
+// "ed25519:<hex>". The returned string must be freed with us_free.
+//
+//export us_seed_public_key
+func us_seed_public_key(seed_p unsafe.Pointer, index C.uint64_t) *C.char {
+	defer recoverPanic(nil)
+	s, err := loadSeed(seed_p)
+	if setError(err) {
+		return nil
+	}
+	return C.CString(s.PublicKey(uint64(index)).String())
+}
+
+//export us_seed_free
+func us_seed_free(seed_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if seed_p == nil {
+		return !setError(nil)
+	}
+	_, err := ptrs.Take(seed_p, handles.Seed)
+	return !setError(err)
+}
+
+// us_validate_address reports whether addr is a valid Sia address.
+//
+//export us_validate_address
+func us_validate_address(addr *C.char) bool {
+	defer recoverPanic(nil)
+	setError(nil)
+	return addr != nil && new(types.UnlockHash).LoadString(C.GoString(addr)) == nil
+}
+
+// us_txn_init creates an empty transaction that pays fee_per_byte hastings
+// per byte in miner fees. It must be freed with us_txn_free.
+//
+//export us_txn_init
+func us_txn_init(fee_per_byte *C.char) unsafe.Pointer {
+	defer recoverPanic(nil)
+	if fee_per_byte == nil {
+		setError(errcode.ErrNullArgument)
+		return nil
+	}
+	fee, err := parseAmount(C.GoString(fee_per_byte))
+	if setError(err) {
+		return nil
+	}
+	return ptrs.Store(handles.Txn, &txnBuilder{feePerByte: fee})
+}
+
+// us_txn_add_output adds an output sending amount hastings to addr.
+//
+//export us_txn_add_output
+func us_txn_add_output(txn_p unsafe.Pointer, addr *C.char, amount *C.char) bool {
+	defer recoverPanic(nil)
+	t, err := loadTxn(txn_p)
+	if setError(err) {
+		return false
+	} else if addr == nil || amount == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !setError(t.addOutput(C.GoString(addr), C.GoString(amount)))
+}
+
+// us_txn_add_input adds the output output_id, worth value hastings, as an
+// input. The output must be spendable by public_key, which is derived from the
+// signing seed at key_index. It returns 1 if the inputs now cover the outputs
+// and the miner fee, 0 if more inputs are needed, or -1 on failure.
+//
+//export us_txn_add_input
+func us_txn_add_input(txn_p unsafe.Pointer, output_id *C.char, value *C.char, public_key *C.char, key_index C.uint64_t) (ret C.int) {
+	defer recoverPanic(func() { ret = -1 })
+	t, err := loadTxn(txn_p)
+	if setError(err) {
+		return -1
+	} else if output_id == nil || value == nil || public_key == nil {
+		setError(errcode.ErrNullArgument)
+		return -1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	funded, err := t.addInput(C.GoString(output_id), C.GoString(value), C.GoString(public_key), uint64(key_index))
+	if setError(err) {
+		return -1
+	} else if funded {
+		return 1
+	}
+	return 0
+}
+
+// us_txn_finalize sets the miner fee and sends any change to change_addr. It
+// fails if the inputs do not cover the outputs.
+//
+//export us_txn_finalize
+func us_txn_finalize(txn_p unsafe.Pointer, change_addr *C.char) bool {
+	defer recoverPanic(nil)
+	t, err := loadTxn(txn_p)
+	if setError(err) {
+		return false
+	} else if change_addr == nil {
+		return !setError(errcode.ErrNullArgument)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !setError(t.finalize(C.GoString(change_addr)))
+}
+
+// us_txn_sign signs each input of the transaction with the corresponding key
+// derived from seed, replacing any existing signatures.
+//
+//export us_txn_sign
+func us_txn_sign(txn_p unsafe.Pointer, seed_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	t, err := loadTxn(txn_p)
+	if setError(err) {
+		return false
+	}
+	s, err := loadSeed(seed_p)
+	if setError(err) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sign(s)
+	return true
+}
+
+// us_txn_json returns the transaction encoded as JSON, as accepted by siad and
+// walrus. The returned string must be freed with us_free.
+//
+//export us_txn_json
+func us_txn_json(txn_p unsafe.Pointer) *C.char {
+	defer recoverPanic(nil)
+	t, err := loadTxn(txn_p)
+	if setError(err) {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	js, err := json.Marshal(t.txn)
+	if setError(err) {
+		return nil
+	}
+	return C.CString(string(js))
+}
+
+// us_txn_encode returns the transaction in the Sia binary encoding, storing
+// its length in n. The returned buffer must be freed with us_free.
+//
+//export us_txn_encode
+func us_txn_encode(txn_p unsafe.Pointer, n *C.size_t) unsafe.Pointer {
+	defer recoverPanic(nil)
+	t, err := loadTxn(txn_p)
+	if setError(err) {
+		return nil
+	} else if n == nil {
+		setError(errcode.ErrNullArgument)
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var buf bytes.Buffer
+	if err := t.txn.MarshalSia(&buf); setError(err) {
+		return nil
+	}
+	*n = C.size_t(buf.Len())
+	return C.CBytes(buf.Bytes())
+}
+
+//export us_txn_free
+func us_txn_free(txn_p unsafe.Pointer) bool {
+	defer recoverPanic(nil)
+	if txn_p == nil {
+		return !setError(nil)
 	}
-	pf := loadPtr(file_p).(*renterutil.PseudoFile)
-	freePtr(file_p)
-	return !setError(pf.Close())
+	_, err := ptrs.Take(txn_p, handles.Txn)
+	return !setError(err)
 }
 
 func main() {}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us-bindings/internal/errcode"
+	"lukechampine.com/us-bindings/internal/ghost"
+	"lukechampine.com/us-bindings/internal/handles"
+	"lukechampine.com/us-bindings/internal/servertest"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/wallet"
+)
+
+// Test files cannot use cgo, so they refer to C types by the names that cgo
+// generates for bindings.go, e.g. _Ctype_char for C.char. Since the exports
+// are called from Go, Go memory can be passed where C memory is expected.
+
+// cString returns s as a NUL-terminated string.
+func cString(s string) *_Ctype_char {
+	b := append([]byte(s), 0)
+	return (*_Ctype_char)(unsafe.Pointer(&b[0]))
+}
+
+// goString returns the NUL-terminated string at p.
+func goString(p *_Ctype_char) string {
+	var b []byte
+	for q := unsafe.Pointer(p); *(*byte)(q) != 0; q = unsafe.Add(q, 1) {
+		b = append(b, *(*byte)(q))
+	}
+	return string(b)
+}
+
+// checkError checks that the most recent call on the current thread failed
+// with the error code corresponding to want, or succeeded if want is nil. The
+// caller must be locked to its thread.
+func checkError(t *testing.T, desc string, want error) {
+	t.Helper()
+	code, msg := us_error_code(), us_error()
+	if want == nil {
+		if code != errorCode(nil) || msg != nil {
+			t.Errorf("%v: expected no error, got %v (%q)", desc, code, goString(msg))
+		}
+	} else if code != errorCode(want) || msg == nil {
+		t.Errorf("%v: expected error code %v, got %v", desc, errorCode(want), code)
+	}
+}
+
+func TestThreadErrors(t *testing.T) {
+	// half of the goroutines make failing calls and half make succeeding
+	// calls; each is locked to its own thread, and yields between the call
+	// and the check, so that the calls of other threads are interleaved
+	bogus := unsafe.Pointer(new(int))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		fail := i%2 == 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			for j := 0; j < 1000; j++ {
+				if fail {
+					if us_seed_free(bogus) {
+						t.Error("freeing a bogus handle should fail")
+						return
+					}
+					runtime.Gosched()
+					checkError(t, "failing thread", errcode.ErrInvalidHandle)
+				} else {
+					if !us_seed_free(us_seed_init()) {
+						t.Error("freeing a seed should succeed")
+						return
+					}
+					runtime.Gosched()
+					checkError(t, "succeeding thread", nil)
+				}
+				if t.Failed() {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestErrorCleared(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	bogus := unsafe.Pointer(new(int))
+	addr := cString(vectorAddresses[0])
+	phrase := cString(vectorPhrase)
+
+	// every call that does not fail must clear the error left by the
+	// previous call, even if it has nothing to report
+	var seed unsafe.Pointer
+	tests := []struct {
+		desc string
+		call func()
+	}{
+		{"us_seed_init", func() { seed = us_seed_init() }},
+		{"us_seed_from_phrase", func() { us_seed_free(seed); seed = us_seed_from_phrase(phrase) }},
+		{"us_validate_address", func() {
+			if !us_validate_address(addr) {
+				t.Error("address should be valid")
+			}
+		}},
+		{"us_validate_address (invalid)", func() { us_validate_address(phrase) }},
+		{"us_seed_free (NULL)", func() { us_seed_free(nil) }},
+		{"us_txn_free (NULL)", func() { us_txn_free(nil) }},
+		{"us_hostset_free (NULL)", func() { us_hostset_free(nil) }},
+		{"us_fs_close (NULL)", func() { us_fs_close(nil) }},
+		{"us_file_close (NULL)", func() { us_file_close(nil) }},
+		{"us_cq_free (NULL)", func() { us_cq_free(nil) }},
+	}
+	for _, test := range tests {
+		if us_seed_free(bogus) {
+			t.Fatal("freeing a bogus handle should fail")
+		}
+		test.call()
+		checkError(t, test.desc, nil)
+	}
+	if !us_seed_free(seed) {
+		t.Error("freeing a seed should succeed")
+	}
+}
+
+func TestBogusHandles(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// free a seed, then create a transaction, which reuses the seed's slot in
+	// the handle table with a new generation
+	stale := us_seed_init()
+	us_seed_free(stale)
+	txn := us_txn_init(cString("1"))
+	defer us_txn_free(txn)
+	if uintptr(txn)&(1<<handles.GenShift-1) != uintptr(stale)&(1<<handles.GenShift-1) {
+		t.Fatal("expected freed slot to be reused")
+	}
+	seed := us_seed_init()
+	defer us_seed_free(seed)
+
+	bogus := []struct {
+		desc string
+		p    unsafe.Pointer
+		err  error
+	}{
+		{"Go pointer", unsafe.Pointer(new(int)), errcode.ErrInvalidHandle},
+		{"index out of range", unsafe.Add(seed, 1<<20), errcode.ErrInvalidHandle},
+		{"future generation", unsafe.Add(seed, 1<<handles.GenShift), errcode.ErrInvalidHandle},
+		{"closed handle", stale, errcode.ErrClosedHandle},
+		{"wrong kind", seed, errcode.ErrInvalidHandle},
+		{"wrong kind", txn, errcode.ErrInvalidHandle},
+	}
+
+	var contract _Ctype_struct_contract_t
+	var info _Ctype_us_fileinfo_t
+	var comp _Ctype_us_completion_t
+	var n _Ctype_size_t
+	buf := make([]byte, 64)
+	bufp := unsafe.Pointer(&buf[0])
+	name := cString("foo")
+	exports := []struct {
+		name string
+		kind handles.Kind
+		call func(p unsafe.Pointer) bool // reports whether the call succeeded
+	}{
+		{"us_hostset_free", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_free(p) }},
+		{"us_hostset_add", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_add(p, &contract) }},
+		{"us_hostset_add_dir", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_add_dir(p, cString(t.TempDir())) != -1 }},
+		{"us_hostset_set_limits", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_set_limits(p, nil) }},
+		{"us_fs_init", handles.HostSet, func(p unsafe.Pointer) bool { return us_fs_init(cString(t.TempDir()), p) != nil }},
+		{"us_client_free", handles.Client, func(p unsafe.Pointer) bool { return us_client_free(p) }},
+		{"us_client_set_limits", handles.Client, func(p unsafe.Pointer) bool { return us_client_set_limits(p, nil) }},
+		{"us_ll_session_init", handles.Client, func(p unsafe.Pointer) bool { return us_ll_session_init(p, &contract) != nil }},
+		{"us_fs_close", handles.FS, func(p unsafe.Pointer) bool { return us_fs_close(p) }},
+		{"us_fs_create", handles.FS, func(p unsafe.Pointer) bool { return us_fs_create(p, name, 1) != nil }},
+		{"us_fs_open", handles.FS, func(p unsafe.Pointer) bool { return us_fs_open(p, name) != nil }},
+		{"us_fs_mkdir", handles.FS, func(p unsafe.Pointer) bool { return us_fs_mkdir(p, name, 0700) }},
+		{"us_fs_mkdirall", handles.FS, func(p unsafe.Pointer) bool { return us_fs_mkdirall(p, name, 0700) }},
+		{"us_fs_remove", handles.FS, func(p unsafe.Pointer) bool { return us_fs_remove(p, name) }},
+		{"us_fs_removeall", handles.FS, func(p unsafe.Pointer) bool { return us_fs_removeall(p, name) }},
+		{"us_fs_rename", handles.FS, func(p unsafe.Pointer) bool { return us_fs_rename(p, name, name) }},
+		{"us_fs_stat", handles.FS, func(p unsafe.Pointer) bool { return us_fs_stat(p, name, &info) }},
+		{"us_fs_opendir", handles.FS, func(p unsafe.Pointer) bool { return us_fs_opendir(p, name) != nil }},
+		{"us_dir_next", handles.Dir, func(p unsafe.Pointer) bool { return us_dir_next(p, &info) != -1 }},
+		{"us_dir_close", handles.Dir, func(p unsafe.Pointer) bool { return us_dir_close(p) }},
+		{"us_file_read", handles.File, func(p unsafe.Pointer) bool { return us_file_read(p, bufp, 64) != -1 }},
+		{"us_file_write", handles.File, func(p unsafe.Pointer) bool { return us_file_write(p, bufp, 64) != -1 }},
+		{"us_file_read_at", handles.File, func(p unsafe.Pointer) bool { return us_file_read_at(p, bufp, 64, 0) != -1 }},
+		{"us_file_write_at", handles.File, func(p unsafe.Pointer) bool { return us_file_write_at(p, bufp, 64, 0) != -1 }},
+		{"us_file_seek", handles.File, func(p unsafe.Pointer) bool { return us_file_seek(p, 0, 0) != -1 }},
+		{"us_file_size", handles.File, func(p unsafe.Pointer) bool { return us_file_size(p) != -1 }},
+		{"us_file_truncate", handles.File, func(p unsafe.Pointer) bool { return us_file_truncate(p, 0) }},
+		{"us_file_sync", handles.File, func(p unsafe.Pointer) bool { return us_file_sync(p) }},
+		{"us_file_close", handles.File, func(p unsafe.Pointer) bool { return us_file_close(p) }},
+		{"us_ll_upload", handles.Session, func(p unsafe.Pointer) bool { return us_ll_upload(p, bufp, bufp) }},
+		{"us_ll_download", handles.Session, func(p unsafe.Pointer) bool { return us_ll_download(p, bufp, bufp, 0, 64) }},
+		{"us_ll_session_close", handles.Session, func(p unsafe.Pointer) bool { return us_ll_session_close(p) }},
+		{"us_cq_fd", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_fd(p) != -1 }},
+		{"us_cq_poll", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_poll(p, &comp) != -1 }},
+		{"us_cq_cancel", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_cancel(p, 1) }},
+		{"us_cq_free", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_free(p) }},
+		{"us_fs_close_async", handles.Queue, func(p unsafe.Pointer) bool { return us_fs_close_async(p, nil, nil) != 0 }},
+		{"us_seed_phrase", handles.Seed, func(p unsafe.Pointer) bool { return us_seed_phrase(p) != nil }},
+		{"us_seed_public_key", handles.Seed, func(p unsafe.Pointer) bool { return us_seed_public_key(p, 0) != nil }},
+		{"us_seed_free", handles.Seed, func(p unsafe.Pointer) bool { return us_seed_free(p) }},
+		{"us_txn_add_output", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_add_output(p, name, name) }},
+		{"us_txn_add_input", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_add_input(p, name, name, name, 0) != -1 }},
+		{"us_txn_finalize", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_finalize(p, name) }},
+		{"us_txn_sign", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_sign(p, seed) }},
+		{"us_txn_json", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_json(p) != nil }},
+		{"us_txn_encode", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_encode(p, &n) != nil }},
+		{"us_txn_free", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_free(p) }},
+	}
+	for _, e := range exports {
+		for _, h := range bogus {
+			if h.p == seed && e.kind == handles.Seed || h.p == txn && e.kind == handles.Txn {
+				continue
+			}
+			if e.call(h.p) {
+				t.Errorf("%v with %v: expected failure", e.name, h.desc)
+			}
+			checkError(t, e.name+" with "+h.desc, h.err)
+		}
+	}
+
+	// the valid handles must be unaffected
+	if p := us_seed_phrase(seed); p == nil {
+		t.Error("seed handle should still be valid")
+	} else {
+		us_free(unsafe.Pointer(p))
+	}
+	if p := us_txn_json(txn); p == nil {
+		t.Error("transaction handle should still be valid")
+	} else {
+		us_free(unsafe.Pointer(p))
+	}
+}
+
+// newTestFS returns a HostSet containing one contract, whose host is
+// never contacted, and a FileSystem using it.
+func newTestFS(t *testing.T) (hs, fs unsafe.Pointer) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(100) // chain height
+	}))
+	t.Cleanup(srv.Close)
+	hs = us_hostset_init(cString(srv.URL))
+	if hs == nil {
+		t.Fatal(goString(us_error()))
+	}
+	var contract _Ctype_struct_contract_t
+	contract.hostKey[0] = 1
+	contract.id[0] = 1
+	if !us_hostset_add(hs, &contract) {
+		t.Fatal(goString(us_error()))
+	}
+	fs = us_fs_init(cString(t.TempDir()), hs)
+	if fs == nil {
+		t.Fatal(goString(us_error()))
+	}
+	return hs, fs
+}
+
+func TestFreeOrder(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	live := ptrs.Len()
+
+	hs, fs := newTestFS(t)
+	file := us_fs_create(fs, cString("foo"), 1)
+	if file == nil {
+		t.Fatal(goString(us_error()))
+	}
+	dir := us_fs_opendir(fs, cString("."))
+	if dir == nil {
+		t.Fatal(goString(us_error()))
+	}
+
+	// objects cannot be freed while their dependents are open
+	if us_hostset_free(hs) {
+		t.Error("HostSet should not be freed while its FileSystem is open")
+	}
+	checkError(t, "us_hostset_free", errcode.ErrBusy)
+	if us_fs_close(fs) {
+		t.Error("FileSystem should not be closed while its File and Directory are open")
+	}
+	checkError(t, "us_fs_close", errcode.ErrBusy)
+
+	// nor while they are pinned by an operation
+	if _, err := ptrs.Pin(file, handles.File); err != nil {
+		t.Fatal(err)
+	}
+	if us_file_close(file) {
+		t.Error("File should not be closed while pinned")
+	}
+	checkError(t, "us_file_close", errcode.ErrBusy)
+	ptrs.Unpin(file)
+
+	// each successful free releases its parent
+	if !us_file_close(file) {
+		t.Fatal(goString(us_error()))
+	}
+	if us_fs_close(fs) {
+		t.Error("FileSystem should not be closed while its Directory is open")
+	}
+	checkError(t, "us_fs_close", errcode.ErrBusy)
+	for _, free := range []func() bool{
+		func() bool { return us_dir_close(dir) },
+		func() bool { return us_fs_close(fs) },
+		func() bool { return us_hostset_free(hs) },
+	} {
+		if !free() {
+			t.Fatal(goString(us_error()))
+		}
+		checkError(t, "free", nil)
+	}
+
+	// freeing twice is an error, but freeing NULL is not
+	if us_hostset_free(hs) {
+		t.Error("HostSet should not be freed twice")
+	}
+	checkError(t, "us_hostset_free", errcode.ErrClosedHandle)
+	if !us_hostset_free(nil) || !us_fs_close(nil) || !us_file_close(nil) || !us_dir_close(nil) {
+		t.Error("freeing NULL should succeed")
+	}
+
+	// objects without dependents can be freed in any order
+	cq, seed, txn := us_cq_init(), us_seed_init(), us_txn_init(cString("1"))
+	if !us_seed_free(seed) || !us_cq_free(cq) || !us_txn_free(txn) {
+		t.Fatal(goString(us_error()))
+	}
+
+	if n := ptrs.Len(); n != live {
+		t.Errorf("leaked %v handles", n-live)
+	}
+}
+
+func TestLargeOffsets(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	hs, fs := newTestFS(t)
+	defer us_hostset_free(hs)
+	defer us_fs_close(fs)
+	file := us_fs_create(fs, cString("foo"), 1)
+	if file == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_file_close(file)
+	// discard the pending write before closing, so that it is never uploaded
+	defer us_file_truncate(file, 0)
+
+	const off = 1<<32 + 64 // past 4 GiB, on a chunk boundary
+	data := []byte("hello")
+	if n := us_file_write_at(file, unsafe.Pointer(&data[0]), _Ctype_size_t(len(data)), off); n != _Ctype_ssize_t(len(data)) {
+		t.Fatal(n, goString(us_error()))
+	}
+	if size := us_file_size(file); size != off+5 {
+		t.Errorf("expected size %v, got %v", off+5, size)
+	}
+
+	buf := make([]byte, 10)
+	if n := us_file_read_at(file, unsafe.Pointer(&buf[0]), 10, off); n != 5 || string(buf[:n]) != "hello" {
+		t.Errorf("expected to read %q, got %q", "hello", buf[:n])
+	}
+	if n := us_file_read_at(file, unsafe.Pointer(&buf[0]), 10, off+5); n != 0 {
+		t.Errorf("expected to read nothing at end of file, got %v bytes", n)
+	}
+	checkError(t, "us_file_read_at", nil)
+	if n := us_file_read_at(file, unsafe.Pointer(&buf[0]), 10, -1); n != -1 {
+		t.Error("negative offset should be rejected")
+	}
+	checkError(t, "us_file_read_at", errcode.ErrNegative)
+
+	for _, test := range []struct {
+		offset int64
+		whence int
+		pos    int64
+	}{
+		{off + 7, 0, off + 7}, // SEEK_SET
+		{-5, 1, off + 2},      // SEEK_CUR
+		{-5, 2, off},          // SEEK_END
+		{1 << 40, 0, 1 << 40}, // beyond end of file
+		{-(1 << 40), 2, -1},   // before start of file
+		{0, 3, -1},            // invalid whence
+	} {
+		if pos := us_file_seek(file, _Ctype_int64_t(test.offset), _Ctype_int(test.whence)); int64(pos) != test.pos {
+			t.Errorf("seek(%v, %v): expected %v, got %v", test.offset, test.whence, test.pos, pos)
+		}
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads more than 4 GiB")
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	h := ghost.NewOnDisk(t, ghost.FreeSettings, ghost.StubWallet{}, ghost.StubTpool{})
+	contract := formGhostContract(t, h, ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	shardSrv := servertest.NewShard(t, h.Key, h.Settings.NetAddress, h.Height())
+	hs := us_hostset_init(cString(shardSrv.URL))
+	if hs == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_hostset_free(hs)
+	if !us_hostset_add(hs, &contract) {
+		t.Fatal(goString(us_error()))
+	}
+	fs := us_fs_init(cString(t.TempDir()), hs)
+	if fs == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_fs_close(fs)
+
+	// fill the file with zeros up to off, then write past it; the hole must
+	// be written, since a file cannot be flushed with gaps in it
+	const off = 1<<32 + 64
+	data := []byte("hello")
+	file := us_fs_create(fs, cString("foo"), 1)
+	if file == nil {
+		t.Fatal(goString(us_error()))
+	}
+	zeros := make([]byte, renterhost.SectorSize)
+	for n := int64(0); n < off; {
+		chunk := zeros
+		if rem := off - n; rem < int64(len(chunk)) {
+			chunk = chunk[:rem]
+		}
+		if m := us_file_write_at(file, unsafe.Pointer(&chunk[0]), _Ctype_size_t(len(chunk)), _Ctype_int64_t(n)); m != _Ctype_ssize_t(len(chunk)) {
+			t.Fatal(m, goString(us_error()))
+		}
+		n += int64(len(chunk))
+	}
+	if n := us_file_write_at(file, unsafe.Pointer(&data[0]), _Ctype_size_t(len(data)), off); n != _Ctype_ssize_t(len(data)) {
+		t.Fatal(n, goString(us_error()))
+	}
+	if !us_file_sync(file) || !us_file_close(file) {
+		t.Fatal(goString(us_error()))
+	}
+
+	// reopen the file, which must now be read from the host
+	file = us_fs_open(fs, cString("foo"))
+	if file == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_file_close(file)
+	if size := us_file_size(file); size != off+5 {
+		t.Errorf("expected size %v, got %v", off+5, size)
+	}
+	if pos := us_file_seek(file, -5, 2); pos != off {
+		t.Errorf("expected SEEK_END to reach %v, got %v", off, pos)
+	}
+	buf := make([]byte, 10)
+	if n := us_file_read(file, unsafe.Pointer(&buf[0]), 10); n != 5 || string(buf[:n]) != "hello" {
+		t.Errorf("expected to read %q, got %q", "hello", buf[:n])
+	}
+	if n := us_file_read_at(file, unsafe.Pointer(&buf[0]), 10, off-5); n != 10 || string(buf) != "\x00\x00\x00\x00\x00hello" {
+		t.Errorf("expected to read across the end of the hole, got %q", buf[:n])
+	}
+}
+
+// Wallet test vectors, shared with the gomobile and Python bindings, which
+// must all derive the same keys and produce the same signed transaction.
+const (
+	vectorPhrase = "alpha abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abstract"
+	vectorInput0 = "0100000000000000000000000000000000000000000000000000000000000000"
+	vectorInput1 = "0200000000000000000000000000000000000000000000000000000000000000"
+	vectorTxnID  = "1e2e0da7f63bbf1f602fffcba9d77108b078eb48a5b3298af1fbb32b31e346fa"
+)
+
+var (
+	vectorPublicKeys = []string{
+		"ed25519:f64a814f44b4471d3b4e0d3646b3c582b641b4b2476fa954847681b91406c52a",
+		"ed25519:173de750868a9eef5306c492fa6755e60e2b89ade131c5653256b91480f9c21e",
+	}
+	vectorAddresses = []string{
+		"e893e43146db144782038ddd28e557f4205a6e688397336c73aa5af8af09556c58c86b05e025",
+		"31a6227605f5a8e11fb55c877d19ce1b31ce4350137c8114b896bc8a26053410d8952ab105e3",
+		"d44f1f98ae239772ed50cde9e02b332796533012c7a4d3b85942085a51f635d7296c331b9a1a",
+	}
+	vectorSignatures = []string{
+		"bb43eb4b6ab24baec2e280fddbd71e7e2e3e608ed409f70cb614750d9cd72a726cc5d57a2e544b3d859db1e66201d49692beb8f12765ebde76ca8f9c7095c807",
+		"15fce94ffc4a7b77879dbc1ede812616584f8ee14250f09f711511f9165df1eeb0877a5ba6011915bdc7b5b049029134bd231288347be90471c702880724590a",
+	}
+)
+
+func TestWalletVectors(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	seed := us_seed_from_phrase(cString(vectorPhrase))
+	if seed == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_seed_free(seed)
+	phrase := us_seed_phrase(seed)
+	if goString(phrase) != vectorPhrase {
+		t.Errorf("phrase did not round-trip: %q", goString(phrase))
+	}
+	us_free(unsafe.Pointer(phrase))
+	for i, exp := range vectorPublicKeys {
+		pk := us_seed_public_key(seed, _Ctype_uint64_t(i))
+		if goString(pk) != exp {
+			t.Errorf("public key %v: expected %v, got %v", i, exp, goString(pk))
+		}
+		us_free(unsafe.Pointer(pk))
+	}
+	for _, addr := range vectorAddresses {
+		if !us_validate_address(cString(addr)) {
+			t.Errorf("address %v should be valid", addr)
+		}
+	}
+
+	// send 1000000 H to address 2 from two inputs, with change to address 0
+	txn := us_txn_init(cString("10"))
+	if txn == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_txn_free(txn)
+	if !us_txn_add_output(txn, cString(vectorAddresses[2]), cString("1000000")) {
+		t.Fatal(goString(us_error()))
+	}
+	if r := us_txn_add_input(txn, cString(vectorInput0), cString("800000"), cString(vectorPublicKeys[0]), 0); r != 0 {
+		t.Fatal("first input should not fund the transaction:", r, goString(us_error()))
+	} else if r := us_txn_add_input(txn, cString(vectorInput1), cString("5000000"), cString(vectorPublicKeys[1]), 1); r != 1 {
+		t.Fatal("second input should fund the transaction:", r, goString(us_error()))
+	} else if !us_txn_finalize(txn, cString(vectorAddresses[0])) || !us_txn_sign(txn, seed) {
+		t.Fatal(goString(us_error()))
+	}
+
+	var n _Ctype_size_t
+	enc := us_txn_encode(txn, &n)
+	if enc == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_free(enc)
+	var decoded types.Transaction
+	if err := decoded.UnmarshalSia(bytes.NewReader(unsafe.Slice((*byte)(enc), n))); err != nil {
+		t.Fatal(err)
+	} else if err := decoded.StandaloneValid(types.FoundationHardforkHeight + 1); err != nil {
+		t.Error("signed transaction should be valid:", err)
+	}
+	if id := decoded.ID().String(); id != vectorTxnID {
+		t.Errorf("expected transaction ID %v, got %v", vectorTxnID, id)
+	}
+	if len(decoded.TransactionSignatures) != len(vectorSignatures) {
+		t.Fatalf("expected %v signatures, got %v", len(vectorSignatures), len(decoded.TransactionSignatures))
+	}
+	for i, exp := range vectorSignatures {
+		if sig := hex.EncodeToString(decoded.TransactionSignatures[i].Signature); sig != exp {
+			t.Errorf("signature %v: expected %v, got %v", i, exp, sig)
+		}
+	}
+
+	// the JSON encoding must describe the same transaction
+	js := us_txn_json(txn)
+	defer us_free(unsafe.Pointer(js))
+	var fromJSON types.Transaction
+	if err := json.Unmarshal([]byte(goString(js)), &fromJSON); err != nil {
+		t.Fatal(err)
+	} else if fromJSON.ID() != decoded.ID() {
+		t.Error("JSON and binary encodings differ")
+	}
+}
+
+// formGhostContract forms a contract with h, paid for by a stub wallet.
+func formGhostContract(t *testing.T, h *ghost.Host, renterKey ed25519.PrivateKey) (contract _Ctype_struct_contract_t) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	host, err := hostdb.Scan(ctx, h.Settings.NetAddress, h.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, _, err := proto.FormContract(ghost.StubWallet{}, ghost.StubTpool{}, renterKey, host, types.SiacoinPrecision, h.Height(), h.Height()+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := rev.ID()
+	copy((*[32]byte)(unsafe.Pointer(&contract.hostKey))[:], h.PublicKey.Ed25519())
+	copy((*[32]byte)(unsafe.Pointer(&contract.id))[:], id[:])
+	copy((*[32]byte)(unsafe.Pointer(&contract.renterKey))[:], renterKey[:ed25519.SeedSize])
+	return contract
+}
+
+func TestRenewContract(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	h := ghost.New(t, ghost.FreeSettings, ghost.StubWallet{}, ghost.StubTpool{})
+	renterKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	contract := formGhostContract(t, h, renterKey)
+
+	seed, err := wallet.SeedFromPhrase(vectorPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardSrv := servertest.NewShard(t, h.Key, h.Settings.NetAddress, h.Height())
+	walrusSrv := httptest.NewServer(servertest.NewWalrus(seed, types.SiacoinPrecision.Mul64(10)))
+	defer walrusSrv.Close()
+	client := us_client_init(cString(shardSrv.URL), cString(walrusSrv.URL), cString(vectorPhrase))
+	if client == nil {
+		t.Fatal(goString(us_error()))
+	}
+	defer us_client_free(client)
+
+	const duration = 40
+	var renewed _Ctype_struct_contract_t
+	if !us_client_renew_contract(client, &contract, cString("1SC"), duration, &renewed) {
+		t.Fatal(goString(us_error()))
+	}
+	checkError(t, "us_client_renew_contract", nil)
+	if renewed.hostKey != contract.hostKey {
+		t.Error("renewed contract should be with the same host")
+	} else if renewed.id == contract.id {
+		t.Error("renewed contract should have a new ID")
+	} else if renewed.renterKey != contract.renterKey {
+		t.Error("renewed contract should keep the renter key")
+	}
+
+	// the renewed contract can be locked with the same key, and ends
+	// duration blocks after the current height
+	var newID types.FileContractID
+	copy(newID[:], (*[32]byte)(unsafe.Pointer(&renewed.id))[:])
+	s, err := proto.NewSession(h.Settings.NetAddress, h.PublicKey, newID, renterKey, h.Height())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if end := s.Revision().EndHeight(); end != h.Height()+duration {
+		t.Errorf("expected end height %v, got %v", h.Height()+duration, end)
+	}
+}
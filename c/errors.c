@@ -0,0 +1,19 @@
+#include <stdlib.h>
+
+// The most recent error reported on each thread. See setError in bindings.go.
+static __thread char *thread_error;
+static __thread int thread_error_code;
+
+void set_thread_error(char *err, int code) {
+	free(thread_error);
+	thread_error = err;
+	thread_error_code = code;
+}
+
+char *get_thread_error(void) {
+	return thread_error;
+}
+
+int get_thread_error_code(void) {
+	return thread_error_code;
+}
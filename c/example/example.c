@@ -2,25 +2,18 @@
 #include <string.h>
 #include "../us.h"
 
-void decodeHex(uint8_t *out, char *hex) {
-	while (*hex != 0) {
-		sscanf(hex, "%2hhx", out++);
-		hex += 2;
-	}
-}
-
 void main() {
 	// load contract
 	//
-	// fill in this string with a hex-encoded contract; it should be 192 bytes.
-	// You can turn an existing contract into a hex string with the following
-	// command:
-	//     xxd -ps -s 12 -l 96 my.contract | tr -d '\n'
-	char *contractHex = "<hex contract string>";
-	uint8_t cdata[96];
-	decodeHex(cdata, contractHex);
+	// fill in this string with the path of a contract formed by user. (You can
+	// also use us_contract_init_hex with a hex-encoded contract, or
+	// us_hostset_add_dir to load every contract in a directory.)
+	char *contractPath = "<path to .contract file>";
 	contract_t c;
-	us_contract_init(&c, cdata);
+	if (!us_contract_load(&c, contractPath)) {
+		puts(us_error());
+		return;
+	}
 
 	// create host set with contract
 	//
@@ -80,4 +73,8 @@ closefs:
 	if (!us_fs_close(fs)) {
 		puts(us_error());
 	}
+	// free the host set
+	if (!us_hostset_free(hs)) {
+		puts(us_error());
+	}
 }
@@ -1,21 +1,46 @@
 package us // import "lukechampine.com/us-bindings/gomobile"
 
 import (
+	"bytes"
+	"context"
 	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/shard"
+	"lukechampine.com/us-bindings/internal/contractfile"
+	"lukechampine.com/us-bindings/internal/pricing"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renter/renterutil"
 	"lukechampine.com/us/wallet"
 )
 
+// recoverPanic converts a panic into an ordinary error, so that a bug (or bad
+// input) cannot crash the host application. It must be deferred directly by
+// the function whose named error result it sets.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+	}
+}
+
 // A Contract is a file contract formed with a Sia host.
 type Contract struct {
 	hostKey   hostdb.HostPublicKey
@@ -23,10 +48,14 @@ type Contract struct {
 	renterKey ed25519.PrivateKey
 }
 
-// NewContract parses a binary-encoded contract.
-func NewContract(b []byte) (*Contract, error) {
+// NewContract parses a binary-encoded contract. b may be either the 96-byte
+// contract itself or the full contents of a contract file.
+func NewContract(b []byte) (_ *Contract, err error) {
+	defer recoverPanic(&err)
 	if len(b) != 96 {
-		return nil, errors.New("invalid contract")
+		if b, err = contractfile.Parse(b); err != nil {
+			return nil, err
+		}
 	}
 	var pk [32]byte
 	copy(pk[:], b[:32])
@@ -38,41 +67,387 @@ func NewContract(b []byte) (*Contract, error) {
 	return c, nil
 }
 
+// NewContractFromHex parses a hex-encoded contract, e.g. one scanned from a QR
+// code.
+func NewContractFromHex(s string) (_ *Contract, err error) {
+	defer recoverPanic(&err)
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", contractfile.ErrInvalid, err)
+	} else if len(b) != 96 {
+		return nil, fmt.Errorf("%w: wrong size (%v bytes, expected 96)", contractfile.ErrInvalid, len(b))
+	}
+	return NewContract(b)
+}
+
+// LoadContract reads a contract file formed by the user tool.
+func LoadContract(path string) (_ *Contract, err error) {
+	defer recoverPanic(&err)
+	b, err := contractfile.Read(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewContract(b)
+}
+
 // A HostSet is a set of Sia hosts that can be used for uploading and
 // downloading.
 type HostSet struct {
-	set *renterutil.HostSet
+	set      *renterutil.HostSet
+	guard    pricing.Guard
+	mu       sync.Mutex
+	sessions map[hostdb.HostPublicKey]*proto.Session    // most recent session with each host
+	busy     map[hostdb.HostPublicKey]*transferSessions // transfer communicating with each host
+	released sync.Cond                                  // signaled when hosts are removed from busy
+}
+
+// onConnect is called by the underlying set whenever it connects to a host.
+// Sessions with hosts whose settings violate the set's price limits are closed
+// by the guard and never used.
+func (hs *HostSet) onConnect(s *proto.Session) {
+	if !hs.guard.Admit(s) {
+		return
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.sessions[s.HostKey()] = s
+	s.SetRPCStatsRecorder(statsRecorder{hs})
+}
+
+// A statsRecorder forwards the number of bytes transferred in each RPC to the
+// transfer communicating with the RPC's host, if any.
+type statsRecorder struct {
+	hs *HostSet
+}
+
+// RecordRPCStats implements proto.RPCStatsRecorder.
+func (r statsRecorder) RecordRPCStats(stats proto.RPCStats) {
+	r.hs.mu.Lock()
+	ts := r.hs.busy[stats.Host]
+	r.hs.mu.Unlock()
+	if ts != nil && ts.p != nil {
+		ts.p.addRPC(stats)
+	}
+}
+
+// claimHosts marks ts as the transfer communicating with hosts, waiting until
+// no other transfer is communicating with any of them. Sessions are shared by
+// all transfers, so this is what allows the RPCs with a host to be attributed
+// to a single transfer.
+func (hs *HostSet) claimHosts(ts *transferSessions, hosts []hostdb.HostPublicKey) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for {
+		free := true
+		for _, h := range hosts {
+			if other, ok := hs.busy[h]; ok && other != ts {
+				free = false
+				break
+			}
+		}
+		if free {
+			break
+		}
+		hs.released.Wait()
+	}
+	for _, h := range hosts {
+		hs.busy[h] = ts
+	}
+}
+
+// releaseHosts undoes claimHosts.
+func (hs *HostSet) releaseHosts(ts *transferSessions, hosts []hostdb.HostPublicKey) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for _, h := range hosts {
+		if hs.busy[h] == ts {
+			delete(hs.busy, h)
+		}
+	}
+	hs.released.Broadcast()
+}
+
+// interrupt closes the sessions with the specified hosts. The renter-host
+// protocol has no way to abort an RPC, so closing the connection is the only
+// way to interrupt one; the underlying set reconnects to each host the next
+// time it is used.
+func (hs *HostSet) interrupt(hosts []hostdb.HostPublicKey) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for _, h := range hosts {
+		if s, ok := hs.sessions[h]; ok {
+			s.Close()
+		}
+	}
 }
 
 // AddHost adds a host to the set.
-func (hs *HostSet) AddHost(c *Contract) {
+func (hs *HostSet) AddHost(c *Contract) (err error) {
+	defer recoverPanic(&err)
+	if c == nil {
+		return errors.New("nil contract")
+	}
 	hs.set.AddHost(renter.Contract{
 		HostKey:   c.hostKey,
 		ID:        c.id,
 		RenterKey: c.renterKey,
 	})
+	return nil
+}
+
+// AddHostsFromDir adds every contract file (i.e. every file with a .contract
+// extension) in dir to the set, returning the number of contracts added. If
+// any file is invalid, no contracts are added.
+func (hs *HostSet) AddHostsFromDir(dir string) (_ int, err error) {
+	defer recoverPanic(&err)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var contracts []*Contract
+	for _, info := range infos {
+		if info.IsDir() || filepath.Ext(info.Name()) != ".contract" {
+			continue
+		}
+		c, err := LoadContract(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return 0, err
+		}
+		contracts = append(contracts, c)
+	}
+	for _, c := range contracts {
+		if err := hs.AddHost(c); err != nil {
+			return 0, err
+		}
+	}
+	return len(contracts), nil
+}
+
+// SetLimits sets the price limits of the set, replacing any previous limits.
+// The settings of each host are checked whenever the set connects to it, and an
+// operation that would use a host whose settings violate the limits fails with
+// an error for which the set's IsPriceExceeded method returns true. If limits
+// is nil, the limits are removed.
+func (hs *HostSet) SetLimits(limits *PriceLimits) (err error) {
+	defer recoverPanic(&err)
+	l, err := limits.parse()
+	if err != nil {
+		return err
+	}
+	hs.guard.SetLimits(l)
+	return nil
 }
 
 // NewHostSet returns an empty HostSet, using the provided shard server to
 // resolve public keys to network addresses.
-func NewHostSet(shardSrv string) (*HostSet, error) {
+func NewHostSet(shardSrv string) (_ *HostSet, err error) {
+	defer recoverPanic(&err)
 	c := shard.NewClient(shardSrv)
 	currentHeight, err := c.ChainHeight()
 	if err != nil {
 		return nil, err
 	}
-	return &HostSet{
-		set: renterutil.NewHostSet(c, currentHeight),
-	}, nil
+	hs := &HostSet{
+		sessions: make(map[hostdb.HostPublicKey]*proto.Session),
+		busy:     make(map[hostdb.HostPublicKey]*transferSessions),
+	}
+	hs.released.L = &hs.mu
+	hs.set = renterutil.NewHostSet(c, currentHeight)
+	hs.set.SetOnConnect(hs.onConnect)
+	return hs, nil
+}
+
+// PriceLimits restricts the prices paid to hosts. Prices are in hastings;
+// an empty string (or a MinCollateralRatio of 0) means no limit.
+type PriceLimits struct {
+	MaxStoragePrice    string // per byte per block
+	MaxUploadPrice     string // per byte
+	MaxDownloadPrice   string // per byte
+	MaxContractPrice   string
+	MinCollateralRatio float64 // collateral divided by storage price
+}
+
+// NewPriceLimits returns a PriceLimits with no limits set.
+func NewPriceLimits() *PriceLimits {
+	return new(PriceLimits)
+}
+
+// IsPriceExceeded reports whether err, returned by an operation on a file of
+// the set, was caused by a host whose settings violate the set's price limits.
+func (hs *HostSet) IsPriceExceeded(err error) bool {
+	return errors.Is(hs.guard.Explain(err), pricing.ErrPriceExceeded)
+}
+
+// parse converts pl to pricing.Limits.
+func (pl *PriceLimits) parse() (pricing.Limits, error) {
+	var l pricing.Limits
+	if pl == nil {
+		return l, nil
+	}
+	for _, p := range []struct {
+		s string
+		c *types.Currency
+	}{
+		{pl.MaxStoragePrice, &l.MaxStoragePrice},
+		{pl.MaxUploadPrice, &l.MaxUploadPrice},
+		{pl.MaxDownloadPrice, &l.MaxDownloadPrice},
+		{pl.MaxContractPrice, &l.MaxContractPrice},
+	} {
+		if p.s == "" {
+			continue
+		}
+		c, err := parseAmount(p.s)
+		if err != nil {
+			return pricing.Limits{}, err
+		}
+		*p.c = c
+	}
+	if pl.MinCollateralRatio < 0 {
+		return pricing.Limits{}, errors.New("collateral ratio must not be negative")
+	}
+	l.MinCollateralRatio = pl.MinCollateralRatio
+	return l, nil
+}
+
+// HostInfo contains the settings of a host, as reported by ScanHost. Prices
+// are in hastings.
+type HostInfo struct {
+	PublicKey              string
+	NetAddress             string
+	Version                string
+	AcceptingContracts     bool
+	MaxDuration            int64 // blocks
+	WindowSize             int64 // blocks
+	RemainingStorage       int64 // bytes
+	TotalStorage           int64 // bytes
+	ContractPrice          string
+	StoragePrice           string // per byte per block
+	Collateral             string // per byte per block
+	MaxCollateral          string
+	UploadBandwidthPrice   string // per byte
+	DownloadBandwidthPrice string // per byte
+	BaseRPCPrice           string
+	SectorAccessPrice      string
+	LatencyMillis          float64
+}
+
+func newHostInfo(h hostdb.ScannedHost) *HostInfo {
+	return &HostInfo{
+		PublicKey:              string(h.PublicKey),
+		NetAddress:             string(h.NetAddress),
+		Version:                h.Version,
+		AcceptingContracts:     h.AcceptingContracts,
+		MaxDuration:            int64(h.MaxDuration),
+		WindowSize:             int64(h.WindowSize),
+		RemainingStorage:       int64(h.RemainingStorage),
+		TotalStorage:           int64(h.TotalStorage),
+		ContractPrice:          h.ContractPrice.String(),
+		StoragePrice:           h.StoragePrice.String(),
+		Collateral:             h.Collateral.String(),
+		MaxCollateral:          h.MaxCollateral.String(),
+		UploadBandwidthPrice:   h.UploadBandwidthPrice.String(),
+		DownloadBandwidthPrice: h.DownloadBandwidthPrice.String(),
+		BaseRPCPrice:           h.BaseRPCPrice.String(),
+		SectorAccessPrice:      h.SectorAccessPrice.String(),
+		LatencyMillis:          float64(h.Latency) / float64(time.Millisecond),
+	}
+}
+
+const maxConcurrentScans = 32
+
+// scanHosts resolves the host matching each key prefix through the shard
+// server and scans the hosts concurrently.
+func scanHosts(shardSrv string, prefixes []string, timeoutMillis int) ([]*HostInfo, []error) {
+	timeout := 10 * time.Second
+	if timeoutMillis > 0 {
+		timeout = time.Duration(timeoutMillis) * time.Millisecond
+	}
+	c := shard.NewClient(shardSrv)
+	hosts := make([]*HostInfo, len(prefixes))
+	errs := make([]error, len(prefixes))
+	sem := make(chan struct{}, maxConcurrentScans)
+	var wg sync.WaitGroup
+	for i := range prefixes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer recoverPanic(&errs[i])
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			hostKey, err := c.LookupHost(prefixes[i])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			addr, err := c.ResolveHostKey(hostKey)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			h, err := hostdb.Scan(ctx, addr, hostKey)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			hosts[i] = newHostInfo(h)
+		}(i)
+	}
+	wg.Wait()
+	return hosts, errs
+}
+
+// ScanHost uses the provided shard server to resolve the host whose public
+// key starts with hostKey, and requests its settings. It waits at most
+// timeoutMillis milliseconds, or 10 seconds if timeoutMillis is 0.
+func ScanHost(shardSrv string, hostKey string, timeoutMillis int) (_ *HostInfo, err error) {
+	defer recoverPanic(&err)
+	hosts, errs := scanHosts(shardSrv, []string{hostKey}, timeoutMillis)
+	return hosts[0], errs[0]
+}
+
+// HostScanResults holds the results of ScanHosts.
+type HostScanResults struct {
+	hosts []*HostInfo
+	errs  []error
+}
+
+// Len returns the number of hosts that were scanned.
+func (r *HostScanResults) Len() int {
+	return len(r.hosts)
+}
+
+// Get returns the settings of the i'th host, or the error encountered while
+// scanning it.
+func (r *HostScanResults) Get(i int) (_ *HostInfo, err error) {
+	defer recoverPanic(&err)
+	if i < 0 || i >= len(r.hosts) {
+		return nil, errors.New("index out of range")
+	}
+	return r.hosts[i], r.errs[i]
+}
+
+// ScanHosts is like ScanHost, but scans multiple hosts concurrently. hostKeys
+// is a whitespace-separated list of host keys (or key prefixes). The results
+// are in the same order.
+func ScanHosts(shardSrv string, hostKeys string, timeoutMillis int) (_ *HostScanResults, err error) {
+	defer recoverPanic(&err)
+	hosts, errs := scanHosts(shardSrv, strings.Fields(hostKeys), timeoutMillis)
+	return &HostScanResults{hosts: hosts, errs: errs}, nil
 }
 
 // A FileSystem supports I/O operations on Sia files.
 type FileSystem struct {
 	pfs *renterutil.PseudoFS
+	hs  *HostSet
 }
 
-// Upload creates a file with the given name, data, and redundancy.
-func (fs *FileSystem) Upload(name string, data []byte, minHosts int) error {
+// Upload creates a file with the given name, data, and redundancy. For large
+// files, use NewUpload or UploadFile, which do not hold the whole file in
+// memory.
+func (fs *FileSystem) Upload(name string, data []byte, minHosts int) (err error) {
+	defer recoverPanic(&err)
 	pf, err := fs.pfs.Create(name, minHosts)
 	if err != nil {
 		return err
@@ -86,8 +461,10 @@ func (fs *FileSystem) Upload(name string, data []byte, minHosts int) error {
 	return nil
 }
 
-// Download retrieves the contents of the named file.
-func (fs *FileSystem) Download(name string) ([]byte, error) {
+// Download retrieves the contents of the named file. For large files, use
+// NewDownload or DownloadFile, which do not hold the whole file in memory.
+func (fs *FileSystem) Download(name string) (_ []byte, err error) {
+	defer recoverPanic(&err)
 	pf, err := fs.pfs.Open(name)
 	if err != nil {
 		return nil, err
@@ -96,16 +473,558 @@ func (fs *FileSystem) Download(name string) ([]byte, error) {
 	return ioutil.ReadAll(pf)
 }
 
+// Size returns the size of the named file.
+func (fs *FileSystem) Size(name string) (_ int64, err error) {
+	defer recoverPanic(&err)
+	fi, err := fs.pfs.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Truncate changes the size of the named file, which must not exceed its
+// current size.
+func (fs *FileSystem) Truncate(name string, size int64) (err error) {
+	defer recoverPanic(&err)
+	if size < 0 {
+		return errors.New("size must not be negative")
+	}
+	pf, err := fs.pfs.OpenFile(name, os.O_RDWR, 0, 0)
+	if err != nil {
+		return err
+	}
+	if err := pf.Truncate(size); err != nil {
+		pf.Close()
+		return err
+	}
+	return pf.Close()
+}
+
+// transferChunkSize is the size of the buffer used by UploadFile and
+// DownloadFile. It is a multiple of the segment size, so that each write fills
+// whole segments.
+const transferChunkSize = 1 << 20
+
+// An Upload writes a new file to a FileSystem incrementally, so that the file
+// never needs to fit in memory.
+type Upload struct {
+	mu sync.Mutex
+	pf *renterutil.PseudoFile
+}
+
+// Write appends chunk to the file.
+func (u *Upload) Write(chunk []byte) (_ int, err error) {
+	defer recoverPanic(&err)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pf == nil {
+		return 0, os.ErrClosed
+	}
+	return u.pf.Write(chunk)
+}
+
+// Close finishes the upload, flushing any buffered data to the hosts. The
+// Upload must not be used afterwards.
+func (u *Upload) Close() (err error) {
+	defer recoverPanic(&err)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pf == nil {
+		return os.ErrClosed
+	}
+	err = u.pf.Sync()
+	if cerr := u.pf.Close(); err == nil {
+		err = cerr
+	}
+	u.pf = nil
+	return err
+}
+
+// NewUpload creates a file with the given name and redundancy, returning an
+// Upload that writes to it.
+func (fs *FileSystem) NewUpload(name string, minHosts int) (_ *Upload, err error) {
+	defer recoverPanic(&err)
+	pf, err := fs.pfs.Create(name, minHosts)
+	if err != nil {
+		return nil, err
+	}
+	return &Upload{pf: pf}, nil
+}
+
+// A Download reads a file from a FileSystem incrementally, so that the file
+// never needs to fit in memory.
+type Download struct {
+	mu sync.Mutex
+	pf *renterutil.PseudoFile
+}
+
+// Read reads up to n bytes from the current offset. It returns an empty slice
+// at the end of the file.
+func (d *Download) Read(n int) (_ []byte, err error) {
+	defer recoverPanic(&err)
+	if n < 0 {
+		return nil, errors.New("size must not be negative")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pf == nil {
+		return nil, os.ErrClosed
+	}
+	buf := make([]byte, n)
+	n, err = io.ReadFull(d.pf, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// Seek sets the offset for the next Read, interpreted according to whence: 0
+// means relative to the start of the file, 1 relative to the current offset,
+// and 2 relative to the end. It returns the new offset.
+func (d *Download) Seek(offset int64, whence int) (_ int64, err error) {
+	defer recoverPanic(&err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pf == nil {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart, io.SeekCurrent:
+		return d.pf.Seek(offset, whence)
+	case io.SeekEnd:
+		// PseudoFile subtracts offset from the size when seeking relative to
+		// the end, so resolve the offset here instead
+		fi, err := d.pf.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return d.pf.Seek(fi.Size()+offset, io.SeekStart)
+	default:
+		return 0, fmt.Errorf("invalid whence %v", whence)
+	}
+}
+
+// Size returns the size of the file.
+func (d *Download) Size() (_ int64, err error) {
+	defer recoverPanic(&err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pf == nil {
+		return 0, os.ErrClosed
+	}
+	fi, err := d.pf.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Close closes the file. The Download must not be used afterwards.
+func (d *Download) Close() (err error) {
+	defer recoverPanic(&err)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pf == nil {
+		return os.ErrClosed
+	}
+	err = d.pf.Close()
+	d.pf = nil
+	return err
+}
+
+// NewDownload opens the named file, returning a Download that reads from it.
+func (fs *FileSystem) NewDownload(name string) (_ *Download, err error) {
+	defer recoverPanic(&err)
+	pf, err := fs.pfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Download{pf: pf}, nil
+}
+
+// UploadFile creates a file with the given name and redundancy, containing
+// the contents of the local file at localPath. If the upload fails, the file
+// is removed.
+func (fs *FileSystem) UploadFile(name string, localPath string, minHosts int) (err error) {
+	defer recoverPanic(&err)
+	return fs.uploadFile(context.Background(), name, localPath, minHosts, nil, nil)
+}
+
+// DownloadFile writes the contents of the named file to the local file at
+// localPath, replacing it if it exists. The local file is only replaced once
+// the download has succeeded.
+func (fs *FileSystem) DownloadFile(name string, localPath string) (err error) {
+	defer recoverPanic(&err)
+	return fs.downloadFile(context.Background(), name, localPath, nil, nil)
+}
+
+func (fs *FileSystem) uploadFile(ctx context.Context, name string, localPath string, minHosts int, p *transferProgress, ts *transferSessions) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if p != nil {
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		p.total = stat.Size()
+	}
+	pf, err := fs.pfs.Create(name, minHosts)
+	if err != nil {
+		return err
+	}
+	err = ts.setFile(pf)
+	if err == nil {
+		err = copyChunks(ctx, progressWriter{sessionIO{pf, ts}, p}, f)
+	}
+	if err == nil {
+		err = ts.do(pf.Sync)
+	}
+	if err == nil {
+		err = ts.do(pf.Close)
+	}
+	if err != nil {
+		// discard whatever has not been uploaded yet, so that closing the file
+		// does not try again, and remove the file
+		pf.Truncate(0)
+		pf.Close()
+		fs.pfs.Remove(name)
+		return err
+	}
+	return nil
+}
+
+func (fs *FileSystem) downloadFile(ctx context.Context, name string, localPath string, p *transferProgress, ts *transferSessions) error {
+	pf, err := fs.pfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+	if err := ts.setFile(pf); err != nil {
+		return err
+	}
+	if p != nil {
+		stat, err := pf.Stat()
+		if err != nil {
+			return err
+		}
+		p.total = stat.Size()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(localPath), "."+filepath.Base(localPath)+".part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after a successful rename
+	if err := copyChunks(ctx, progressWriter{f, p}, sessionIO{pf, ts}); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), localPath)
+}
+
+// copyChunks copies src to dst in chunks of transferChunkSize, stopping early
+// if ctx is canceled.
+func copyChunks(ctx context.Context, dst io.Writer, src io.Reader) error {
+	buf := make([]byte, transferChunkSize)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// A ProgressListener receives progress reports for a Transfer. It may be
+// implemented in Swift or Kotlin. Its methods are called from background
+// threads, and should return quickly.
+type ProgressListener interface {
+	// OnProgress reports the number of bytes of the file that have been
+	// transferred so far, along with the size of the file. Uploads buffer up
+	// to a sector per host before sending it, and flush the remainder before
+	// the transfer completes.
+	OnProgress(transferred int64, total int64)
+	// OnHostProgress reports the total number of bytes uploaded to and
+	// downloaded from a host during the transfer, including protocol
+	// overhead. It is called after each RPC with the host. Concurrent
+	// transfers using the same HostSet take turns communicating with a
+	// shared host, so each RPC is reported to one transfer only; RPCs
+	// made by other operations on the set while a transfer is using the
+	// host are reported to that transfer.
+	OnHostProgress(hostKey string, uploaded int64, downloaded int64)
+}
+
+// transferProgress tracks the progress of a Transfer and forwards it to a
+// ProgressListener.
+type transferProgress struct {
+	l     ProgressListener
+	total int64
+
+	mu    sync.Mutex
+	n     int64
+	hosts map[hostdb.HostPublicKey][2]int64
+}
+
+func (p *transferProgress) addBytes(n int) {
+	p.mu.Lock()
+	p.n += int64(n)
+	transferred := p.n
+	p.mu.Unlock()
+	p.l.OnProgress(transferred, p.total)
+}
+
+func (p *transferProgress) addRPC(stats proto.RPCStats) {
+	p.mu.Lock()
+	totals := p.hosts[stats.Host]
+	totals[0] += int64(stats.Uploaded)
+	totals[1] += int64(stats.Downloaded)
+	p.hosts[stats.Host] = totals
+	p.mu.Unlock()
+	p.l.OnHostProgress(string(stats.Host), totals[0], totals[1])
+}
+
+// A progressWriter reports the bytes written through it to a transferProgress.
+type progressWriter struct {
+	w io.Writer
+	p *transferProgress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	if pw.p != nil && n > 0 {
+		pw.p.addBytes(n)
+	}
+	return n, err
+}
+
+// transferSessions tracks when a Transfer is communicating with the hosts of
+// its file, so that canceling it interrupts only those sessions, and only
+// while they are in use by the transfer, and so that the RPCs with those hosts
+// are reported to its progress. A nil *transferSessions performs no tracking.
+type transferSessions struct {
+	hs       *HostSet
+	p        *transferProgress
+	mu       sync.Mutex
+	hosts    []hostdb.HostPublicKey
+	busy     bool
+	canceled bool
+}
+
+// setFile records the hosts storing pf.
+func (ts *transferSessions) setFile(pf *renterutil.PseudoFile) error {
+	if ts == nil {
+		return nil
+	}
+	fi, err := pf.Stat()
+	if err != nil {
+		return err
+	}
+	m, ok := fi.Sys().(renter.MetaIndex)
+	if !ok {
+		return errors.New("not a metafile")
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.hosts = m.Hosts
+	return nil
+}
+
+// do calls fn, which may communicate with the hosts of the file, once no other
+// transfer is communicating with them. It returns context.Canceled without
+// calling fn if the transfer has been canceled.
+func (ts *transferSessions) do(fn func() error) error {
+	if ts == nil {
+		return fn()
+	}
+	ts.mu.Lock()
+	hosts := ts.hosts
+	ts.mu.Unlock()
+	ts.hs.claimHosts(ts, hosts)
+	defer ts.hs.releaseHosts(ts, hosts)
+	ts.mu.Lock()
+	if ts.canceled {
+		ts.mu.Unlock()
+		return context.Canceled
+	}
+	ts.busy = true
+	ts.mu.Unlock()
+	defer func() {
+		ts.mu.Lock()
+		ts.busy = false
+		ts.mu.Unlock()
+	}()
+	return fn()
+}
+
+// cancel prevents further calls to do, and interrupts the call in progress, if
+// any.
+func (ts *transferSessions) cancel() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.canceled = true
+	if ts.busy {
+		ts.hs.interrupt(ts.hosts)
+	}
+}
+
+// sessionIO wraps the Read and Write methods of a PseudoFile with
+// transferSessions.do.
+type sessionIO struct {
+	pf *renterutil.PseudoFile
+	ts *transferSessions
+}
+
+func (sio sessionIO) Read(b []byte) (n int, err error) {
+	err = sio.ts.do(func() error {
+		n, err = sio.pf.Read(b)
+		return err
+	})
+	return
+}
+
+func (sio sessionIO) Write(b []byte) (n int, err error) {
+	err = sio.ts.do(func() error {
+		n, err = sio.pf.Write(b)
+		return err
+	})
+	return
+}
+
+// ErrCanceled is returned by Transfer.Wait if the transfer was canceled.
+var ErrCanceled = errors.New("transfer was canceled")
+
+// IsCanceled reports whether err was caused by canceling a Transfer.
+func IsCanceled(err error) bool {
+	return errors.Is(err, ErrCanceled)
+}
+
+// A Transfer is an upload or download running in the background.
+type Transfer struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Cancel stops the transfer, interrupting any RPCs in progress. If the
+// transfer is communicating with the hosts of its file, their sessions are
+// closed, so other operations using those hosts at the same moment may fail as
+// well; the hosts are reconnected as needed afterwards. A canceled upload
+// leaves no file behind, and a canceled download leaves the local file
+// untouched. Canceling a finished transfer has no effect.
+func (t *Transfer) Cancel() {
+	t.cancel()
+}
+
+// Wait blocks until the transfer finishes, returning its error, if any.
+func (t *Transfer) Wait() error {
+	<-t.done
+	return t.err
+}
+
+// IsDone reports whether the transfer has finished.
+func (t *Transfer) IsDone() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// startTransfer calls fn in a new goroutine, returning a Transfer that tracks
+// it. If the Transfer is canceled while fn is running, the sessions it is using
+// are interrupted. fn's error is replaced with ErrCanceled if it failed after
+// the Transfer was canceled.
+func (fs *FileSystem) startTransfer(l ProgressListener, fn func(context.Context, *transferProgress, *transferSessions) error) *Transfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Transfer{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	var p *transferProgress
+	if l != nil {
+		p = &transferProgress{
+			l:     l,
+			hosts: make(map[hostdb.HostPublicKey][2]int64),
+		}
+	}
+	ts := &transferSessions{hs: fs.hs, p: p}
+	go func() {
+		defer close(t.done)
+		defer cancel()
+		stop := make(chan struct{})
+		interrupted := make(chan struct{})
+		go func() {
+			defer close(interrupted)
+			select {
+			case <-ctx.Done():
+				ts.cancel()
+			case <-stop:
+			}
+		}()
+		err := func() (err error) {
+			defer recoverPanic(&err)
+			return fn(ctx, p, ts)
+		}()
+		close(stop)
+		<-interrupted
+		if err != nil && ctx.Err() != nil {
+			err = ErrCanceled
+		}
+		t.err = err
+	}()
+	return t
+}
+
+// StartUploadFile is like UploadFile, but runs in the background, reporting
+// its progress to l, which may be nil.
+func (fs *FileSystem) StartUploadFile(name string, localPath string, minHosts int, l ProgressListener) *Transfer {
+	return fs.startTransfer(l, func(ctx context.Context, p *transferProgress, ts *transferSessions) error {
+		return fs.uploadFile(ctx, name, localPath, minHosts, p, ts)
+	})
+}
+
+// StartDownloadFile is like DownloadFile, but runs in the background,
+// reporting its progress to l, which may be nil.
+func (fs *FileSystem) StartDownloadFile(name string, localPath string, l ProgressListener) *Transfer {
+	return fs.startTransfer(l, func(ctx context.Context, p *transferProgress, ts *transferSessions) error {
+		return fs.downloadFile(ctx, name, localPath, p, ts)
+	})
+}
+
 // Close shuts down the filesystem, flushing any uncommitted writes.
-func (fs *FileSystem) Close() error {
+func (fs *FileSystem) Close() (err error) {
+	defer recoverPanic(&err)
 	return fs.pfs.Close()
 }
 
 // NewFileSystem returns a filesystem rooted at root using the provided hosts.
-func NewFileSystem(root string, hs *HostSet) (*FileSystem, error) {
+func NewFileSystem(root string, hs *HostSet) (_ *FileSystem, err error) {
+	defer recoverPanic(&err)
+	if hs == nil {
+		return nil, errors.New("nil HostSet")
+	}
 	pfs := renterutil.NewFileSystem(root, hs.set)
 	return &FileSystem{
 		pfs: pfs,
+		hs:  hs,
 	}, nil
 }
 
@@ -129,25 +1048,156 @@ func (s *Seed) PublicKey(index int) string {
 }
 
 // SeedFromPhrase returns the seed derived from the supplied phrase.
-func SeedFromPhrase(phrase string) (*Seed, error) {
+func SeedFromPhrase(phrase string) (_ *Seed, err error) {
+	defer recoverPanic(&err)
 	s, err := wallet.SeedFromPhrase(phrase)
 	return &Seed{s}, err
 }
 
-func parseAddr(addr string) types.UnlockHash {
+// Address derives the standard address at the specified index, i.e. the
+// address of the standard unlock conditions for PublicKey(index).
+func (s *Seed) Address(index int) string {
+	return s.address(uint64(index)).String()
+}
+
+func (s *Seed) address(index uint64) types.UnlockHash {
+	return wallet.StandardUnlockConditions(s.seed.PublicKey(index)).UnlockHash()
+}
+
+// A DerivedAddress is an address derived from a seed.
+type DerivedAddress struct {
+	Index     int
+	Address   string
+	PublicKey string
+}
+
+func (s *Seed) derive(index uint64) *DerivedAddress {
+	return &DerivedAddress{
+		Index:     int(index),
+		Address:   s.address(index).String(),
+		PublicKey: s.seed.PublicKey(index).String(),
+	}
+}
+
+// An AddressList is a list of addresses derived from a seed.
+type AddressList struct {
+	addrs []*DerivedAddress
+}
+
+// Len returns the number of addresses in the list.
+func (l *AddressList) Len() int {
+	return len(l.addrs)
+}
+
+// Get returns the i'th address in the list.
+func (l *AddressList) Get(i int) (_ *DerivedAddress, err error) {
+	defer recoverPanic(&err)
+	if i < 0 || i >= len(l.addrs) {
+		return nil, errors.New("index out of range")
+	}
+	return l.addrs[i], nil
+}
+
+// Addresses derives the n addresses starting at index start.
+func (s *Seed) Addresses(start int, n int) (_ *AddressList, err error) {
+	defer recoverPanic(&err)
+	if start < 0 || n < 0 {
+		return nil, errors.New("start and n must not be negative")
+	}
+	l := &AddressList{addrs: make([]*DerivedAddress, n)}
+	for i := range l.addrs {
+		l.addrs[i] = s.derive(uint64(start + i))
+	}
+	return l, nil
+}
+
+// An AddressChecker reports whether an address has ever been used, i.e.
+// whether any transaction has sent coins to or from it. It may be implemented
+// in Swift or Kotlin, e.g. on top of a block explorer, or created with
+// NewWalrusChecker.
+type AddressChecker interface {
+	IsUsed(addr string) (bool, error)
+}
+
+// A walrusChecker checks addresses using a walrus server.
+type walrusChecker struct {
+	addr string
+}
+
+// IsUsed implements AddressChecker.
+func (c walrusChecker) IsUsed(addr string) (_ bool, err error) {
+	defer recoverPanic(&err)
 	var uh types.UnlockHash
 	if err := uh.LoadString(addr); err != nil {
-		panic(err)
+		return false, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	// only the existence of a transaction matters, so ask for at most one
+	resp, err := http.Get(fmt.Sprintf("%v/transactions?addr=%v&max=1", c.addr, uh))
+	if err != nil {
+		return false, err
+	}
+	defer io.Copy(ioutil.Discard, resp.Body)
+	defer resp.Body.Close()
+	if !(200 <= resp.StatusCode && resp.StatusCode <= 299) {
+		errString, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("walrus: %v", strings.TrimSpace(string(errString)))
 	}
-	return uh
+	var txids []types.TransactionID
+	if err := json.NewDecoder(resp.Body).Decode(&txids); err != nil {
+		return false, err
+	}
+	return len(txids) > 0, nil
+}
+
+// NewWalrusChecker returns an AddressChecker that queries the walrus server at
+// walrusAddr (e.g. "http://localhost:9380"). walrus only records the
+// transactions of addresses it tracks, so the server must have been tracking
+// the seed's addresses since they were first used.
+func NewWalrusChecker(walrusAddr string) AddressChecker {
+	return walrusChecker{strings.TrimSuffix(walrusAddr, "/")}
 }
 
-func parseAmount(value string) types.Currency {
+// ScanAddresses checks the seed's addresses in order, starting at index 0,
+// until gapLimit consecutive addresses are unused. It returns the used
+// addresses; the next address to hand out is the one after the last of them.
+func (s *Seed) ScanAddresses(c AddressChecker, gapLimit int) (_ *AddressList, err error) {
+	defer recoverPanic(&err)
+	if c == nil {
+		return nil, errors.New("nil AddressChecker")
+	} else if gapLimit <= 0 {
+		return nil, errors.New("gap limit must be positive")
+	}
+	var used []*DerivedAddress
+	for index, gap := uint64(0), 0; gap < gapLimit; index++ {
+		a := s.derive(index)
+		ok, err := c.IsUsed(a.Address)
+		if err != nil {
+			return nil, fmt.Errorf("could not check address %v: %w", index, err)
+		}
+		if ok {
+			used = append(used, a)
+			gap = 0
+		} else {
+			gap++
+		}
+	}
+	return &AddressList{addrs: used}, nil
+}
+
+func parseAddr(addr string) (types.UnlockHash, error) {
+	var uh types.UnlockHash
+	if err := uh.LoadString(addr); err != nil {
+		return types.UnlockHash{}, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	return uh, nil
+}
+
+func parseAmount(value string) (types.Currency, error) {
 	var c types.Currency
 	if _, err := fmt.Sscan(value, &c); err != nil {
-		panic(err)
+		return types.Currency{}, fmt.Errorf("invalid amount %q: %w", value, err)
 	}
-	return c
+	return c, nil
 }
 
 type Transaction struct {
@@ -158,19 +1208,34 @@ type Transaction struct {
 	sigs       map[crypto.Hash]uint64
 }
 
-func NewTransaction(feePerByte string) *Transaction {
+func NewTransaction(feePerByte string) (_ *Transaction, err error) {
+	defer recoverPanic(&err)
+	fee, err := parseAmount(feePerByte)
+	if err != nil {
+		return nil, err
+	}
 	return &Transaction{
-		feePerByte: parseAmount(feePerByte),
+		feePerByte: fee,
 		sigs:       make(map[crypto.Hash]uint64),
-	}
+	}, nil
 }
 
-func (t *Transaction) AddOutput(addr string, amount string) {
+func (t *Transaction) AddOutput(addr string, amount string) (err error) {
+	defer recoverPanic(&err)
+	uh, err := parseAddr(addr)
+	if err != nil {
+		return err
+	}
+	value, err := parseAmount(amount)
+	if err != nil {
+		return err
+	}
 	t.txn.SiacoinOutputs = append(t.txn.SiacoinOutputs, types.SiacoinOutput{
-		UnlockHash: parseAddr(addr),
-		Value:      parseAmount(amount),
+		UnlockHash: uh,
+		Value:      value,
 	})
-	t.outputSum = t.outputSum.Add(parseAmount(amount))
+	t.outputSum = t.outputSum.Add(value)
+	return nil
 }
 
 func (t *Transaction) calcFee() types.Currency {
@@ -178,14 +1243,19 @@ func (t *Transaction) calcFee() types.Currency {
 	return t.feePerByte.Mul64(uint64(size))
 }
 
-func (t *Transaction) AddInput(id string, value string, publicKey string, keyIndex int) bool {
+func (t *Transaction) AddInput(id string, value string, publicKey string, keyIndex int) (_ bool, err error) {
+	defer recoverPanic(&err)
 	var scoid crypto.Hash
 	if err := scoid.LoadString(id); err != nil {
-		panic(err)
+		return false, fmt.Errorf("invalid output ID %q: %w", id, err)
 	}
 	var pk types.SiaPublicKey
 	if pk.LoadString(publicKey); pk.Algorithm != types.SignatureEd25519 {
-		panic("invalid public key")
+		return false, errors.New("invalid public key")
+	}
+	amount, err := parseAmount(value)
+	if err != nil {
+		return false, err
 	}
 	t.txn.SiacoinInputs = append(t.txn.SiacoinInputs, types.SiacoinInput{
 		ParentID:         types.SiacoinOutputID(scoid),
@@ -193,13 +1263,14 @@ func (t *Transaction) AddInput(id string, value string, publicKey string, keyInd
 	})
 	t.sigs[crypto.Hash(scoid)] = uint64(keyIndex)
 
-	t.inputSum = t.inputSum.Add(parseAmount(value))
-	return t.inputSum.Cmp(t.outputSum.Add(t.calcFee())) >= 0
+	t.inputSum = t.inputSum.Add(amount)
+	return t.inputSum.Cmp(t.outputSum.Add(t.calcFee())) >= 0, nil
 }
 
-func (t *Transaction) Finalize(changeAddr string) {
+func (t *Transaction) Finalize(changeAddr string) (err error) {
+	defer recoverPanic(&err)
 	if t.inputSum.Cmp(t.outputSum) < 0 {
-		panic("insufficient inputs")
+		return errors.New("insufficient inputs")
 	}
 	fee := t.calcFee()
 	change := t.inputSum.Sub(t.outputSum)
@@ -207,21 +1278,665 @@ func (t *Transaction) Finalize(changeAddr string) {
 		fee = change
 	}
 	change = change.Sub(fee)
+	if !change.IsZero() {
+		if err := t.AddOutput(changeAddr, change.String()); err != nil {
+			return err
+		}
+	}
 	t.txn.MinerFees = []types.Currency{fee}
+	return nil
+}
+
+// A UTXO is an unspent siacoin output that can be used as a transaction input.
+// Value is in hastings, and PublicKey is derived from the signing seed at
+// KeyIndex.
+type UTXO struct {
+	ID        string
+	Value     string
+	PublicKey string
+	KeyIndex  int
+}
+
+type utxo struct {
+	id       types.SiacoinOutputID
+	value    types.Currency
+	pk       types.SiaPublicKey
+	keyIndex uint64
+}
+
+func parseUTXO(id string, value string, publicKey string, keyIndex int) (utxo, error) {
+	var scoid crypto.Hash
+	if err := scoid.LoadString(id); err != nil {
+		return utxo{}, fmt.Errorf("invalid output ID %q: %w", id, err)
+	}
+	var pk types.SiaPublicKey
+	if pk.LoadString(publicKey); pk.Algorithm != types.SignatureEd25519 {
+		return utxo{}, errors.New("invalid public key")
+	}
+	amount, err := parseAmount(value)
+	if err != nil {
+		return utxo{}, err
+	}
+	if keyIndex < 0 {
+		return utxo{}, errors.New("key index must not be negative")
+	}
+	return utxo{
+		id:       types.SiacoinOutputID(scoid),
+		value:    amount,
+		pk:       pk,
+		keyIndex: uint64(keyIndex),
+	}, nil
+}
+
+func (u utxo) export() *UTXO {
+	return &UTXO{
+		ID:        crypto.Hash(u.id).String(),
+		Value:     u.value.String(),
+		PublicKey: u.pk.String(),
+		KeyIndex:  int(u.keyIndex),
+	}
+}
+
+// A UTXOSet is a set of outputs that Transaction.SelectInputs can choose
+// from.
+type UTXOSet struct {
+	utxos []utxo
+}
+
+// NewUTXOSet returns an empty UTXOSet.
+func NewUTXOSet() *UTXOSet {
+	return new(UTXOSet)
+}
+
+// Add adds an output to the set.
+func (s *UTXOSet) Add(id string, value string, publicKey string, keyIndex int) (err error) {
+	defer recoverPanic(&err)
+	u, err := parseUTXO(id, value, publicKey, keyIndex)
+	if err != nil {
+		return err
+	}
+	for _, v := range s.utxos {
+		if v.id == u.id {
+			return fmt.Errorf("duplicate output ID %q", id)
+		}
+	}
+	s.utxos = append(s.utxos, u)
+	return nil
+}
+
+// Len returns the number of outputs in the set.
+func (s *UTXOSet) Len() int {
+	return len(s.utxos)
+}
+
+// Coin selection strategies for Transaction.SelectInputs.
+const (
+	// SelectLargestFirst spends the largest outputs first.
+	SelectLargestFirst = iota
+	// SelectBranchAndBound searches for a set of outputs that covers the
+	// outputs and fee without leaving change, falling back to
+	// SelectLargestFirst if there is none.
+	SelectBranchAndBound
+	// SelectFewestInputs spends as few outputs as possible, preferring the
+	// smallest ones that suffice, so that large outputs are kept for later.
+	SelectFewestInputs
+)
+
+// maxSelectionTries bounds the number of subsets considered by the search
+// strategies.
+const maxSelectionTries = 100000
+
+// A Selection describes the inputs, change, and fee chosen by
+// Transaction.SelectInputs.
+type Selection struct {
+	inputs []utxo
+	change types.Currency
+	fee    types.Currency
+}
+
+// NumInputs returns the number of inputs chosen.
+func (s *Selection) NumInputs() int {
+	return len(s.inputs)
+}
+
+// Input returns the i'th input chosen.
+func (s *Selection) Input(i int) (_ *UTXO, err error) {
+	defer recoverPanic(&err)
+	if i < 0 || i >= len(s.inputs) {
+		return nil, errors.New("index out of range")
+	}
+	return s.inputs[i].export(), nil
+}
+
+// Change returns the value of the change output, in hastings, or "0" if the
+// transaction has none.
+func (s *Selection) Change() string {
+	return s.change.String()
+}
+
+// Fee returns the miner fee, in hastings.
+func (s *Selection) Fee() string {
+	return s.fee.String()
+}
+
+// signedSize returns the size of txn once each of its inputs is signed.
+func signedSize(txn types.Transaction) int {
+	txn.TransactionSignatures = make([]types.TransactionSignature, len(txn.SiacoinInputs))
+	for i, in := range txn.SiacoinInputs {
+		sig := wallet.StandardTransactionSignature(crypto.Hash(in.ParentID))
+		sig.Signature = make([]byte, ed25519.SignatureSize)
+		txn.TransactionSignatures[i] = sig
+	}
+	return txn.MarshalSiaSize()
+}
+
+// withInputs returns t's transaction with the given inputs added, along with
+// a change output to changeAddr if change is true.
+func (t *Transaction) withInputs(inputs []utxo, change bool, changeAddr types.UnlockHash) types.Transaction {
+	txn := t.txn
+	txn.SiacoinInputs = make([]types.SiacoinInput, len(inputs))
+	for i, u := range inputs {
+		txn.SiacoinInputs[i] = types.SiacoinInput{
+			ParentID:         u.id,
+			UnlockConditions: wallet.StandardUnlockConditions(u.pk),
+		}
+	}
+	txn.SiacoinOutputs = append([]types.SiacoinOutput(nil), t.txn.SiacoinOutputs...)
+	if change {
+		txn.SiacoinOutputs = append(txn.SiacoinOutputs, types.SiacoinOutput{UnlockHash: changeAddr})
+	}
+	return txn
+}
+
+// dustThreshold returns the largest change output that is not worth creating:
+// one whose value would not cover the fee for adding it to a transaction plus
+// the fee for spending it later. value is a placeholder for the output's value,
+// which must be at least as large as the real value.
+func (t *Transaction) dustThreshold(changeAddr types.UnlockHash, value types.Currency) types.Currency {
+	var txn types.Transaction
+	base := signedSize(txn)
+	txn.SiacoinOutputs = []types.SiacoinOutput{{UnlockHash: changeAddr, Value: value}}
+	withOutput := signedSize(txn)
+	txn.SiacoinOutputs = nil
+	txn.SiacoinInputs = []types.SiacoinInput{{
+		UnlockConditions: wallet.StandardUnlockConditions(types.Ed25519PublicKey(crypto.PublicKey{})),
+	}}
+	withInput := signedSize(txn)
+	return t.feePerByte.Mul64(uint64((withOutput - base) + (withInput - base)))
+}
+
+// settle computes the fee and change for a transaction spending inputs. The
+// fee is computed from the exact size of the signed transaction. If the
+// leftover value would be dust (see dustThreshold), it is added to the fee
+// instead, so the change is either zero or worth spending. ok is false if the
+// inputs do not cover the outputs and fee.
+func (t *Transaction) settle(inputs []utxo, changeAddr types.UnlockHash) (fee, change types.Currency, ok bool) {
+	var sum types.Currency
+	for _, u := range inputs {
+		sum = sum.Add(u.value)
+	}
+	if sum.Cmp(t.outputSum) < 0 {
+		return types.ZeroCurrency, types.ZeroCurrency, false
+	}
+	available := sum.Sub(t.outputSum)
+
+	// the fee and change are encoded in the transaction, so their sizes affect
+	// the fee; iterate until the fee stops growing
+	txn := t.withInputs(inputs, true, changeAddr)
+	for {
+		if available.Cmp(fee) <= 0 {
+			break
+		}
+		txn.MinerFees = []types.Currency{fee}
+		txn.SiacoinOutputs[len(txn.SiacoinOutputs)-1].Value = available.Sub(fee)
+		newFee := t.feePerByte.Mul64(uint64(signedSize(txn)))
+		if newFee.Cmp(fee) <= 0 {
+			if change := available.Sub(fee); change.Cmp(t.dustThreshold(changeAddr, available)) > 0 {
+				return fee, change, true
+			}
+			break
+		}
+		fee = newFee
+	}
+
+	// no room for change, or the change would be dust; the leftover value
+	// goes to the fee
+	txn = t.withInputs(inputs, false, changeAddr)
+	txn.MinerFees = []types.Currency{available}
+	if t.feePerByte.Mul64(uint64(signedSize(txn))).Cmp(available) > 0 {
+		return types.ZeroCurrency, types.ZeroCurrency, false
+	}
+	return available, types.ZeroCurrency, true
+}
+
+// selectLargestFirst returns the shortest prefix of sorted, which is sorted by
+// descending value, that covers the outputs and fee.
+func (t *Transaction) selectLargestFirst(sorted []utxo, changeAddr types.UnlockHash) []utxo {
+	for n := 1; n <= len(sorted); n++ {
+		if _, _, ok := t.settle(sorted[:n], changeAddr); ok {
+			return sorted[:n]
+		}
+	}
+	return nil
+}
+
+// selectFewestInputs returns the set of n outputs with the smallest total
+// value that covers the outputs and fee, where n is the smallest number of
+// outputs that suffices.
+func (t *Transaction) selectFewestInputs(sorted []utxo, changeAddr types.UnlockHash) []utxo {
+	best := t.selectLargestFirst(sorted, changeAddr)
+	if best == nil {
+		return nil
+	}
+	n := len(best)
+	bestSum := sumUTXOs(best)
+
+	// depth-first search over subsets of size n, in descending order of value
+	var tries int
+	chosen := make([]utxo, 0, n)
+	var search func(i int, sum types.Currency)
+	search = func(i int, sum types.Currency) {
+		if tries++; tries > maxSelectionTries || sum.Cmp(bestSum) >= 0 {
+			return
+		} else if len(chosen) == n {
+			if _, _, ok := t.settle(chosen, changeAddr); ok {
+				best = append([]utxo(nil), chosen...)
+				bestSum = sum
+			}
+			return
+		}
+		for j := i; j <= len(sorted)-(n-len(chosen)); j++ {
+			// the remaining picks can be no larger than sorted[j], so if they
+			// cannot reach the outputs, neither can any later choice
+			max := sum.Add(sorted[j].value.Mul64(uint64(n - len(chosen))))
+			if max.Cmp(t.outputSum) < 0 {
+				return
+			}
+			chosen = append(chosen, sorted[j])
+			search(j+1, sum.Add(sorted[j].value))
+			chosen = chosen[:len(chosen)-1]
+		}
+	}
+	search(0, types.ZeroCurrency)
+	return best
+}
+
+// selectBranchAndBound searches for a set of outputs that covers the outputs
+// and fee with less excess than the cost of a change output, so that the
+// transaction needs no change. Each output is valued at its value minus the
+// fee for spending it.
+func (t *Transaction) selectBranchAndBound(sorted []utxo, changeAddr types.UnlockHash) []utxo {
+	if len(sorted) == 0 {
+		return nil
+	}
+	// estimate costs using placeholder amounts as large as any real amount
+	maxAmount := sumUTXOs(sorted).Add(t.outputSum)
+	sizeWith := func(inputs []utxo, change bool) uint64 {
+		txn := t.withInputs(inputs, change, changeAddr)
+		txn.MinerFees = []types.Currency{maxAmount}
+		if change {
+			txn.SiacoinOutputs[len(txn.SiacoinOutputs)-1].Value = maxAmount
+		}
+		return uint64(signedSize(txn))
+	}
+	baseSize := sizeWith(nil, false)
+	inputCost := t.feePerByte.Mul64(sizeWith(sorted[:1], false) - baseSize)
+	changeCost := t.feePerByte.Mul64(sizeWith(nil, true) - baseSize)
+	target := t.outputSum.Add(t.feePerByte.Mul64(baseSize))
+	upper := target.Add(changeCost)
+
+	var candidates []utxo
+	var remaining types.Currency
+	for _, u := range sorted {
+		if u.value.Cmp(inputCost) > 0 {
+			candidates = append(candidates, u)
+			remaining = remaining.Add(u.value.Sub(inputCost))
+		}
+	}
+
+	var tries int
+	var found []utxo
+	chosen := make([]utxo, 0, len(candidates))
+	var search func(i int, sum, remaining types.Currency) bool
+	search = func(i int, sum, remaining types.Currency) bool {
+		if tries++; tries > maxSelectionTries || sum.Cmp(upper) > 0 || sum.Add(remaining).Cmp(target) < 0 {
+			return false
+		} else if sum.Cmp(target) >= 0 {
+			if _, change, ok := t.settle(chosen, changeAddr); ok && change.IsZero() {
+				found = append([]utxo(nil), chosen...)
+				return true
+			}
+			return false
+		} else if i == len(candidates) {
+			return false
+		}
+		eff := candidates[i].value.Sub(inputCost)
+		remaining = remaining.Sub(eff)
+		chosen = append(chosen, candidates[i])
+		if search(i+1, sum.Add(eff), remaining) {
+			return true
+		}
+		chosen = chosen[:len(chosen)-1]
+		return search(i+1, sum, remaining)
+	}
+	if search(0, types.ZeroCurrency, remaining) {
+		return found
+	}
+	return t.selectLargestFirst(sorted, changeAddr)
+}
+
+func sumUTXOs(utxos []utxo) (sum types.Currency) {
+	for _, u := range utxos {
+		sum = sum.Add(u.value)
+	}
+	return sum
+}
+
+// SelectInputs chooses inputs from utxos to fund the outputs added so far,
+// using the given strategy, and adds them to the transaction along with any
+// change, sent to changeAddr, and the miner fee. The fee is computed from the
+// exact size of the signed transaction. It replaces AddInput and Finalize; the
+// transaction must not already have inputs. The returned Selection can be
+// shown to the user before the transaction is signed.
+func (t *Transaction) SelectInputs(utxos *UTXOSet, strategy int, changeAddr string) (_ *Selection, err error) {
+	defer recoverPanic(&err)
+	if utxos == nil {
+		return nil, errors.New("nil UTXOSet")
+	} else if len(t.txn.SiacoinInputs) > 0 {
+		return nil, errors.New("transaction already has inputs")
+	}
+	uh, err := parseAddr(changeAddr)
+	if err != nil {
+		return nil, err
+	}
+	sorted := append([]utxo(nil), utxos.utxos...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := sorted[i].value.Cmp(sorted[j].value); c != 0 {
+			return c > 0
+		}
+		return bytes.Compare(sorted[i].id[:], sorted[j].id[:]) < 0
+	})
+
+	var inputs []utxo
+	switch strategy {
+	case SelectLargestFirst:
+		inputs = t.selectLargestFirst(sorted, uh)
+	case SelectBranchAndBound:
+		inputs = t.selectBranchAndBound(sorted, uh)
+	case SelectFewestInputs:
+		inputs = t.selectFewestInputs(sorted, uh)
+	default:
+		return nil, fmt.Errorf("unknown strategy %v", strategy)
+	}
+	if inputs == nil {
+		return nil, errors.New("insufficient inputs")
+	}
+	fee, change, _ := t.settle(inputs, uh)
+
+	for _, u := range inputs {
+		t.txn.SiacoinInputs = append(t.txn.SiacoinInputs, types.SiacoinInput{
+			ParentID:         u.id,
+			UnlockConditions: wallet.StandardUnlockConditions(u.pk),
+		})
+		t.sigs[crypto.Hash(u.id)] = u.keyIndex
+		t.inputSum = t.inputSum.Add(u.value)
+	}
 	if !change.IsZero() {
-		t.AddOutput(changeAddr, change.String())
+		t.txn.SiacoinOutputs = append(t.txn.SiacoinOutputs, types.SiacoinOutput{
+			UnlockHash: uh,
+			Value:      change,
+		})
+		t.outputSum = t.outputSum.Add(change)
 	}
+	t.txn.MinerFees = nil
+	if !fee.IsZero() {
+		t.txn.MinerFees = []types.Currency{fee}
+	}
+	return &Selection{
+		inputs: inputs,
+		change: change,
+		fee:    fee,
+	}, nil
 }
 
-func (t *Transaction) Sign(s *Seed) {
-	for id, keyIndex := range t.sigs {
-		wallet.AppendTransactionSignature(&t.txn, wallet.StandardTransactionSignature(id), s.seed.SecretKey(keyIndex))
+func (t *Transaction) Sign(s *Seed) (err error) {
+	defer recoverPanic(&err)
+	if s == nil {
+		return errors.New("nil seed")
 	}
+	// sign in input order, so that the result is deterministic
+	t.txn.TransactionSignatures = nil
+	for _, in := range t.txn.SiacoinInputs {
+		id := crypto.Hash(in.ParentID)
+		wallet.AppendTransactionSignature(&t.txn, wallet.StandardTransactionSignature(id), s.seed.SecretKey(t.sigs[id]))
+	}
+	return nil
+}
+
+// AsJSON returns the transaction encoded as JSON, as accepted by siad and
+// walrus.
+func (t *Transaction) AsJSON() (_ string, err error) {
+	defer recoverPanic(&err)
+	return txnJSON(t.txn)
+}
+
+// ID returns the ID of the transaction. The ID does not cover signatures, so
+// it does not change when the transaction is signed.
+func (t *Transaction) ID() string {
+	return t.txn.ID().String()
+}
+
+// AsBinary returns the transaction in the Sia binary encoding.
+func (t *Transaction) AsBinary() (_ []byte, err error) {
+	defer recoverPanic(&err)
+	return txnBinary(t.txn)
+}
+
+// AsHex returns the transaction in the Sia binary encoding, as a hex string.
+func (t *Transaction) AsHex() (_ string, err error) {
+	defer recoverPanic(&err)
+	b, err := txnBinary(t.txn)
+	return hex.EncodeToString(b), err
+}
+
+// AsBase64 returns the transaction in the Sia binary encoding, as a standard
+// base64 string.
+func (t *Transaction) AsBase64() (_ string, err error) {
+	defer recoverPanic(&err)
+	b, err := txnBinary(t.txn)
+	return base64.StdEncoding.EncodeToString(b), err
 }
 
-func (t *Transaction) AsJSON() string {
-	js, _ := json.Marshal(t.txn)
-	return string(js)
+// Inspect returns a read-only view of the transaction in its current state.
+func (t *Transaction) Inspect() (_ *TransactionInfo, err error) {
+	defer recoverPanic(&err)
+	// round-trip through the binary encoding to make a deep copy, so that
+	// later changes to t are not reflected
+	b, err := txnBinary(t.txn)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeTransaction(b)
+}
+
+func txnJSON(txn types.Transaction) (string, error) {
+	js, err := json.Marshal(txn)
+	if err != nil {
+		return "", err
+	}
+	return string(js), nil
+}
+
+func txnBinary(txn types.Transaction) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := txn.MarshalSia(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A TransactionInfo is a read-only view of a transaction, e.g. one built
+// elsewhere and decoded with DecodeTransaction, for display before it is
+// signed or broadcast. Amounts are in hastings.
+type TransactionInfo struct {
+	txn types.Transaction
+}
+
+// An InputInfo describes a siacoin input of a transaction. PublicKey is empty
+// unless the input is spendable by a single public key.
+type InputInfo struct {
+	ParentID  string
+	Address   string
+	PublicKey string
+}
+
+// An OutputInfo describes a siacoin output of a transaction.
+type OutputInfo struct {
+	ID      string
+	Address string
+	Value   string
+}
+
+// A SignatureInfo describes a signature in a transaction. Signature is
+// hex-encoded.
+type SignatureInfo struct {
+	ParentID         string
+	PublicKeyIndex   int
+	WholeTransaction bool
+	Signature        string
+}
+
+// ID returns the ID of the transaction.
+func (ti *TransactionInfo) ID() string {
+	return ti.txn.ID().String()
+}
+
+// NumInputs returns the number of siacoin inputs in the transaction.
+func (ti *TransactionInfo) NumInputs() int {
+	return len(ti.txn.SiacoinInputs)
+}
+
+// Input returns the i'th siacoin input of the transaction.
+func (ti *TransactionInfo) Input(i int) (_ *InputInfo, err error) {
+	defer recoverPanic(&err)
+	if i < 0 || i >= len(ti.txn.SiacoinInputs) {
+		return nil, errors.New("index out of range")
+	}
+	in := ti.txn.SiacoinInputs[i]
+	info := &InputInfo{
+		ParentID: crypto.Hash(in.ParentID).String(),
+		Address:  in.UnlockConditions.UnlockHash().String(),
+	}
+	if uc := in.UnlockConditions; len(uc.PublicKeys) == 1 && uc.SignaturesRequired == 1 {
+		info.PublicKey = uc.PublicKeys[0].String()
+	}
+	return info, nil
+}
+
+// NumOutputs returns the number of siacoin outputs in the transaction.
+func (ti *TransactionInfo) NumOutputs() int {
+	return len(ti.txn.SiacoinOutputs)
+}
+
+// Output returns the i'th siacoin output of the transaction.
+func (ti *TransactionInfo) Output(i int) (_ *OutputInfo, err error) {
+	defer recoverPanic(&err)
+	if i < 0 || i >= len(ti.txn.SiacoinOutputs) {
+		return nil, errors.New("index out of range")
+	}
+	out := ti.txn.SiacoinOutputs[i]
+	return &OutputInfo{
+		ID:      crypto.Hash(ti.txn.SiacoinOutputID(uint64(i))).String(),
+		Address: out.UnlockHash.String(),
+		Value:   out.Value.String(),
+	}, nil
+}
+
+// MinerFee returns the total of the transaction's miner fees.
+func (ti *TransactionInfo) MinerFee() string {
+	var sum types.Currency
+	for _, fee := range ti.txn.MinerFees {
+		sum = sum.Add(fee)
+	}
+	return sum.String()
+}
+
+// NumSignatures returns the number of signatures in the transaction.
+func (ti *TransactionInfo) NumSignatures() int {
+	return len(ti.txn.TransactionSignatures)
+}
+
+// Signature returns the i'th signature of the transaction.
+func (ti *TransactionInfo) Signature(i int) (_ *SignatureInfo, err error) {
+	defer recoverPanic(&err)
+	if i < 0 || i >= len(ti.txn.TransactionSignatures) {
+		return nil, errors.New("index out of range")
+	}
+	sig := ti.txn.TransactionSignatures[i]
+	return &SignatureInfo{
+		ParentID:         sig.ParentID.String(),
+		PublicKeyIndex:   int(sig.PublicKeyIndex),
+		WholeTransaction: sig.CoveredFields.WholeTransaction,
+		Signature:        hex.EncodeToString(sig.Signature),
+	}, nil
+}
+
+// HasOtherFields reports whether the transaction contains anything besides
+// siacoin inputs, siacoin outputs, miner fees, and signatures, e.g. file
+// contracts or siafund transfers, which the other methods do not describe.
+func (ti *TransactionInfo) HasOtherFields() bool {
+	txn := ti.txn
+	return len(txn.FileContracts) > 0 || len(txn.FileContractRevisions) > 0 ||
+		len(txn.StorageProofs) > 0 || len(txn.SiafundInputs) > 0 ||
+		len(txn.SiafundOutputs) > 0 || len(txn.ArbitraryData) > 0
+}
+
+// Validate checks the structure and signatures of the transaction, as a node
+// would before accepting it. It does not check that the inputs exist or are
+// unspent.
+func (ti *TransactionInfo) Validate() (err error) {
+	defer recoverPanic(&err)
+	return ti.txn.StandaloneValid(types.FoundationHardforkHeight + 1)
+}
+
+// AsJSON returns the transaction encoded as JSON.
+func (ti *TransactionInfo) AsJSON() (_ string, err error) {
+	defer recoverPanic(&err)
+	return txnJSON(ti.txn)
+}
+
+// DecodeTransaction decodes a transaction in the Sia binary encoding.
+func DecodeTransaction(b []byte) (_ *TransactionInfo, err error) {
+	defer recoverPanic(&err)
+	var txn types.Transaction
+	r := bytes.NewReader(b)
+	if err := txn.UnmarshalSia(r); err != nil {
+		return nil, fmt.Errorf("invalid transaction: %w", err)
+	} else if r.Len() != 0 {
+		return nil, errors.New("invalid transaction: trailing data")
+	}
+	return &TransactionInfo{txn}, nil
+}
+
+// ParseTransaction decodes a transaction encoded as JSON, or in the Sia binary
+// encoding as a hex or base64 string.
+func ParseTransaction(s string) (_ *TransactionInfo, err error) {
+	defer recoverPanic(&err)
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		var txn types.Transaction
+		if err := json.Unmarshal([]byte(s), &txn); err != nil {
+			return nil, fmt.Errorf("invalid transaction: %w", err)
+		}
+		return &TransactionInfo{txn}, nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		if b, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, errors.New("invalid transaction: not JSON, hex, or base64")
+		}
+	}
+	return DecodeTransaction(b)
 }
 
 // ValidateAddress returns true if addr is a valid Sia address.
@@ -0,0 +1,721 @@
+package us
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us-bindings/internal/ghost"
+	"lukechampine.com/us-bindings/internal/servertest"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/proto"
+)
+
+// newWalrusServer returns a server implementing the walrus /transactions
+// endpoint, for which the given addresses have each sent or received one
+// transaction.
+func newWalrusServer(t *testing.T, used ...string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/transactions" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if r.URL.Query().Get("max") != "1" {
+			t.Errorf("expected max=1, got %q", r.URL.RawQuery)
+		}
+		txids := []types.TransactionID{}
+		for _, addr := range used {
+			if r.URL.Query().Get("addr") == addr {
+				txids = append(txids, types.TransactionID{1})
+			}
+		}
+		json.NewEncoder(w).Encode(txids)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWalrusChecker(t *testing.T) {
+	s := NewSeed()
+	srv := newWalrusServer(t, s.Address(1))
+	c := NewWalrusChecker(srv.URL + "/")
+	for i, exp := range []bool{false, true, false} {
+		if used, err := c.IsUsed(s.Address(i)); err != nil {
+			t.Fatal(err)
+		} else if used != exp {
+			t.Errorf("address %v: expected used = %v, got %v", i, exp, used)
+		}
+	}
+	if _, err := c.IsUsed("not an address"); err == nil {
+		t.Error("expected error for invalid address")
+	}
+
+	// errors from the server should be reported
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database is locked", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+	if _, err := NewWalrusChecker(bad.URL).IsUsed(s.Address(0)); err == nil || err.Error() != "walrus: database is locked" {
+		t.Error("expected walrus error, got", err)
+	}
+}
+
+// Wallet test vectors, shared with the C and Python bindings, which must all
+// derive the same keys and produce the same signed transaction.
+const (
+	vectorPhrase = "alpha abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abstract"
+	vectorInput0 = "0100000000000000000000000000000000000000000000000000000000000000"
+	vectorInput1 = "0200000000000000000000000000000000000000000000000000000000000000"
+	vectorTxnID  = "1e2e0da7f63bbf1f602fffcba9d77108b078eb48a5b3298af1fbb32b31e346fa"
+)
+
+var (
+	vectorPublicKeys = []string{
+		"ed25519:f64a814f44b4471d3b4e0d3646b3c582b641b4b2476fa954847681b91406c52a",
+		"ed25519:173de750868a9eef5306c492fa6755e60e2b89ade131c5653256b91480f9c21e",
+	}
+	vectorAddresses = []string{
+		"e893e43146db144782038ddd28e557f4205a6e688397336c73aa5af8af09556c58c86b05e025",
+		"31a6227605f5a8e11fb55c877d19ce1b31ce4350137c8114b896bc8a26053410d8952ab105e3",
+		"d44f1f98ae239772ed50cde9e02b332796533012c7a4d3b85942085a51f635d7296c331b9a1a",
+	}
+	vectorSignatures = []string{
+		"bb43eb4b6ab24baec2e280fddbd71e7e2e3e608ed409f70cb614750d9cd72a726cc5d57a2e544b3d859db1e66201d49692beb8f12765ebde76ca8f9c7095c807",
+		"15fce94ffc4a7b77879dbc1ede812616584f8ee14250f09f711511f9165df1eeb0877a5ba6011915bdc7b5b049029134bd231288347be90471c702880724590a",
+	}
+)
+
+// newVectorTransaction returns the unsigned test vector transaction, which
+// sends 1000000 H to address 2 from two inputs, with change to address 0.
+func newVectorTransaction(t *testing.T) *Transaction {
+	t.Helper()
+	txn, err := NewTransaction("10")
+	if err != nil {
+		t.Fatal(err)
+	} else if err := txn.AddOutput(vectorAddresses[2], "1000000"); err != nil {
+		t.Fatal(err)
+	}
+	if funded, err := txn.AddInput(vectorInput0, "800000", vectorPublicKeys[0], 0); err != nil || funded {
+		t.Fatal("first input should not fund the transaction:", funded, err)
+	} else if funded, err := txn.AddInput(vectorInput1, "5000000", vectorPublicKeys[1], 1); err != nil || !funded {
+		t.Fatal("second input should fund the transaction:", funded, err)
+	} else if err := txn.Finalize(vectorAddresses[0]); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+func TestWalletVectors(t *testing.T) {
+	s, err := SeedFromPhrase(vectorPhrase)
+	if err != nil {
+		t.Fatal(err)
+	} else if s.ToPhrase() != vectorPhrase {
+		t.Errorf("phrase did not round-trip: %q", s.ToPhrase())
+	}
+	for i, pk := range vectorPublicKeys {
+		if s.PublicKey(i) != pk {
+			t.Errorf("public key %v: expected %v, got %v", i, pk, s.PublicKey(i))
+		}
+	}
+	for i, addr := range vectorAddresses {
+		if s.Address(i) != addr {
+			t.Errorf("address %v: expected %v, got %v", i, addr, s.Address(i))
+		}
+	}
+
+	txn := newVectorTransaction(t)
+	if err := txn.Sign(s); err != nil {
+		t.Fatal(err)
+	}
+	if txn.ID() != vectorTxnID {
+		t.Errorf("expected transaction ID %v, got %v", vectorTxnID, txn.ID())
+	}
+	info, err := txn.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := info.Validate(); err != nil {
+		t.Error("signed transaction should be valid:", err)
+	}
+	if info.NumSignatures() != len(vectorSignatures) {
+		t.Fatalf("expected %v signatures, got %v", len(vectorSignatures), info.NumSignatures())
+	}
+	for i, exp := range vectorSignatures {
+		if sig, err := info.Signature(i); err != nil {
+			t.Fatal(err)
+		} else if sig.Signature != exp {
+			t.Errorf("signature %v: expected %v, got %v", i, exp, sig.Signature)
+		}
+	}
+}
+
+// newTestUTXOSet returns a UTXOSet with outputs of the given values, in SC,
+// spendable by s.
+func newTestUTXOSet(t *testing.T, s *Seed, values ...uint64) *UTXOSet {
+	set := NewUTXOSet()
+	for i, v := range values {
+		id := crypto.Hash{byte(i + 1)}.String()
+		if err := set.Add(id, types.SiacoinPrecision.Mul64(v).String(), s.PublicKey(i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return set
+}
+
+func TestSelectInputs(t *testing.T) {
+	s, err := SeedFromPhrase(vectorPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := newTestUTXOSet(t, s, 50, 30, 20, 7, 3)
+	feePerByte := types.NewCurrency64(10)
+
+	// the fee for spending the 30 SC and 7 SC outputs without change, plus
+	// less than the cost of a change output
+	probe := &Transaction{feePerByte: feePerByte}
+	probe.txn.SiacoinOutputs = []types.SiacoinOutput{{UnlockHash: s.address(2), Value: types.SiacoinPrecision.Mul64(37)}}
+	probe.txn = probe.withInputs([]utxo{set.utxos[1], set.utxos[3]}, false, types.UnlockHash{})
+	probe.txn.MinerFees = []types.Currency{types.NewCurrency64(10000)}
+	exactFee := feePerByte.Mul64(uint64(signedSize(probe.txn))).Add64(100)
+	sc := types.SiacoinPrecision.Mul64
+
+	tests := []struct {
+		desc     string
+		send     types.Currency
+		strategy int
+		inputs   []uint64 // values of the expected inputs, in SC
+		change   bool
+	}{
+		{"largest first", sc(25), SelectLargestFirst, []uint64{50}, true},
+		{"fewest inputs", sc(25), SelectFewestInputs, []uint64{30}, true},
+		{"branch and bound falls back to largest first", sc(25), SelectBranchAndBound, []uint64{50}, true},
+		{"largest first, two inputs", sc(60), SelectLargestFirst, []uint64{50, 30}, true},
+		{"fewest inputs, two inputs", sc(60), SelectFewestInputs, []uint64{50, 20}, true},
+		{"branch and bound avoids change", sc(37).Sub(exactFee), SelectBranchAndBound, []uint64{30, 7}, false},
+		{"largest first with change", sc(37).Sub(exactFee), SelectLargestFirst, []uint64{50}, true},
+	}
+	for _, test := range tests {
+		txn, _ := NewTransaction(feePerByte.String())
+		if err := txn.AddOutput(s.Address(2), test.send.String()); err != nil {
+			t.Fatal(err)
+		}
+		sel, err := txn.SelectInputs(set, test.strategy, s.Address(0))
+		if err != nil {
+			t.Errorf("%v: %v", test.desc, err)
+			continue
+		}
+		var inputs []uint64
+		var sum types.Currency
+		for i := 0; i < sel.NumInputs(); i++ {
+			u, _ := sel.Input(i)
+			v, _ := parseAmount(u.Value)
+			inputs = append(inputs, v.Div(types.SiacoinPrecision).Big().Uint64())
+			sum = sum.Add(v)
+		}
+		if fmt.Sprint(inputs) != fmt.Sprint(test.inputs) {
+			t.Errorf("%v: expected inputs %v SC, got %v SC", test.desc, test.inputs, inputs)
+		}
+		fee, _ := parseAmount(sel.Fee())
+		change, _ := parseAmount(sel.Change())
+		if !sum.Equals(test.send.Add(fee).Add(change)) {
+			t.Errorf("%v: inputs (%v) do not equal outputs (%v) + fee (%v) + change (%v)", test.desc, sum, test.send, fee, change)
+		} else if change.IsZero() == test.change {
+			t.Errorf("%v: expected change = %v, got %v", test.desc, test.change, change)
+		}
+
+		// the fee must match the exact size of the signed transaction; without
+		// change, it may also include leftover value
+		if err := txn.Sign(s); err != nil {
+			t.Fatal(err)
+		}
+		exact := feePerByte.Mul64(uint64(txn.txn.MarshalSiaSize()))
+		if test.change && !fee.Equals(exact) {
+			t.Errorf("%v: expected fee %v, got %v", test.desc, exact, fee)
+		} else if fee.Cmp(exact) < 0 {
+			t.Errorf("%v: fee %v is less than %v", test.desc, fee, exact)
+		} else if err := txn.txn.StandaloneValid(types.FoundationHardforkHeight + 1); err != nil {
+			t.Errorf("%v: signed transaction is invalid: %v", test.desc, err)
+		}
+	}
+
+	// selection fails if the outputs cannot be covered, or if they can be
+	// covered only without the fee
+	for _, send := range []types.Currency{sc(111), sc(110)} {
+		txn, _ := NewTransaction(feePerByte.String())
+		txn.AddOutput(s.Address(2), send.String())
+		for strategy := SelectLargestFirst; strategy <= SelectFewestInputs; strategy++ {
+			if _, err := txn.SelectInputs(set, strategy, s.Address(0)); err == nil {
+				t.Errorf("sending %v with strategy %v should fail", send, strategy)
+			}
+		}
+	}
+}
+
+func TestSettleDust(t *testing.T) {
+	s, err := SeedFromPhrase(vectorPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := newTestUTXOSet(t, s, 1)
+	txn, _ := NewTransaction("10")
+	changeAddr := s.address(0)
+	// settle computes the threshold using the value left after the send,
+	// which is encoded in as many bytes as this placeholder in every case below
+	dust := txn.dustThreshold(changeAddr, types.NewCurrency64(10000))
+	if dust.IsZero() {
+		t.Fatal("dust threshold should be non-zero")
+	}
+	txn.txn.SiacoinOutputs = []types.SiacoinOutput{{UnlockHash: s.address(2)}}
+	// the fee for a transaction with change; the values only affect the size
+	// through their encoded length, which is the same for every case below
+	probe := txn.withInputs(set.utxos, true, changeAddr)
+	probe.MinerFees = []types.Currency{types.NewCurrency64(10000)}
+	probe.SiacoinOutputs[0].Value = types.SiacoinPrecision.Sub64(10000)
+	probe.SiacoinOutputs[1].Value = dust
+	fee := txn.feePerByte.Mul64(uint64(signedSize(probe)))
+
+	for _, test := range []struct {
+		leftover types.Currency // value remaining after the send and fee
+		change   bool
+	}{
+		{types.ZeroCurrency, false},
+		{dust.Div64(2), false},
+		{dust, false},
+		{dust.Add64(1), true},
+		{dust.Mul64(10), true},
+	} {
+		send := types.SiacoinPrecision.Sub(fee).Sub(test.leftover)
+		txn.txn.SiacoinOutputs[0].Value = send
+		txn.outputSum = send
+		gotFee, change, ok := txn.settle(set.utxos, changeAddr)
+		if !ok {
+			t.Errorf("leftover %v: settle failed", test.leftover)
+		} else if !change.IsZero() != test.change {
+			t.Errorf("leftover %v: expected change = %v, got %v", test.leftover, test.change, change)
+		} else if test.change && (!gotFee.Equals(fee) || !change.Equals(test.leftover)) {
+			t.Errorf("leftover %v: expected fee %v and change %v, got %v and %v", test.leftover, fee, test.leftover, gotFee, change)
+		} else if !test.change && !gotFee.Equals(types.SiacoinPrecision.Sub(send)) {
+			t.Errorf("leftover %v: leftover should be added to the fee, got fee %v", test.leftover, gotFee)
+		}
+	}
+}
+
+func TestTransactionEncoding(t *testing.T) {
+	s, err := SeedFromPhrase(vectorPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := newVectorTransaction(t)
+	unsignedID := txn.ID()
+	if err := txn.Sign(s); err != nil {
+		t.Fatal(err)
+	} else if txn.ID() != unsignedID {
+		t.Error("signing should not change the transaction ID")
+	}
+	js, err := txn.AsJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := txn.AsBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexStr, err := txn.AsHex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64, err := txn.AsBase64()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decode := map[string]func() (*TransactionInfo, error){
+		"binary":    func() (*TransactionInfo, error) { return DecodeTransaction(bin) },
+		"JSON":      func() (*TransactionInfo, error) { return ParseTransaction(js) },
+		"hex":       func() (*TransactionInfo, error) { return ParseTransaction(hexStr) },
+		"base64":    func() (*TransactionInfo, error) { return ParseTransaction(b64) },
+		"padded":    func() (*TransactionInfo, error) { return ParseTransaction("\n" + hexStr + " ") },
+		"inspected": txn.Inspect,
+	}
+	for enc, fn := range decode {
+		ti, err := fn()
+		if err != nil {
+			t.Errorf("%v: %v", enc, err)
+			continue
+		}
+		if ti.ID() != vectorTxnID {
+			t.Errorf("%v: expected ID %v, got %v", enc, vectorTxnID, ti.ID())
+		} else if tb, err := txnBinary(ti.txn); err != nil || !bytes.Equal(tb, bin) {
+			t.Errorf("%v: encoding does not round-trip: %v", enc, err)
+		} else if _, err := ti.AsJSON(); err != nil {
+			t.Errorf("%v: %v", enc, err)
+		} else if err := ti.Validate(); err != nil {
+			t.Errorf("%v: decoded transaction is invalid: %v", enc, err)
+		} else if ti.HasOtherFields() {
+			t.Errorf("%v: transaction has no other fields", enc)
+		}
+
+		if ti.NumInputs() != 2 || ti.NumOutputs() != 2 || ti.NumSignatures() != 2 {
+			t.Errorf("%v: expected 2 inputs, outputs and signatures, got %v, %v and %v", enc, ti.NumInputs(), ti.NumOutputs(), ti.NumSignatures())
+			continue
+		}
+		for i, id := range []string{vectorInput0, vectorInput1} {
+			in, _ := ti.Input(i)
+			if in.ParentID != id || in.PublicKey != vectorPublicKeys[i] || in.Address != vectorAddresses[i] {
+				t.Errorf("%v: input %v does not match: %+v", enc, i, in)
+			}
+			sig, _ := ti.Signature(i)
+			if sig.ParentID != id || !sig.WholeTransaction || sig.Signature != vectorSignatures[i] {
+				t.Errorf("%v: signature %v does not match: %+v", enc, i, sig)
+			}
+		}
+		// outputs are the payment, then the change
+		out, _ := ti.Output(0)
+		change, _ := ti.Output(1)
+		if out.Address != vectorAddresses[2] || out.Value != "1000000" || change.Address != vectorAddresses[0] {
+			t.Errorf("%v: outputs do not match: %+v, %+v", enc, out, change)
+		} else if out.ID != crypto.Hash(txn.txn.SiacoinOutputID(0)).String() {
+			t.Errorf("%v: wrong output ID %v", enc, out.ID)
+		}
+		fee, _ := parseAmount(ti.MinerFee())
+		changeValue, _ := parseAmount(change.Value)
+		if !fee.Add(changeValue).Add64(1000000).Equals64(5800000) {
+			t.Errorf("%v: fee (%v) and outputs do not equal inputs", enc, fee)
+		}
+		if _, err := ti.Input(2); err == nil {
+			t.Errorf("%v: out-of-range input should be rejected", enc)
+		} else if _, err := ti.Output(-1); err == nil {
+			t.Errorf("%v: out-of-range output should be rejected", enc)
+		} else if _, err := ti.Signature(2); err == nil {
+			t.Errorf("%v: out-of-range signature should be rejected", enc)
+		}
+	}
+
+	// an inspected transaction does not change with the original
+	ti, _ := txn.Inspect()
+	txn.AddOutput(vectorAddresses[1], "1")
+	if ti.NumOutputs() != 2 || ti.ID() != vectorTxnID {
+		t.Error("inspected transaction should not reflect later changes")
+	}
+
+	// a tampered transaction decodes, but does not validate
+	tampered := append([]byte(nil), bin...)
+	tampered[len(tampered)-1] ^= 1
+	if ti, err := DecodeTransaction(tampered); err != nil {
+		t.Error(err)
+	} else if ti.Validate() == nil {
+		t.Error("tampered signature should be invalid")
+	}
+
+	// other fields are reported
+	other := newVectorTransaction(t)
+	other.txn.ArbitraryData = [][]byte{[]byte("hello")}
+	if ti, err := other.Inspect(); err != nil {
+		t.Fatal(err)
+	} else if !ti.HasOtherFields() {
+		t.Error("arbitrary data should be reported")
+	}
+
+	for _, s := range []string{
+		"",
+		"not a transaction",
+		"{not json",
+		hexStr[:len(hexStr)-2],
+		hexStr + "00",
+	} {
+		if _, err := ParseTransaction(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+	if _, err := DecodeTransaction(bin[:len(bin)-1]); err == nil {
+		t.Error("expected error decoding truncated transaction")
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	s, err := SeedFromPhrase(vectorPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, start := range []int{0, 1} {
+		l, err := s.Addresses(start, len(vectorAddresses)-start)
+		if err != nil {
+			t.Fatal(err)
+		} else if l.Len() != len(vectorAddresses)-start {
+			t.Fatalf("expected %v addresses, got %v", len(vectorAddresses)-start, l.Len())
+		}
+		for i := 0; i < l.Len(); i++ {
+			a, _ := l.Get(i)
+			if index := start + i; a.Index != index || a.Address != vectorAddresses[index] || a.PublicKey != s.PublicKey(index) {
+				t.Errorf("address %v does not match: %+v", index, a)
+			}
+		}
+		if _, err := l.Get(l.Len()); err == nil {
+			t.Error("out-of-range index should be rejected")
+		}
+	}
+	if l, err := s.Addresses(5, 0); err != nil || l.Len() != 0 {
+		t.Error("expected empty list, got", l, err)
+	}
+	if _, err := s.Addresses(-1, 1); err == nil {
+		t.Error("negative start should be rejected")
+	} else if _, err := s.Addresses(0, -1); err == nil {
+		t.Error("negative count should be rejected")
+	}
+}
+
+// A countingChecker counts the addresses checked by an AddressChecker.
+type countingChecker struct {
+	AddressChecker
+	checked []string
+}
+
+func (c *countingChecker) IsUsed(addr string) (bool, error) {
+	c.checked = append(c.checked, addr)
+	return c.AddressChecker.IsUsed(addr)
+}
+
+func TestScanAddresses(t *testing.T) {
+	s, err := SeedFromPhrase(vectorPhrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newWalrusServer(t, s.Address(0), s.Address(2), s.Address(5))
+	tests := []struct {
+		gapLimit int
+		used     []int
+		checked  int
+	}{
+		{1, []int{0}, 2},
+		{2, []int{0, 2}, 5},
+		{3, []int{0, 2, 5}, 9},
+		{10, []int{0, 2, 5}, 16},
+	}
+	for _, test := range tests {
+		c := &countingChecker{AddressChecker: NewWalrusChecker(srv.URL)}
+		l, err := s.ScanAddresses(c, test.gapLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var used []int
+		for i := 0; i < l.Len(); i++ {
+			a, _ := l.Get(i)
+			if a.Address != s.Address(a.Index) || a.PublicKey != s.PublicKey(a.Index) {
+				t.Errorf("gap limit %v: address %v does not match its index", test.gapLimit, a.Index)
+			}
+			used = append(used, a.Index)
+		}
+		if fmt.Sprint(used) != fmt.Sprint(test.used) {
+			t.Errorf("gap limit %v: expected used addresses %v, got %v", test.gapLimit, test.used, used)
+		} else if len(c.checked) != test.checked {
+			t.Errorf("gap limit %v: expected %v addresses to be checked, got %v", test.gapLimit, test.checked, len(c.checked))
+		}
+	}
+
+	// an unused seed has no used addresses
+	c := &countingChecker{AddressChecker: NewWalrusChecker(srv.URL)}
+	if l, err := NewSeed().ScanAddresses(c, 20); err != nil || l.Len() != 0 || len(c.checked) != 20 {
+		t.Error("expected no used addresses after 20 checks, got", l, err, len(c.checked))
+	}
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database is locked", http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+	if _, err := s.ScanAddresses(NewWalrusChecker(bad.URL), 5); err == nil {
+		t.Error("expected checker error to be reported")
+	} else if _, err := s.ScanAddresses(nil, 5); err == nil {
+		t.Error("nil checker should be rejected")
+	} else if _, err := s.ScanAddresses(NewWalrusChecker(srv.URL), 0); err == nil {
+		t.Error("zero gap limit should be rejected")
+	}
+}
+
+// A hostProgressListener records the reports of OnHostProgress.
+type hostProgressListener struct {
+	mu      sync.Mutex
+	reports map[string][2]int64
+}
+
+func (l *hostProgressListener) OnProgress(transferred, total int64) {}
+
+func (l *hostProgressListener) OnHostProgress(hostKey string, uploaded, downloaded int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reports[hostKey] = [2]int64{uploaded, downloaded}
+}
+
+func TestHostProgress(t *testing.T) {
+	hs := &HostSet{
+		sessions: make(map[hostdb.HostPublicKey]*proto.Session),
+		busy:     make(map[hostdb.HostPublicKey]*transferSessions),
+	}
+	hs.released.L = &hs.mu
+	rec := statsRecorder{hs}
+	shared := hostdb.HostPublicKey("ed25519:" + strings.Repeat("ab", 32))
+	other := hostdb.HostPublicKey("ed25519:" + strings.Repeat("cd", 32))
+
+	newTransfer := func(hosts ...hostdb.HostPublicKey) (*transferSessions, *hostProgressListener) {
+		l := &hostProgressListener{reports: make(map[string][2]int64)}
+		p := &transferProgress{l: l, hosts: make(map[hostdb.HostPublicKey][2]int64)}
+		return &transferSessions{hs: hs, p: p, hosts: hosts}, l
+	}
+	ts1, l1 := newTransfer(shared)
+	ts2, l2 := newTransfer(shared, other)
+
+	// while the first transfer is using the shared host, the second must wait
+	// for it, and RPCs with the shared host are reported to the first only
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	done1 := make(chan error)
+	go func() {
+		done1 <- ts1.do(func() error {
+			close(inside)
+			<-release
+			return nil
+		})
+	}()
+	<-inside
+	entered2 := make(chan struct{})
+	done2 := make(chan error)
+	go func() {
+		done2 <- ts2.do(func() error {
+			close(entered2)
+			rec.RecordRPCStats(proto.RPCStats{Host: shared, Uploaded: 100})
+			rec.RecordRPCStats(proto.RPCStats{Host: other, Downloaded: 7})
+			return nil
+		})
+	}()
+	rec.RecordRPCStats(proto.RPCStats{Host: shared, Uploaded: 10, Downloaded: 1})
+	rec.RecordRPCStats(proto.RPCStats{Host: other, Uploaded: 1000})
+	select {
+	case <-entered2:
+		t.Fatal("second transfer should wait for the shared host")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done1; err != nil {
+		t.Fatal(err)
+	} else if err := <-done2; err != nil {
+		t.Fatal(err)
+	}
+	// once neither transfer is using a host, its RPCs are reported to no one
+	rec.RecordRPCStats(proto.RPCStats{Host: shared, Uploaded: 1e6})
+
+	if exp := map[string][2]int64{string(shared): {10, 1}}; fmt.Sprint(l1.reports) != fmt.Sprint(exp) {
+		t.Errorf("first transfer: expected %v, got %v", exp, l1.reports)
+	}
+	if exp := map[string][2]int64{string(shared): {100, 0}, string(other): {0, 7}}; fmt.Sprint(l2.reports) != fmt.Sprint(exp) {
+		t.Errorf("second transfer: expected %v, got %v", exp, l2.reports)
+	}
+	if len(hs.busy) != 0 {
+		t.Error("hosts should be released after each call, got", hs.busy)
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("uploads more than 4 GiB")
+	}
+	h := ghost.NewOnDisk(t, ghost.FreeSettings, ghost.StubWallet{}, ghost.StubTpool{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	host, err := hostdb.Scan(ctx, h.Settings.NetAddress, h.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renterKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rev, _, err := proto.FormContract(ghost.StubWallet{}, ghost.StubTpool{}, renterKey, host, types.SiacoinPrecision, h.Height(), h.Height()+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := rev.ID()
+	contract, err := NewContract(append(append(append([]byte(nil), h.PublicKey.Ed25519()...), id[:]...), renterKey[:ed25519.SeedSize]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardSrv := servertest.NewShard(t, h.Key, h.Settings.NetAddress, h.Height())
+	hs, err := NewHostSet(shardSrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := hs.AddHost(contract); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := NewFileSystem(t.TempDir(), hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	// write zeros up to off, then data past it
+	const off = 1<<32 + 64
+	u, err := fs.NewUpload("foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeros := make([]byte, transferChunkSize)
+	for n := int64(0); n < off; {
+		chunk := zeros
+		if rem := off - n; rem < int64(len(chunk)) {
+			chunk = chunk[:rem]
+		}
+		if _, err := u.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		n += int64(len(chunk))
+	}
+	if _, err := u.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file must now be read from the host
+	if size, err := fs.Size("foo"); err != nil || size != off+5 {
+		t.Fatalf("expected size %v, got %v (%v)", off+5, size, err)
+	}
+	d, err := fs.NewDownload("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, err := d.Size(); err != nil || size != off+5 {
+		t.Errorf("expected size %v, got %v (%v)", off+5, size, err)
+	} else if pos, err := d.Seek(-5, io.SeekEnd); err != nil || pos != off {
+		t.Errorf("expected seek to %v, got %v (%v)", off, pos, err)
+	} else if b, err := d.Read(10); err != nil || string(b) != "hello" {
+		t.Errorf("expected to read %q, got %q (%v)", "hello", b, err)
+	} else if _, err := d.Seek(off-5, io.SeekStart); err != nil {
+		t.Error(err)
+	} else if b, err := d.Read(10); err != nil || string(b) != "\x00\x00\x00\x00\x00hello" {
+		t.Errorf("expected to read across the end of the zeros, got %q (%v)", b, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// truncating keeps the offsets past 4 GiB intact
+	if err := fs.Truncate("foo", off+2); err != nil {
+		t.Fatal(err)
+	} else if size, err := fs.Size("foo"); err != nil || size != off+2 {
+		t.Fatalf("expected size %v, got %v (%v)", off+2, size, err)
+	}
+	d, err = fs.NewDownload("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if pos, err := d.Seek(-2, io.SeekEnd); err != nil || pos != off {
+		t.Errorf("expected seek to %v, got %v (%v)", off, pos, err)
+	} else if b, err := d.Read(10); err != nil || string(b) != "he" {
+		t.Errorf("expected to read %q, got %q (%v)", "he", b, err)
+	}
+}
@@ -4,6 +4,9 @@ go 1.15
 
 require (
 	gitlab.com/NebulousLabs/Sia v1.5.4
-	lukechampine.com/shard v0.3.7 // indirect
+	lukechampine.com/shard v0.3.7
+	lukechampine.com/us-bindings/internal v0.0.0-00010101000000-000000000000
 	lukechampine.com/us v0.19.1
 )
+
+replace lukechampine.com/us-bindings/internal => ../internal
@@ -0,0 +1,33 @@
+#ifndef US_ERRORS_H
+#define US_ERRORS_H
+
+// Error codes returned by us_error_code. This is the only definition of the
+// codes; the C and Python bindings both include it, so a code has the same
+// value in every binding. Errors are mapped to codes by internal/errcode. New
+// codes must be added at the end.
+typedef enum us_errcode_t {
+	US_OK = 0,
+	US_ERR_UNKNOWN,
+	US_ERR_INVALID_ARGUMENT,
+	US_ERR_NOT_FOUND,
+	US_ERR_EXISTS,
+	US_ERR_PERMISSION,
+	US_ERR_IS_DIRECTORY,
+	US_ERR_NOT_DIRECTORY,
+	US_ERR_EOF,
+	US_ERR_CLOSED,
+	US_ERR_NETWORK,
+	US_ERR_TIMEOUT,
+	US_ERR_HOST_REJECTED,
+	US_ERR_INVALID_PROOF,
+	US_ERR_INSUFFICIENT_FUNDS,
+	US_ERR_CONTRACT_LOCKED,
+	US_ERR_CONTRACT_FINALIZED,
+	US_ERR_INVALID_HANDLE,
+	US_ERR_PANIC,
+	US_ERR_BUSY,
+	US_ERR_CANCELED,
+	US_ERR_PRICE_EXCEEDED,
+} us_errcode_t;
+
+#endif
@@ -0,0 +1,200 @@
+// Package async implements the completion queue used by the asynchronous
+// operations of the C and Python bindings. Each operation runs on its own
+// goroutine and posts its result to a Queue, whose file descriptor is readable
+// whenever results are waiting, so it can be registered with an event loop.
+package async
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"unsafe"
+
+	"lukechampine.com/us-bindings/internal/errcode"
+	"lukechampine.com/us-bindings/internal/handles"
+	"lukechampine.com/us/renterhost"
+)
+
+// A Completion is the result of an asynchronous operation.
+type Completion struct {
+	Op     uint64
+	Ctx    unsafe.Pointer // caller-supplied context of the operation
+	Result int64          // -1 if Err is non-nil
+	Handle unsafe.Pointer // object created by the operation, if any
+	Err    error
+	Name   string // export that started the operation
+}
+
+// A Queue runs asynchronous operations and collects their completions.
+type Queue struct {
+	ptrs     *handles.Table
+	r, w     *os.File
+	mu       sync.Mutex
+	done     []Completion
+	pending  map[uint64]context.CancelFunc
+	nextOp   uint64
+	signaled bool // whether r contains a byte
+	closed   bool
+}
+
+// NewQueue returns an empty Queue. Operations on the queue unpin their
+// handles in ptrs when they finish.
+func NewQueue(ptrs *handles.Table) (*Queue, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{
+		ptrs:    ptrs,
+		r:       r,
+		w:       w,
+		pending: make(map[uint64]context.CancelFunc),
+	}, nil
+}
+
+// Fd returns a file descriptor that is readable whenever completions are
+// waiting. It must not be read directly.
+func (q *Queue) Fd() uintptr {
+	return q.r.Fd()
+}
+
+// Submit runs fn on a new goroutine and posts its result to the queue. The
+// handles in pinned must already be pinned; they are unpinned before the
+// result is posted. The context passed to fn is canceled by Cancel; if fn
+// fails after the operation is canceled, its completion reports
+// errcode.ErrCanceled.
+func (q *Queue) Submit(ctx unsafe.Pointer, name string, pinned []unsafe.Pointer, fn func(context.Context) (int64, unsafe.Pointer, error)) (uint64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, errcode.ErrClosedHandle
+	}
+	q.nextOp++
+	opCtx, cancel := context.WithCancel(context.Background())
+	q.pending[q.nextOp] = cancel
+	c := Completion{
+		Op:   q.nextOp,
+		Ctx:  ctx,
+		Name: name,
+	}
+	go func() {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					c.Err = fmt.Errorf("%w: %v\n%s", errcode.ErrPanic, r, debug.Stack())
+				}
+			}()
+			if opCtx.Err() != nil {
+				c.Err = errcode.ErrCanceled
+				return
+			}
+			c.Result, c.Handle, c.Err = fn(opCtx)
+		}()
+		if c.Err != nil {
+			c.Result = -1
+			if opCtx.Err() != nil && !errors.Is(c.Err, errcode.ErrPanic) {
+				c.Err = errcode.ErrCanceled
+			}
+		}
+		cancel()
+		for _, p := range pinned {
+			q.ptrs.Unpin(p)
+		}
+		q.post(c)
+	}()
+	return c.Op, nil
+}
+
+// post adds a completion to the queue. The descriptor is kept readable for as
+// long as the queue is non-empty, so at most one byte is ever buffered in the
+// pipe and neither post nor Poll can block on it.
+func (q *Queue) post(c Completion) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, c.Op)
+	q.done = append(q.done, c)
+	if !q.signaled {
+		q.w.Write([]byte{1})
+		q.signaled = true
+	}
+}
+
+// Poll removes the oldest completion from the queue. It returns false if the
+// queue is empty.
+func (q *Queue) Poll() (Completion, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.done) == 0 {
+		return Completion{}, false
+	}
+	c := q.done[0]
+	q.done[0] = Completion{}
+	q.done = q.done[1:]
+	if len(q.done) == 0 && q.signaled {
+		q.r.Read(make([]byte, 1))
+		q.signaled = false
+	}
+	return c, true
+}
+
+// Cancel cancels the context of the pending operation op. It has no effect if
+// op has already completed.
+func (q *Queue) Cancel(op uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cancel, ok := q.pending[op]; ok {
+		cancel()
+	}
+}
+
+// Close prevents further operations from being submitted and returns the
+// completions that were posted but not polled. It fails with errcode.ErrBusy
+// if any operations are still pending. The descriptor remains open until
+// Release is called.
+func (q *Queue) Close() ([]Completion, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) > 0 {
+		return nil, fmt.Errorf("%w: %v operations are still pending", errcode.ErrBusy, len(q.pending))
+	}
+	q.closed = true
+	done := q.done
+	q.done = nil
+	return done, nil
+}
+
+// Release closes the descriptor of a closed queue.
+func (q *Queue) Release() {
+	q.r.Close()
+	q.w.Close()
+}
+
+// ChunkSize is the amount of data passed to each call by TransferChunks. File
+// reads and writes cannot be interrupted, so a canceled read or write stops at
+// the next chunk boundary.
+const ChunkSize = renterhost.SectorSize
+
+// TransferChunks calls fn on successive chunks of b, starting at offset off,
+// until b is exhausted, fn transfers less than a full chunk, or ctx is
+// canceled.
+func TransferChunks(ctx context.Context, b []byte, off int64, fn func(chunk []byte, off int64) (int, error)) (n int, err error) {
+	for len(b) > 0 {
+		if ctx.Err() != nil {
+			return n, errcode.ErrCanceled
+		}
+		chunk := b
+		if len(chunk) > ChunkSize {
+			chunk = chunk[:ChunkSize]
+		}
+		m, err := fn(chunk, off+int64(n))
+		n += m
+		if err != nil || m < len(chunk) {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
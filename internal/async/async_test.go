@@ -0,0 +1,153 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"unsafe"
+
+	"lukechampine.com/us-bindings/internal/errcode"
+	"lukechampine.com/us-bindings/internal/handles"
+)
+
+// waitCompletion polls q until a completion is posted.
+func waitCompletion(t *testing.T, q *Queue) Completion {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if c, ok := q.Poll(); ok {
+			return c
+		}
+	}
+	t.Fatal("no completion was posted")
+	return Completion{}
+}
+
+func TestQueue(t *testing.T) {
+	var ptrs handles.Table
+	q, err := NewQueue(&ptrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ptrs.Store(handles.Seed, "seed")
+	if _, err := ptrs.Pin(p, handles.Seed); err != nil {
+		t.Fatal(err)
+	}
+	ctx := unsafe.Pointer(new(int))
+	release := make(chan struct{})
+	op, err := q.Submit(ctx, "us_test", []unsafe.Pointer{p}, func(context.Context) (int64, unsafe.Pointer, error) {
+		<-release
+		return 7, nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the queue cannot be closed, nor the pinned handle taken, while the
+	// operation is pending
+	if _, err := q.Close(); !errors.Is(err, errcode.ErrBusy) {
+		t.Fatal("expected ErrBusy, got", err)
+	} else if _, err := ptrs.Take(p, handles.Seed); !errors.Is(err, errcode.ErrBusy) {
+		t.Fatal("expected ErrBusy, got", err)
+	} else if _, ok := q.Poll(); ok {
+		t.Fatal("expected empty queue")
+	}
+
+	close(release)
+	if c := waitCompletion(t, q); c.Op != op || c.Ctx != ctx || c.Result != 7 || c.Err != nil || c.Name != "us_test" {
+		t.Fatalf("wrong completion: %+v", c)
+	} else if _, ok := q.Poll(); ok {
+		t.Fatal("expected empty queue")
+	} else if _, err := ptrs.Take(p, handles.Seed); err != nil {
+		t.Fatal("pinned handle should be unpinned:", err)
+	}
+
+	// completions that were never polled are returned by Close
+	if _, err := q.Submit(nil, "us_test", nil, func(context.Context) (int64, unsafe.Pointer, error) {
+		return 0, nil, errors.New("failed")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	done, err := q.Close()
+	for deadline := time.Now().Add(10 * time.Second); errors.Is(err, errcode.ErrBusy) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		done, err = q.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	} else if len(done) != 1 || done[0].Result != -1 || done[0].Err == nil {
+		t.Fatalf("wrong completions: %+v", done)
+	} else if _, err := q.Submit(nil, "us_test", nil, nil); !errors.Is(err, errcode.ErrClosedHandle) {
+		t.Fatal("expected ErrClosedHandle, got", err)
+	}
+	q.Release()
+}
+
+func TestQueueCancel(t *testing.T) {
+	var ptrs handles.Table
+	q, err := NewQueue(&ptrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Release()
+
+	started := make(chan struct{})
+	op, err := q.Submit(nil, "us_test", nil, func(ctx context.Context) (int64, unsafe.Pointer, error) {
+		close(started)
+		<-ctx.Done()
+		return 0, nil, errors.New("connection closed")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	q.Cancel(op)
+	if c := waitCompletion(t, q); !errors.Is(c.Err, errcode.ErrCanceled) || c.Result != -1 {
+		t.Fatalf("expected canceled completion, got %+v", c)
+	}
+	q.Cancel(op) // no effect
+
+	if _, err := q.Submit(nil, "us_test", nil, func(context.Context) (int64, unsafe.Pointer, error) {
+		panic("oops")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if c := waitCompletion(t, q); !errors.Is(c.Err, errcode.ErrPanic) {
+		t.Fatalf("expected panic, got %+v", c)
+	}
+	if _, err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransferChunks(t *testing.T) {
+	b := make([]byte, 2*ChunkSize+1)
+	var offsets []int64
+	n, err := TransferChunks(context.Background(), b, 10, func(chunk []byte, off int64) (int, error) {
+		offsets = append(offsets, off)
+		return len(chunk), nil
+	})
+	if err != nil || n != len(b) {
+		t.Fatal(n, err)
+	} else if len(offsets) != 3 || offsets[0] != 10 || offsets[1] != 10+ChunkSize || offsets[2] != 10+2*ChunkSize {
+		t.Fatal("wrong chunk offsets:", offsets)
+	}
+
+	// a short transfer ends the loop
+	n, err = TransferChunks(context.Background(), b, 0, func(chunk []byte, off int64) (int, error) {
+		return 5, nil
+	})
+	if err != nil || n != 5 {
+		t.Fatal(n, err)
+	}
+
+	// cancellation takes effect at the next chunk boundary
+	ctx, cancel := context.WithCancel(context.Background())
+	n, err = TransferChunks(ctx, b, 0, func(chunk []byte, off int64) (int, error) {
+		cancel()
+		return len(chunk), nil
+	})
+	if !errors.Is(err, errcode.ErrCanceled) || n != ChunkSize {
+		t.Fatalf("expected cancellation after one chunk, got %v, %v", n, err)
+	}
+}
@@ -0,0 +1,64 @@
+// Package contractfile reads the contract files written by the user tool. It
+// is shared by the C, Python, and gomobile bindings.
+package contractfile
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// A contract file is a 12-byte header (magic string plus version) followed by
+// the 96-byte contract.
+const (
+	magic   = "us-contract"
+	version = 2
+	size    = len(magic) + 1 + 96
+)
+
+// ErrInvalid is wrapped by the errors of malformed contracts.
+var ErrInvalid = errors.New("invalid contract")
+
+// Parse validates the contents of a contract file and returns the 96-byte
+// contract it contains.
+func Parse(b []byte) ([]byte, error) {
+	if len(b) < len(magic) || string(b[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: not a contract file", ErrInvalid)
+	} else if len(b) > len(magic) && b[len(magic)] != version {
+		return nil, fmt.Errorf("%w: unsupported version %v (expected %v)", ErrInvalid, b[len(magic)], version)
+	} else if len(b) < size {
+		return nil, fmt.Errorf("%w: file is truncated (%v bytes, expected %v)", ErrInvalid, len(b), size)
+	} else if len(b) > size {
+		return nil, fmt.Errorf("%w: file is too large (%v bytes, expected %v)", ErrInvalid, len(b), size)
+	}
+	return b[len(magic)+1:], nil
+}
+
+// Read reads the contract file at path and returns the 96-byte contract it
+// contains.
+func Read(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return c, nil
+}
+
+// Decode decodes a 96-byte contract: the host's public key, the contract ID,
+// and the seed of the renter's key.
+func Decode(b []byte) renter.Contract {
+	c := renter.Contract{
+		HostKey:   hostdb.HostKeyFromPublicKey(b[:32]),
+		RenterKey: ed25519.NewKeyFromSeed(b[64:96]),
+	}
+	copy(c.ID[:], b[32:64])
+	return c
+}
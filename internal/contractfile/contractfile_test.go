@@ -0,0 +1,46 @@
+package contractfile
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	contract := bytes.Repeat([]byte{1}, 96)
+	valid := append([]byte(magic+"\x02"), contract...)
+	tests := []struct {
+		desc string
+		b    []byte
+		err  string // substring of the expected error; empty means no error
+	}{
+		{"valid", valid, ""},
+		{"bad magic", append([]byte("us-kontract\x02"), contract...), "not a contract file"},
+		{"bad version", append([]byte(magic+"\x01"), contract...), "unsupported version"},
+		{"truncated", valid[:len(valid)-1], "truncated"},
+		{"too large", append(valid, 0), "too large"},
+		{"empty", nil, "not a contract file"},
+	}
+	for _, test := range tests {
+		c, err := Parse(test.b)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.desc, err)
+			} else if !bytes.Equal(c, contract) {
+				t.Errorf("%v: wrong contract", test.desc)
+			}
+		} else if !errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: expected %q, got %v", test.desc, test.err, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "contract")
+	if err := ioutil.WriteFile(path, valid[:20], 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := Read(path); !errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), path) {
+		t.Fatal("expected error naming the path, got", err)
+	}
+}
@@ -0,0 +1,111 @@
+// Package errcode defines the errors reported by the C and Python bindings,
+// and maps errors to the codes of include/us_errors.h.
+package errcode
+
+// #cgo CFLAGS: -I${SRCDIR}/../../include
+// #include "us_errors.h"
+import "C"
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"lukechampine.com/us-bindings/internal/contractfile"
+	"lukechampine.com/us-bindings/internal/pricing"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renter/renterutil"
+	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/wallet"
+)
+
+// Errors reported by the bindings themselves.
+var (
+	ErrInvalidHandle      = errors.New("invalid handle")
+	ErrClosedHandle       = errors.New("handle has already been closed")
+	ErrNullArgument       = errors.New("argument must not be NULL")
+	ErrNegative           = errors.New("offset or size must not be negative")
+	ErrWhence             = errors.New("whence must be SEEK_SET, SEEK_CUR or SEEK_END")
+	ErrInvalidArgument    = errors.New("invalid argument")
+	ErrInvalidLimits      = errors.New("invalid price limits")
+	ErrInsufficientInputs = errors.New("insufficient inputs")
+	ErrPanic              = errors.New("panic")
+	ErrBusy               = errors.New("object is still in use")
+	ErrCanceled           = errors.New("operation was canceled")
+)
+
+// Of returns the us_errcode_t corresponding to err, or US_OK if err is nil.
+func Of(err error) int {
+	var hostErrs renterutil.HostErrorSet
+	var rpcErr *renterhost.RPCError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return C.US_OK
+	case errors.Is(err, ErrInvalidHandle):
+		return C.US_ERR_INVALID_HANDLE
+	case errors.Is(err, ErrClosedHandle):
+		return C.US_ERR_CLOSED
+	case errors.Is(err, ErrNullArgument), errors.Is(err, ErrNegative), errors.Is(err, ErrWhence),
+		errors.Is(err, ErrInvalidArgument), errors.Is(err, ErrInvalidLimits), errors.Is(err, contractfile.ErrInvalid):
+		return C.US_ERR_INVALID_ARGUMENT
+	case errors.Is(err, ErrPanic):
+		return C.US_ERR_PANIC
+	case errors.Is(err, ErrBusy):
+		return C.US_ERR_BUSY
+	case errors.Is(err, ErrCanceled), errors.Is(err, context.Canceled):
+		return C.US_ERR_CANCELED
+	case errors.Is(err, pricing.ErrPriceExceeded):
+		return C.US_ERR_PRICE_EXCEEDED
+	case errors.As(err, &hostErrs):
+		// if every host failed for the same reason, report that reason
+		code := Of(hostErrs[0])
+		for _, he := range hostErrs[1:] {
+			if Of(he) != code {
+				return C.US_ERR_UNKNOWN
+			}
+		}
+		return code
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return C.US_ERR_EOF
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, renterutil.ErrNoHostAnnouncement):
+		return C.US_ERR_NOT_FOUND
+	case errors.Is(err, os.ErrExist):
+		return C.US_ERR_EXISTS
+	case errors.Is(err, os.ErrPermission),
+		errors.Is(err, renterutil.ErrNotReadable),
+		errors.Is(err, renterutil.ErrNotWriteable),
+		errors.Is(err, renterutil.ErrAppendOnly):
+		return C.US_ERR_PERMISSION
+	case errors.Is(err, renterutil.ErrDirectory):
+		return C.US_ERR_IS_DIRECTORY
+	case errors.Is(err, renterutil.ErrNotDirectory):
+		return C.US_ERR_NOT_DIRECTORY
+	case errors.Is(err, renterutil.ErrInvalidFileDescriptor), errors.Is(err, os.ErrClosed):
+		return C.US_ERR_CLOSED
+	case errors.Is(err, proto.ErrInsufficientFunds), errors.Is(err, wallet.ErrInsufficientFunds),
+		errors.Is(err, ErrInsufficientInputs):
+		return C.US_ERR_INSUFFICIENT_FUNDS
+	case errors.Is(err, proto.ErrContractLocked):
+		return C.US_ERR_CONTRACT_LOCKED
+	case errors.Is(err, proto.ErrContractFinalized):
+		return C.US_ERR_CONTRACT_FINALIZED
+	case errors.Is(err, proto.ErrInvalidMerkleProof):
+		return C.US_ERR_INVALID_PROOF
+	case errors.As(err, &rpcErr):
+		return C.US_ERR_HOST_REJECTED
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return C.US_ERR_TIMEOUT
+		}
+		return C.US_ERR_NETWORK
+	case strings.Contains(err.Error(), "no record of that host"):
+		// shard and HostSet both report unknown hosts with an unexported
+		// error, so this is the best we can do
+		return C.US_ERR_NOT_FOUND
+	}
+	return C.US_ERR_UNKNOWN
+}
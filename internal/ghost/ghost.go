@@ -0,0 +1,415 @@
+// Package ghost implements a barebones, ephemeral Sia host. It is used for
+// testing purposes only, not hosting actual renter data on the Sia network.
+//
+// It is adapted from the package of the same name in lukechampine.com/us, which
+// cannot be imported from outside that module.
+package ghost
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/host"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
+)
+
+// DefaultSettings are the default (cheap) ghost settings.
+var DefaultSettings = hostdb.HostSettings{
+	AcceptingContracts:     true,
+	MaxDuration:            144,
+	MaxCollateral:          types.SiacoinPrecision.Mul64(1e9),
+	ContractPrice:          types.SiacoinPrecision,
+	StoragePrice:           types.SiacoinPrecision.Div64(1e9),
+	UploadBandwidthPrice:   types.SiacoinPrecision.Div64(2e9),
+	DownloadBandwidthPrice: types.SiacoinPrecision.Div64(3e9),
+	WindowSize:             5,
+	Version:                "1.5.0",
+	Make:                   "ghost",
+	Model:                  "v0.1.0",
+}
+
+// FreeSettings are the cheapest possible ghost settings.
+//
+// NOTE: it is not possible for contracts to be completely free, because
+// consensus rules disallow FileContracts whose Payout field is 0.
+var FreeSettings = hostdb.HostSettings{
+	AcceptingContracts:     true,
+	MaxDuration:            144,
+	MaxCollateral:          types.ZeroCurrency,
+	ContractPrice:          types.NewCurrency64(1),
+	StoragePrice:           types.ZeroCurrency,
+	UploadBandwidthPrice:   types.ZeroCurrency,
+	DownloadBandwidthPrice: types.ZeroCurrency,
+	WindowSize:             5,
+	Version:                "1.5.0",
+	Make:                   "ghost",
+	Model:                  "v0.1.0",
+}
+
+// A Host is an ephemeral Sia host.
+type Host struct {
+	Settings  hostdb.HostSettings
+	PublicKey hostdb.HostPublicKey
+	Key       ed25519.PrivateKey
+	l         net.Listener
+	cs        *ephemeralContractStore
+	cw        *host.ChainWatcher
+}
+
+// Close closes the host's listener.
+func (h *Host) Close() error {
+	if h.l == nil {
+		return nil
+	}
+	h.l.Close()
+	h.cw.Close()
+	h.l = nil
+	return nil
+}
+
+// Height returns the host's current block height. Contracts formed with the
+// host must start after it.
+func (h *Host) Height() types.BlockHeight {
+	return h.cs.Height()
+}
+
+// ProcessConsensusChange implements modules.ConsensusSetSubscriber.
+func (h *Host) ProcessConsensusChange(cc modules.ConsensusChange) {
+	h.cw.ProcessConsensusChange(cc)
+}
+
+// New returns an initialized host that listens for incoming sessions on a
+// random localhost port. The host is automatically closed with tb.Cleanup.
+func New(tb testing.TB, settings hostdb.HostSettings, wm host.Wallet, tpool host.TransactionPool) *Host {
+	tb.Helper()
+	return newHost(tb, settings, wm, tpool, newEphemeralSectorStore())
+}
+
+// NewOnDisk is like New, but the host stores sectors in a temporary directory
+// rather than in memory, for tests that upload gigabytes of data.
+func NewOnDisk(tb testing.TB, settings hostdb.HostSettings, wm host.Wallet, tpool host.TransactionPool) *Host {
+	tb.Helper()
+	return newHost(tb, settings, wm, tpool, diskSectorStore{
+		ephemeralSectorStore: newEphemeralSectorStore(),
+		dir:                  tb.TempDir(),
+	})
+}
+
+func newHost(tb testing.TB, settings hostdb.HostSettings, wm host.Wallet, tpool host.TransactionPool, ss host.SectorStore) *Host {
+	tb.Helper()
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	settings.NetAddress = modules.NetAddress(l.Addr().String())
+	settings.UnlockHash, err = wm.Address()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	h := &Host{
+		PublicKey: hostdb.HostKeyFromPublicKey(ed25519hash.ExtractPublicKey(key)),
+		Settings:  settings,
+		Key:       key,
+		l:         l,
+	}
+	h.cs = newEphemeralContractStore(key)
+	sh := host.NewSessionHandler(key, (*constantHostSettings)(&h.Settings), h.cs, ss, wm, tpool, nopMetricsRecorder{})
+	go listen(sh, l)
+	h.cw = host.NewChainWatcher(tpool, wm, h.cs, ss)
+	return h
+}
+
+const debug = false
+
+func debugLn(args ...interface{}) {
+	if debug {
+		log.Println(args...)
+	}
+}
+
+func listen(sh *host.SessionHandler, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			debugLn("accept error:", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			err := sh.Serve(conn)
+			if err != nil {
+				debugLn("rpc error:", err)
+			}
+		}()
+	}
+}
+
+type constantHostSettings hostdb.HostSettings
+
+func (chs *constantHostSettings) Settings() hostdb.HostSettings {
+	return hostdb.HostSettings(*chs)
+}
+
+type ephemeralSectorStore struct {
+	sectors   map[crypto.Hash]*[renterhost.SectorSize]byte
+	contracts map[types.FileContractID][]crypto.Hash
+}
+
+func (ess ephemeralSectorStore) Sector(root crypto.Hash) (*[renterhost.SectorSize]byte, error) {
+	sector, ok := ess.sectors[root]
+	if !ok {
+		return nil, fmt.Errorf("no sector with Merkle root %v", root)
+	}
+	return sector, nil
+}
+
+func (ess ephemeralSectorStore) AddSector(root crypto.Hash, sector *[renterhost.SectorSize]byte) error {
+	ess.sectors[root] = sector
+	return nil
+}
+
+func (ess ephemeralSectorStore) DeleteSector(root crypto.Hash) error {
+	delete(ess.sectors, root)
+	return nil
+}
+
+func (ess ephemeralSectorStore) ContractRoots(id types.FileContractID) ([]crypto.Hash, error) {
+	return ess.contracts[id], nil
+}
+
+func (ess ephemeralSectorStore) SetContractRoots(id types.FileContractID, roots []crypto.Hash) error {
+	ess.contracts[id] = roots
+	return nil
+}
+
+func newEphemeralSectorStore() ephemeralSectorStore {
+	return ephemeralSectorStore{
+		sectors:   make(map[crypto.Hash]*[renterhost.SectorSize]byte),
+		contracts: make(map[types.FileContractID][]crypto.Hash),
+	}
+}
+
+// diskSectorStore is an ephemeralSectorStore that keeps sector data in files
+// named by their Merkle roots.
+type diskSectorStore struct {
+	ephemeralSectorStore
+	dir string
+}
+
+func (dss diskSectorStore) path(root crypto.Hash) string {
+	return filepath.Join(dss.dir, root.String())
+}
+
+func (dss diskSectorStore) Sector(root crypto.Hash) (*[renterhost.SectorSize]byte, error) {
+	b, err := ioutil.ReadFile(dss.path(root))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no sector with Merkle root %v", root)
+	} else if err != nil {
+		return nil, err
+	}
+	sector := new([renterhost.SectorSize]byte)
+	copy(sector[:], b)
+	return sector, nil
+}
+
+func (dss diskSectorStore) AddSector(root crypto.Hash, sector *[renterhost.SectorSize]byte) error {
+	return ioutil.WriteFile(dss.path(root), sector[:], 0660)
+}
+
+func (dss diskSectorStore) DeleteSector(root crypto.Hash) error {
+	return os.Remove(dss.path(root))
+}
+
+type ephemeralContractStore struct {
+	key       ed25519.PrivateKey
+	contracts map[types.FileContractID]*host.Contract
+	height    types.BlockHeight
+	ccid      modules.ConsensusChangeID
+	mu        sync.Mutex
+}
+
+func (ecm *ephemeralContractStore) SigningKey() ed25519.PrivateKey {
+	return ecm.key
+}
+
+func (ecm *ephemeralContractStore) ActionableContracts() []host.Contract {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+	var contracts []host.Contract
+	for _, c := range ecm.contracts {
+		if host.ContractIsActionable(*c, ecm.height) {
+			contracts = append(contracts, *c)
+		}
+	}
+	return contracts
+}
+
+func (ecm *ephemeralContractStore) Contract(id types.FileContractID) (host.Contract, error) {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+	c := ecm.contracts[id]
+	if c == nil {
+		return host.Contract{}, errors.New("no record of that contract")
+	}
+	return *c, nil
+}
+
+func (ecm *ephemeralContractStore) AddContract(c host.Contract) error {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+	ecm.contracts[c.ID()] = &c
+	return nil
+}
+
+func (ecm *ephemeralContractStore) ReviseContract(rev types.FileContractRevision, renterSig, hostSig []byte) error {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+	c, ok := ecm.contracts[rev.ID()]
+	if !ok {
+		return errors.New("no record of that contract")
+	}
+	c.Revision = rev
+	c.Signatures[0].Signature = renterSig
+	c.Signatures[1].Signature = hostSig
+	return nil
+}
+
+func (ecm *ephemeralContractStore) UpdateContractTransactions(id types.FileContractID, final, proof []types.Transaction, err error) {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+	if c, ok := ecm.contracts[id]; ok {
+		c.FinalizationSet = final
+		c.ProofSet = proof
+		c.FatalError = err
+	}
+}
+
+func (ecm *ephemeralContractStore) ApplyConsensusChange(reverted, applied host.ProcessedConsensusChange, ccid modules.ConsensusChangeID) {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+
+	for _, id := range reverted.Contracts {
+		if cc, ok := ecm.contracts[id]; ok {
+			cc.FormationConfirmed = false
+		}
+	}
+	for _, id := range reverted.Revisions {
+		if cc, ok := ecm.contracts[id]; ok {
+			cc.FinalizationConfirmed = false
+		}
+	}
+	for _, id := range reverted.Proofs {
+		if cc, ok := ecm.contracts[id]; ok {
+			cc.ProofConfirmed = false
+		}
+	}
+	for _, id := range applied.Contracts {
+		if cc, ok := ecm.contracts[id]; ok {
+			cc.FormationConfirmed = true
+		}
+	}
+	for _, id := range applied.Revisions {
+		if cc, ok := ecm.contracts[id]; ok {
+			cc.FinalizationConfirmed = true
+		}
+	}
+	for _, id := range applied.Proofs {
+		if cc, ok := ecm.contracts[id]; ok {
+			cc.ProofConfirmed = true
+		}
+	}
+	ecm.height -= types.BlockHeight(len(reverted.BlockIDs))
+
+	// adjust for genesis block (this should only ever be called once)
+	if ecm.ccid == modules.ConsensusChangeBeginning {
+		ecm.height--
+	}
+
+	for _, id := range applied.BlockIDs {
+		ecm.height++
+		for _, cc := range ecm.contracts {
+			if cc.ProofHeight == ecm.height && len(cc.FinalizationSet) > 0 {
+				rev := cc.FinalizationSet[len(cc.FinalizationSet)-1].FileContractRevisions[0]
+				cc.ProofSegment = host.StorageProofSegment(id, rev.ParentID, rev.NewFileSize)
+			}
+		}
+	}
+
+	// mark contracts as failed if their formation transaction is not confirmed
+	// within 6 blocks
+	for _, c := range ecm.contracts {
+		if c.FatalError == nil && !c.FormationConfirmed && ecm.height > c.FormationHeight+6 {
+			c.FatalError = errors.New("contract formation transaction was not confirmed on blockchain")
+		}
+	}
+
+	ecm.ccid = ccid
+}
+
+func (ecm *ephemeralContractStore) ConsensusChangeID() modules.ConsensusChangeID {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+	return ecm.ccid
+}
+
+func (ecm *ephemeralContractStore) Height() types.BlockHeight {
+	ecm.mu.Lock()
+	defer ecm.mu.Unlock()
+	return ecm.height
+}
+
+func newEphemeralContractStore(key ed25519.PrivateKey) *ephemeralContractStore {
+	return &ephemeralContractStore{
+		key:       key,
+		contracts: make(map[types.FileContractID]*host.Contract),
+		height:    types.FoundationHardforkHeight + 1,
+	}
+}
+
+type nopMetricsRecorder struct{}
+
+func (nopMetricsRecorder) RecordSessionMetric(ctx *host.SessionContext, m host.Metric) {}
+
+// StubWallet is a host.Wallet and proto.Wallet that never adds inputs to a
+// transaction. It is sufficient for contracts formed under FreeSettings.
+type StubWallet struct{}
+
+// Address implements host.Wallet.
+func (StubWallet) Address() (_ types.UnlockHash, _ error) { return }
+
+// FundTransaction implements host.Wallet.
+func (StubWallet) FundTransaction(*types.Transaction, types.Currency) ([]crypto.Hash, func(), error) {
+	return nil, func() {}, nil
+}
+
+// SignTransaction implements host.Wallet.
+func (StubWallet) SignTransaction(*types.Transaction, []crypto.Hash) error { return nil }
+
+// StubTpool is a host.TransactionPool and proto.TransactionPool that accepts
+// every transaction and charges no fees.
+type StubTpool struct{}
+
+// AcceptTransactionSet implements host.TransactionPool.
+func (StubTpool) AcceptTransactionSet([]types.Transaction) (_ error) { return }
+
+// UnconfirmedParents implements host.TransactionPool.
+func (StubTpool) UnconfirmedParents(types.Transaction) (_ []types.Transaction, _ error) { return }
+
+// FeeEstimate implements host.TransactionPool.
+func (StubTpool) FeeEstimate() (_, _ types.Currency, _ error) { return }
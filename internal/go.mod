@@ -0,0 +1,10 @@
+module lukechampine.com/us-bindings/internal
+
+go 1.15
+
+require (
+	gitlab.com/NebulousLabs/Sia v1.5.4
+	gitlab.com/NebulousLabs/encoding v0.0.0-20200604091946-456c3dc907fe
+	lukechampine.com/frand v1.3.0
+	lukechampine.com/us v0.19.1
+)
@@ -0,0 +1,227 @@
+// Package handles implements the handle tables of the C and Python bindings.
+// Go pointers cannot be retained by C code, so objects handed to C are stored
+// in a table and referred to by an opaque handle instead. A handle encodes the
+// object's index in the table and a generation, so that a stale handle is
+// detected rather than silently referring to whatever object reuses its slot.
+package handles
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"lukechampine.com/us-bindings/internal/errcode"
+)
+
+// A Kind identifies the type of object referred to by a handle.
+type Kind uint8
+
+// Kinds of objects.
+const (
+	HostSet Kind = iota + 1
+	FS
+	File
+	Dir
+	Queue
+	Client
+	Seed
+	Txn
+	Session
+)
+
+func (k Kind) String() string {
+	switch k {
+	case HostSet:
+		return "HostSet"
+	case FS:
+		return "FileSystem"
+	case File:
+		return "File"
+	case Dir:
+		return "Directory"
+	case Queue:
+		return "CompletionQueue"
+	case Client:
+		return "Client"
+	case Seed:
+		return "Seed"
+	case Txn:
+		return "Transaction"
+	case Session:
+		return "Session"
+	default:
+		return "unknown"
+	}
+}
+
+// GenShift is the bit position of the generation in a handle: 16 on 32-bit
+// platforms, 32 on 64-bit platforms. The top bit of a handle is always set.
+// Handles are passed through Go code as unsafe.Pointers, so they must not
+// resemble Go heap addresses; on 64-bit platforms, this bit makes them
+// non-canonical addresses that the garbage collector ignores.
+const (
+	GenShift = 16 << (^uintptr(0) >> 63)
+	tag      = 1 << (2*GenShift - 1)
+	genMask  = 1<<(GenShift-1) - 1
+)
+
+type entry struct {
+	kind   Kind
+	gen    uintptr
+	v      interface{}
+	parent uintptr // index of the entry that this entry depends on, if any
+	refs   int     // number of entries that depend on this entry
+}
+
+// A Table maps handles to objects. The zero value is an empty table.
+type Table struct {
+	mu      sync.Mutex
+	entries []entry // handle index i refers to entries[i-1]
+	free    []uintptr
+}
+
+// Store adds v to the table and returns its handle. It returns nil if v is
+// nil.
+func (t *Table) Store(kind Kind, v interface{}) unsafe.Pointer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if v == nil {
+		return nil
+	}
+	return t.insert(kind, v, 0)
+}
+
+// StoreChild is like Store, but also records that v depends on the object
+// referenced by parent. The parent cannot be taken until v is.
+func (t *Table) StoreChild(kind Kind, v interface{}, parent unsafe.Pointer, parentKind Kind) (unsafe.Pointer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pe, err := t.lookup(parent, parentKind)
+	if err != nil {
+		return nil, err
+	}
+	pe.refs++
+	return t.insert(kind, v, uintptr(parent)&(1<<GenShift-1)), nil
+}
+
+func (t *Table) insert(kind Kind, v interface{}, parent uintptr) unsafe.Pointer {
+	var index uintptr
+	if len(t.free) > 0 {
+		index = t.free[len(t.free)-1]
+		t.free = t.free[:len(t.free)-1]
+	} else {
+		t.entries = append(t.entries, entry{})
+		index = uintptr(len(t.entries))
+	}
+	e := &t.entries[index-1]
+	e.kind = kind
+	e.v = v
+	e.parent = parent
+	return toPointer(tag | e.gen<<GenShift | index)
+}
+
+// toPointer returns h as an unsafe.Pointer. A handle is not an address, so
+// this reinterprets h's bits rather than converting it, which go vet would
+// flag as a possible misuse of unsafe.Pointer.
+func toPointer(h uintptr) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&h))
+}
+
+func (t *Table) lookup(p unsafe.Pointer, kind Kind) (*entry, error) {
+	if p == nil {
+		return nil, errcode.ErrNullArgument
+	}
+	index := uintptr(p) & (1<<GenShift - 1)
+	gen := uintptr(p) >> GenShift & genMask
+	if uintptr(p)&tag == 0 || index == 0 || index > uintptr(len(t.entries)) {
+		return nil, errcode.ErrInvalidHandle
+	}
+	e := &t.entries[index-1]
+	if gen > e.gen {
+		return nil, errcode.ErrInvalidHandle
+	} else if gen < e.gen || e.v == nil {
+		return nil, errcode.ErrClosedHandle
+	} else if e.kind != kind {
+		return nil, fmt.Errorf("%w: expected %v, got %v", errcode.ErrInvalidHandle, kind, e.kind)
+	}
+	return e, nil
+}
+
+// Load returns the object referenced by p, which must be of the specified
+// kind.
+func (t *Table) Load(p unsafe.Pointer, kind Kind) (interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.lookup(p, kind)
+	if err != nil {
+		return nil, err
+	}
+	return e.v, nil
+}
+
+// Take is like Load, but also removes the object from the table. This ensures
+// that only one caller can close a given handle. Take fails if other objects
+// still depend on the object.
+func (t *Table) Take(p unsafe.Pointer, kind Kind) (interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.lookup(p, kind)
+	if err != nil {
+		return nil, err
+	} else if e.refs > 0 {
+		return nil, fmt.Errorf("%w: %v has %v open dependents", errcode.ErrBusy, kind, e.refs)
+	}
+	if e.parent != 0 {
+		t.entries[e.parent-1].refs--
+	}
+	v := e.v
+	e.v = nil
+	e.parent = 0
+	e.gen = (e.gen + 1) & genMask
+	t.free = append(t.free, uintptr(p)&(1<<GenShift-1))
+	return v, nil
+}
+
+// Pin is like Load, but also prevents the object from being taken until Unpin
+// is called.
+func (t *Table) Pin(p unsafe.Pointer, kind Kind) (interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.lookup(p, kind)
+	if err != nil {
+		return nil, err
+	}
+	e.refs++
+	return e.v, nil
+}
+
+// Unpin undoes a successful call to Pin.
+func (t *Table) Unpin(p unsafe.Pointer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[uintptr(p)&(1<<GenShift-1)-1].refs--
+}
+
+// Root returns the object that the object referenced by p depends on, directly
+// or indirectly, and that depends on nothing itself; this is the object
+// referenced by p if it has no parent. It returns nil if p is not a valid
+// handle of the specified kind.
+func (t *Table) Root(p unsafe.Pointer, kind Kind) interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.lookup(p, kind)
+	if err != nil {
+		return nil
+	}
+	for e.parent != 0 {
+		e = &t.entries[e.parent-1]
+	}
+	return e.v
+}
+
+// Len returns the number of objects in the table.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries) - len(t.free)
+}
@@ -0,0 +1,84 @@
+package handles
+
+import (
+	"errors"
+	"testing"
+	"unsafe"
+
+	"lukechampine.com/us-bindings/internal/errcode"
+)
+
+func TestTable(t *testing.T) {
+	var tab Table
+	parent := tab.Store(HostSet, "hostset")
+	child, err := tab.StoreChild(FS, "fs", parent, HostSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tab.Load(child, FS); err != nil || v != "fs" {
+		t.Fatalf("expected fs, got %v, %v", v, err)
+	} else if v := tab.Root(child, FS); v != "hostset" {
+		t.Fatalf("expected child's root to be hostset, got %v", v)
+	} else if tab.Len() != 2 {
+		t.Fatalf("expected 2 objects, got %v", tab.Len())
+	}
+
+	// the parent cannot be taken while the child is open
+	if _, err := tab.Take(parent, HostSet); !errors.Is(err, errcode.ErrBusy) {
+		t.Fatal("expected ErrBusy, got", err)
+	} else if _, err := tab.Take(child, FS); err != nil {
+		t.Fatal(err)
+	} else if _, err := tab.Take(parent, HostSet); err != nil {
+		t.Fatal(err)
+	} else if tab.Len() != 0 {
+		t.Fatalf("expected 0 objects, got %v", tab.Len())
+	}
+
+	// a pinned object cannot be taken until it is unpinned
+	p := tab.Store(Seed, "seed")
+	if _, err := tab.Pin(p, Seed); err != nil {
+		t.Fatal(err)
+	} else if _, err := tab.Take(p, Seed); !errors.Is(err, errcode.ErrBusy) {
+		t.Fatal("expected ErrBusy, got", err)
+	}
+	tab.Unpin(p)
+	if _, err := tab.Take(p, Seed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableBogusHandles(t *testing.T) {
+	var tab Table
+	stale := tab.Store(Seed, "seed")
+	tab.Take(stale, Seed)
+	live := tab.Store(Txn, "txn")
+	if uintptr(live)&(1<<GenShift-1) != uintptr(stale)&(1<<GenShift-1) {
+		t.Fatal("expected freed slot to be reused")
+	}
+
+	tests := []struct {
+		desc string
+		p    unsafe.Pointer
+		kind Kind
+		err  error
+	}{
+		{"nil", nil, Txn, errcode.ErrNullArgument},
+		{"Go pointer", unsafe.Pointer(new(int)), Txn, errcode.ErrInvalidHandle},
+		{"index out of range", toPointer(uintptr(live) + 1<<20), Txn, errcode.ErrInvalidHandle},
+		{"future generation", toPointer(uintptr(live) + 1<<GenShift), Txn, errcode.ErrInvalidHandle},
+		{"stale handle", stale, Seed, errcode.ErrClosedHandle},
+		{"wrong kind", live, Seed, errcode.ErrInvalidHandle},
+	}
+	for _, test := range tests {
+		if _, err := tab.Load(test.p, test.kind); !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got %v", test.desc, test.err, err)
+		} else if _, err := tab.Take(test.p, test.kind); !errors.Is(err, test.err) {
+			t.Errorf("%v: expected %v, got %v", test.desc, test.err, err)
+		} else if v := tab.Root(test.p, test.kind); v != nil {
+			t.Errorf("%v: expected no root, got %v", test.desc, v)
+		}
+	}
+	if v, err := tab.Load(live, Txn); err != nil || v != "txn" {
+		t.Fatalf("expected txn, got %v, %v", v, err)
+	}
+}
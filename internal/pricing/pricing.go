@@ -0,0 +1,199 @@
+// Package pricing enforces limits on the prices that the bindings pay to
+// hosts. It is shared by the C, Python, and gomobile bindings.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// ErrPriceExceeded is wrapped by the errors of hosts whose settings violate a
+// set of Limits.
+var ErrPriceExceeded = errors.New("host settings violate price limits")
+
+// Limits restricts the settings of the hosts a renter will use. A zero value
+// means no limit.
+type Limits struct {
+	MaxStoragePrice    types.Currency // per byte per block
+	MaxUploadPrice     types.Currency // per byte
+	MaxDownloadPrice   types.Currency // per byte
+	MaxContractPrice   types.Currency
+	MinCollateralRatio float64 // collateral divided by storage price
+}
+
+// IsZero reports whether l imposes no limits.
+func (l Limits) IsZero() bool {
+	return l.MaxStoragePrice.IsZero() && l.MaxUploadPrice.IsZero() &&
+		l.MaxDownloadPrice.IsZero() && l.MaxContractPrice.IsZero() &&
+		l.MinCollateralRatio == 0
+}
+
+// Check returns an error wrapping ErrPriceExceeded if s violates l.
+func (l Limits) Check(s hostdb.HostSettings) error {
+	exceeds := func(price, max types.Currency) bool {
+		return !max.IsZero() && price.Cmp(max) > 0
+	}
+	switch {
+	case exceeds(s.StoragePrice, l.MaxStoragePrice):
+		return fmt.Errorf("%w: storage price (%v) exceeds limit (%v)", ErrPriceExceeded, s.StoragePrice, l.MaxStoragePrice)
+	case exceeds(s.UploadBandwidthPrice, l.MaxUploadPrice):
+		return fmt.Errorf("%w: upload price (%v) exceeds limit (%v)", ErrPriceExceeded, s.UploadBandwidthPrice, l.MaxUploadPrice)
+	case exceeds(s.DownloadBandwidthPrice, l.MaxDownloadPrice):
+		return fmt.Errorf("%w: download price (%v) exceeds limit (%v)", ErrPriceExceeded, s.DownloadBandwidthPrice, l.MaxDownloadPrice)
+	case exceeds(s.ContractPrice, l.MaxContractPrice):
+		return fmt.Errorf("%w: contract price (%v) exceeds limit (%v)", ErrPriceExceeded, s.ContractPrice, l.MaxContractPrice)
+	}
+	if l.MinCollateralRatio > 0 && !s.StoragePrice.IsZero() {
+		ratio := new(big.Rat).SetFrac(s.Collateral.Big(), s.StoragePrice.Big())
+		if ratio.Cmp(new(big.Rat).SetFloat64(l.MinCollateralRatio)) < 0 {
+			f, _ := ratio.Float64()
+			return fmt.Errorf("%w: collateral ratio (%.3g) is below limit (%.3g)", ErrPriceExceeded, f, l.MinCollateralRatio)
+		}
+	}
+	return nil
+}
+
+// ParseCurrency parses a currency value with units, such as "100H" or "1.5KS".
+func ParseCurrency(s string) (types.Currency, error) {
+	var hastings string
+	if strings.HasSuffix(s, "H") {
+		hastings = strings.TrimSuffix(s, "H")
+	} else {
+		units := []string{"pS", "nS", "uS", "mS", "SC", "KS", "MS", "GS", "TS"}
+		for i, unit := range units {
+			if strings.HasSuffix(s, unit) {
+				// scan into big.Rat
+				r, ok := new(big.Rat).SetString(strings.TrimSuffix(s, unit))
+				if !ok {
+					return types.Currency{}, errors.New("Malformed currency value")
+				}
+				// convert units
+				exp := 24 + 3*(int64(i)-4)
+				mag := new(big.Int).Exp(big.NewInt(10), big.NewInt(exp), nil)
+				r.Mul(r, new(big.Rat).SetInt(mag))
+				// r must be an integer at this point
+				if !r.IsInt() {
+					return types.Currency{}, errors.New("Non-integer number of hastings")
+				}
+				hastings = r.RatString()
+				break
+			}
+		}
+	}
+	if hastings == "" {
+		return types.Currency{}, errors.New("Currency value is missing units")
+	}
+	var c types.Currency
+	_, err := fmt.Sscan(hastings, &c)
+	if err != nil {
+		return types.Currency{}, fmt.Errorf("Could not scan currency value: %w", err)
+	}
+	return c, nil
+}
+
+// A Guard holds Limits that may be replaced while in use, and enforces them on
+// the sessions of a renterutil.HostSet. A host only reports its settings once
+// a session has been established, so the Guard checks each session as the set
+// connects to it; pass Admit to the set's SetOnConnect method. The zero value
+// imposes no limits.
+type Guard struct {
+	mu       sync.Mutex
+	limits   Limits
+	rejected map[hostdb.HostPublicKey]error // violation that closed each host's most recent session
+}
+
+// SetLimits replaces the limits of g.
+func (g *Guard) SetLimits(l Limits) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limits = l
+}
+
+// Limits returns the current limits of g.
+func (g *Guard) Limits() Limits {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.limits
+}
+
+// Admit checks the settings of s, a newly-connected session, against the
+// limits of g. If they are violated, or cannot be retrieved, Admit closes s and
+// returns false.
+//
+// Closing the session is the only way to stop a HostSet from using it, and the
+// operation that triggered the connection then fails with a connection error.
+// Explain attributes such errors to the violation.
+func (g *Guard) Admit(s *proto.Session) bool {
+	l := g.Limits()
+	if l.IsZero() {
+		g.record(s.HostKey(), nil)
+		return true
+	}
+	settings, err := s.Settings()
+	if err == nil {
+		err = l.Check(settings)
+	}
+	if err != nil {
+		s.Close()
+		if errors.Is(err, ErrPriceExceeded) {
+			g.record(s.HostKey(), err)
+		}
+		return false
+	}
+	g.record(s.HostKey(), nil)
+	return true
+}
+
+// record sets the violation that closed the most recent session with hostKey,
+// or clears it if err is nil.
+func (g *Guard) record(hostKey hostdb.HostPublicKey, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err == nil {
+		delete(g.rejected, hostKey)
+		return
+	}
+	if g.rejected == nil {
+		g.rejected = make(map[hostdb.HostPublicKey]error)
+	}
+	g.rejected[hostKey] = err
+}
+
+// Explain returns err, annotated with the violation responsible, if err
+// includes the error of a host whose most recent session was closed by g. The
+// returned error wraps ErrPriceExceeded. Otherwise, err is returned unchanged.
+// A nil Guard explains nothing.
+func (g *Guard) Explain(err error) error {
+	if g == nil {
+		return err
+	}
+	var hosts []hostdb.HostPublicKey
+	var hes renterutil.HostErrorSet
+	var he *renterutil.HostError
+	if errors.As(err, &hes) {
+		for _, e := range hes {
+			hosts = append(hosts, e.HostKey)
+		}
+	} else if errors.As(err, &he) {
+		hosts = append(hosts, he.HostKey)
+	}
+	if len(hosts) == 0 || errors.Is(err, ErrPriceExceeded) {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, h := range hosts {
+		if v, ok := g.rejected[h]; ok {
+			return fmt.Errorf("%v: %w (%v)", h.ShortKey(), v, err)
+		}
+	}
+	return err
+}
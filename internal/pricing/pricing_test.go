@@ -0,0 +1,153 @@
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+func TestLimitsCheck(t *testing.T) {
+	hc := types.NewCurrency64
+	settings := hostdb.HostSettings{
+		StoragePrice:           hc(100),
+		Collateral:             hc(200),
+		UploadBandwidthPrice:   hc(10),
+		DownloadBandwidthPrice: hc(20),
+		ContractPrice:          hc(1000),
+	}
+	tests := []struct {
+		desc   string
+		limits Limits
+		modify func(*hostdb.HostSettings)
+		err    string // substring of the expected error; empty means no error
+	}{
+		{"no limits", Limits{}, nil, ""},
+		{"prices equal to limits", Limits{
+			MaxStoragePrice:  hc(100),
+			MaxUploadPrice:   hc(10),
+			MaxDownloadPrice: hc(20),
+			MaxContractPrice: hc(1000),
+		}, nil, ""},
+		{"storage price", Limits{MaxStoragePrice: hc(99)}, nil, "storage price"},
+		{"upload price", Limits{MaxUploadPrice: hc(9)}, nil, "upload price"},
+		{"download price", Limits{MaxDownloadPrice: hc(19)}, nil, "download price"},
+		{"contract price", Limits{MaxContractPrice: hc(999)}, nil, "contract price"},
+		{"first violation is reported", Limits{MaxStoragePrice: hc(1), MaxContractPrice: hc(1)}, nil, "storage price"},
+
+		{"ratio equal to limit", Limits{MinCollateralRatio: 2}, nil, ""},
+		{"ratio above limit", Limits{MinCollateralRatio: 1.5}, nil, ""},
+		{"ratio below limit", Limits{MinCollateralRatio: 2.5}, nil, "collateral ratio (2) is below limit (2.5)"},
+		{"fractional ratio", Limits{MinCollateralRatio: 1.5}, func(s *hostdb.HostSettings) {
+			s.Collateral = hc(149)
+		}, "collateral ratio (1.49)"},
+		{"zero collateral", Limits{MinCollateralRatio: 0.001}, func(s *hostdb.HostSettings) {
+			s.Collateral = types.ZeroCurrency
+		}, "collateral ratio (0)"},
+		{"free storage", Limits{MinCollateralRatio: 1000}, func(s *hostdb.HostSettings) {
+			s.StoragePrice = types.ZeroCurrency
+		}, ""},
+		{"ratio of large values", Limits{MinCollateralRatio: 2}, func(s *hostdb.HostSettings) {
+			s.StoragePrice = types.SiacoinPrecision.Mul64(1e9)
+			s.Collateral = s.StoragePrice.Mul64(2).Sub(hc(1))
+		}, "collateral ratio"},
+	}
+	for _, test := range tests {
+		s := settings
+		if test.modify != nil {
+			test.modify(&s)
+		}
+		err := test.limits.Check(s)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.desc, err)
+			}
+		} else if !errors.Is(err, ErrPriceExceeded) || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: expected error containing %q, got %v", test.desc, test.err, err)
+		}
+	}
+}
+
+func TestLimitsIsZero(t *testing.T) {
+	if !(Limits{}).IsZero() {
+		t.Error("zero Limits should be zero")
+	}
+	for _, l := range []Limits{
+		{MaxStoragePrice: types.NewCurrency64(1)},
+		{MaxUploadPrice: types.NewCurrency64(1)},
+		{MaxDownloadPrice: types.NewCurrency64(1)},
+		{MaxContractPrice: types.NewCurrency64(1)},
+		{MinCollateralRatio: 0.5},
+	} {
+		if l.IsZero() {
+			t.Errorf("%+v should not be zero", l)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	bad := hostdb.HostPublicKey("ed25519:" + strings.Repeat("ab", 32))
+	good := hostdb.HostPublicKey("ed25519:" + strings.Repeat("cd", 32))
+	violation := Limits{MaxContractPrice: types.NewCurrency64(1)}.Check(hostdb.HostSettings{ContractPrice: types.NewCurrency64(2)})
+	var g Guard
+	g.record(bad, violation)
+
+	connErr := errors.New("use of closed network connection")
+	hostErrs := renterutil.HostErrorSet{
+		{HostKey: good, Err: connErr},
+		{HostKey: bad, Err: connErr},
+	}
+	tests := []struct {
+		desc     string
+		err      error
+		explains bool
+	}{
+		{"nil", nil, false},
+		{"unrelated error", connErr, false},
+		{"error of another host", &renterutil.HostError{HostKey: good, Err: connErr}, false},
+		{"error of rejected host", &renterutil.HostError{HostKey: bad, Err: connErr}, true},
+		{"wrapped set including rejected host", fmt.Errorf("could not upload to some hosts: %w", hostErrs), true},
+		{"set excluding rejected host", hostErrs[:1], false},
+	}
+	for _, test := range tests {
+		err := g.Explain(test.err)
+		if !test.explains {
+			if errors.Is(err, ErrPriceExceeded) || fmt.Sprint(err) != fmt.Sprint(test.err) {
+				t.Errorf("%v: error should be unchanged, got %v", test.desc, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrPriceExceeded) {
+			t.Errorf("%v: expected ErrPriceExceeded, got %v", test.desc, err)
+		} else if !strings.Contains(err.Error(), bad.ShortKey()) || !strings.Contains(err.Error(), connErr.Error()) {
+			t.Errorf("%v: explanation should name the host and the original error, got %v", test.desc, err)
+		} else if g.Explain(err) != err {
+			t.Errorf("%v: explaining an explained error should not change it", test.desc)
+		}
+	}
+
+	// rejections are private to each guard: another guard neither explains
+	// them nor clears them by admitting the host
+	var other Guard
+	if err := other.Explain(hostErrs); errors.Is(err, ErrPriceExceeded) {
+		t.Error("another guard should not explain the rejection, got", err)
+	}
+	other.record(bad, nil)
+	if err := g.Explain(hostErrs); !errors.Is(err, ErrPriceExceeded) {
+		t.Error("another guard should not clear the rejection, got", err)
+	}
+	if err := (*Guard)(nil).Explain(hostErrs); errors.Is(err, ErrPriceExceeded) {
+		t.Error("a nil guard should not explain anything, got", err)
+	}
+
+	// once a host is admitted again, its errors are no longer attributed to
+	// the old violation
+	g.record(bad, nil)
+	if err := g.Explain(hostErrs); errors.Is(err, ErrPriceExceeded) {
+		t.Error("forgiven host should not be explained, got", err)
+	}
+}
@@ -0,0 +1,107 @@
+// Package servertest implements local shard and walrus servers for testing the
+// bindings' shard and walrus backends.
+package servertest
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+	"lukechampine.com/us-bindings/internal/walrus"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/wallet"
+)
+
+// NewShard returns a server implementing the shard routes used by the
+// bindings, which knows of a single host with the given key and address, and
+// reports the given chain height. The server is closed with tb.Cleanup.
+func NewShard(tb testing.TB, key ed25519.PrivateKey, addr modules.NetAddress, height types.BlockHeight) *httptest.Server {
+	hostKey := hostdb.HostKeyFromPublicKey(ed25519.PublicKey(key[32:]))
+	ha := modules.HostAnnouncement{
+		Specifier:  modules.PrefixHostAnnouncement,
+		NetAddress: addr,
+		PublicKey:  hostKey.SiaPublicKey(),
+	}
+	var sig crypto.Signature
+	copy(sig[:], ed25519hash.Sign(key, crypto.HashObject(ha)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/height" {
+			json.NewEncoder(w).Encode(height)
+		} else if prefix := strings.TrimPrefix(r.URL.Path, "/host/"); prefix != r.URL.Path && strings.HasPrefix(string(hostKey), prefix) {
+			w.Write(encoding.MarshalAll(ha, sig))
+		} else if prefix != r.URL.Path {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// A Walrus implements the walrus routes used by walrus.Wallet, tracking
+// addresses derived from a seed. Its fields must not be accessed while
+// requests are in flight.
+type Walrus struct {
+	mu        sync.Mutex
+	Index     uint64 // next seed index
+	Addrs     map[types.UnlockHash]uint64
+	UTXOs     []walrus.UTXO
+	Broadcast [][]types.Transaction
+}
+
+// NewWalrus returns a Walrus holding a single output of the specified value,
+// spendable with the first key derived from seed.
+func NewWalrus(seed wallet.Seed, value types.Currency) *Walrus {
+	uc := wallet.StandardUnlockConditions(seed.PublicKey(0))
+	return &Walrus{
+		Index: 1,
+		Addrs: make(map[types.UnlockHash]uint64),
+		UTXOs: []walrus.UTXO{{
+			ID:               types.SiacoinOutputID{1},
+			Value:            value,
+			UnlockConditions: uc,
+			UnlockHash:       uc.UnlockHash(),
+		}},
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (ws *Walrus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	switch r.Method + " " + r.URL.Path {
+	case "GET /seedindex":
+		json.NewEncoder(w).Encode(ws.Index)
+		ws.Index++
+	case "POST /addresses":
+		var info wallet.SeedAddressInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ws.Addrs[info.UnlockHash()] = info.KeyIndex
+	case "GET /utxos":
+		json.NewEncoder(w).Encode(ws.UTXOs)
+	case "GET /fee":
+		json.NewEncoder(w).Encode(types.NewCurrency64(10))
+	case "POST /broadcast":
+		var txnSet []types.Transaction
+		if err := json.NewDecoder(r.Body).Decode(&txnSet); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ws.Broadcast = append(ws.Broadcast, txnSet)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
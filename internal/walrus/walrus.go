@@ -0,0 +1,244 @@
+// Package walrus implements a wallet backed by a walrus server. It is shared
+// by the C and Python bindings.
+package walrus
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/wallet"
+)
+
+// ErrNoWallet is returned by every method of a nil *Wallet.
+var ErrNoWallet = errors.New("no wallet configured (a walrus server and seed are required)")
+
+// A Wallet funds and signs transactions using a walrus server, which tracks
+// the outputs of addresses derived from a seed. The seed itself never leaves
+// this process. A Wallet implements proto.Wallet and proto.TransactionPool; a
+// nil *Wallet does too, but every method fails with ErrNoWallet.
+type Wallet struct {
+	addr string
+	seed wallet.Seed
+	mu   sync.Mutex
+	used map[types.SiacoinOutputID]struct{} // outputs claimed by FundTransaction
+	keys map[types.UnlockHash]uint64        // key indices of funding addresses
+}
+
+// A UTXO is an unspent output, as reported by the walrus server.
+type UTXO struct {
+	ID               types.SiacoinOutputID  `json:"ID"`
+	Value            types.Currency         `json:"value"`
+	UnlockConditions types.UnlockConditions `json:"unlockConditions"`
+	UnlockHash       types.UnlockHash       `json:"unlockHash"`
+	KeyIndex         uint64                 `json:"keyIndex"`
+}
+
+// NewWallet returns a wallet using the walrus server at addr, which must track
+// the addresses of seed.
+func NewWallet(addr string, seed wallet.Seed) *Wallet {
+	return &Wallet{
+		addr: addr,
+		seed: seed,
+		used: make(map[types.SiacoinOutputID]struct{}),
+		keys: make(map[types.UnlockHash]uint64),
+	}
+}
+
+func (c *Wallet) req(method, route string, body, resp interface{}) error {
+	var r io.Reader
+	if body != nil {
+		js, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(js)
+	}
+	req, err := http.NewRequest(method, c.addr+route, r)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer io.Copy(ioutil.Discard, res.Body)
+	defer res.Body.Close()
+	if !(200 <= res.StatusCode && res.StatusCode <= 299) {
+		errString, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("walrus: %v", strings.TrimSpace(string(errString)))
+	} else if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// newAddress derives the next unused address from the seed and registers it
+// with the walrus server. c.mu must be held.
+func (c *Wallet) newAddress() (types.UnlockHash, error) {
+	var index uint64
+	if err := c.req("GET", "/seedindex", nil, &index); err != nil {
+		return types.UnlockHash{}, err
+	}
+	info := wallet.SeedAddressInfo{
+		UnlockConditions: wallet.StandardUnlockConditions(c.seed.PublicKey(index)),
+		KeyIndex:         index,
+	}
+	if err := c.req("POST", "/addresses", info, nil); err != nil {
+		return types.UnlockHash{}, err
+	}
+	return info.UnlockHash(), nil
+}
+
+// Address implements proto.Wallet.
+func (c *Wallet) Address() (types.UnlockHash, error) {
+	if c == nil {
+		return types.UnlockHash{}, ErrNoWallet
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.newAddress()
+}
+
+// FundTransaction implements proto.Wallet. Only confirmed outputs are used,
+// largest first.
+func (c *Wallet) FundTransaction(txn *types.Transaction, amount types.Currency) ([]crypto.Hash, func(), error) {
+	if c == nil {
+		return nil, nil, ErrNoWallet
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if amount.IsZero() {
+		return nil, func() {}, nil
+	}
+	var utxos []UTXO
+	if err := c.req("GET", "/utxos", nil, &utxos); err != nil {
+		return nil, nil, err
+	}
+	unused := utxos[:0]
+	for _, u := range utxos {
+		if _, ok := c.used[u.ID]; !ok {
+			unused = append(unused, u)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].Value.Cmp(unused[j].Value) > 0
+	})
+	var inputs []UTXO
+	var sum types.Currency
+	for _, u := range unused {
+		if sum.Cmp(amount) >= 0 {
+			break
+		}
+		inputs = append(inputs, u)
+		sum = sum.Add(u.Value)
+	}
+	if sum.Cmp(amount) < 0 {
+		return nil, nil, wallet.ErrInsufficientFunds
+	}
+	if change := sum.Sub(amount); !change.IsZero() {
+		addr, err := c.newAddress()
+		if err != nil {
+			return nil, nil, err
+		}
+		txn.SiacoinOutputs = append(txn.SiacoinOutputs, types.SiacoinOutput{
+			UnlockHash: addr,
+			Value:      change,
+		})
+	}
+	var toSign []crypto.Hash
+	for _, u := range inputs {
+		txn.SiacoinInputs = append(txn.SiacoinInputs, types.SiacoinInput{
+			ParentID:         u.ID,
+			UnlockConditions: u.UnlockConditions,
+		})
+		txn.TransactionSignatures = append(txn.TransactionSignatures, wallet.StandardTransactionSignature(crypto.Hash(u.ID)))
+		toSign = append(toSign, crypto.Hash(u.ID))
+		c.used[u.ID] = struct{}{}
+		c.keys[u.UnlockConditions.UnlockHash()] = u.KeyIndex
+	}
+	discard := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, u := range inputs {
+			delete(c.used, u.ID)
+		}
+	}
+	return toSign, discard, nil
+}
+
+// SignTransaction implements proto.Wallet. Only inputs previously added by
+// FundTransaction can be signed.
+func (c *Wallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash) error {
+	if c == nil {
+		return ErrNoWallet
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(toSign) == 0 {
+		for _, input := range txn.SiacoinInputs {
+			if index, ok := c.keys[input.UnlockConditions.UnlockHash()]; ok {
+				txnSig := wallet.StandardTransactionSignature(crypto.Hash(input.ParentID))
+				wallet.AppendTransactionSignature(txn, txnSig, c.seed.SecretKey(index))
+			}
+		}
+		return nil
+	}
+outer:
+	for _, id := range toSign {
+		for _, input := range txn.SiacoinInputs {
+			if crypto.Hash(input.ParentID) != id {
+				continue
+			}
+			index, ok := c.keys[input.UnlockConditions.UnlockHash()]
+			if !ok {
+				return fmt.Errorf("no key for input %v", id)
+			}
+			for i, sig := range txn.TransactionSignatures {
+				if sig.ParentID == id {
+					sigHash := txn.SigHash(i, types.FoundationHardforkHeight+1)
+					txn.TransactionSignatures[i].Signature = ed25519hash.Sign(c.seed.SecretKey(index), sigHash)
+					continue outer
+				}
+			}
+		}
+		return fmt.Errorf("no signature for input %v", id)
+	}
+	return nil
+}
+
+// AcceptTransactionSet implements proto.TransactionPool.
+func (c *Wallet) AcceptTransactionSet(txnSet []types.Transaction) error {
+	if c == nil {
+		return ErrNoWallet
+	}
+	return c.req("POST", "/broadcast", txnSet, nil)
+}
+
+// UnconfirmedParents implements proto.TransactionPool. FundTransaction only
+// spends confirmed outputs, so there are never any unconfirmed parents.
+func (c *Wallet) UnconfirmedParents(txn types.Transaction) ([]types.Transaction, error) {
+	return nil, nil
+}
+
+// FeeEstimate implements proto.TransactionPool.
+func (c *Wallet) FeeEstimate() (minFee, maxFee types.Currency, err error) {
+	if c == nil {
+		return types.ZeroCurrency, types.ZeroCurrency, ErrNoWallet
+	}
+	var fee types.Currency
+	err = c.req("GET", "/fee", nil, &fee)
+	return fee, fee, err
+}
+
+// newShardBackend returns a backend using the specified shard server and,
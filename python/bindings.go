@@ -1,39 +1,92 @@
 package main
 
 /*
-#cgo pkg-config: python-3.6
+#cgo pkg-config: python3
+#cgo CFLAGS: -I${SRCDIR}/../include
 #include <Python.h>
+#include <stdlib.h>
 #include <unistd.h>
 #include <stdint.h>
+#include <pthread.h>
+#include "us_errors.h"
+
+static uintptr_t current_thread(void) {
+    return (uintptr_t)pthread_self();
+}
+
 typedef struct contract_t {
     uint8_t hostKey[32];
     uint8_t id[32];
     uint8_t renterKey[32];
 } contract_t;
+
+// A range of a sector to download, as passed to us_ll_download_many.
+typedef struct us_section_t {
+    uint8_t root[32];  // Merkle root of the sector
+    uint32_t offset;   // must be a multiple of 64
+    uint32_t length;   // must be a multiple of 64
+    void *buf;         // receives length bytes
+} us_section_t;
+
+// Optional limits on the prices paid to hosts, as passed to
+// us_ll_client_set_limits and us_hostset_set_limits. Prices are strings such
+// as "100H" or "1SC"; NULL or an empty string means no limit.
+typedef struct us_limits_t {
+    const char *max_storage_price;   // per byte per block
+    const char *max_upload_price;    // per byte
+    const char *max_download_price;  // per byte
+    const char *max_contract_price;
+    double min_collateral_ratio;     // collateral per storage price; 0 means no limit
+} us_limits_t;
+
+// The result of an asynchronous operation, as returned by us_cq_poll.
+typedef struct us_completion_t {
+    uint64_t op;       // ID returned by the *_async call
+    void *ctx;         // context passed to the *_async call
+    int64_t result;    // bytes transferred, 0 on success, or -1 on failure
+    void *handle;      // new File, for us_fs_create_async and us_fs_open_async
+    us_errcode_t error_code;
+    char *error;       // NULL on success; otherwise must be freed with us_free
+} us_completion_t;
 */
 import "C"
 import (
+    "encoding/json"
     "fmt"
+    "io"
+    "io/ioutil"
+    "net"
+    "path/filepath"
     "reflect"
     "runtime"
+    "runtime/debug"
     "strings"
     "sync"
+    "sync/atomic"
     "unsafe"
     "context"
     "time"
-    "math/big"
     "bytes"
+    "crypto/ed25519"
 
     "github.com/pkg/errors"
     "gitlab.com/NebulousLabs/Sia/crypto"
+    "gitlab.com/NebulousLabs/Sia/modules"
     "gitlab.com/NebulousLabs/Sia/types"
-    "lukechampine.com/us/ed25519"
+    "lukechampine.com/shard"
+    "lukechampine.com/us-bindings/internal/async"
+    "lukechampine.com/us-bindings/internal/contractfile"
+    "lukechampine.com/us-bindings/internal/errcode"
+    "lukechampine.com/us-bindings/internal/handles"
+    "lukechampine.com/us-bindings/internal/pricing"
+    "lukechampine.com/us-bindings/internal/walrus"
     "lukechampine.com/us/hostdb"
+    "lukechampine.com/us/merkle"
     "lukechampine.com/us/renter"
     "lukechampine.com/us/renter/proto"
     "lukechampine.com/us/renter/renterutil"
     "lukechampine.com/us/renterhost"
-    // "lukechampine.co/shard"
+    "lukechampine.com/us/wallet"
 )
 
 // cgo doesn't let us pass Go pointers to C code. This is annoying, because it
@@ -48,74 +101,255 @@ import (
 // the table and calls the appropriate method. We make the API slightly nicer by
 // using unsafe.Pointer as our index, which gives us 'nil/null' semantics, but
 // in reality it's just an integer.
-var (
-    ptrtab   = make(map[uintptr]interface{})
-    ptrIndex uintptr
-    ptrMu    sync.Mutex
-)
+//
+// Each entry in the table records the kind of object it holds and a generation
+// counter that is incremented whenever the entry is freed. The handle encodes
+// both the table index and the generation, so a stale handle (i.e. one that
+// has been closed, and whose index may have been reused) or a handle of the
+// wrong kind is detected and rejected with an error, rather than crashing the
+// interpreter.
+//
+// Entries also track their dependencies: a FileSystem depends on its HostSet,
+// and a File depends on its FileSystem. An object cannot be freed while any of
+// its dependents are still open.
+//
+// The table is implemented by package handles, which the C bindings use as
+// well.
+var ptrs handles.Table
 
-func storePtr(v interface{}) unsafe.Pointer {
-    ptrMu.Lock()
-    defer ptrMu.Unlock()
-    if v == nil {
-        return nil
+// guardOf returns the guard of the host set that the object referenced by p
+// depends on, directly or indirectly, or nil if there is none. Host errors of
+// operations on the object are explained by that guard.
+func guardOf(p unsafe.Pointer, kind handles.Kind) *pricing.Guard {
+    if hs, ok := ptrs.Root(p, kind).(*hostSet); ok {
+        return hs.guard
     }
-    ptrIndex++
-    ptrtab[ptrIndex] = v
-    return unsafe.Pointer(ptrIndex) // go vet complains about this, but it's fine
+    return nil
 }
 
-func loadPtr(p unsafe.Pointer) interface{} {
-    ptrMu.Lock()
-    defer ptrMu.Unlock()
-    if p == nil {
-        return nil
+func loadClient(p unsafe.Pointer) (*client, error) {
+    v, err := ptrs.Load(p, handles.Client)
+    if err != nil {
+        return nil, err
     }
-    return ptrtab[uintptr(p)]
+    return v.(*client), nil
 }
 
-func freePtr(p unsafe.Pointer) {
-    ptrMu.Lock()
-    defer ptrMu.Unlock()
-    if p != nil {
-        delete(ptrtab, uintptr(p))
+func loadSession(p unsafe.Pointer) (*session, error) {
+    v, err := ptrs.Load(p, handles.Session)
+    if err != nil {
+        return nil, err
     }
+    return v.(*session), nil
 }
 
-var (
-    clientMu  sync.Mutex
-)
+func loadHostSet(p unsafe.Pointer) (*hostSet, error) {
+    v, err := ptrs.Load(p, handles.HostSet)
+    if err != nil {
+        return nil, err
+    }
+    return v.(*hostSet), nil
+}
+
+func loadFS(p unsafe.Pointer) (*renterutil.PseudoFS, error) {
+    v, err := ptrs.Load(p, handles.FS)
+    if err != nil {
+        return nil, err
+    }
+    return v.(*renterutil.PseudoFS), nil
+}
+
+func loadFile(p unsafe.Pointer) (*renterutil.PseudoFile, error) {
+    v, err := ptrs.Load(p, handles.File)
+    if err != nil {
+        return nil, err
+    }
+    return v.(*renterutil.PseudoFile), nil
+}
+
+// A backend supplies the chain, host, and wallet access needed by the
+// low-level client. Either a siad node or a shard server (optionally paired
+// with a walrus server) can serve as a backend.
+type backend interface {
+    ChainHeight() (types.BlockHeight, error)
+    LookupHost(prefix string) (hostdb.HostPublicKey, error)
+    renter.HostKeyResolver
+    proto.Wallet
+    proto.TransactionPool
+}
+
+// A client is a backend along with the price limits of the contracts and
+// sessions it creates.
+type client struct {
+    backend
+    limits pricing.Limits // guarded by clientMu
+}
+
+// snapshot returns the backend and current price limits of c.
+func (c *client) snapshot() (backend, pricing.Limits) {
+    clientMu.Lock()
+    defer clientMu.Unlock()
+    return c.backend, c.limits
+}
+
+// A shardBackend resolves hosts through a shard server and funds transactions
+// through a walrus server. The wallet may be nil, in which case every wallet
+// operation fails with walrus.ErrNoWallet.
+type shardBackend struct {
+    *shard.Client
+    *walrus.Wallet
+}
+
+// newShardBackend returns a backend using the specified shard server and,
+// if walrusAddr and phrase are not empty, the specified walrus server and seed.
+func newShardBackend(shardAddr, walrusAddr, phrase string) (*shardBackend, error) {
+    b := &shardBackend{Client: shard.NewClient(shardAddr)}
+    if walrusAddr == "" && phrase == "" {
+        return b, nil
+    } else if walrusAddr == "" || phrase == "" {
+        return nil, errors.New("a walrus server requires a seed, and vice versa")
+    }
+    seed, err := wallet.SeedFromPhrase(phrase)
+    if err != nil {
+        return nil, err
+    }
+    b.Wallet = walrus.NewWallet(walrusAddr, seed)
+    return b, nil
+}
+
+// clientMu guards the mutable fields of every client. It is held only while
+// they are read or written, never across network I/O.
+var clientMu sync.Mutex
 
 // It's also not easy to pass errors to C code, so we store a global error on
 // the Go side and make it accessible via a function. All functions that would
 // normally return an error return a 'falsey' value instead; the C code can then
 // call us_error to access the corresponding error.
+//
+// Errors are keyed by the caller (the Python object making the call) and by
+// the calling thread. Calls are made without holding the GIL, so two threads
+// may use the same object at once; keying by thread ensures that a success on
+// one thread cannot clobber a failure on another before it is reported. An
+// exported function always runs on the thread that called it.
 var (
-    us_err = make(map[uintptr]error)
+    us_err = make(map[uintptr]map[uintptr]error)
     errMu  sync.Mutex
 )
 
 func setError(id unsafe.Pointer, err error) bool {
-    if err != nil {
-        // get calling function name
-        pc, _, _, _ := runtime.Caller(1)
-        fnName := strings.TrimPrefix(runtime.FuncForPC(pc).Name(), "main.")
-        err = fmt.Errorf("%v: %v", fnName, err)
+    thread := uintptr(C.current_thread())
+    errMu.Lock()
+    defer errMu.Unlock()
+    if err == nil {
+        delete(us_err[uintptr(id)], thread)
+        return false
+    }
+    if us_err[uintptr(id)] == nil {
+        us_err[uintptr(id)] = make(map[uintptr]error)
     }
+    us_err[uintptr(id)][thread] = fmt.Errorf("%v: %w", exportName(), err)
+    return true
+}
+
+// getError returns the error most recently set by the caller on the current
+// thread.
+func getError(id unsafe.Pointer) error {
+    thread := uintptr(C.current_thread())
     errMu.Lock()
     defer errMu.Unlock()
-    us_err[uintptr(id)] = err
-    return us_err[uintptr(id)] != nil
+    return us_err[uintptr(id)][thread]
+}
+
+// exportName returns the name of the exported function currently executing.
+func exportName() string {
+    pcs := make([]uintptr, 128)
+    frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+    for {
+        f, more := frames.Next()
+        if name := strings.TrimPrefix(f.Function, "main."); strings.HasPrefix(name, "us_") {
+            return name
+        } else if !more {
+            return "unknown"
+        }
+    }
+}
+
+// A panic must never unwind into C code, since the Go runtime will abort the
+// whole interpreter. Every exported function therefore defers recoverPanic,
+// which converts a panic into an ordinary error. If fail is non-nil, it is
+// called to set the function's return value to its error value; otherwise, the
+// zero value is returned.
+func recoverPanic(id unsafe.Pointer, fail func()) {
+    if r := recover(); r != nil {
+        setError(id, fmt.Errorf("%w: %v\n%s", errcode.ErrPanic, r, debug.Stack()))
+        if fail != nil {
+            fail()
+        }
+    }
 }
 
+// us_error returns the caller's most recent error, or NULL if its most recent
+// call succeeded. The string must be freed with us_free.
+//
 //export us_error
 func us_error(id unsafe.Pointer) *C.char {
+    err := getError(id)
+    if err == nil {
+        return nil
+    }
+    return allocString(err.Error())
+}
+
+// us_error_code returns the us_errcode_t corresponding to us_error, or US_OK
+// if the caller's most recent call succeeded.
+//
+//export us_error_code
+func us_error_code(id unsafe.Pointer) C.us_errcode_t {
+    return errorCode(getError(id))
+}
+
+// us_error_free discards the error state associated with the caller, on every
+// thread. It should be called when the caller is destroyed.
+//
+//export us_error_free
+func us_error_free(id unsafe.Pointer) {
     errMu.Lock()
     defer errMu.Unlock()
-    if us_err[uintptr(id)] == nil {
-        return nil
+    delete(us_err, uintptr(id))
+}
+
+// cAllocs is the number of buffers allocated by allocString and allocBytes
+// that have not yet been freed with us_free. Tests use it to check for leaks.
+var cAllocs int64
+
+// allocString is like C.CString, but counts the allocation in cAllocs. All
+// memory handed over to the caller must be allocated by allocString or
+// allocBytes.
+func allocString(s string) *C.char {
+    atomic.AddInt64(&cAllocs, 1)
+    return C.CString(s)
+}
+
+// allocBytes is like C.CBytes, but counts the allocation in cAllocs.
+func allocBytes(b []byte) unsafe.Pointer {
+    atomic.AddInt64(&cAllocs, 1)
+    return C.CBytes(b)
+}
+
+// us_free frees memory allocated by the library. It must be used (instead of
+// free) for any memory that the library hands over to the caller.
+//
+//export us_free
+func us_free(p unsafe.Pointer) {
+    if p != nil {
+        atomic.AddInt64(&cAllocs, -1)
+        C.free(p)
     }
-    return C.CString(us_err[uintptr(id)].Error())
+}
+
+// errorCode classifies err, returning the us_errcode_t that best describes it.
+func errorCode(err error) C.us_errcode_t {
+    return C.us_errcode_t(errcode.Of(err))
 }
 
 // goBytes is like C.GoBytes, but directly aliases the C memory instead of
@@ -128,56 +362,52 @@ func goBytes(ptr unsafe.Pointer, n int) []byte {
     }))
 }
 
-func scanCurrency(s string) (types.Currency, error) {
-    var hastings string
-    if strings.HasSuffix(s, "H") {
-        hastings = strings.TrimSuffix(s, "H")
-    } else {
-        units := []string{"pS", "nS", "uS", "mS", "SC", "KS", "MS", "GS", "TS"}
-        for i, unit := range units {
-            if strings.HasSuffix(s, unit) {
-                // scan into big.Rat
-                r, ok := new(big.Rat).SetString(strings.TrimSuffix(s, unit))
-                if !ok {
-                    return types.Currency{}, errors.New("Malformed currency value")
-                }
-                // convert units
-                exp := 24 + 3*(int64(i)-4)
-                mag := new(big.Int).Exp(big.NewInt(10), big.NewInt(exp), nil)
-                r.Mul(r, new(big.Rat).SetInt(mag))
-                // r must be an integer at this point
-                if !r.IsInt() {
-                    return types.Currency{}, errors.New("Non-integer number of hastings")
-                }
-                hastings = r.RatString()
-                break
-            }
-        }
-    }
-    if hastings == "" {
-        return types.Currency{}, errors.New("Currency value is missing units")
-    }
-    var c types.Currency
-    _, err := fmt.Sscan(hastings, &c)
-    if err != nil {
-      return types.Currency{}, errors.Wrap(err, "Could not scan currency value")
-    }
-    return c, nil
-}
-
 //export us_ll_client_init
 func us_ll_client_init(addr *C.char, pw *C.char) unsafe.Pointer {
+    defer recoverPanic(nil, nil)
     siadAddr := C.GoString(addr)
     siadPassword := C.GoString(pw)
     siadClient := renterutil.NewSiadClient(siadAddr, siadPassword)
-    return storePtr(siadClient)
+    return ptrs.Store(handles.Client, &client{backend: siadClient})
+}
+
+// us_ll_client_init_shard creates a client that resolves hosts through the
+// shard server at shard_addr. If walrus_addr and seed (a 12-word phrase) are
+// provided, contracts are funded through that walrus server using keys derived
+// from the seed; otherwise, the client cannot form contracts.
+//
+//export us_ll_client_init_shard
+func us_ll_client_init_shard(id unsafe.Pointer, shard_addr *C.char, walrus_addr *C.char, seed *C.char) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    if shard_addr == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    b, err := newShardBackend(C.GoString(shard_addr), C.GoString(walrus_addr), C.GoString(seed))
+    if setError(id, err) {
+        return nil
+    }
+    return ptrs.Store(handles.Client, &client{backend: b})
+}
+
+//export us_ll_client_close
+func us_ll_client_close(id unsafe.Pointer, client_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    if client_p == nil {
+        return !setError(id, nil)
+    }
+    _, err := ptrs.Take(client_p, handles.Client)
+    return !setError(id, err)
 }
 
 //export us_ll_form_contract
 func us_ll_form_contract(id unsafe.Pointer, client_p unsafe.Pointer, host_str *C.char, key_ptr unsafe.Pointer, total_funds *C.char, duration C.uint) unsafe.Pointer {
-    clientMu.Lock()
-    defer clientMu.Unlock()
-    siad := loadPtr(client_p).(*renterutil.SiadClient)
+    defer recoverPanic(id, nil)
+    c, err := loadClient(client_p)
+    if setError(id, err) {
+        return nil
+    }
+    siad, limits := c.snapshot()
     hostKeyPrefix := C.GoString(host_str)
     totalFunds := C.GoString(total_funds)
 
@@ -194,6 +424,8 @@ func us_ll_form_contract(id unsafe.Pointer, client_p unsafe.Pointer, host_str *C
     host, err := hostdb.Scan(ctx, addr, hostKey)
     if setError(id, err) {
         return nil
+    } else if setError(id, limits.Check(host.HostSettings)) {
+        return nil
     }
 
     currentHeight, err := siad.ChainHeight()
@@ -202,7 +434,7 @@ func us_ll_form_contract(id unsafe.Pointer, client_p unsafe.Pointer, host_str *C
     }
 
     key := ed25519.NewKeyFromSeed(goBytes(key_ptr, 32))
-    funds, err := scanCurrency(totalFunds)
+    funds, err := pricing.ParseCurrency(totalFunds)
     if setError(id, err) {
         return nil
     }
@@ -214,176 +446,2057 @@ func us_ll_form_contract(id unsafe.Pointer, client_p unsafe.Pointer, host_str *C
     copy(buf[0:32], contract.HostKey().Ed25519())
     copy(buf[32:64], contract.Revision.ParentID[:])
     copy(buf[64:96], key[:ed25519.SeedSize])
-    return C.CBytes(buf)
+    return allocBytes(buf)
 }
 
-//export us_ll_new_session
-func us_ll_new_session(id unsafe.Pointer, client_p unsafe.Pointer, host_str *C.char, contract *C.struct_contract_t) unsafe.Pointer {
-    clientMu.Lock()
-    defer clientMu.Unlock()
-    siad := loadPtr(client_p).(*renterutil.SiadClient)
-    hostKeyPrefix := C.GoString(host_str)
+// us_ll_renew_contract renews contract with its host, returning a new contract
+// in the same format as us_ll_form_contract. The new contract ends duration
+// blocks after the current height and uses the same renter key. The data
+// stored under the old contract is carried over, after which the old contract
+// can no longer be revised.
+//
+//export us_ll_renew_contract
+func us_ll_renew_contract(id unsafe.Pointer, client_p unsafe.Pointer, contract *C.struct_contract_t, total_funds *C.char, duration C.uint) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    cl, err := loadClient(client_p)
+    if setError(id, err) {
+        return nil
+    } else if contract == nil || total_funds == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    siad, limits := cl.snapshot()
+    c := contractfile.Decode(C.GoBytes(unsafe.Pointer(contract), C.sizeof_struct_contract_t))
+    funds, err := pricing.ParseCurrency(C.GoString(total_funds))
+    if setError(id, err) {
+        return nil
+    }
 
-    hostKey, err := siad.LookupHost(hostKeyPrefix)
+    addr, err := siad.ResolveHostKey(c.HostKey)
     if setError(id, err) {
         return nil
     }
-    addr, err := siad.ResolveHostKey(hostKey)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    host, err := hostdb.Scan(ctx, addr, c.HostKey)
     if setError(id, err) {
         return nil
+    } else if setError(id, limits.Check(host.HostSettings)) {
+        return nil
     }
+
     currentHeight, err := siad.ChainHeight()
     if setError(id, err) {
         return nil
     }
 
-    var c renter.Contract
-    copy(c.ID[:], C.GoBytes(unsafe.Pointer(&contract.id), 32))
-    c.HostKey = hostdb.HostKeyFromPublicKey(C.GoBytes(unsafe.Pointer(&contract.hostKey), 32))
-    c.RenterKey = ed25519.NewKeyFromSeed(C.GoBytes(unsafe.Pointer(&contract.renterKey), 32))
-    session, err := proto.NewSession(addr, hostKey, c.ID, c.RenterKey, currentHeight)
+    renewed, _, err := proto.RenewContract(siad, siad, c.ID, c.RenterKey, host, funds, currentHeight, currentHeight+types.BlockHeight(duration))
     if setError(id, err) {
         return nil
     }
-    return storePtr(session)
+    buf := make([]byte, C.sizeof_struct_contract_t)
+    copy(buf[0:32], renewed.HostKey().Ed25519())
+    copy(buf[32:64], renewed.Revision.ParentID[:])
+    copy(buf[64:96], c.RenterKey[:ed25519.SeedSize])
+    return allocBytes(buf)
 }
 
-//export us_ll_upload
-func us_ll_upload(id unsafe.Pointer, session_p unsafe.Pointer, buf unsafe.Pointer) unsafe.Pointer {
-    session := loadPtr(session_p).(*proto.Session)
-    var sector [renterhost.SectorSize]byte
-    copy(sector[:], goBytes(buf, renterhost.SectorSize))
-    root, err := session.Append(&sector)
-    if setError(id, err) {
-        return nil
+// Host scanning
+
+const (
+    defaultScanTimeout = 10 * time.Second
+    maxConcurrentScans = 32
+)
+
+// scanTimeout converts a timeout in milliseconds, where zero means the
+// default, to a Duration.
+func scanTimeout(ms C.uint) time.Duration {
+    if ms == 0 {
+        return defaultScanTimeout
     }
-    return C.CBytes(root[:])
+    return time.Duration(ms) * time.Millisecond
 }
 
-//export us_ll_download
-func us_ll_download(id unsafe.Pointer, session_p unsafe.Pointer, root unsafe.Pointer, buf unsafe.Pointer, offset C.uint, length C.uint) C.ssize_t {
-    session := loadPtr(session_p).(*proto.Session)
-    var sectorMerkleRoot crypto.Hash
-    copy(sectorMerkleRoot[:], goBytes(root, crypto.HashSize))
-    dst := bytes.NewBuffer(make([]byte, 0, length))
-    err := session.Read(dst, []renterhost.RPCReadRequestSection{{
-              MerkleRoot: sectorMerkleRoot,
-              Offset:     uint32(offset),
-              Length:     uint32(length),
-    }})
-    if setError(id, err) {
-        return -1
+// resolveHosts looks up the public key and address of the host matching each
+// key prefix. If a host cannot be resolved, the corresponding error is set.
+func resolveHosts(siad backend, prefixes []string) ([]hostdb.HostPublicKey, []modules.NetAddress, []error) {
+    keys := make([]hostdb.HostPublicKey, len(prefixes))
+    addrs := make([]modules.NetAddress, len(prefixes))
+    errs := make([]error, len(prefixes))
+    for i, prefix := range prefixes {
+        keys[i], errs[i] = siad.LookupHost(prefix)
+        if errs[i] == nil {
+            addrs[i], errs[i] = siad.ResolveHostKey(keys[i])
+        }
     }
-    copy(goBytes(buf, int(length)), dst.Bytes())
-    return C.ssize_t(length)
+    return keys, addrs, errs
 }
 
-//export us_ll_session_close
-func us_ll_session_close(id unsafe.Pointer, session_p unsafe.Pointer) bool {
-    session := loadPtr(session_p).(*proto.Session)
-    session.Close()
-    freePtr(session_p)
-    return true
+// scanHosts concurrently scans each host whose error is not already set,
+// setting the error of any host that cannot be scanned within timeout.
+func scanHosts(keys []hostdb.HostPublicKey, addrs []modules.NetAddress, errs []error, timeout time.Duration) []hostdb.ScannedHost {
+    hosts := make([]hostdb.ScannedHost, len(keys))
+    sem := make(chan struct{}, maxConcurrentScans)
+    var wg sync.WaitGroup
+    for i := range keys {
+        if errs[i] != nil {
+            continue
+        }
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            sem <- struct{}{}
+            defer func() { <-sem }()
+            ctx, cancel := context.WithTimeout(context.Background(), timeout)
+            defer cancel()
+            hosts[i], errs[i] = hostdb.Scan(ctx, addrs[i], keys[i])
+        }(i)
+    }
+    wg.Wait()
+    return hosts
 }
 
-//export us_hostset_init
-func us_hostset_init(id unsafe.Pointer, addr *C.char, pw *C.char) unsafe.Pointer {
-    siadAddr := C.GoString(addr)
-    siadPassword := C.GoString(pw)
-    siadClient := renterutil.NewSiadClient(siadAddr, siadPassword)
-    currentHeight, err := siadClient.ChainHeight()
+// hostScan is the JSON encoding of a scanned host. Currency values are encoded
+// as strings, in hastings.
+type hostScan struct {
+    *hostdb.HostSettings
+    PublicKey hostdb.HostPublicKey `json:"publicKey,omitempty"`
+    Latency   float64              `json:"latency,omitempty"` // milliseconds
+    Error     string               `json:"error,omitempty"`
+    ErrorCode int                  `json:"errorCode,omitempty"`
+}
+
+func newHostScan(h hostdb.ScannedHost) hostScan {
+    return hostScan{
+        HostSettings: &h.HostSettings,
+        PublicKey:    h.PublicKey,
+        Latency:      float64(h.Latency) / float64(time.Millisecond),
+    }
+}
+
+// us_ll_scan_host resolves the host matching the key prefix host_str and
+// requests its settings, waiting at most timeout_ms milliseconds (or 10
+// seconds, if timeout_ms is 0). It returns the settings, public key, and
+// latency (in milliseconds) of the host, encoded as a JSON object. The
+// returned string must be freed with us_free.
+//
+//export us_ll_scan_host
+func us_ll_scan_host(id unsafe.Pointer, client_p unsafe.Pointer, host_str *C.char, timeout_ms C.uint) *C.char {
+    defer recoverPanic(id, nil)
+    if host_str == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    c, err := loadClient(client_p)
+    if setError(id, err) {
+        return nil
+    }
+    siad, _ := c.snapshot()
+    keys, addrs, errs := resolveHosts(siad, []string{C.GoString(host_str)})
+    hosts := scanHosts(keys, addrs, errs, scanTimeout(timeout_ms))
+    if setError(id, errs[0]) {
+        return nil
+    }
+    js, err := json.Marshal(newHostScan(hosts[0]))
     if setError(id, err) {
         return nil
     }
-    hs := renterutil.NewHostSet(siadClient, currentHeight)
-    return storePtr(hs)
+    return allocString(string(js))
 }
 
-//export us_hostset_add
-func us_hostset_add(id unsafe.Pointer, hostset_p unsafe.Pointer, contract *C.struct_contract_t) bool {
-    hs := loadPtr(hostset_p).(*renterutil.HostSet)
-    var c renter.Contract
-    copy(c.ID[:], C.GoBytes(unsafe.Pointer(&contract.id), 32))
-    c.HostKey = hostdb.HostKeyFromPublicKey(C.GoBytes(unsafe.Pointer(&contract.hostKey), 32))
-    c.RenterKey = ed25519.NewKeyFromSeed(C.GoBytes(unsafe.Pointer(&contract.renterKey), 32))
-    hs.AddHost(c)
-    return true
+// us_ll_scan_hosts is like us_ll_scan_host, but scans the n hosts in host_strs
+// concurrently, returning a JSON array. If a host could not be scanned, its
+// entry contains only the error and errorCode fields. It fails only if its
+// arguments are invalid.
+//
+//export us_ll_scan_hosts
+func us_ll_scan_hosts(id unsafe.Pointer, client_p unsafe.Pointer, host_strs **C.char, n C.size_t, timeout_ms C.uint) *C.char {
+    defer recoverPanic(id, nil)
+    if host_strs == nil && n > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    cstrs := unsafe.Slice(host_strs, int(n))
+    prefixes := make([]string, len(cstrs))
+    for i, s := range cstrs {
+        if s == nil {
+            setError(id, errcode.ErrNullArgument)
+            return nil
+        }
+        prefixes[i] = C.GoString(s)
+    }
+    c, err := loadClient(client_p)
+    if setError(id, err) {
+        return nil
+    }
+    siad, _ := c.snapshot()
+    keys, addrs, errs := resolveHosts(siad, prefixes)
+    hosts := scanHosts(keys, addrs, errs, scanTimeout(timeout_ms))
+    scans := make([]hostScan, len(hosts))
+    for i := range scans {
+        if errs[i] != nil {
+            scans[i] = hostScan{Error: errs[i].Error(), ErrorCode: int(errorCode(errs[i]))}
+        } else {
+            scans[i] = newHostScan(hosts[i])
+        }
+    }
+    js, err := json.Marshal(scans)
+    if setError(id, err) {
+        return nil
+    }
+    return allocString(string(js))
 }
 
-//export us_fs_init
-func us_fs_init(id unsafe.Pointer, root *C.char, hs unsafe.Pointer) unsafe.Pointer {
-    pfs := renterutil.NewFileSystem(C.GoString(root), loadPtr(hs).(*renterutil.HostSet))
-    return storePtr(pfs)
+// A session is a proto.Session along with its underlying connection. The
+// renter-host protocol has no way to abort an RPC, so the only way to
+// interrupt one is to close the connection, which also ends the session.
+type session struct {
+    *proto.Session
+    conn     net.Conn
+    settings hostdb.HostSettings // as reported when the session was created
+    mu       sync.Mutex          // serializes RPCs
 }
 
-//export us_fs_close
-func us_fs_close(id unsafe.Pointer, fs_p unsafe.Pointer) bool {
-    if loadPtr(fs_p) == nil {
-        return true
+// do calls fn with exclusive access to the session. If ctx is canceled before
+// fn returns, the session's connection is closed.
+func (s *session) do(ctx context.Context, fn func(*proto.Session) error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if ctx.Err() != nil {
+        return errcode.ErrCanceled
     }
-    pfs := loadPtr(fs_p).(*renterutil.PseudoFS)
-    freePtr(fs_p)
-    return !setError(id, pfs.Close())
+    if ctx.Done() != nil {
+        done := make(chan struct{})
+        defer close(done)
+        go func() {
+            select {
+            case <-ctx.Done():
+                s.conn.Close()
+            case <-done:
+            }
+        }()
+    }
+    return fn(s.Session)
 }
 
-//export us_fs_create
-func us_fs_create(id unsafe.Pointer, fs_p unsafe.Pointer, name *C.char, minHosts int) unsafe.Pointer {
-    pfs := loadPtr(fs_p).(*renterutil.PseudoFS)
-    pf, err := pfs.Create(C.GoString(name), minHosts)
-    if setError(id, err) {
-        return nil
+// newSession locks c and returns a session with its host. It is like
+// proto.NewSession, but retains the connection. It fails if the host's settings
+// violate limits.
+func newSession(siad backend, limits pricing.Limits, hostKeyPrefix string, c renter.Contract) (*session, error) {
+    hostKey, err := siad.LookupHost(hostKeyPrefix)
+    if err != nil {
+        return nil, err
+    }
+    addr, err := siad.ResolveHostKey(hostKey)
+    if err != nil {
+        return nil, err
+    }
+    currentHeight, err := siad.ChainHeight()
+    if err != nil {
+        return nil, err
+    }
+    conn, err := net.DialTimeout("tcp", string(addr), 60*time.Second)
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(60 * time.Second))
+    s, err := proto.NewUnlockedSessionFromConn(conn, hostKey, currentHeight)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    if err := s.Lock(c.ID, c.RenterKey, 10*time.Second); err != nil {
+        s.Close()
+        return nil, err
     }
-    return storePtr(pf)
+    settings, err := s.Settings()
+    if err != nil {
+        s.Close()
+        return nil, err
+    } else if err := limits.Check(settings); err != nil {
+        s.Close()
+        return nil, err
+    }
+    return &session{Session: s, conn: conn, settings: settings}, nil
 }
 
-//export us_fs_open
-func us_fs_open(id unsafe.Pointer, fs_p unsafe.Pointer, name *C.char) unsafe.Pointer {
-    pfs := loadPtr(fs_p).(*renterutil.PseudoFS)
-    pf, err := pfs.Open(C.GoString(name))
+//export us_ll_new_session
+func us_ll_new_session(id unsafe.Pointer, client_p unsafe.Pointer, host_str *C.char, contract *C.struct_contract_t) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    cl, err := loadClient(client_p)
     if setError(id, err) {
         return nil
     }
-    return storePtr(pf)
-}
+    siad, limits := cl.snapshot()
+    hostKeyPrefix := C.GoString(host_str)
 
-//export us_file_read
-func us_file_read(id unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) C.ssize_t {
-    pf := loadPtr(file_p).(*renterutil.PseudoFile)
-    n, err := pf.Read(goBytes(buf, int(count)))
+    var c renter.Contract
+    copy(c.ID[:], C.GoBytes(unsafe.Pointer(&contract.id), 32))
+    c.HostKey = hostdb.HostKeyFromPublicKey(C.GoBytes(unsafe.Pointer(&contract.hostKey), 32))
+    c.RenterKey = ed25519.NewKeyFromSeed(C.GoBytes(unsafe.Pointer(&contract.renterKey), 32))
+    session, err := newSession(siad, limits, hostKeyPrefix, c)
     if setError(id, err) {
-        return -1
+        return nil
     }
-    return C.ssize_t(n)
+    return ptrs.Store(handles.Session, session)
 }
 
-//export us_file_write
-func us_file_write(id unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) C.ssize_t {
-    pf := loadPtr(file_p).(*renterutil.PseudoFile)
-    n, err := pf.Write(goBytes(buf, int(count)))
+//export us_ll_upload
+func us_ll_upload(id unsafe.Pointer, session_p unsafe.Pointer, buf unsafe.Pointer) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    session, err := loadSession(session_p)
     if setError(id, err) {
-        return -1
+        return nil
+    } else if buf == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
     }
-    return C.ssize_t(n)
+    var sector [renterhost.SectorSize]byte
+    copy(sector[:], goBytes(buf, renterhost.SectorSize))
+    var root crypto.Hash
+    err = session.do(context.Background(), func(s *proto.Session) (err error) {
+        root, err = s.Append(&sector)
+        return
+    })
+    if setError(id, err) {
+        return nil
+    }
+    return allocBytes(root[:])
 }
 
-//export us_file_seek
-func us_file_seek(id unsafe.Pointer, file_p unsafe.Pointer, offset C.long, whence C.int) C.int {
-    pf := loadPtr(file_p).(*renterutil.PseudoFile)
-    n, err := pf.Seek(int64(offset), int(whence))
+//export us_ll_download
+func us_ll_download(id unsafe.Pointer, session_p unsafe.Pointer, root unsafe.Pointer, buf unsafe.Pointer, offset C.uint, length C.uint) (ret C.ssize_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    session, err := loadSession(session_p)
     if setError(id, err) {
         return -1
+    } else if root == nil || (buf == nil && length > 0) {
+        setError(id, errcode.ErrNullArgument)
+        return -1
     }
-    return C.int(n)
-}
-
+    var sectorMerkleRoot crypto.Hash
+    copy(sectorMerkleRoot[:], goBytes(root, crypto.HashSize))
+    err = session.do(context.Background(), func(s *proto.Session) error {
+        return downloadSections(s, []section{{sectorMerkleRoot, uint32(offset), goBytes(buf, int(length))}})
+    })
+    if setError(id, err) {
+        return -1
+    }
+    return C.ssize_t(length)
+}
+
+// A section is a range of a sector, along with the buffer that receives it.
+type section struct {
+    root   crypto.Hash
+    offset uint32
+    buf    []byte
+}
+
+// A sectionWriter writes to a sequence of buffers, filling each in turn.
+type sectionWriter [][]byte
+
+func (w *sectionWriter) Write(p []byte) (int, error) {
+    n := len(p)
+    for len(p) > 0 {
+        if len(*w) == 0 {
+            return n - len(p), io.ErrShortWrite
+        }
+        c := copy((*w)[0], p)
+        (*w)[0] = (*w)[0][c:]
+        if len((*w)[0]) == 0 {
+            *w = (*w)[1:]
+        }
+        p = p[c:]
+    }
+    return n, nil
+}
+
+// downloadSections downloads secs with a single Read RPC, writing the data
+// directly into their buffers. Empty sections are skipped, since hosts reject
+// them. If an error is returned, the contents of the buffers are unspecified
+// and must not be used.
+func downloadSections(s *proto.Session, secs []section) error {
+    var reqs []renterhost.RPCReadRequestSection
+    var w sectionWriter
+    for _, sec := range secs {
+        if len(sec.buf) == 0 {
+            continue
+        }
+        reqs = append(reqs, renterhost.RPCReadRequestSection{
+            MerkleRoot: sec.root,
+            Offset:     sec.offset,
+            Length:     uint32(len(sec.buf)),
+        })
+        w = append(w, sec.buf)
+    }
+    return s.Read(&w, reqs)
+}
+
+// goSections converts an array of n us_section_t to sections. The buffers
+// alias the caller's memory.
+func goSections(sections *C.us_section_t, n C.size_t) ([]section, error) {
+    if sections == nil && n > 0 {
+        return nil, errcode.ErrNullArgument
+    }
+    cs := unsafe.Slice(sections, int(n))
+    secs := make([]section, len(cs))
+    for i, c := range cs {
+        if c.buf == nil && c.length > 0 {
+            return nil, errcode.ErrNullArgument
+        }
+        copy(secs[i].root[:], C.GoBytes(unsafe.Pointer(&c.root), crypto.HashSize))
+        secs[i].offset = uint32(c.offset)
+        secs[i].buf = goBytes(c.buf, int(c.length))
+    }
+    return secs, nil
+}
+
+// us_ll_download_many downloads n sections, which may belong to different
+// sectors, in a single round-trip. Each section's data is written directly to
+// its buffer. It returns the total number of bytes downloaded, or -1 on
+// failure, in which case the contents of the buffers are unspecified.
+//
+//export us_ll_download_many
+func us_ll_download_many(id unsafe.Pointer, session_p unsafe.Pointer, sections *C.us_section_t, n C.size_t) (ret C.ssize_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    session, err := loadSession(session_p)
+    if setError(id, err) {
+        return -1
+    }
+    secs, err := goSections(sections, n)
+    if setError(id, err) {
+        return -1
+    }
+    err = session.do(context.Background(), func(s *proto.Session) error {
+        return downloadSections(s, secs)
+    })
+    if setError(id, err) {
+        return -1
+    }
+    var total int
+    for _, sec := range secs {
+        total += len(sec.buf)
+    }
+    return C.ssize_t(total)
+}
+
+// us_ll_session_settings returns the host's settings, encoded as JSON, as
+// reported when the session was created. These are the prices that the session
+// pays. Currency values are encoded as strings, in hastings. The returned
+// string must be freed with us_free.
+//
+//export us_ll_session_settings
+func us_ll_session_settings(id unsafe.Pointer, session_p unsafe.Pointer) *C.char {
+    defer recoverPanic(id, nil)
+    session, err := loadSession(session_p)
+    if setError(id, err) {
+        return nil
+    }
+    js, err := json.Marshal(session.settings)
+    if setError(id, err) {
+        return nil
+    }
+    return allocString(string(js))
+}
+
+// revisionInfo summarizes the latest revision of a contract.
+type revisionInfo struct {
+    ID             types.FileContractID `json:"id"`
+    HostKey        hostdb.HostPublicKey `json:"hostKey"`
+    RevisionNumber uint64               `json:"revisionNumber"`
+    Size           uint64               `json:"size"`
+    NumSectors     int                  `json:"numSectors"`
+    MerkleRoot     crypto.Hash          `json:"merkleRoot"`
+    EndHeight      types.BlockHeight    `json:"endHeight"`
+    WindowEnd      types.BlockHeight    `json:"windowEnd"`
+    RenterFunds    types.Currency       `json:"renterFunds"`
+    HostCollateral types.Currency       `json:"hostCollateral"`
+}
+
+// us_ll_session_revision returns the latest revision of the session's
+// contract, encoded as JSON. Currency values are encoded as strings, in
+// hastings. The returned string must be freed with us_free.
+//
+//export us_ll_session_revision
+func us_ll_session_revision(id unsafe.Pointer, session_p unsafe.Pointer) *C.char {
+    defer recoverPanic(id, nil)
+    session, err := loadSession(session_p)
+    if setError(id, err) {
+        return nil
+    }
+    var info revisionInfo
+    err = session.do(context.Background(), func(s *proto.Session) error {
+        rev := s.Revision()
+        info = revisionInfo{
+            ID:             rev.ID(),
+            HostKey:        rev.HostKey(),
+            RevisionNumber: rev.Revision.NewRevisionNumber,
+            Size:           rev.Revision.NewFileSize,
+            NumSectors:     rev.NumSectors(),
+            MerkleRoot:     rev.Revision.NewFileMerkleRoot,
+            EndHeight:      rev.EndHeight(),
+            WindowEnd:      rev.Revision.NewWindowEnd,
+            RenterFunds:    rev.RenterFunds(),
+            HostCollateral: rev.Revision.NewMissedProofOutputs[1].Value,
+        }
+        return nil
+    })
+    if setError(id, err) {
+        return nil
+    }
+    js, err := json.Marshal(info)
+    if setError(id, err) {
+        return nil
+    }
+    return allocString(string(js))
+}
+
+var errSectorIndex = fmt.Errorf("%w: sector index out of range", errcode.ErrInvalidArgument)
+
+// contractState returns the size of the session's contract, and writes its
+// Merkle root to root, if root is non-NULL.
+func contractState(s *proto.Session, root unsafe.Pointer) int64 {
+    rev := s.Revision().Revision
+    if root != nil {
+        copy(goBytes(root, crypto.HashSize), rev.NewFileMerkleRoot[:])
+    }
+    return int64(rev.NewFileSize)
+}
+
+// appendSectors appends each sector with a single Write RPC, writing their
+// Merkle roots to roots.
+func appendSectors(s *proto.Session, sectors []byte, roots []byte) error {
+    actions := make([]renterhost.RPCWriteAction, len(sectors)/renterhost.SectorSize)
+    for i := range actions {
+        sector := sectors[i*renterhost.SectorSize:][:renterhost.SectorSize]
+        actions[i] = renterhost.RPCWriteAction{
+            Type: renterhost.RPCWriteActionAppend,
+            Data: sector,
+        }
+        root := merkle.SectorRoot((*[renterhost.SectorSize]byte)(unsafe.Pointer(&sector[0])))
+        copy(roots[i*crypto.HashSize:], root[:])
+    }
+    return s.Write(actions)
+}
+
+// swapSectors swaps each pair of sector indices with a single Write RPC.
+func swapSectors(s *proto.Session, pairs []uint64) error {
+    actions := make([]renterhost.RPCWriteAction, len(pairs)/2)
+    numSectors := uint64(s.Revision().NumSectors())
+    for i := range actions {
+        a, b := pairs[i*2], pairs[i*2+1]
+        if a >= numSectors || b >= numSectors {
+            return errSectorIndex
+        }
+        actions[i] = renterhost.RPCWriteAction{
+            Type: renterhost.RPCWriteActionSwap,
+            A:    a,
+            B:    b,
+        }
+    }
+    return s.Write(actions)
+}
+
+// trimSectors removes the last n sectors of the contract.
+func trimSectors(s *proto.Session, n uint64) error {
+    if n > uint64(s.Revision().NumSectors()) {
+        return errSectorIndex
+    } else if n == 0 {
+        return nil
+    }
+    return s.Write([]renterhost.RPCWriteAction{{
+        Type: renterhost.RPCWriteActionTrim,
+        A:    n,
+    }})
+}
+
+// goRoots converts n packed 32-byte Merkle roots to a slice.
+func goRoots(roots unsafe.Pointer, n C.size_t) []crypto.Hash {
+    hs := make([]crypto.Hash, n)
+    b := goBytes(roots, int(n)*crypto.HashSize)
+    for i := range hs {
+        copy(hs[i][:], b[i*crypto.HashSize:])
+    }
+    return hs
+}
+
+// goPairs converts n pairs of sector indices to a slice of 2n indices.
+func goPairs(pairs *C.uint64_t, n C.size_t) []uint64 {
+    return append([]uint64(nil), unsafe.Slice((*uint64)(unsafe.Pointer(pairs)), int(n)*2)...)
+}
+
+// The functions below modify the sectors stored under the session's contract.
+// Each returns the new size of the contract in bytes, or -1 on failure. If
+// contract_root is non-NULL, the contract's new Merkle root is written to it.
+
+// us_ll_upload_many appends n sectors, stored contiguously in bufs, with a
+// single Write RPC. The Merkle root of each sector is written to roots, which
+// must point to n*32 bytes.
+//
+//export us_ll_upload_many
+func us_ll_upload_many(id unsafe.Pointer, session_p unsafe.Pointer, bufs unsafe.Pointer, n C.size_t, roots unsafe.Pointer, contract_root unsafe.Pointer) (ret C.int64_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    session, err := loadSession(session_p)
+    if setError(id, err) {
+        return -1
+    } else if n > 0 && (bufs == nil || roots == nil) {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    sectors := goBytes(bufs, int(n)*renterhost.SectorSize)
+    rootBuf := goBytes(roots, int(n)*crypto.HashSize)
+    var size int64
+    err = session.do(context.Background(), func(s *proto.Session) error {
+        if err := appendSectors(s, sectors, rootBuf); err != nil {
+            return err
+        }
+        size = contractState(s, contract_root)
+        return nil
+    })
+    if setError(id, err) {
+        return -1
+    }
+    return C.int64_t(size)
+}
+
+// us_ll_swap_sectors swaps n pairs of sectors with a single Write RPC. pairs
+// points to 2n sector indices; pairs[2i] is swapped with pairs[2i+1].
+//
+//export us_ll_swap_sectors
+func us_ll_swap_sectors(id unsafe.Pointer, session_p unsafe.Pointer, pairs *C.uint64_t, n C.size_t, contract_root unsafe.Pointer) (ret C.int64_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    session, err := loadSession(session_p)
+    if setError(id, err) {
+        return -1
+    } else if pairs == nil && n > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    indices := goPairs(pairs, n)
+    var size int64
+    err = session.do(context.Background(), func(s *proto.Session) error {
+        if err := swapSectors(s, indices); err != nil {
+            return err
+        }
+        size = contractState(s, contract_root)
+        return nil
+    })
+    if setError(id, err) {
+        return -1
+    }
+    return C.int64_t(size)
+}
+
+// us_ll_trim_sectors removes the last n sectors of the contract.
+//
+//export us_ll_trim_sectors
+func us_ll_trim_sectors(id unsafe.Pointer, session_p unsafe.Pointer, n C.uint64_t, contract_root unsafe.Pointer) (ret C.int64_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    session, err := loadSession(session_p)
+    if setError(id, err) {
+        return -1
+    }
+    var size int64
+    err = session.do(context.Background(), func(s *proto.Session) error {
+        if err := trimSectors(s, uint64(n)); err != nil {
+            return err
+        }
+        size = contractState(s, contract_root)
+        return nil
+    })
+    if setError(id, err) {
+        return -1
+    }
+    return C.int64_t(size)
+}
+
+// us_ll_delete_sectors deletes the sectors with the n Merkle roots stored
+// contiguously in roots, swapping them to the end of the contract and trimming
+// them with a single Write RPC. Roots that are not present in the contract are
+// ignored.
+//
+//export us_ll_delete_sectors
+func us_ll_delete_sectors(id unsafe.Pointer, session_p unsafe.Pointer, roots unsafe.Pointer, n C.size_t, contract_root unsafe.Pointer) (ret C.int64_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    session, err := loadSession(session_p)
+    if setError(id, err) {
+        return -1
+    } else if roots == nil && n > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    hs := goRoots(roots, n)
+    var size int64
+    err = session.do(context.Background(), func(s *proto.Session) error {
+        if err := s.DeleteSectors(hs); err != nil {
+            return err
+        }
+        size = contractState(s, contract_root)
+        return nil
+    })
+    if setError(id, err) {
+        return -1
+    }
+    return C.int64_t(size)
+}
+
+//export us_ll_session_close
+func us_ll_session_close(id unsafe.Pointer, session_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    if session_p == nil {
+        return !setError(id, nil)
+    }
+    v, err := ptrs.Take(session_p, handles.Session)
+    if setError(id, err) {
+        return false
+    }
+    v.(*session).Close()
+    return true
+}
+
+// Price limits
+//
+// A client or HostSet can be given limits on the prices that it will pay.
+// Host settings are checked against the limits before forming or renewing a
+// contract, when a session is created, and whenever a HostSet connects to a
+// host, so a host that violates them is rejected before any money moves.
+// The limits themselves are implemented by the pricing package, which is shared
+// with the other bindings.
+
+// goLimits converts limits to pricing.Limits. A NULL limits, or a NULL or empty
+// string within it, means no limit.
+func goLimits(limits *C.us_limits_t) (pricing.Limits, error) {
+    var l pricing.Limits
+    if limits == nil {
+        return l, nil
+    }
+    for _, p := range []struct {
+        s *C.char
+        c *types.Currency
+    }{
+        {limits.max_storage_price, &l.MaxStoragePrice},
+        {limits.max_upload_price, &l.MaxUploadPrice},
+        {limits.max_download_price, &l.MaxDownloadPrice},
+        {limits.max_contract_price, &l.MaxContractPrice},
+    } {
+        if p.s == nil || C.GoString(p.s) == "" {
+            continue
+        }
+        c, err := pricing.ParseCurrency(C.GoString(p.s))
+        if err != nil {
+            return pricing.Limits{}, errors.Wrap(errcode.ErrInvalidLimits, err.Error())
+        }
+        *p.c = c
+    }
+    l.MinCollateralRatio = float64(limits.min_collateral_ratio)
+    if l.MinCollateralRatio < 0 {
+        return pricing.Limits{}, errors.Wrap(errcode.ErrInvalidLimits, "collateral ratio must not be negative")
+    }
+    return l, nil
+}
+
+// A hostSet is a renterutil.HostSet whose hosts are subject to price limits.
+type hostSet struct {
+    *renterutil.HostSet
+    guard *pricing.Guard
+}
+
+func newHostSet(hkr renter.HostKeyResolver, currentHeight types.BlockHeight) *hostSet {
+    guard := new(pricing.Guard)
+    set := renterutil.NewHostSet(hkr, currentHeight)
+    set.SetOnConnect(func(s *proto.Session) { guard.Admit(s) })
+    return &hostSet{
+        HostSet: set,
+        guard:   guard,
+    }
+}
+
+// us_ll_client_set_limits sets the price limits of the client, replacing any
+// previous limits. Forming or renewing a contract, or creating a session, with
+// a host whose settings violate them fails with US_ERR_PRICE_EXCEEDED. If
+// limits is NULL, the limits are removed.
+//
+//export us_ll_client_set_limits
+func us_ll_client_set_limits(id unsafe.Pointer, client_p unsafe.Pointer, limits *C.us_limits_t) bool {
+    defer recoverPanic(id, nil)
+    clientMu.Lock()
+    defer clientMu.Unlock()
+    c, err := loadClient(client_p)
+    if setError(id, err) {
+        return false
+    }
+    l, err := goLimits(limits)
+    if setError(id, err) {
+        return false
+    }
+    c.limits = l
+    return true
+}
+
+// us_hostset_set_limits sets the price limits of the HostSet, replacing any
+// previous limits. The settings of each host are checked whenever the HostSet
+// connects to it, and an operation that would use a host whose settings
+// violate the limits fails with US_ERR_PRICE_EXCEEDED. If limits is NULL, the
+// limits are removed.
+//
+//export us_hostset_set_limits
+func us_hostset_set_limits(id unsafe.Pointer, hostset_p unsafe.Pointer, limits *C.us_limits_t) bool {
+    defer recoverPanic(id, nil)
+    hs, err := loadHostSet(hostset_p)
+    if setError(id, err) {
+        return false
+    }
+    l, err := goLimits(limits)
+    if setError(id, err) {
+        return false
+    }
+    hs.guard.SetLimits(l)
+    return true
+}
+
+//export us_hostset_init
+func us_hostset_init(id unsafe.Pointer, addr *C.char, pw *C.char) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    siadAddr := C.GoString(addr)
+    siadPassword := C.GoString(pw)
+    siadClient := renterutil.NewSiadClient(siadAddr, siadPassword)
+    currentHeight, err := siadClient.ChainHeight()
+    if setError(id, err) {
+        return nil
+    }
+    return ptrs.Store(handles.HostSet, newHostSet(siadClient, currentHeight))
+}
+
+// us_hostset_init_shard creates a HostSet that resolves hosts through the shard
+// server at shard_addr, rather than through siad.
+//
+//export us_hostset_init_shard
+func us_hostset_init_shard(id unsafe.Pointer, shard_addr *C.char) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    if shard_addr == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    c := shard.NewClient(C.GoString(shard_addr))
+    currentHeight, err := c.ChainHeight()
+    if setError(id, err) {
+        return nil
+    }
+    return ptrs.Store(handles.HostSet, newHostSet(c, currentHeight))
+}
+
+// us_hostset_free closes all of the HostSet's sessions and frees it. It fails if
+// the HostSet is still in use by a filesystem.
+//
+//export us_hostset_free
+func us_hostset_free(id unsafe.Pointer, hostset_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    if hostset_p == nil {
+        return !setError(id, nil)
+    }
+    v, err := ptrs.Take(hostset_p, handles.HostSet)
+    if setError(id, err) {
+        return false
+    }
+    return !setError(id, v.(*hostSet).Close())
+}
+
+//export us_hostset_add
+func us_hostset_add(id unsafe.Pointer, hostset_p unsafe.Pointer, contract *C.struct_contract_t) bool {
+    defer recoverPanic(id, nil)
+    hs, err := loadHostSet(hostset_p)
+    if setError(id, err) {
+        return false
+    } else if contract == nil {
+        return !setError(id, errcode.ErrNullArgument)
+    }
+    var c renter.Contract
+    copy(c.ID[:], C.GoBytes(unsafe.Pointer(&contract.id), 32))
+    c.HostKey = hostdb.HostKeyFromPublicKey(C.GoBytes(unsafe.Pointer(&contract.hostKey), 32))
+    c.RenterKey = ed25519.NewKeyFromSeed(C.GoBytes(unsafe.Pointer(&contract.renterKey), 32))
+    hs.AddHost(c)
+    return true
+}
+
+// us_contract_load reads a contract file, as written by the user tool, into
+// contract.
+//
+//export us_contract_load
+func us_contract_load(id unsafe.Pointer, contract *C.struct_contract_t, path *C.char) bool {
+    defer recoverPanic(id, nil)
+    if contract == nil || path == nil {
+        return !setError(id, errcode.ErrNullArgument)
+    }
+    b, err := contractfile.Read(C.GoString(path))
+    if setError(id, err) {
+        return false
+    }
+    copy(goBytes(unsafe.Pointer(contract), 96), b)
+    return true
+}
+
+// us_hostset_add_dir adds every contract file (i.e. every file with a
+// .contract extension) in dir to the host set, returning the number of
+// contracts added. If any file is invalid, no contracts are added.
+//
+//export us_hostset_add_dir
+func us_hostset_add_dir(id unsafe.Pointer, hostset_p unsafe.Pointer, dir *C.char) (ret C.int) {
+    defer recoverPanic(id, func() { ret = -1 })
+    hs, err := loadHostSet(hostset_p)
+    if setError(id, err) {
+        return -1
+    } else if dir == nil {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    infos, err := ioutil.ReadDir(C.GoString(dir))
+    if setError(id, err) {
+        return -1
+    }
+    var contracts []renter.Contract
+    for _, info := range infos {
+        if info.IsDir() || filepath.Ext(info.Name()) != ".contract" {
+            continue
+        }
+        b, err := contractfile.Read(filepath.Join(C.GoString(dir), info.Name()))
+        if setError(id, err) {
+            return -1
+        }
+        contracts = append(contracts, contractfile.Decode(b))
+    }
+    for _, c := range contracts {
+        hs.AddHost(c)
+    }
+    return C.int(len(contracts))
+}
+
+//export us_fs_init
+func us_fs_init(id unsafe.Pointer, root *C.char, hs_p unsafe.Pointer) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    hs, err := loadHostSet(hs_p)
+    if setError(id, err) {
+        return nil
+    }
+    pfs := renterutil.NewFileSystem(C.GoString(root), hs.HostSet)
+    fs_p, err := ptrs.StoreChild(handles.FS, pfs, hs_p, handles.HostSet)
+    if setError(id, err) {
+        return nil
+    }
+    return fs_p
+}
+
+//export us_fs_close
+func us_fs_close(id unsafe.Pointer, fs_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    if fs_p == nil {
+        return !setError(id, nil)
+    }
+    guard := guardOf(fs_p, handles.FS)
+    v, err := ptrs.Take(fs_p, handles.FS)
+    if setError(id, err) {
+        return false
+    }
+    return !setError(id, guard.Explain(v.(*renterutil.PseudoFS).Close()))
+}
+
+//export us_fs_create
+func us_fs_create(id unsafe.Pointer, fs_p unsafe.Pointer, name *C.char, minHosts int) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    pfs, err := loadFS(fs_p)
+    if setError(id, err) {
+        return nil
+    }
+    pf, err := pfs.Create(C.GoString(name), minHosts)
+    if setError(id, err) {
+        return nil
+    }
+    file_p, err := ptrs.StoreChild(handles.File, pf, fs_p, handles.FS)
+    if setError(id, err) {
+        pf.Close()
+        return nil
+    }
+    return file_p
+}
+
+//export us_fs_open
+func us_fs_open(id unsafe.Pointer, fs_p unsafe.Pointer, name *C.char) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    pfs, err := loadFS(fs_p)
+    if setError(id, err) {
+        return nil
+    }
+    pf, err := pfs.Open(C.GoString(name))
+    if setError(id, err) {
+        return nil
+    }
+    file_p, err := ptrs.StoreChild(handles.File, pf, fs_p, handles.FS)
+    if setError(id, err) {
+        pf.Close()
+        return nil
+    }
+    return file_p
+}
+
+//export us_file_read
+func us_file_read(id unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) (ret C.ssize_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return -1
+    } else if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    n, err := pf.Read(goBytes(buf, int(count)))
+    if setError(id, guardOf(file_p, handles.File).Explain(err)) {
+        return -1
+    }
+    return C.ssize_t(n)
+}
+
+//export us_file_write
+func us_file_write(id unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t) (ret C.ssize_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return -1
+    } else if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    n, err := pf.Write(goBytes(buf, int(count)))
+    if setError(id, guardOf(file_p, handles.File).Explain(err)) {
+        return -1
+    }
+    return C.ssize_t(n)
+}
+
+// us_file_read_at reads up to count bytes from the file at the specified
+// offset, without using or modifying the file's cursor; it is safe to call
+// concurrently on the same file. Like pread(2), it returns the number of bytes
+// read, which is less than count if the end of the file was reached, and 0 if
+// offset is at or past the end.
+//
+//export us_file_read_at
+func us_file_read_at(id unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, offset C.int64_t) (ret C.ssize_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return -1
+    } else if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    } else if offset < 0 {
+        setError(id, errcode.ErrNegative)
+        return -1
+    }
+    n, err := pf.ReadAt(goBytes(buf, int(count)), int64(offset))
+    if err == io.EOF {
+        err = nil
+    }
+    if setError(id, guardOf(file_p, handles.File).Explain(err)) {
+        return -1
+    }
+    return C.ssize_t(n)
+}
+
+// us_file_write_at writes count bytes to the file at the specified offset,
+// without using or modifying the file's cursor.
+//
+//export us_file_write_at
+func us_file_write_at(id unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, offset C.int64_t) (ret C.ssize_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return -1
+    } else if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    } else if offset < 0 {
+        setError(id, errcode.ErrNegative)
+        return -1
+    }
+    n, err := pf.WriteAt(goBytes(buf, int(count)), int64(offset))
+    if setError(id, guardOf(file_p, handles.File).Explain(err)) {
+        return -1
+    }
+    return C.ssize_t(n)
+}
+
+// seekFile is like pf.Seek, but interprets an offset relative to the end of
+// the file the way lseek(2) does; PseudoFile subtracts it from the size
+// instead.
+func seekFile(pf *renterutil.PseudoFile, offset int64, whence int) (int64, error) {
+    switch whence {
+    case io.SeekStart, io.SeekCurrent:
+    case io.SeekEnd:
+        fi, err := pf.Stat()
+        if err != nil {
+            return 0, err
+        }
+        offset, whence = fi.Size()+offset, io.SeekStart
+    default:
+        return 0, errcode.ErrWhence
+    }
+    return pf.Seek(offset, whence)
+}
+
+// us_file_seek sets the file's cursor, interpreting offset according to whence
+// like lseek(2), and returns the new offset.
+//
+//export us_file_seek
+func us_file_seek(id unsafe.Pointer, file_p unsafe.Pointer, offset C.int64_t, whence C.int) (ret C.int64_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return -1
+    }
+    n, err := seekFile(pf, int64(offset), int(whence))
+    if setError(id, err) {
+        return -1
+    }
+    return C.int64_t(n)
+}
+
+// us_file_size returns the current size of the file, including any
+// uncommitted writes.
+//
+//export us_file_size
+func us_file_size(id unsafe.Pointer, file_p unsafe.Pointer) (ret C.int64_t) {
+    defer recoverPanic(id, func() { ret = -1 })
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return -1
+    }
+    fi, err := pf.Stat()
+    if setError(id, err) {
+        return -1
+    }
+    return C.int64_t(fi.Size())
+}
+
+// us_file_truncate changes the size of the file, which must not exceed its
+// current size. The file's cursor is not changed.
+//
+//export us_file_truncate
+func us_file_truncate(id unsafe.Pointer, file_p unsafe.Pointer, size C.int64_t) bool {
+    defer recoverPanic(id, nil)
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return false
+    } else if size < 0 {
+        return !setError(id, errcode.ErrNegative)
+    }
+    return !setError(id, guardOf(file_p, handles.File).Explain(pf.Truncate(int64(size))))
+}
+
+// us_file_sync uploads any uncommitted writes to the file and updates its
+// metadata on disk.
+//
+//export us_file_sync
+func us_file_sync(id unsafe.Pointer, file_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    pf, err := loadFile(file_p)
+    if setError(id, err) {
+        return false
+    }
+    return !setError(id, guardOf(file_p, handles.File).Explain(pf.Sync()))
+}
+
 //export us_file_close
 func us_file_close(id unsafe.Pointer, file_p unsafe.Pointer) bool {
-    if loadPtr(file_p) == nil {
-        return true
+    defer recoverPanic(id, nil)
+    if file_p == nil {
+        return !setError(id, nil)
+    }
+    guard := guardOf(file_p, handles.File)
+    v, err := ptrs.Take(file_p, handles.File)
+    if setError(id, err) {
+        return false
+    }
+    return !setError(id, guard.Explain(v.(*renterutil.PseudoFile).Close()))
+}
+
+// Asynchronous operations
+//
+// Each *_async function starts an operation on a new goroutine and returns
+// immediately with a nonzero operation ID, or 0 if the operation could not be
+// started (in which case us_error describes why). When the operation finishes,
+// its result is posted to the completion queue passed to the call.
+//
+// A completion queue exposes a file descriptor that is readable whenever
+// completions are waiting, so it can be registered with an event loop. When
+// the descriptor becomes readable, call us_cq_poll until it returns 0; the
+// descriptor must not be read directly.
+//
+// Buffers passed to an asynchronous operation must remain valid until its
+// completion is delivered, even if the operation is canceled. The handles it
+// uses cannot be closed until then either; closing them fails with
+// US_ERR_BUSY.
+
+// releaseHandle closes the File or Session created by an operation whose
+// completion was never polled, so that its parent can still be freed.
+func releaseHandle(p unsafe.Pointer) {
+    if v, err := ptrs.Take(p, handles.File); err == nil {
+        v.(*renterutil.PseudoFile).Close()
+    } else if v, err := ptrs.Take(p, handles.Session); err == nil {
+        v.(*session).Close()
+    }
+}
+
+func loadQueue(p unsafe.Pointer) (*async.Queue, error) {
+    v, err := ptrs.Load(p, handles.Queue)
+    if err != nil {
+        return nil, err
+    }
+    return v.(*async.Queue), nil
+}
+
+// startAsync submits fn to the queue referenced by cq_p, pinning the handles
+// in pinned for the duration of the operation. It reports any error via
+// setError and returns the ID of the new operation, or 0 on failure.
+func startAsync(id, cq_p, ctx unsafe.Pointer, pinned []unsafe.Pointer, fn func(context.Context) (int64, unsafe.Pointer, error)) C.uint64_t {
+    cq, err := loadQueue(cq_p)
+    if err == nil {
+        var op uint64
+        if op, err = cq.Submit(ctx, exportName(), pinned, fn); err == nil {
+            setError(id, nil)
+            return C.uint64_t(op)
+        }
+    }
+    for _, p := range pinned {
+        ptrs.Unpin(p)
+    }
+    setError(id, err)
+    return 0
+}
+
+// us_cq_init creates a completion queue for asynchronous operations. It must
+// be freed with us_cq_free.
+//
+//export us_cq_init
+func us_cq_init(id unsafe.Pointer) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    cq, err := async.NewQueue(&ptrs)
+    if setError(id, err) {
+        return nil
+    }
+    return ptrs.Store(handles.Queue, cq)
+}
+
+// us_cq_fd returns a file descriptor that is readable whenever completions
+// are waiting in the queue.
+//
+//export us_cq_fd
+func us_cq_fd(id unsafe.Pointer, cq_p unsafe.Pointer) (ret C.int) {
+    defer recoverPanic(id, func() { ret = -1 })
+    cq, err := loadQueue(cq_p)
+    if setError(id, err) {
+        return -1
+    }
+    return C.int(cq.Fd())
+}
+
+// us_cq_poll removes a completion from the queue and stores it in c,
+// returning 1. If the queue is empty, it returns 0 without blocking.
+//
+//export us_cq_poll
+func us_cq_poll(id unsafe.Pointer, cq_p unsafe.Pointer, c *C.us_completion_t) (ret C.int) {
+    defer recoverPanic(id, func() { ret = -1 })
+    cq, err := loadQueue(cq_p)
+    if setError(id, err) {
+        return -1
+    } else if c == nil {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    comp, ok := cq.Poll()
+    if !ok {
+        return 0
+    }
+    *c = C.us_completion_t{
+        op:         C.uint64_t(comp.Op),
+        ctx:        comp.Ctx,
+        result:     C.int64_t(comp.Result),
+        handle:     comp.Handle,
+        error_code: errorCode(comp.Err),
+    }
+    if comp.Err != nil {
+        c.error = allocString(fmt.Sprintf("%v: %v", comp.Name, comp.Err))
+    }
+    return 1
+}
+
+// us_cq_cancel requests that a pending operation be canceled. Its completion
+// is still delivered; if the operation was interrupted, it fails with
+// US_ERR_CANCELED. Operations on a Session are interrupted by closing the
+// session's connection, so the Session cannot be used afterwards. File reads
+// and writes stop at the next chunk boundary (see async.ChunkSize), so some of
+// the data may already have been transferred. The remaining filesystem
+// operations (opening, creating, syncing, and closing) cannot be interrupted
+// once they have started. Canceling an operation that has already completed
+// has no effect.
+//
+//export us_cq_cancel
+func us_cq_cancel(id unsafe.Pointer, cq_p unsafe.Pointer, op C.uint64_t) bool {
+    defer recoverPanic(id, nil)
+    cq, err := loadQueue(cq_p)
+    if setError(id, err) {
+        return false
+    }
+    cq.Cancel(uint64(op))
+    return true
+}
+
+// us_cq_free frees a completion queue. It fails with US_ERR_BUSY if any
+// operations using the queue are still pending. Completions that have been
+// posted but not polled are discarded, and any File or Session they created is
+// closed.
+//
+//export us_cq_free
+func us_cq_free(id unsafe.Pointer, cq_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    if cq_p == nil {
+        return !setError(id, nil)
+    }
+    cq, err := loadQueue(cq_p)
+    if setError(id, err) {
+        return false
+    }
+    done, err := cq.Close()
+    if setError(id, err) {
+        return false
+    }
+    if _, err := ptrs.Take(cq_p, handles.Queue); setError(id, err) {
+        return false
+    }
+    for _, c := range done {
+        if c.Handle != nil {
+            releaseHandle(c.Handle)
+        }
+    }
+    cq.Release()
+    return true
+}
+
+// startOpenFile pins the filesystem referenced by fs_p and runs fn on it
+// asynchronously, storing the resulting file in the completion's handle.
+func startOpenFile(id, cq_p, fs_p, ctx unsafe.Pointer, fn func(*renterutil.PseudoFS) (*renterutil.PseudoFile, error)) C.uint64_t {
+    v, err := ptrs.Pin(fs_p, handles.FS)
+    if setError(id, err) {
+        return 0
+    }
+    pfs := v.(*renterutil.PseudoFS)
+    return startAsync(id, cq_p, ctx, []unsafe.Pointer{fs_p}, func(context.Context) (int64, unsafe.Pointer, error) {
+        pf, err := fn(pfs)
+        if err != nil {
+            return 0, nil, err
+        }
+        file_p, err := ptrs.StoreChild(handles.File, pf, fs_p, handles.FS)
+        if err != nil {
+            pf.Close()
+            return 0, nil, err
+        }
+        return 0, file_p, nil
+    })
+}
+
+// us_fs_create_async is the asynchronous version of us_fs_create. The new
+// File is stored in the handle field of the completion.
+//
+//export us_fs_create_async
+func us_fs_create_async(id unsafe.Pointer, cq_p unsafe.Pointer, fs_p unsafe.Pointer, name *C.char, minHosts int, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    goname := C.GoString(name)
+    return startOpenFile(id, cq_p, fs_p, ctx, func(pfs *renterutil.PseudoFS) (*renterutil.PseudoFile, error) {
+        return pfs.Create(goname, minHosts)
+    })
+}
+
+// us_fs_open_async is the asynchronous version of us_fs_open. The new File is
+// stored in the handle field of the completion.
+//
+//export us_fs_open_async
+func us_fs_open_async(id unsafe.Pointer, cq_p unsafe.Pointer, fs_p unsafe.Pointer, name *C.char, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    goname := C.GoString(name)
+    return startOpenFile(id, cq_p, fs_p, ctx, func(pfs *renterutil.PseudoFS) (*renterutil.PseudoFile, error) {
+        return pfs.Open(goname)
+    })
+}
+
+// us_fs_close_async is the asynchronous version of us_fs_close. The handle is
+// invalidated immediately; the completion reports whether the filesystem's
+// pending data was flushed successfully.
+//
+//export us_fs_close_async
+func us_fs_close_async(id unsafe.Pointer, cq_p unsafe.Pointer, fs_p unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if _, err := loadQueue(cq_p); setError(id, err) {
+        return 0
+    }
+    guard := guardOf(fs_p, handles.FS)
+    v, err := ptrs.Take(fs_p, handles.FS)
+    if setError(id, err) {
+        return 0
+    }
+    pfs := v.(*renterutil.PseudoFS)
+    op := startAsync(id, cq_p, ctx, nil, func(context.Context) (int64, unsafe.Pointer, error) {
+        return 0, nil, guard.Explain(pfs.Close())
+    })
+    if op == 0 {
+        // the handle is already gone, so close the filesystem anyway
+        pfs.Close()
+    }
+    return op
+}
+
+// startFileOp pins the file referenced by file_p and runs fn on it
+// asynchronously.
+func startFileOp(id, cq_p, file_p, ctx unsafe.Pointer, fn func(context.Context, *renterutil.PseudoFile) (int, error)) C.uint64_t {
+    v, err := ptrs.Pin(file_p, handles.File)
+    if setError(id, err) {
+        return 0
+    }
+    pf := v.(*renterutil.PseudoFile)
+    guard := guardOf(file_p, handles.File)
+    return startAsync(id, cq_p, ctx, []unsafe.Pointer{file_p}, func(opCtx context.Context) (int64, unsafe.Pointer, error) {
+        n, err := fn(opCtx, pf)
+        return int64(n), nil, guard.Explain(err)
+    })
+}
+
+// us_file_read_async is the asynchronous version of us_file_read.
+//
+//export us_file_read_async
+func us_file_read_async(id unsafe.Pointer, cq_p unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    b := goBytes(buf, int(count))
+    return startFileOp(id, cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+        return async.TransferChunks(opCtx, b, 0, func(chunk []byte, _ int64) (int, error) {
+            return pf.Read(chunk)
+        })
+    })
+}
+
+// us_file_write_async is the asynchronous version of us_file_write.
+//
+//export us_file_write_async
+func us_file_write_async(id unsafe.Pointer, cq_p unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    b := goBytes(buf, int(count))
+    return startFileOp(id, cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+        return async.TransferChunks(opCtx, b, 0, func(chunk []byte, _ int64) (int, error) {
+            return pf.Write(chunk)
+        })
+    })
+}
+
+// us_file_read_at_async is the asynchronous version of us_file_read_at.
+//
+//export us_file_read_at_async
+func us_file_read_at_async(id unsafe.Pointer, cq_p unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, offset C.int64_t, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    } else if offset < 0 {
+        setError(id, errcode.ErrNegative)
+        return 0
+    }
+    b := goBytes(buf, int(count))
+    return startFileOp(id, cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+        n, err := async.TransferChunks(opCtx, b, int64(offset), pf.ReadAt)
+        if err == io.EOF {
+            err = nil
+        }
+        return n, err
+    })
+}
+
+// us_file_write_at_async is the asynchronous version of us_file_write_at.
+//
+//export us_file_write_at_async
+func us_file_write_at_async(id unsafe.Pointer, cq_p unsafe.Pointer, file_p unsafe.Pointer, buf unsafe.Pointer, count C.size_t, offset C.int64_t, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if buf == nil && count > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    } else if offset < 0 {
+        setError(id, errcode.ErrNegative)
+        return 0
+    }
+    b := goBytes(buf, int(count))
+    return startFileOp(id, cq_p, file_p, ctx, func(opCtx context.Context, pf *renterutil.PseudoFile) (int, error) {
+        return async.TransferChunks(opCtx, b, int64(offset), pf.WriteAt)
+    })
+}
+
+// us_file_sync_async is the asynchronous version of us_file_sync.
+//
+//export us_file_sync_async
+func us_file_sync_async(id unsafe.Pointer, cq_p unsafe.Pointer, file_p unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    return startFileOp(id, cq_p, file_p, ctx, func(_ context.Context, pf *renterutil.PseudoFile) (int, error) {
+        return 0, pf.Sync()
+    })
+}
+
+// us_file_close_async is the asynchronous version of us_file_close. The handle
+// is invalidated immediately; the completion reports whether the file's
+// contents were flushed successfully.
+//
+//export us_file_close_async
+func us_file_close_async(id unsafe.Pointer, cq_p unsafe.Pointer, file_p unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if _, err := loadQueue(cq_p); setError(id, err) {
+        return 0
+    }
+    guard := guardOf(file_p, handles.File)
+    v, err := ptrs.Take(file_p, handles.File)
+    if setError(id, err) {
+        return 0
+    }
+    pf := v.(*renterutil.PseudoFile)
+    op := startAsync(id, cq_p, ctx, nil, func(context.Context) (int64, unsafe.Pointer, error) {
+        return 0, nil, guard.Explain(pf.Close())
+    })
+    if op == 0 {
+        // the handle is already gone, so close the file anyway
+        pf.Close()
+    }
+    return op
+}
+
+// us_ll_new_session_async is the asynchronous version of us_ll_new_session.
+// The new Session is stored in the handle field of the completion.
+//
+//export us_ll_new_session_async
+func us_ll_new_session_async(id unsafe.Pointer, cq_p unsafe.Pointer, client_p unsafe.Pointer, host_str *C.char, contract *C.struct_contract_t, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if host_str == nil || contract == nil {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    v, err := ptrs.Pin(client_p, handles.Client)
+    if setError(id, err) {
+        return 0
+    }
+    cl, hostKeyPrefix := v.(*client), C.GoString(host_str)
+    c := contractfile.Decode(C.GoBytes(unsafe.Pointer(contract), C.sizeof_struct_contract_t))
+    return startAsync(id, cq_p, ctx, []unsafe.Pointer{client_p}, func(context.Context) (int64, unsafe.Pointer, error) {
+        siad, limits := cl.snapshot()
+        session, err := newSession(siad, limits, hostKeyPrefix, c)
+        if err != nil {
+            return 0, nil, err
+        }
+        return 0, ptrs.Store(handles.Session, session), nil
+    })
+}
+
+// startSessionOp pins the session referenced by session_p and runs fn on it
+// asynchronously. Canceling the operation closes the session's connection.
+func startSessionOp(id, cq_p, session_p, ctx unsafe.Pointer, fn func(*proto.Session) (int64, error)) C.uint64_t {
+    v, err := ptrs.Pin(session_p, handles.Session)
+    if setError(id, err) {
+        return 0
+    }
+    sess := v.(*session)
+    return startAsync(id, cq_p, ctx, []unsafe.Pointer{session_p}, func(opCtx context.Context) (n int64, _ unsafe.Pointer, err error) {
+        err = sess.do(opCtx, func(s *proto.Session) (err error) {
+            n, err = fn(s)
+            return
+        })
+        return n, nil, err
+    })
+}
+
+// us_ll_upload_async is the asynchronous version of us_ll_upload. The sector's
+// Merkle root is written to root, which must point to 32 bytes.
+//
+//export us_ll_upload_async
+func us_ll_upload_async(id unsafe.Pointer, cq_p unsafe.Pointer, session_p unsafe.Pointer, buf unsafe.Pointer, root unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if buf == nil || root == nil {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    sector := new([renterhost.SectorSize]byte)
+    copy(sector[:], goBytes(buf, renterhost.SectorSize))
+    rootBuf := goBytes(root, crypto.HashSize)
+    return startSessionOp(id, cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+        h, err := s.Append(sector)
+        if err != nil {
+            return 0, err
+        }
+        copy(rootBuf, h[:])
+        return 0, nil
+    })
+}
+
+// us_ll_download_async is the asynchronous version of us_ll_download.
+//
+//export us_ll_download_async
+func us_ll_download_async(id unsafe.Pointer, cq_p unsafe.Pointer, session_p unsafe.Pointer, root unsafe.Pointer, buf unsafe.Pointer, offset C.uint, length C.uint, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if root == nil || (buf == nil && length > 0) {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    var sectorMerkleRoot crypto.Hash
+    copy(sectorMerkleRoot[:], goBytes(root, crypto.HashSize))
+    b := goBytes(buf, int(length))
+    return startSessionOp(id, cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+        if err := downloadSections(s, []section{{sectorMerkleRoot, uint32(offset), b}}); err != nil {
+            return 0, err
+        }
+        return int64(len(b)), nil
+    })
+}
+
+// us_ll_download_many_async is the asynchronous version of
+// us_ll_download_many. The sections array itself is copied, but the buffers
+// must remain valid until the operation completes.
+//
+//export us_ll_download_many_async
+func us_ll_download_many_async(id unsafe.Pointer, cq_p unsafe.Pointer, session_p unsafe.Pointer, sections *C.us_section_t, n C.size_t, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    secs, err := goSections(sections, n)
+    if setError(id, err) {
+        return 0
+    }
+    return startSessionOp(id, cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+        if err := downloadSections(s, secs); err != nil {
+            return 0, err
+        }
+        var total int64
+        for _, sec := range secs {
+            total += int64(len(sec.buf))
+        }
+        return total, nil
+    })
+}
+
+// The asynchronous versions of the functions that modify sectors report the
+// new size of the contract as the result of the completion. Their arguments
+// (but not roots or contract_root) are copied before they return.
+
+// us_ll_upload_many_async is the asynchronous version of us_ll_upload_many.
+//
+//export us_ll_upload_many_async
+func us_ll_upload_many_async(id unsafe.Pointer, cq_p unsafe.Pointer, session_p unsafe.Pointer, bufs unsafe.Pointer, n C.size_t, roots unsafe.Pointer, contract_root unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if n > 0 && (bufs == nil || roots == nil) {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    sectors := C.GoBytes(bufs, C.int(int(n)*renterhost.SectorSize))
+    rootBuf := goBytes(roots, int(n)*crypto.HashSize)
+    return startSessionOp(id, cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+        if err := appendSectors(s, sectors, rootBuf); err != nil {
+            return 0, err
+        }
+        return contractState(s, contract_root), nil
+    })
+}
+
+// us_ll_swap_sectors_async is the asynchronous version of us_ll_swap_sectors.
+//
+//export us_ll_swap_sectors_async
+func us_ll_swap_sectors_async(id unsafe.Pointer, cq_p unsafe.Pointer, session_p unsafe.Pointer, pairs *C.uint64_t, n C.size_t, contract_root unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if pairs == nil && n > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    indices := goPairs(pairs, n)
+    return startSessionOp(id, cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+        if err := swapSectors(s, indices); err != nil {
+            return 0, err
+        }
+        return contractState(s, contract_root), nil
+    })
+}
+
+// us_ll_trim_sectors_async is the asynchronous version of us_ll_trim_sectors.
+//
+//export us_ll_trim_sectors_async
+func us_ll_trim_sectors_async(id unsafe.Pointer, cq_p unsafe.Pointer, session_p unsafe.Pointer, n C.uint64_t, contract_root unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    return startSessionOp(id, cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+        if err := trimSectors(s, uint64(n)); err != nil {
+            return 0, err
+        }
+        return contractState(s, contract_root), nil
+    })
+}
+
+// us_ll_delete_sectors_async is the asynchronous version of
+// us_ll_delete_sectors.
+//
+//export us_ll_delete_sectors_async
+func us_ll_delete_sectors_async(id unsafe.Pointer, cq_p unsafe.Pointer, session_p unsafe.Pointer, roots unsafe.Pointer, n C.size_t, contract_root unsafe.Pointer, ctx unsafe.Pointer) C.uint64_t {
+    defer recoverPanic(id, nil)
+    if roots == nil && n > 0 {
+        setError(id, errcode.ErrNullArgument)
+        return 0
+    }
+    hs := goRoots(roots, n)
+    return startSessionOp(id, cq_p, session_p, ctx, func(s *proto.Session) (int64, error) {
+        if err := s.DeleteSectors(hs); err != nil {
+            return 0, err
+        }
+        return contractState(s, contract_root), nil
+    })
+}
+
+func parseAddr(addr string) (types.UnlockHash, error) {
+    var uh types.UnlockHash
+    if err := uh.LoadString(addr); err != nil {
+        return types.UnlockHash{}, fmt.Errorf("%w: invalid address %q: %v", errcode.ErrInvalidArgument, addr, err)
+    }
+    return uh, nil
+}
+
+func parseAmount(value string) (types.Currency, error) {
+    var c types.Currency
+    if _, err := fmt.Sscan(value, &c); err != nil {
+        return types.Currency{}, fmt.Errorf("%w: invalid amount %q: %v", errcode.ErrInvalidArgument, value, err)
+    }
+    return c, nil
+}
+
+// A txnBuilder builds a transaction that sends siacoins from addresses derived
+// from a seed.
+type txnBuilder struct {
+    mu         sync.Mutex
+    txn        types.Transaction
+    feePerByte types.Currency
+    inputSum   types.Currency
+    outputSum  types.Currency
+    keys       []uint64 // key index of each input
+}
+
+func (t *txnBuilder) addOutput(addr, amount string) error {
+    uh, err := parseAddr(addr)
+    if err != nil {
+        return err
+    }
+    value, err := parseAmount(amount)
+    if err != nil {
+        return err
+    }
+    t.txn.SiacoinOutputs = append(t.txn.SiacoinOutputs, types.SiacoinOutput{
+        UnlockHash: uh,
+        Value:      value,
+    })
+    t.outputSum = t.outputSum.Add(value)
+    return nil
+}
+
+func (t *txnBuilder) calcFee() types.Currency {
+    size := t.txn.MarshalSiaSize() + 100*len(t.txn.SiacoinInputs)
+    return t.feePerByte.Mul64(uint64(size))
+}
+
+// addInput adds an input and reports whether the inputs now cover the outputs
+// and the fee.
+func (t *txnBuilder) addInput(id, value, publicKey string, keyIndex uint64) (bool, error) {
+    var scoid crypto.Hash
+    if err := scoid.LoadString(id); err != nil {
+        return false, fmt.Errorf("%w: invalid output ID %q: %v", errcode.ErrInvalidArgument, id, err)
+    }
+    var pk types.SiaPublicKey
+    if pk.LoadString(publicKey); pk.Algorithm != types.SignatureEd25519 {
+        return false, fmt.Errorf("%w: invalid public key %q", errcode.ErrInvalidArgument, publicKey)
+    }
+    amount, err := parseAmount(value)
+    if err != nil {
+        return false, err
+    }
+    t.txn.SiacoinInputs = append(t.txn.SiacoinInputs, types.SiacoinInput{
+        ParentID:         types.SiacoinOutputID(scoid),
+        UnlockConditions: wallet.StandardUnlockConditions(pk),
+    })
+    t.keys = append(t.keys, keyIndex)
+    t.inputSum = t.inputSum.Add(amount)
+    return t.inputSum.Cmp(t.outputSum.Add(t.calcFee())) >= 0, nil
+}
+
+// finalize sets the miner fee and sends any change to changeAddr.
+func (t *txnBuilder) finalize(changeAddr string) error {
+    if t.inputSum.Cmp(t.outputSum) < 0 {
+        return errcode.ErrInsufficientInputs
+    }
+    fee := t.calcFee()
+    change := t.inputSum.Sub(t.outputSum)
+    if change.Cmp(fee) < 0 {
+        fee = change
+    }
+    change = change.Sub(fee)
+    if !change.IsZero() {
+        if err := t.addOutput(changeAddr, change.String()); err != nil {
+            return err
+        }
+    }
+    t.txn.MinerFees = []types.Currency{fee}
+    return nil
+}
+
+// sign replaces any existing signatures with a signature for each input, in
+// order.
+func (t *txnBuilder) sign(seed wallet.Seed) {
+    t.txn.TransactionSignatures = nil
+    for i, in := range t.txn.SiacoinInputs {
+        sig := wallet.StandardTransactionSignature(crypto.Hash(in.ParentID))
+        wallet.AppendTransactionSignature(&t.txn, sig, seed.SecretKey(t.keys[i]))
+    }
+}
+
+func loadSeed(p unsafe.Pointer) (wallet.Seed, error) {
+    v, err := ptrs.Load(p, handles.Seed)
+    if err != nil {
+        return wallet.Seed{}, err
+    }
+    return v.(wallet.Seed), nil
+}
+
+func loadTxn(p unsafe.Pointer) (*txnBuilder, error) {
+    v, err := ptrs.Load(p, handles.Txn)
+    if err != nil {
+        return nil, err
+    }
+    return v.(*txnBuilder), nil
+}
+
+// us_seed_init generates a new random seed. It must be freed with
+// us_seed_free.
+//
+//export us_seed_init
+func us_seed_init(id unsafe.Pointer) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    setError(id, nil)
+    return ptrs.Store(handles.Seed, wallet.NewSeed())
+}
+
+// us_seed_from_phrase returns the seed encoded by a 12-word phrase. It must be
+// freed with us_seed_free.
+//
+//export us_seed_from_phrase
+func us_seed_from_phrase(id unsafe.Pointer, phrase *C.char) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    if phrase == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    s, err := wallet.SeedFromPhrase(C.GoString(phrase))
+    if err != nil {
+        setError(id, fmt.Errorf("%w: %v", errcode.ErrInvalidArgument, err))
+        return nil
+    }
+    setError(id, nil)
+    return ptrs.Store(handles.Seed, s)
+}
+
+// us_seed_phrase returns the 12-word phrase encoding the seed. The returned
+// string must be freed with us_free.
+//
+//export us_seed_phrase
+func us_seed_phrase(id unsafe.Pointer, seed_p unsafe.Pointer) *C.char {
+    defer recoverPanic(id, nil)
+    s, err := loadSeed(seed_p)
+    if setError(id, err) {
+        return nil
+    }
+    return allocString(s.String())
+}
+
+// us_seed_public_key returns the public key at the given index, in the form
+// "ed25519:<hex>". The returned string must be freed with us_free.
+//
+//export us_seed_public_key
+func us_seed_public_key(id unsafe.Pointer, seed_p unsafe.Pointer, index C.uint64_t) *C.char {
+    defer recoverPanic(id, nil)
+    s, err := loadSeed(seed_p)
+    if setError(id, err) {
+        return nil
+    }
+    return allocString(s.PublicKey(uint64(index)).String())
+}
+
+//export us_seed_free
+func us_seed_free(id unsafe.Pointer, seed_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    if seed_p == nil {
+        return !setError(id, nil)
+    }
+    _, err := ptrs.Take(seed_p, handles.Seed)
+    return !setError(id, err)
+}
+
+// us_validate_address reports whether addr is a valid Sia address.
+//
+//export us_validate_address
+func us_validate_address(id unsafe.Pointer, addr *C.char) bool {
+    defer recoverPanic(id, nil)
+    setError(id, nil)
+    return addr != nil && new(types.UnlockHash).LoadString(C.GoString(addr)) == nil
+}
+
+// us_txn_init creates an empty transaction that pays fee_per_byte hastings
+// per byte in miner fees. It must be freed with us_txn_free.
+//
+//export us_txn_init
+func us_txn_init(id unsafe.Pointer, fee_per_byte *C.char) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    if fee_per_byte == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    fee, err := parseAmount(C.GoString(fee_per_byte))
+    if setError(id, err) {
+        return nil
+    }
+    return ptrs.Store(handles.Txn, &txnBuilder{feePerByte: fee})
+}
+
+// us_txn_add_output adds an output sending amount hastings to addr.
+//
+//export us_txn_add_output
+func us_txn_add_output(id unsafe.Pointer, txn_p unsafe.Pointer, addr *C.char, amount *C.char) bool {
+    defer recoverPanic(id, nil)
+    t, err := loadTxn(txn_p)
+    if setError(id, err) {
+        return false
+    } else if addr == nil || amount == nil {
+        return !setError(id, errcode.ErrNullArgument)
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return !setError(id, t.addOutput(C.GoString(addr), C.GoString(amount)))
+}
+
+// us_txn_add_input adds the output output_id, worth value hastings, as an
+// input. The output must be spendable by public_key, which is derived from the
+// signing seed at key_index. It returns 1 if the inputs now cover the outputs
+// and the miner fee, 0 if more inputs are needed, or -1 on failure.
+//
+//export us_txn_add_input
+func us_txn_add_input(id unsafe.Pointer, txn_p unsafe.Pointer, output_id *C.char, value *C.char, public_key *C.char, key_index C.uint64_t) (ret C.int) {
+    defer recoverPanic(id, func() { ret = -1 })
+    t, err := loadTxn(txn_p)
+    if setError(id, err) {
+        return -1
+    } else if output_id == nil || value == nil || public_key == nil {
+        setError(id, errcode.ErrNullArgument)
+        return -1
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    funded, err := t.addInput(C.GoString(output_id), C.GoString(value), C.GoString(public_key), uint64(key_index))
+    if setError(id, err) {
+        return -1
+    } else if funded {
+        return 1
+    }
+    return 0
+}
+
+// us_txn_finalize sets the miner fee and sends any change to change_addr. It
+// fails if the inputs do not cover the outputs.
+//
+//export us_txn_finalize
+func us_txn_finalize(id unsafe.Pointer, txn_p unsafe.Pointer, change_addr *C.char) bool {
+    defer recoverPanic(id, nil)
+    t, err := loadTxn(txn_p)
+    if setError(id, err) {
+        return false
+    } else if change_addr == nil {
+        return !setError(id, errcode.ErrNullArgument)
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return !setError(id, t.finalize(C.GoString(change_addr)))
+}
+
+// us_txn_sign signs each input of the transaction with the corresponding key
+// derived from seed, replacing any existing signatures.
+//
+//export us_txn_sign
+func us_txn_sign(id unsafe.Pointer, txn_p unsafe.Pointer, seed_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    t, err := loadTxn(txn_p)
+    if setError(id, err) {
+        return false
+    }
+    s, err := loadSeed(seed_p)
+    if setError(id, err) {
+        return false
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.sign(s)
+    return true
+}
+
+// us_txn_json returns the transaction encoded as JSON, as accepted by siad and
+// walrus. The returned string must be freed with us_free.
+//
+//export us_txn_json
+func us_txn_json(id unsafe.Pointer, txn_p unsafe.Pointer) *C.char {
+    defer recoverPanic(id, nil)
+    t, err := loadTxn(txn_p)
+    if setError(id, err) {
+        return nil
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    js, err := json.Marshal(t.txn)
+    if setError(id, err) {
+        return nil
+    }
+    return allocString(string(js))
+}
+
+// us_txn_encode returns the transaction in the Sia binary encoding, storing
+// its length in n. The returned buffer must be freed with us_free.
+//
+//export us_txn_encode
+func us_txn_encode(id unsafe.Pointer, txn_p unsafe.Pointer, n *C.size_t) unsafe.Pointer {
+    defer recoverPanic(id, nil)
+    t, err := loadTxn(txn_p)
+    if setError(id, err) {
+        return nil
+    } else if n == nil {
+        setError(id, errcode.ErrNullArgument)
+        return nil
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    var buf bytes.Buffer
+    if err := t.txn.MarshalSia(&buf); setError(id, err) {
+        return nil
+    }
+    *n = C.size_t(buf.Len())
+    return allocBytes(buf.Bytes())
+}
+
+//export us_txn_free
+func us_txn_free(id unsafe.Pointer, txn_p unsafe.Pointer) bool {
+    defer recoverPanic(id, nil)
+    if txn_p == nil {
+        return !setError(id, nil)
     }
-    pf := loadPtr(file_p).(*renterutil.PseudoFile)
-    freePtr(file_p)
-    return !setError(id, pf.Close())
+    _, err := ptrs.Take(txn_p, handles.Txn)
+    return !setError(id, err)
 }
 
 func main() {}
@@ -0,0 +1,868 @@
+package main
+
+import (
+    "bytes"
+    "crypto/ed25519"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net"
+    "net/http/httptest"
+    "os"
+    "runtime"
+    "sync/atomic"
+    "testing"
+    "time"
+    "unsafe"
+
+    "gitlab.com/NebulousLabs/Sia/modules"
+    "gitlab.com/NebulousLabs/Sia/types"
+    "lukechampine.com/us-bindings/internal/errcode"
+    "lukechampine.com/us-bindings/internal/ghost"
+    "lukechampine.com/us-bindings/internal/handles"
+    "lukechampine.com/us-bindings/internal/servertest"
+    "lukechampine.com/us-bindings/internal/walrus"
+    "lukechampine.com/us/hostdb"
+    "lukechampine.com/us/merkle"
+    "lukechampine.com/us/renterhost"
+    "lukechampine.com/us/wallet"
+)
+
+// Test files cannot use cgo, so they refer to C types by the names that cgo
+// generates for bindings.go, e.g. _Ctype_char for C.char. Since the exports
+// are called from Go, Go memory can be passed where C memory is expected.
+
+// cString returns s as a NUL-terminated string.
+func cString(s string) *_Ctype_char {
+    b := append([]byte(s), 0)
+    return (*_Ctype_char)(unsafe.Pointer(&b[0]))
+}
+
+// goString returns the NUL-terminated string at p, and frees it.
+func goString(p *_Ctype_char) string {
+    if p == nil {
+        return ""
+    }
+    defer us_free(unsafe.Pointer(p))
+    var b []byte
+    for q := unsafe.Pointer(p); *(*byte)(q) != 0; q = unsafe.Add(q, 1) {
+        b = append(b, *(*byte)(q))
+    }
+    return string(b)
+}
+
+// checkError checks that the most recent call with the given id on the
+// current thread failed with the error code corresponding to want, or
+// succeeded if want is nil. The caller must be locked to its thread.
+func checkError(t *testing.T, id unsafe.Pointer, desc string, want error) {
+    t.Helper()
+    got := getError(id)
+    if want == nil {
+        if got != nil {
+            t.Errorf("%v: expected no error, got %v", desc, got)
+        }
+    } else if got == nil {
+        t.Errorf("%v: expected error code %v, got no error", desc, errorCode(want))
+    } else if errorCode(got) != errorCode(want) {
+        t.Errorf("%v: expected error code %v, got %v (%v)", desc, errorCode(want), errorCode(got), got)
+    }
+}
+
+func TestBogusHandles(t *testing.T) {
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    id := unsafe.Pointer(new(int))
+    defer us_error_free(id)
+
+    // free a seed, then create a transaction, which reuses the seed's slot in
+    // the handle table with a new generation
+    stale := us_seed_init(id)
+    us_seed_free(id, stale)
+    txn := us_txn_init(id, cString("1"))
+    defer us_txn_free(id, txn)
+    if uintptr(txn)&(1<<handles.GenShift-1) != uintptr(stale)&(1<<handles.GenShift-1) {
+        t.Fatal("expected freed slot to be reused")
+    }
+    seed := us_seed_init(id)
+    defer us_seed_free(id, seed)
+    cq := us_cq_init(id)
+    defer us_cq_free(id, cq)
+
+    bogus := []struct {
+        desc string
+        p    unsafe.Pointer
+        err  error
+    }{
+        {"Go pointer", unsafe.Pointer(new(int)), errcode.ErrInvalidHandle},
+        {"index out of range", unsafe.Add(seed, 1<<20), errcode.ErrInvalidHandle},
+        {"future generation", unsafe.Add(seed, 1<<handles.GenShift), errcode.ErrInvalidHandle},
+        {"closed handle", stale, errcode.ErrClosedHandle},
+        {"wrong kind", seed, errcode.ErrInvalidHandle},
+        {"wrong kind", txn, errcode.ErrInvalidHandle},
+    }
+
+    var contract _Ctype_struct_contract_t
+    var section _Ctype_us_section_t
+    var comp _Ctype_us_completion_t
+    var pair [2]_Ctype_uint64_t
+    var n _Ctype_size_t
+    buf := make([]byte, renterhost.SectorSize)
+    bufp := unsafe.Pointer(&buf[0])
+    root := make([]byte, 32)
+    rootp := unsafe.Pointer(&root[0])
+    key := make([]byte, 32)
+    keyp := unsafe.Pointer(&key[0])
+    name := cString("foo")
+    host := cString("ed25519:0000")
+    funds := cString("1SC")
+    exports := []struct {
+        name string
+        kind handles.Kind
+        call func(p unsafe.Pointer) bool // reports whether the call succeeded
+    }{
+        {"us_ll_client_close", handles.Client, func(p unsafe.Pointer) bool { return us_ll_client_close(id, p) }},
+        {"us_ll_client_set_limits", handles.Client, func(p unsafe.Pointer) bool { return us_ll_client_set_limits(id, p, nil) }},
+        {"us_ll_form_contract", handles.Client, func(p unsafe.Pointer) bool { return us_ll_form_contract(id, p, host, keyp, funds, 10) != nil }},
+        {"us_ll_renew_contract", handles.Client, func(p unsafe.Pointer) bool { return us_ll_renew_contract(id, p, &contract, funds, 10) != nil }},
+        {"us_ll_scan_host", handles.Client, func(p unsafe.Pointer) bool { return us_ll_scan_host(id, p, host, 1) != nil }},
+        {"us_ll_scan_hosts", handles.Client, func(p unsafe.Pointer) bool { return us_ll_scan_hosts(id, p, &host, 1, 1) != nil }},
+        {"us_ll_new_session", handles.Client, func(p unsafe.Pointer) bool { return us_ll_new_session(id, p, host, &contract) != nil }},
+        {"us_ll_new_session_async", handles.Client, func(p unsafe.Pointer) bool { return us_ll_new_session_async(id, cq, p, host, &contract, nil) != 0 }},
+        {"us_ll_upload", handles.Session, func(p unsafe.Pointer) bool { return us_ll_upload(id, p, bufp) != nil }},
+        {"us_ll_download", handles.Session, func(p unsafe.Pointer) bool { return us_ll_download(id, p, rootp, bufp, 0, 64) != -1 }},
+        {"us_ll_download_many", handles.Session, func(p unsafe.Pointer) bool { return us_ll_download_many(id, p, &section, 1) != -1 }},
+        {"us_ll_session_settings", handles.Session, func(p unsafe.Pointer) bool { return us_ll_session_settings(id, p) != nil }},
+        {"us_ll_session_revision", handles.Session, func(p unsafe.Pointer) bool { return us_ll_session_revision(id, p) != nil }},
+        {"us_ll_upload_many", handles.Session, func(p unsafe.Pointer) bool { return us_ll_upload_many(id, p, bufp, 1, rootp, rootp) != -1 }},
+        {"us_ll_swap_sectors", handles.Session, func(p unsafe.Pointer) bool { return us_ll_swap_sectors(id, p, &pair[0], 1, rootp) != -1 }},
+        {"us_ll_trim_sectors", handles.Session, func(p unsafe.Pointer) bool { return us_ll_trim_sectors(id, p, 1, rootp) != -1 }},
+        {"us_ll_delete_sectors", handles.Session, func(p unsafe.Pointer) bool { return us_ll_delete_sectors(id, p, rootp, 1, rootp) != -1 }},
+        {"us_ll_session_close", handles.Session, func(p unsafe.Pointer) bool { return us_ll_session_close(id, p) }},
+        {"us_ll_upload_async", handles.Session, func(p unsafe.Pointer) bool { return us_ll_upload_async(id, cq, p, bufp, rootp, nil) != 0 }},
+        {"us_ll_download_async", handles.Session, func(p unsafe.Pointer) bool { return us_ll_download_async(id, cq, p, rootp, bufp, 0, 64, nil) != 0 }},
+        {"us_ll_download_many_async", handles.Session, func(p unsafe.Pointer) bool { return us_ll_download_many_async(id, cq, p, &section, 1, nil) != 0 }},
+        {"us_ll_upload_many_async", handles.Session, func(p unsafe.Pointer) bool { return us_ll_upload_many_async(id, cq, p, bufp, 1, rootp, rootp, nil) != 0 }},
+        {"us_ll_swap_sectors_async", handles.Session, func(p unsafe.Pointer) bool { return us_ll_swap_sectors_async(id, cq, p, &pair[0], 1, rootp, nil) != 0 }},
+        {"us_ll_trim_sectors_async", handles.Session, func(p unsafe.Pointer) bool { return us_ll_trim_sectors_async(id, cq, p, 1, rootp, nil) != 0 }},
+        {"us_ll_delete_sectors_async", handles.Session, func(p unsafe.Pointer) bool { return us_ll_delete_sectors_async(id, cq, p, rootp, 1, rootp, nil) != 0 }},
+        {"us_hostset_free", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_free(id, p) }},
+        {"us_hostset_add", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_add(id, p, &contract) }},
+        {"us_hostset_add_dir", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_add_dir(id, p, cString(t.TempDir())) != -1 }},
+        {"us_hostset_set_limits", handles.HostSet, func(p unsafe.Pointer) bool { return us_hostset_set_limits(id, p, nil) }},
+        {"us_fs_init", handles.HostSet, func(p unsafe.Pointer) bool { return us_fs_init(id, cString(t.TempDir()), p) != nil }},
+        {"us_fs_close", handles.FS, func(p unsafe.Pointer) bool { return us_fs_close(id, p) }},
+        {"us_fs_create", handles.FS, func(p unsafe.Pointer) bool { return us_fs_create(id, p, name, 1) != nil }},
+        {"us_fs_open", handles.FS, func(p unsafe.Pointer) bool { return us_fs_open(id, p, name) != nil }},
+        {"us_fs_create_async", handles.FS, func(p unsafe.Pointer) bool { return us_fs_create_async(id, cq, p, name, 1, nil) != 0 }},
+        {"us_fs_open_async", handles.FS, func(p unsafe.Pointer) bool { return us_fs_open_async(id, cq, p, name, nil) != 0 }},
+        {"us_fs_close_async", handles.FS, func(p unsafe.Pointer) bool { return us_fs_close_async(id, cq, p, nil) != 0 }},
+        {"us_file_read", handles.File, func(p unsafe.Pointer) bool { return us_file_read(id, p, bufp, 64) != -1 }},
+        {"us_file_write", handles.File, func(p unsafe.Pointer) bool { return us_file_write(id, p, bufp, 64) != -1 }},
+        {"us_file_read_at", handles.File, func(p unsafe.Pointer) bool { return us_file_read_at(id, p, bufp, 64, 0) != -1 }},
+        {"us_file_write_at", handles.File, func(p unsafe.Pointer) bool { return us_file_write_at(id, p, bufp, 64, 0) != -1 }},
+        {"us_file_seek", handles.File, func(p unsafe.Pointer) bool { return us_file_seek(id, p, 0, 0) != -1 }},
+        {"us_file_size", handles.File, func(p unsafe.Pointer) bool { return us_file_size(id, p) != -1 }},
+        {"us_file_truncate", handles.File, func(p unsafe.Pointer) bool { return us_file_truncate(id, p, 0) }},
+        {"us_file_sync", handles.File, func(p unsafe.Pointer) bool { return us_file_sync(id, p) }},
+        {"us_file_close", handles.File, func(p unsafe.Pointer) bool { return us_file_close(id, p) }},
+        {"us_file_read_async", handles.File, func(p unsafe.Pointer) bool { return us_file_read_async(id, cq, p, bufp, 64, nil) != 0 }},
+        {"us_file_write_async", handles.File, func(p unsafe.Pointer) bool { return us_file_write_async(id, cq, p, bufp, 64, nil) != 0 }},
+        {"us_file_read_at_async", handles.File, func(p unsafe.Pointer) bool { return us_file_read_at_async(id, cq, p, bufp, 64, 0, nil) != 0 }},
+        {"us_file_write_at_async", handles.File, func(p unsafe.Pointer) bool { return us_file_write_at_async(id, cq, p, bufp, 64, 0, nil) != 0 }},
+        {"us_file_sync_async", handles.File, func(p unsafe.Pointer) bool { return us_file_sync_async(id, cq, p, nil) != 0 }},
+        {"us_file_close_async", handles.File, func(p unsafe.Pointer) bool { return us_file_close_async(id, cq, p, nil) != 0 }},
+        {"us_cq_fd", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_fd(id, p) != -1 }},
+        {"us_cq_poll", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_poll(id, p, &comp) != -1 }},
+        {"us_cq_cancel", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_cancel(id, p, 1) }},
+        {"us_cq_free", handles.Queue, func(p unsafe.Pointer) bool { return us_cq_free(id, p) }},
+        {"us_seed_phrase", handles.Seed, func(p unsafe.Pointer) bool { return us_seed_phrase(id, p) != nil }},
+        {"us_seed_public_key", handles.Seed, func(p unsafe.Pointer) bool { return us_seed_public_key(id, p, 0) != nil }},
+        {"us_seed_free", handles.Seed, func(p unsafe.Pointer) bool { return us_seed_free(id, p) }},
+        {"us_txn_add_output", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_add_output(id, p, name, name) }},
+        {"us_txn_add_input", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_add_input(id, p, name, name, name, 0) != -1 }},
+        {"us_txn_finalize", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_finalize(id, p, name) }},
+        {"us_txn_sign", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_sign(id, p, seed) }},
+        {"us_txn_json", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_json(id, p) != nil }},
+        {"us_txn_encode", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_encode(id, p, &n) != nil }},
+        {"us_txn_free", handles.Txn, func(p unsafe.Pointer) bool { return us_txn_free(id, p) }},
+    }
+    for _, e := range exports {
+        for _, h := range bogus {
+            if h.p == seed && e.kind == handles.Seed || h.p == txn && e.kind == handles.Txn {
+                continue
+            }
+            if e.call(h.p) {
+                t.Errorf("%v with %v: expected failure", e.name, h.desc)
+            }
+            checkError(t, id, e.name+" with "+h.desc, h.err)
+        }
+    }
+
+    // the valid handles must be unaffected, and nothing may have been
+    // submitted to the queue
+    if p := us_seed_phrase(id, seed); p == nil {
+        t.Error("seed handle should still be valid")
+    } else {
+        us_free(unsafe.Pointer(p))
+    }
+    if p := us_txn_json(id, txn); p == nil {
+        t.Error("transaction handle should still be valid")
+    } else {
+        us_free(unsafe.Pointer(p))
+    }
+    if us_cq_poll(id, cq, &comp) != 0 {
+        t.Error("no operations should have been submitted")
+    }
+}
+
+// newGhostClient returns a low-level client that resolves h through a shard
+// server and funds contracts through a walrus server holding 10 SC for
+// vectorPhrase. It also returns the shard server's address.
+func newGhostClient(t *testing.T, id unsafe.Pointer, h *ghost.Host) (unsafe.Pointer, string) {
+    shardSrv := servertest.NewShard(t, h.Key, h.Settings.NetAddress, h.Height())
+    seed, err := wallet.SeedFromPhrase(vectorPhrase)
+    if err != nil {
+        t.Fatal(err)
+    }
+    walrusSrv := httptest.NewServer(servertest.NewWalrus(seed, types.SiacoinPrecision.Mul64(10)))
+    t.Cleanup(walrusSrv.Close)
+    client := us_ll_client_init_shard(id, cString(shardSrv.URL), cString(walrusSrv.URL), cString(vectorPhrase))
+    if client == nil {
+        t.Fatal(getError(id))
+    }
+    return client, shardSrv.URL
+}
+
+// formGhostContract forms a contract with h, returning it in the format of
+// us_ll_form_contract. The contract is allocated by the library.
+func formGhostContract(t *testing.T, id, client unsafe.Pointer, h *ghost.Host, renterSeed []byte) *_Ctype_struct_contract_t {
+    p := us_ll_form_contract(id, client, cString(string(h.PublicKey)), unsafe.Pointer(&renterSeed[0]), cString("1SC"), 20)
+    if p == nil {
+        t.Fatal(getError(id))
+    }
+    return (*_Ctype_struct_contract_t)(p)
+}
+
+func TestLeaks(t *testing.T) {
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    live, allocs := ptrs.Len(), atomic.LoadInt64(&cAllocs)
+    id := unsafe.Pointer(new(int))
+
+    h := ghost.New(t, ghost.FreeSettings, ghost.StubWallet{}, ghost.StubTpool{})
+    client, shardAddr := newGhostClient(t, id, h)
+    contract := formGhostContract(t, id, client, h, make([]byte, 32))
+    host := cString(string(h.PublicKey))
+    for _, p := range []*_Ctype_char{
+        us_ll_scan_host(id, client, host, 1000),
+        us_ll_scan_hosts(id, client, &host, 1, 1000),
+    } {
+        if p == nil {
+            t.Fatal(getError(id))
+        }
+        us_free(unsafe.Pointer(p))
+    }
+
+    // a session's buffers and strings, and the session itself
+    session := us_ll_new_session(id, client, host, contract)
+    if session == nil {
+        t.Fatal(getError(id))
+    }
+    sector := make([]byte, renterhost.SectorSize)
+    copy(sector, "hello, world")
+    root := us_ll_upload(id, session, unsafe.Pointer(&sector[0]))
+    if root == nil {
+        t.Fatal(getError(id))
+    }
+    buf := make([]byte, merkle.SegmentSize)
+    if us_ll_download(id, session, root, unsafe.Pointer(&buf[0]), 0, merkle.SegmentSize) != merkle.SegmentSize {
+        t.Fatal(getError(id))
+    } else if !bytes.Equal(buf, sector[:merkle.SegmentSize]) {
+        t.Fatalf("downloaded %q", buf)
+    }
+    us_free(root)
+    for _, p := range []*_Ctype_char{
+        us_ll_session_settings(id, session),
+        us_ll_session_revision(id, session),
+    } {
+        if p == nil {
+            t.Fatal(getError(id))
+        }
+        us_free(unsafe.Pointer(p))
+    }
+    if !us_ll_session_close(id, session) || !us_ll_client_close(id, client) {
+        t.Fatal(getError(id))
+    }
+    us_free(unsafe.Pointer(contract))
+
+    // the error string of a failed asynchronous operation
+    hs := us_hostset_init_shard(id, cString(shardAddr))
+    if hs == nil {
+        t.Fatal(getError(id))
+    }
+    fs := us_fs_init(id, cString(t.TempDir()), hs)
+    cq := us_cq_init(id)
+    if fs == nil || cq == nil {
+        t.Fatal(getError(id))
+    } else if us_fs_open_async(id, cq, fs, cString("missing"), nil) == 0 {
+        t.Fatal(getError(id))
+    }
+    var comp _Ctype_us_completion_t
+    for us_cq_poll(id, cq, &comp) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+    if comp.error == nil {
+        t.Fatal("opening a missing file should fail")
+    }
+    us_free(unsafe.Pointer(comp.error))
+    if !us_cq_free(id, cq) || !us_fs_close(id, fs) || !us_hostset_free(id, hs) {
+        t.Fatal(getError(id))
+    }
+
+    // the caller's errors are discarded by us_error_free
+    if us_seed_free(id, unsafe.Pointer(new(int))) {
+        t.Fatal("freeing a bogus handle should fail")
+    } else if p := us_error(id); p == nil {
+        t.Fatal("expected an error")
+    } else {
+        us_free(unsafe.Pointer(p))
+    }
+    us_error_free(id)
+    errMu.Lock()
+    _, ok := us_err[uintptr(id)]
+    errMu.Unlock()
+    if ok {
+        t.Error("us_error_free should discard the caller's errors")
+    }
+
+    if n := ptrs.Len(); n != live {
+        t.Errorf("leaked %v handles", n-live)
+    }
+    if n := atomic.LoadInt64(&cAllocs); n != allocs {
+        t.Errorf("leaked %v buffers", n-allocs)
+    }
+}
+
+func TestRenewContract(t *testing.T) {
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    id := unsafe.Pointer(new(int))
+    defer us_error_free(id)
+    h := ghost.New(t, ghost.FreeSettings, ghost.StubWallet{}, ghost.StubTpool{})
+    client, _ := newGhostClient(t, id, h)
+    defer us_ll_client_close(id, client)
+    renterSeed := bytes.Repeat([]byte{7}, 32)
+    contract := formGhostContract(t, id, client, h, renterSeed)
+    defer us_free(unsafe.Pointer(contract))
+    host := cString(string(h.PublicKey))
+
+    // store a sector under the old contract
+    session := us_ll_new_session(id, client, host, contract)
+    if session == nil {
+        t.Fatal(getError(id))
+    }
+    sector := make([]byte, renterhost.SectorSize)
+    copy(sector, "renew me")
+    root := us_ll_upload(id, session, unsafe.Pointer(&sector[0]))
+    if root == nil {
+        t.Fatal(getError(id))
+    }
+    defer us_free(root)
+    if !us_ll_session_close(id, session) {
+        t.Fatal(getError(id))
+    }
+
+    const duration = 40
+    p := us_ll_renew_contract(id, client, contract, cString("1SC"), duration)
+    if p == nil {
+        t.Fatal(getError(id))
+    }
+    defer us_free(p)
+    renewed := (*_Ctype_struct_contract_t)(p)
+    oldBytes := unsafe.Slice((*byte)(unsafe.Pointer(contract)), 96)
+    newBytes := unsafe.Slice((*byte)(p), 96)
+    if !bytes.Equal(newBytes[:32], oldBytes[:32]) {
+        t.Error("renewed contract should be with the same host")
+    } else if bytes.Equal(newBytes[32:64], oldBytes[32:64]) {
+        t.Error("renewed contract should have a new ID")
+    } else if !bytes.Equal(newBytes[64:], renterSeed) {
+        t.Error("renewed contract should keep the renter key")
+    }
+
+    // the renewed contract can be locked with the same key, ends duration
+    // blocks after the current height, and holds the old contract's data
+    session = us_ll_new_session(id, client, host, renewed)
+    if session == nil {
+        t.Fatal(getError(id))
+    }
+    defer us_ll_session_close(id, session)
+    var info revisionInfo
+    if err := json.Unmarshal([]byte(goString(us_ll_session_revision(id, session))), &info); err != nil {
+        t.Fatal(err, getError(id))
+    } else if !bytes.Equal(info.ID[:], newBytes[32:64]) {
+        t.Errorf("expected revision of %x, got %v", newBytes[32:64], info.ID)
+    } else if info.EndHeight != h.Height()+duration {
+        t.Errorf("expected end height %v, got %v", h.Height()+duration, info.EndHeight)
+    } else if info.NumSectors != 1 {
+        t.Errorf("expected 1 sector to be carried over, got %v", info.NumSectors)
+    }
+    buf := make([]byte, merkle.SegmentSize)
+    if us_ll_download(id, session, root, unsafe.Pointer(&buf[0]), 0, merkle.SegmentSize) != merkle.SegmentSize {
+        t.Fatal(getError(id))
+    } else if !bytes.Equal(buf, sector[:merkle.SegmentSize]) {
+        t.Fatalf("downloaded %q", buf)
+    }
+}
+
+func TestLargeFile(t *testing.T) {
+    if testing.Short() {
+        t.Skip("uploads more than 4 GiB")
+    }
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    id := unsafe.Pointer(new(int))
+    defer us_error_free(id)
+    h := ghost.NewOnDisk(t, ghost.FreeSettings, ghost.StubWallet{}, ghost.StubTpool{})
+    client, shardAddr := newGhostClient(t, id, h)
+    defer us_ll_client_close(id, client)
+    contract := formGhostContract(t, id, client, h, make([]byte, 32))
+    defer us_free(unsafe.Pointer(contract))
+    hs := us_hostset_init_shard(id, cString(shardAddr))
+    if hs == nil {
+        t.Fatal(getError(id))
+    }
+    defer us_hostset_free(id, hs)
+    if !us_hostset_add(id, hs, contract) {
+        t.Fatal(getError(id))
+    }
+    fs := us_fs_init(id, cString(t.TempDir()), hs)
+    if fs == nil {
+        t.Fatal(getError(id))
+    }
+    defer us_fs_close(id, fs)
+
+    // fill the file with zeros up to off, then write past it; the hole must
+    // be written, since a file cannot be flushed with gaps in it
+    const off = 1<<32 + 64
+    data := []byte("hello")
+    file := us_fs_create(id, fs, cString("foo"), 1)
+    if file == nil {
+        t.Fatal(getError(id))
+    }
+    zeros := make([]byte, renterhost.SectorSize)
+    for n := int64(0); n < off; {
+        chunk := zeros
+        if rem := off - n; rem < int64(len(chunk)) {
+            chunk = chunk[:rem]
+        }
+        if m := us_file_write_at(id, file, unsafe.Pointer(&chunk[0]), _Ctype_size_t(len(chunk)), _Ctype_int64_t(n)); m != _Ctype_ssize_t(len(chunk)) {
+            t.Fatal(m, getError(id))
+        }
+        n += int64(len(chunk))
+    }
+    if n := us_file_write_at(id, file, unsafe.Pointer(&data[0]), _Ctype_size_t(len(data)), off); n != _Ctype_ssize_t(len(data)) {
+        t.Fatal(n, getError(id))
+    }
+    if !us_file_sync(id, file) || !us_file_close(id, file) {
+        t.Fatal(getError(id))
+    }
+
+    // reopen the file, which must now be read from the host
+    file = us_fs_open(id, fs, cString("foo"))
+    if file == nil {
+        t.Fatal(getError(id))
+    }
+    defer us_file_close(id, file)
+    if size := us_file_size(id, file); size != off+5 {
+        t.Errorf("expected size %v, got %v", off+5, size)
+    }
+    if pos := us_file_seek(id, file, -5, 2); pos != off {
+        t.Errorf("expected SEEK_END to reach %v, got %v", off, pos)
+    }
+    buf := make([]byte, 10)
+    if n := us_file_read(id, file, unsafe.Pointer(&buf[0]), 10); n != 5 || string(buf[:n]) != "hello" {
+        t.Errorf("expected to read %q, got %q", "hello", buf[:n])
+    }
+    if n := us_file_read_at(id, file, unsafe.Pointer(&buf[0]), 10, off-5); n != 10 || string(buf) != "\x00\x00\x00\x00\x00hello" {
+        t.Errorf("expected to read across the end of the hole, got %q", buf[:n])
+    }
+}
+
+func TestConcurrentProgress(t *testing.T) {
+    // the exports are called without the GIL, so while one thread is blocked
+    // in a File call to a host that never responds, another thread using the
+    // same caller ID must be able to use a Session with a working host
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    id := unsafe.Pointer(new(int))
+    defer us_error_free(id)
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    accepted := make(chan net.Conn, 10)
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            accepted <- conn
+        }
+    }()
+    stallKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+    stallShard := servertest.NewShard(t, stallKey, modules.NetAddress(l.Addr().String()), 1)
+    dir := t.TempDir()
+
+    synced := make(chan bool)
+    go func() {
+        runtime.LockOSThread()
+        defer runtime.UnlockOSThread()
+        hs := us_hostset_init_shard(id, cString(stallShard.URL))
+        if hs == nil {
+            t.Error(getError(id))
+            close(synced)
+            return
+        }
+        defer us_hostset_free(id, hs)
+        var contract _Ctype_struct_contract_t
+        copy((*[32]byte)(unsafe.Pointer(&contract.hostKey))[:], stallKey[32:])
+        contract.id[0] = 1
+        if !us_hostset_add(id, hs, &contract) {
+            t.Error(getError(id))
+            close(synced)
+            return
+        }
+        fs := us_fs_init(id, cString(dir), hs)
+        if fs == nil {
+            t.Error(getError(id))
+            close(synced)
+            return
+        }
+        defer us_fs_close(id, fs)
+        file := us_fs_create(id, fs, cString("foo"), 1)
+        if file == nil {
+            t.Error(getError(id))
+            close(synced)
+            return
+        }
+        defer us_file_close(id, file)
+        defer us_file_truncate(id, file, 0) // discard the pending write
+        data := []byte("hello")
+        if us_file_write(id, file, unsafe.Pointer(&data[0]), _Ctype_size_t(len(data))) != _Ctype_ssize_t(len(data)) {
+            t.Error(getError(id))
+            close(synced)
+            return
+        }
+        ok := us_file_sync(id, file)
+        if !ok && getError(id) == nil {
+            t.Error("failed sync should set an error on its thread")
+        }
+        synced <- ok
+    }()
+
+    // wait for the first thread to connect to the stalled host
+    var conn net.Conn
+    select {
+    case conn = <-accepted:
+    case <-synced:
+        t.Fatal("sync should block on the stalled host")
+    case <-time.After(10 * time.Second):
+        t.Fatal("sync never connected to the host")
+    }
+
+    h := ghost.New(t, ghost.FreeSettings, ghost.StubWallet{}, ghost.StubTpool{})
+    client, _ := newGhostClient(t, id, h)
+    defer us_ll_client_close(id, client)
+    contract := formGhostContract(t, id, client, h, make([]byte, 32))
+    defer us_free(unsafe.Pointer(contract))
+    session := us_ll_new_session(id, client, cString(string(h.PublicKey)), contract)
+    if session == nil {
+        t.Fatal(getError(id))
+    }
+    sector := make([]byte, renterhost.SectorSize)
+    copy(sector, "progress")
+    root := us_ll_upload(id, session, unsafe.Pointer(&sector[0]))
+    if root == nil {
+        t.Fatal(getError(id))
+    }
+    defer us_free(root)
+    buf := make([]byte, merkle.SegmentSize)
+    if us_ll_download(id, session, root, unsafe.Pointer(&buf[0]), 0, merkle.SegmentSize) != merkle.SegmentSize {
+        t.Fatal(getError(id))
+    } else if !bytes.Equal(buf, sector[:merkle.SegmentSize]) {
+        t.Fatalf("downloaded %q", buf)
+    } else if !us_ll_session_close(id, session) {
+        t.Fatal(getError(id))
+    }
+    select {
+    case <-synced:
+        t.Fatal("sync should still be blocked on the stalled host")
+    default:
+    }
+
+    // release the first thread; its failure must not be visible on this one
+    l.Close()
+    conn.Close()
+    if ok, done := <-synced; ok && done {
+        t.Error("sync with a host that hung up should fail")
+    }
+    checkError(t, id, "second thread", nil)
+}
+
+func TestErrorCleared(t *testing.T) {
+    runtime.LockOSThread()
+    defer runtime.UnlockOSThread()
+    id := unsafe.Pointer(new(int))
+    defer us_error_free(id)
+    bogus := unsafe.Pointer(new(int))
+    addr := cString(vectorAddresses[0])
+    phrase := cString(vectorPhrase)
+
+    // every call that does not fail must clear the error left by the
+    // previous call, even if it has nothing to report
+    var seed unsafe.Pointer
+    tests := []struct {
+        desc string
+        call func()
+    }{
+        {"us_seed_init", func() { seed = us_seed_init(id) }},
+        {"us_seed_from_phrase", func() { us_seed_free(id, seed); seed = us_seed_from_phrase(id, phrase) }},
+        {"us_validate_address", func() {
+            if !us_validate_address(id, addr) {
+                t.Error("address should be valid")
+            }
+        }},
+        {"us_validate_address (invalid)", func() { us_validate_address(id, phrase) }},
+        {"us_seed_free (NULL)", func() { us_seed_free(id, nil) }},
+        {"us_txn_free (NULL)", func() { us_txn_free(id, nil) }},
+        {"us_hostset_free (NULL)", func() { us_hostset_free(id, nil) }},
+        {"us_fs_close (NULL)", func() { us_fs_close(id, nil) }},
+        {"us_file_close (NULL)", func() { us_file_close(id, nil) }},
+        {"us_cq_free (NULL)", func() { us_cq_free(id, nil) }},
+        {"us_ll_client_close (NULL)", func() { us_ll_client_close(id, nil) }},
+        {"us_ll_session_close (NULL)", func() { us_ll_session_close(id, nil) }},
+    }
+    for _, test := range tests {
+        if us_seed_free(id, bogus) {
+            t.Fatal("freeing a bogus handle should fail")
+        }
+        test.call()
+        if err := getError(id); err != nil {
+            t.Errorf("%v: expected no error, got %v", test.desc, err)
+        }
+    }
+    if !us_seed_free(id, seed) {
+        t.Error("freeing a seed should succeed")
+    }
+}
+
+func TestShardBackend(t *testing.T) {
+    key := ed25519.NewKeyFromSeed(make([]byte, 32))
+    hostKey := hostdb.HostKeyFromPublicKey(ed25519.PublicKey(key[32:]))
+    shardSrv := servertest.NewShard(t, key, "host.example.com:9982", 123)
+
+    if _, err := newShardBackend(shardSrv.URL, "http://walrus", ""); err == nil {
+        t.Error("a walrus server without a seed should be rejected")
+    } else if _, err := newShardBackend(shardSrv.URL, "", vectorPhrase); err == nil {
+        t.Error("a seed without a walrus server should be rejected")
+    } else if _, err := newShardBackend(shardSrv.URL, "http://walrus", "not a phrase"); err == nil {
+        t.Error("an invalid seed should be rejected")
+    }
+    b, err := newShardBackend(shardSrv.URL, "", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if height, err := b.ChainHeight(); err != nil || height != 123 {
+        t.Errorf("expected height 123, got %v (%v)", height, err)
+    }
+    if addr, err := b.ResolveHostKey(hostKey); err != nil || addr != "host.example.com:9982" {
+        t.Errorf("expected host address, got %q (%v)", addr, err)
+    }
+    if hk, err := b.LookupHost(hostKey.Key()[:8]); err != nil || hk != hostKey {
+        t.Errorf("expected %v, got %v (%v)", hostKey, hk, err)
+    }
+    unknown := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+    if _, err := b.ResolveHostKey(unknown); err == nil || errorCode(err) != errorCode(os.ErrNotExist) {
+        t.Errorf("expected not found error for unknown host, got %v", err)
+    }
+
+    // without a walrus server, wallet operations fail
+    if _, err := b.Address(); !errors.Is(err, walrus.ErrNoWallet) {
+        t.Error("expected walrus.ErrNoWallet, got", err)
+    } else if _, _, err := b.FeeEstimate(); !errors.Is(err, walrus.ErrNoWallet) {
+        t.Error("expected walrus.ErrNoWallet, got", err)
+    } else if err := b.AcceptTransactionSet(nil); !errors.Is(err, walrus.ErrNoWallet) {
+        t.Error("expected walrus.ErrNoWallet, got", err)
+    }
+
+    // the exports accept the same servers
+    hs := us_hostset_init_shard(nil, cString(shardSrv.URL))
+    if hs == nil {
+        t.Fatal(getError(nil))
+    }
+    us_hostset_free(nil, hs)
+    if c := us_ll_client_init_shard(nil, cString(shardSrv.URL), cString(""), cString(vectorPhrase)); c != nil {
+        t.Error("client with a seed but no walrus server should be rejected")
+    }
+}
+
+func TestWalrusBackend(t *testing.T) {
+    seed, err := wallet.SeedFromPhrase(vectorPhrase)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ws := &servertest.Walrus{Addrs: make(map[types.UnlockHash]uint64)}
+    for i, value := range []uint64{3, 5} {
+        uc := wallet.StandardUnlockConditions(seed.PublicKey(uint64(i)))
+        ws.UTXOs = append(ws.UTXOs, walrus.UTXO{
+            ID:               types.SiacoinOutputID{byte(i + 1)},
+            Value:            types.SiacoinPrecision.Mul64(value),
+            UnlockConditions: uc,
+            UnlockHash:       uc.UnlockHash(),
+            KeyIndex:         uint64(i),
+        })
+    }
+    ws.Index = 2
+    walrusSrv := httptest.NewServer(ws)
+    defer walrusSrv.Close()
+    b, err := newShardBackend("http://shard", walrusSrv.URL, vectorPhrase)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // new addresses are derived from the seed and registered with walrus
+    addr, err := b.Address()
+    if err != nil {
+        t.Fatal(err)
+    } else if addr != wallet.StandardUnlockConditions(seed.PublicKey(2)).UnlockHash() {
+        t.Error("address should be derived from the next seed index")
+    } else if index, ok := ws.Addrs[addr]; !ok || index != 2 {
+        t.Error("address should be registered with walrus")
+    }
+    if fee, _, err := b.FeeEstimate(); err != nil || !fee.Equals64(10) {
+        t.Errorf("expected fee of 10 H, got %v (%v)", fee, err)
+    }
+
+    // fund 6 SC, largest output first, with change to a new address
+    var txn types.Transaction
+    toSign, discard, err := b.FundTransaction(&txn, types.SiacoinPrecision.Mul64(6))
+    if err != nil {
+        t.Fatal(err)
+    } else if len(txn.SiacoinInputs) != 2 || txn.SiacoinInputs[0].ParentID != ws.UTXOs[1].ID {
+        t.Fatal("expected both outputs to be used, largest first")
+    } else if len(txn.SiacoinOutputs) != 1 || !txn.SiacoinOutputs[0].Value.Equals(types.SiacoinPrecision.Mul64(2)) {
+        t.Fatal("expected 2 SC of change")
+    } else if _, ok := ws.Addrs[txn.SiacoinOutputs[0].UnlockHash]; !ok {
+        t.Error("change address should be registered with walrus")
+    }
+    if err := b.SignTransaction(&txn, toSign); err != nil {
+        t.Fatal(err)
+    } else if err := txn.StandaloneValid(types.FoundationHardforkHeight + 1); err != nil {
+        t.Error("funded transaction should be valid:", err)
+    }
+
+    // outputs claimed by a transaction cannot be reused until discarded
+    if _, _, err := b.FundTransaction(new(types.Transaction), types.SiacoinPrecision); !errors.Is(err, wallet.ErrInsufficientFunds) {
+        t.Error("expected claimed outputs to be unavailable, got", err)
+    }
+    discard()
+    if _, _, err := b.FundTransaction(new(types.Transaction), types.SiacoinPrecision); err != nil {
+        t.Error("expected discarded outputs to be available, got", err)
+    }
+
+    if err := b.AcceptTransactionSet([]types.Transaction{txn}); err != nil {
+        t.Fatal(err)
+    } else if len(ws.Broadcast) != 1 || ws.Broadcast[0][0].ID() != txn.ID() {
+        t.Error("transaction should be broadcast through walrus")
+    }
+}
+
+// Wallet test vectors, shared with the C and gomobile bindings, which must all
+// derive the same keys and produce the same signed transaction.
+const (
+    vectorPhrase = "alpha abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abstract"
+    vectorInput0 = "0100000000000000000000000000000000000000000000000000000000000000"
+    vectorInput1 = "0200000000000000000000000000000000000000000000000000000000000000"
+    vectorTxnID  = "1e2e0da7f63bbf1f602fffcba9d77108b078eb48a5b3298af1fbb32b31e346fa"
+)
+
+var (
+    vectorPublicKeys = []string{
+        "ed25519:f64a814f44b4471d3b4e0d3646b3c582b641b4b2476fa954847681b91406c52a",
+        "ed25519:173de750868a9eef5306c492fa6755e60e2b89ade131c5653256b91480f9c21e",
+    }
+    vectorAddresses = []string{
+        "e893e43146db144782038ddd28e557f4205a6e688397336c73aa5af8af09556c58c86b05e025",
+        "31a6227605f5a8e11fb55c877d19ce1b31ce4350137c8114b896bc8a26053410d8952ab105e3",
+        "d44f1f98ae239772ed50cde9e02b332796533012c7a4d3b85942085a51f635d7296c331b9a1a",
+    }
+    vectorSignatures = []string{
+        "bb43eb4b6ab24baec2e280fddbd71e7e2e3e608ed409f70cb614750d9cd72a726cc5d57a2e544b3d859db1e66201d49692beb8f12765ebde76ca8f9c7095c807",
+        "15fce94ffc4a7b77879dbc1ede812616584f8ee14250f09f711511f9165df1eeb0877a5ba6011915bdc7b5b049029134bd231288347be90471c702880724590a",
+    }
+)
+
+func TestWalletVectors(t *testing.T) {
+    seed := us_seed_from_phrase(nil, cString(vectorPhrase))
+    if seed == nil {
+        t.Fatal(getError(nil))
+    }
+    defer us_seed_free(nil, seed)
+    if phrase := goString(us_seed_phrase(nil, seed)); phrase != vectorPhrase {
+        t.Errorf("phrase did not round-trip: %q", phrase)
+    }
+    for i, exp := range vectorPublicKeys {
+        if pk := goString(us_seed_public_key(nil, seed, _Ctype_uint64_t(i))); pk != exp {
+            t.Errorf("public key %v: expected %v, got %v", i, exp, pk)
+        }
+    }
+    for _, addr := range vectorAddresses {
+        if !us_validate_address(nil, cString(addr)) {
+            t.Errorf("address %v should be valid", addr)
+        }
+    }
+
+    // send 1000000 H to address 2 from two inputs, with change to address 0
+    txn := us_txn_init(nil, cString("10"))
+    if txn == nil {
+        t.Fatal(getError(nil))
+    }
+    defer us_txn_free(nil, txn)
+    if !us_txn_add_output(nil, txn, cString(vectorAddresses[2]), cString("1000000")) {
+        t.Fatal(getError(nil))
+    }
+    if r := us_txn_add_input(nil, txn, cString(vectorInput0), cString("800000"), cString(vectorPublicKeys[0]), 0); r != 0 {
+        t.Fatal("first input should not fund the transaction:", r, getError(nil))
+    } else if r := us_txn_add_input(nil, txn, cString(vectorInput1), cString("5000000"), cString(vectorPublicKeys[1]), 1); r != 1 {
+        t.Fatal("second input should fund the transaction:", r, getError(nil))
+    } else if !us_txn_finalize(nil, txn, cString(vectorAddresses[0])) || !us_txn_sign(nil, txn, seed) {
+        t.Fatal(getError(nil))
+    }
+
+    var n _Ctype_size_t
+    enc := us_txn_encode(nil, txn, &n)
+    if enc == nil {
+        t.Fatal(getError(nil))
+    }
+    defer us_free(enc)
+    var decoded types.Transaction
+    if err := decoded.UnmarshalSia(bytes.NewReader(unsafe.Slice((*byte)(enc), n))); err != nil {
+        t.Fatal(err)
+    } else if err := decoded.StandaloneValid(types.FoundationHardforkHeight + 1); err != nil {
+        t.Error("signed transaction should be valid:", err)
+    }
+    if id := decoded.ID().String(); id != vectorTxnID {
+        t.Errorf("expected transaction ID %v, got %v", vectorTxnID, id)
+    }
+    if len(decoded.TransactionSignatures) != len(vectorSignatures) {
+        t.Fatalf("expected %v signatures, got %v", len(vectorSignatures), len(decoded.TransactionSignatures))
+    }
+    for i, exp := range vectorSignatures {
+        if sig := hex.EncodeToString(decoded.TransactionSignatures[i].Signature); sig != exp {
+            t.Errorf("signature %v: expected %v, got %v", i, exp, sig)
+        }
+    }
+}
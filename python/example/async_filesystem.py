@@ -0,0 +1,33 @@
+import asyncio
+import os
+import pyus
+
+
+async def main():
+    # see filesystem.py for how to obtain a contract and choose a HostSet
+    c = pyus.load_contract('<path to .contract file>')
+    hs = pyus.HostSet(host='127.0.0.1', port=9980)
+    hs.add_host(c)
+
+    try:
+        os.mkdir("meta")
+    except FileExistsError:
+        pass
+
+    async with pyus.AsyncFileSystem("meta", hs) as fs:
+        # create a file
+        async with fs.create("foo.txt", 1) as f:
+
+            # write (upload) some data
+            data = b"Hello from asyncio!"
+            await f.write(data)
+            print("Uploaded:", data)
+
+        # reopen and read (download) the data; reads of separate files (or
+        # separate offsets of the same file, via pread) can run concurrently
+        async with fs.open("foo.txt") as f:
+            first, second = await asyncio.gather(f.pread(5, 0), f.pread(14, 5))
+            print("Downloaded:", first + second)
+
+
+asyncio.get_event_loop().run_until_complete(main())
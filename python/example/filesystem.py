@@ -1,22 +1,24 @@
 import os
-import binascii
 import pyus
 
 # load contract
 
-# fill in this string with a hex-encoded contract; it should be 192 bytes.
-# You can turn an existing contract into a hex string with the following
-# command:
-#      xxd -ps -s 12 -l 96 my.contract | tr -d '\n'
-c_hex = b'<hex contract string>'
-c = binascii.unhexlify(c_hex)
+# fill in this string with the path of a contract formed by user. (add_host also
+# accepts a hex-encoded contract, and hs.add_dir loads every contract in a
+# directory.)
+c = pyus.load_contract('<path to .contract file>')
 
 # create host set with contract
 
-# args for a siad instance. Eventually this can include support for shard servers
+# args for a siad instance. Alternatively, use a shard server:
+#   hs = pyus.HostSet(shard='http://127.0.0.1:8080')
 hs = pyus.HostSet(host='127.0.0.1', port=9980)
 hs.add_host(c)
 
+# refuse to pay hosts that raise their prices too far; operations that would
+# use such a host raise PriceExceededError
+hs.set_limits(max_storage_price='1000H', max_download_price='100000H')
+
 # create filesystem
 try:
     os.mkdir("meta")
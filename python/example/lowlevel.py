@@ -3,15 +3,27 @@ import binascii
 import pyus
 
 
-# args for a siad instance. Eventually this can include support for walrus+shard servers
+# args for a siad instance. Alternatively, use a shard server for host lookups
+# and a walrus server for funding:
+#   client = pyus.Client(shard='http://127.0.0.1:8080', walrus='http://127.0.0.1:9990', seed='<12-word seed phrase>')
 client = pyus.Client(api_password='3b70ee9c24decf07bb4066849e2c0571')
 
+# refuse to form contracts or create sessions with expensive hosts
+client.set_limits(max_storage_price='1000H', max_contract_price='1SC')
+
+# check the host's prices before committing any money
+host = client.scan_host('feedface')
+print(host['contractPrice'], host['storagePrice'], host['latency'])
+
 # form a new contract with a host, first 4 bytes of the pubkey is sufficient for lookup
 c = client.form_contract('feedface', os.urandom(32), '10mS', 288)
 
 # create a new session with the newly formed contract
 session = client.new_session('feedface', c)
 
+# Check the host's prices and the state of the contract
+print(session.settings['storagePrice'], session.revision['renterFunds'])
+
 # Upload some data, gets padded upto the SectorSize
 h = session.upload(b'A'*64 + b'B'*64)
 
@@ -20,3 +32,16 @@ z = session.download(h, offset=64, length=64)
 
 print(z)
 
+# Download several sections, possibly of different sectors, in one round-trip
+a, b = session.download_many([(h, 0, 64), (h, 64, 64)])
+
+# Upload several sectors with a single contract revision, then delete one of
+# them to stop paying for its storage
+roots, size = session.upload_many([b'C'*64, b'D'*64])
+_, size = session.delete_sectors(roots[:1])
+
+
+# Close the session (the contract is locked while it is open), then renew the
+# contract before it expires. The renewed contract keeps the uploaded data.
+session.close()
+c = client.renew_contract(c, '10mS', 288)
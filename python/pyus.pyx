@@ -1,6 +1,35 @@
 #cython: language_level=3
+import asyncio
 import cython
-from libc.stdlib cimport free
+import json
+import weakref
+from libc.stdint cimport int64_t, uint32_t, uint64_t, uintptr_t
+from libc.stdlib cimport malloc, free
+
+cdef extern from "us_errors.h":
+    ctypedef enum us_errcode_t:
+        US_OK
+        US_ERR_UNKNOWN
+        US_ERR_INVALID_ARGUMENT
+        US_ERR_NOT_FOUND
+        US_ERR_EXISTS
+        US_ERR_PERMISSION
+        US_ERR_IS_DIRECTORY
+        US_ERR_NOT_DIRECTORY
+        US_ERR_EOF
+        US_ERR_CLOSED
+        US_ERR_NETWORK
+        US_ERR_TIMEOUT
+        US_ERR_HOST_REJECTED
+        US_ERR_INVALID_PROOF
+        US_ERR_INSUFFICIENT_FUNDS
+        US_ERR_CONTRACT_LOCKED
+        US_ERR_CONTRACT_FINALIZED
+        US_ERR_INVALID_HANDLE
+        US_ERR_PANIC
+        US_ERR_BUSY
+        US_ERR_CANCELED
+        US_ERR_PRICE_EXCEEDED
 
 cdef extern from "libus.h":
     ctypedef signed char GoInt8
@@ -19,25 +48,104 @@ cdef extern from "libus.h":
         unsigned char hostKey[32]
         unsigned char id[32]
         unsigned char renterKey[32]
+    ctypedef struct us_completion_t:
+        uint64_t op
+        void* ctx
+        int64_t result
+        void* handle
+        int error_code
+        char* error
+    ctypedef struct us_limits_t:
+        const char* max_storage_price
+        const char* max_upload_price
+        const char* max_download_price
+        const char* max_contract_price
+        double min_collateral_ratio
+    ctypedef struct us_section_t:
+        unsigned char root[32]
+        uint32_t offset
+        uint32_t length
+        void* buf
 
     extern char* us_error(void* p0) nogil
+    extern int us_error_code(void* p0) nogil
+    extern void us_error_free(void* p0) nogil
+    extern void us_free(void* p0) nogil
     extern void* us_ll_client_init(char* p0, char* p1) nogil
+    extern void* us_ll_client_init_shard(void* p0, char* p1, char* p2, char* p3) nogil
     extern void* us_ll_form_contract(void* p0, void* p1, char* p2, void* p3, char* p4, unsigned int p5) nogil
+    extern void* us_ll_renew_contract(void* p0, void* p1, contract_t* p2, char* p3, unsigned int p4) nogil
+    extern char* us_ll_scan_host(void* p0, void* p1, char* p2, unsigned int p3) nogil
+    extern char* us_ll_scan_hosts(void* p0, void* p1, char** p2, size_t p3, unsigned int p4) nogil
     extern void* us_ll_new_session(void* p0, void* p1, char* p2, contract_t* p3) nogil
     extern void* us_ll_upload(void* p0, void* p1, void* p2) nogil
     extern ssize_t us_ll_download(void* p0, void* p1, void* p2, void* p3, unsigned int p4, unsigned int p5) nogil
-    extern GoUint8 us_ll_session_close(void* p0, void* p1)
-    extern GoUint8 us_ll_client_close(void* p0)
-    extern void* us_hostset_init(void* p0, char* p1, char* p2);
-    extern GoUint8 us_hostset_add(void* p0, void* p1, contract_t* p2);
-    extern void* us_fs_init(void* p0, char* p1, void* p2);
-    extern GoUint8 us_fs_close(void* p0, void* p1);
-    extern void* us_fs_create(void* p0, void* p1, char* p2, GoInt p3);
-    extern void* us_fs_open(void* p0, void* p1, char* p2);
-    extern ssize_t us_file_read(void* p0, void* p1, void* p2, size_t p3);
-    extern ssize_t us_file_write(void* p0, void* p1, void* p2, size_t p3);
-    extern int us_file_seek(void* p0, void* p1, long int p2, int p3);
-    extern GoUint8 us_file_close(void* p0, void* p1);
+    extern ssize_t us_ll_download_many(void* p0, void* p1, us_section_t* p2, size_t p3) nogil
+    extern int64_t us_ll_upload_many(void* p0, void* p1, void* p2, size_t p3, void* p4, void* p5) nogil
+    extern int64_t us_ll_swap_sectors(void* p0, void* p1, uint64_t* p2, size_t p3, void* p4) nogil
+    extern int64_t us_ll_trim_sectors(void* p0, void* p1, uint64_t p2, void* p3) nogil
+    extern int64_t us_ll_delete_sectors(void* p0, void* p1, void* p2, size_t p3, void* p4) nogil
+    extern char* us_ll_session_settings(void* p0, void* p1) nogil
+    extern char* us_ll_session_revision(void* p0, void* p1) nogil
+    extern GoUint8 us_ll_session_close(void* p0, void* p1) nogil
+    extern GoUint8 us_ll_client_close(void* p0, void* p1) nogil
+    extern GoUint8 us_ll_client_set_limits(void* p0, void* p1, us_limits_t* p2) nogil
+    extern void* us_hostset_init(void* p0, char* p1, char* p2) nogil
+    extern void* us_hostset_init_shard(void* p0, char* p1) nogil
+    extern GoUint8 us_hostset_free(void* p0, void* p1) nogil
+    extern GoUint8 us_hostset_add(void* p0, void* p1, contract_t* p2) nogil
+    extern int us_hostset_add_dir(void* p0, void* p1, char* p2) nogil
+    extern GoUint8 us_hostset_set_limits(void* p0, void* p1, us_limits_t* p2) nogil
+    extern GoUint8 us_contract_load(void* p0, contract_t* p1, char* p2) nogil
+    extern void* us_fs_init(void* p0, char* p1, void* p2) nogil
+    extern GoUint8 us_fs_close(void* p0, void* p1) nogil
+    extern void* us_fs_create(void* p0, void* p1, char* p2, GoInt p3) nogil
+    extern void* us_fs_open(void* p0, void* p1, char* p2) nogil
+    extern ssize_t us_file_read(void* p0, void* p1, void* p2, size_t p3) nogil
+    extern ssize_t us_file_write(void* p0, void* p1, void* p2, size_t p3) nogil
+    extern ssize_t us_file_read_at(void* p0, void* p1, void* p2, size_t p3, int64_t p4) nogil
+    extern ssize_t us_file_write_at(void* p0, void* p1, void* p2, size_t p3, int64_t p4) nogil
+    extern int64_t us_file_seek(void* p0, void* p1, int64_t p2, int p3) nogil
+    extern int64_t us_file_size(void* p0, void* p1) nogil
+    extern GoUint8 us_file_truncate(void* p0, void* p1, int64_t p2) nogil
+    extern GoUint8 us_file_sync(void* p0, void* p1) nogil
+    extern GoUint8 us_file_close(void* p0, void* p1) nogil
+    extern void* us_seed_init(void* p0) nogil
+    extern void* us_seed_from_phrase(void* p0, char* p1) nogil
+    extern char* us_seed_phrase(void* p0, void* p1) nogil
+    extern char* us_seed_public_key(void* p0, void* p1, uint64_t p2) nogil
+    extern GoUint8 us_seed_free(void* p0, void* p1) nogil
+    extern GoUint8 us_validate_address(void* p0, char* p1) nogil
+    extern void* us_txn_init(void* p0, char* p1) nogil
+    extern GoUint8 us_txn_add_output(void* p0, void* p1, char* p2, char* p3) nogil
+    extern int us_txn_add_input(void* p0, void* p1, char* p2, char* p3, char* p4, uint64_t p5) nogil
+    extern GoUint8 us_txn_finalize(void* p0, void* p1, char* p2) nogil
+    extern GoUint8 us_txn_sign(void* p0, void* p1, void* p2) nogil
+    extern char* us_txn_json(void* p0, void* p1) nogil
+    extern void* us_txn_encode(void* p0, void* p1, size_t* p2) nogil
+    extern GoUint8 us_txn_free(void* p0, void* p1) nogil
+    extern void* us_cq_init(void* p0) nogil
+    extern int us_cq_fd(void* p0, void* p1) nogil
+    extern int us_cq_poll(void* p0, void* p1, us_completion_t* p2) nogil
+    extern GoUint8 us_cq_cancel(void* p0, void* p1, uint64_t p2) nogil
+    extern GoUint8 us_cq_free(void* p0, void* p1) nogil
+    extern uint64_t us_fs_create_async(void* p0, void* p1, void* p2, char* p3, GoInt p4, void* p5) nogil
+    extern uint64_t us_fs_open_async(void* p0, void* p1, void* p2, char* p3, void* p4) nogil
+    extern uint64_t us_fs_close_async(void* p0, void* p1, void* p2, void* p3) nogil
+    extern uint64_t us_file_read_async(void* p0, void* p1, void* p2, void* p3, size_t p4, void* p5) nogil
+    extern uint64_t us_file_write_async(void* p0, void* p1, void* p2, void* p3, size_t p4, void* p5) nogil
+    extern uint64_t us_file_read_at_async(void* p0, void* p1, void* p2, void* p3, size_t p4, int64_t p5, void* p6) nogil
+    extern uint64_t us_file_write_at_async(void* p0, void* p1, void* p2, void* p3, size_t p4, int64_t p5, void* p6) nogil
+    extern uint64_t us_file_sync_async(void* p0, void* p1, void* p2, void* p3) nogil
+    extern uint64_t us_file_close_async(void* p0, void* p1, void* p2, void* p3) nogil
+    extern uint64_t us_ll_new_session_async(void* p0, void* p1, void* p2, char* p3, contract_t* p4, void* p5) nogil
+    extern uint64_t us_ll_upload_async(void* p0, void* p1, void* p2, void* p3, void* p4, void* p5) nogil
+    extern uint64_t us_ll_download_async(void* p0, void* p1, void* p2, void* p3, void* p4, unsigned int p5, unsigned int p6, void* p7) nogil
+    extern uint64_t us_ll_download_many_async(void* p0, void* p1, void* p2, us_section_t* p3, size_t p4, void* p5) nogil
+    extern uint64_t us_ll_upload_many_async(void* p0, void* p1, void* p2, void* p3, size_t p4, void* p5, void* p6, void* p7) nogil
+    extern uint64_t us_ll_swap_sectors_async(void* p0, void* p1, void* p2, uint64_t* p3, size_t p4, void* p5, void* p6) nogil
+    extern uint64_t us_ll_trim_sectors_async(void* p0, void* p1, void* p2, uint64_t p3, void* p4, void* p5) nogil
+    extern uint64_t us_ll_delete_sectors_async(void* p0, void* p1, void* p2, void* p3, size_t p4, void* p5, void* p6) nogil
 
 SECTOR_SIZE = 1 << 22
 HASH_LEN = 32
@@ -48,38 +156,600 @@ def error(caller):
     try:
         return e.decode()
     finally:
-        free(e)
+        us_free(e)
+
+
+class Error(RuntimeError):
+    """Base class for all errors raised by pyus."""
+
+class InvalidArgumentError(Error): pass
+class NotFoundError(Error): pass
+class ExistsError(Error): pass
+class PermissionDeniedError(Error): pass
+class IsDirectoryError(Error): pass
+class NotDirectoryError(Error): pass
+class EndOfFileError(Error): pass
+class ClosedError(Error): pass
+class NetworkError(Error): pass
+class NetworkTimeoutError(NetworkError): pass
+class HostError(Error): pass
+class HostRejectedError(HostError): pass
+class InvalidProofError(HostError): pass
+class ContractError(Error): pass
+class InsufficientFundsError(ContractError): pass
+class ContractLockedError(ContractError): pass
+class ContractFinalizedError(ContractError): pass
+class InvalidHandleError(InvalidArgumentError): pass
+class PanicError(Error): pass
+class BusyError(Error): pass
+class CanceledError(Error): pass
+class PriceExceededError(HostError): pass
+
+# keyed by us_errcode_t; the values come from us_errors.h, so they cannot
+# drift from the codes reported by the library
+_errors = {
+    US_ERR_UNKNOWN: Error,
+    US_ERR_INVALID_ARGUMENT: InvalidArgumentError,
+    US_ERR_NOT_FOUND: NotFoundError,
+    US_ERR_EXISTS: ExistsError,
+    US_ERR_PERMISSION: PermissionDeniedError,
+    US_ERR_IS_DIRECTORY: IsDirectoryError,
+    US_ERR_NOT_DIRECTORY: NotDirectoryError,
+    US_ERR_EOF: EndOfFileError,
+    US_ERR_CLOSED: ClosedError,
+    US_ERR_NETWORK: NetworkError,
+    US_ERR_TIMEOUT: NetworkTimeoutError,
+    US_ERR_HOST_REJECTED: HostRejectedError,
+    US_ERR_INVALID_PROOF: InvalidProofError,
+    US_ERR_INSUFFICIENT_FUNDS: InsufficientFundsError,
+    US_ERR_CONTRACT_LOCKED: ContractLockedError,
+    US_ERR_CONTRACT_FINALIZED: ContractFinalizedError,
+    US_ERR_INVALID_HANDLE: InvalidHandleError,
+    US_ERR_PANIC: PanicError,
+    US_ERR_BUSY: BusyError,
+    US_ERR_CANCELED: CanceledError,
+    US_ERR_PRICE_EXCEEDED: PriceExceededError,
+}
+
+
+def _exception(code, msg):
+    cls = _errors.get(code, Error)
+    e = cls(msg)
+    e.code = code
+    return e
+
+
+def exception(caller):
+    return _exception(us_error_code(<void*>caller), error(caller))
+
+
+def load_contract(path):
+    """Reads a contract file formed by user, returning the 96-byte contract."""
+    cdef contract_t c
+    caller = object()
+    path = path.encode()
+    cdef void* id = <void*>caller
+    cdef char* p = path
+    cdef GoUint8 ok
+    with nogil:
+        ok = us_contract_load(id, &c, p)
+    if not ok:
+        e = exception(caller)
+        us_error_free(<void*>caller)
+        raise e
+
+    return bytearray((<char*>&c)[:sizeof(contract_t)])
+
+
+# wallets
+#
+# Amounts are denominated in hastings, and may be given as ints or strings.
+# Transactions are signed in input order, so the same inputs, outputs and seed
+# always produce the same transaction in every binding.
+
+def validate_address(addr):
+    """Returns True if addr is a valid Sia address."""
+    caller = object()
+    addr = addr.encode()
+    return bool(us_validate_address(<void*>caller, addr))
+
+
+cdef class Seed:
+    cdef uintptr_t _seed
+
+    # Pass a 12-word phrase to restore a seed; otherwise, a new random seed is
+    # generated.
+    def __init__(self, phrase=None):
+        cdef void* id = <void*>self
+        cdef char* p
+        if phrase is None:
+            self._seed = <uintptr_t>us_seed_init(id)
+        else:
+            phrase = phrase.encode()
+            p = phrase
+            self._seed = <uintptr_t>us_seed_from_phrase(id, p)
+        if not self._seed:
+            raise exception(self)
 
+    @property
+    def phrase(self):
+        cdef char* s = us_seed_phrase(<void*>self, <void*>self._seed)
+        if not s:
+            raise exception(self)
+
+        try:
+            return s.decode()
+        finally:
+            us_free(s)
+
+    def public_key(self, index):
+        """Returns the public key at index, as 'ed25519:<hex>'."""
+        cdef char* s = us_seed_public_key(<void*>self, <void*>self._seed, index)
+        if not s:
+            raise exception(self)
+
+        try:
+            return s.decode()
+        finally:
+            us_free(s)
 
-cdef class Client:
-    cdef unsigned int siad
+    @property
+    def seed(self):
+        return self._seed
+
+    def __dealloc__(self):
+        cdef void* id = <void*>self
+        cdef void* seed = <void*>self._seed
+        if seed:
+            us_seed_free(id, seed)
+        us_error_free(id)
+
+
+cdef class Transaction:
+    cdef uintptr_t _txn
+
+    def __init__(self, fee_per_byte):
+        fee = str(fee_per_byte).encode()
+        self._txn = <uintptr_t>us_txn_init(<void*>self, fee)
+        if not self._txn:
+            raise exception(self)
+
+    def add_output(self, addr, amount):
+        addr = addr.encode()
+        amount = str(amount).encode()
+        if not us_txn_add_output(<void*>self, <void*>self._txn, addr, amount):
+            raise exception(self)
+
+    def add_input(self, output_id, value, public_key, key_index):
+        """Adds an input, spendable by public_key, which is derived from the
+        signing seed at key_index. Returns True once the inputs cover the
+        outputs and the miner fee."""
+        output_id = output_id.encode()
+        value = str(value).encode()
+        public_key = public_key.encode()
+        cdef int ret = us_txn_add_input(<void*>self, <void*>self._txn, output_id, value, public_key, key_index)
+        if ret < 0:
+            raise exception(self)
+
+        return ret == 1
+
+    def finalize(self, change_addr):
+        """Sets the miner fee and sends any change to change_addr."""
+        change_addr = change_addr.encode()
+        if not us_txn_finalize(<void*>self, <void*>self._txn, change_addr):
+            raise exception(self)
+
+    def sign(self, Seed seed):
+        if not us_txn_sign(<void*>self, <void*>self._txn, <void*>seed._seed):
+            raise exception(self)
+
+    def json(self):
+        """Returns the transaction as a JSON string, as accepted by siad and
+        walrus."""
+        cdef char* js = us_txn_json(<void*>self, <void*>self._txn)
+        if not js:
+            raise exception(self)
+
+        try:
+            return js.decode()
+        finally:
+            us_free(js)
+
+    def encode(self):
+        """Returns the transaction in the Sia binary encoding."""
+        cdef size_t n
+        cdef char* buf = <char*>us_txn_encode(<void*>self, <void*>self._txn, &n)
+        if not buf:
+            raise exception(self)
+
+        try:
+            return bytes(buf[:n])
+        finally:
+            us_free(buf)
+
+    def __dealloc__(self):
+        cdef void* id = <void*>self
+        cdef void* txn = <void*>self._txn
+        if txn:
+            us_txn_free(id, txn)
+        us_error_free(id)
+
+
+# asyncio support
+#
+# Each event loop gets a completion queue whose file descriptor is registered
+# with the loop. Asynchronous operations post their results to the queue, and
+# the loop resolves the corresponding futures as the descriptor becomes
+# readable; no threads are involved on the Python side.
+#
+# Cancelling a task that is awaiting an operation cancels the operation, too.
+# Session operations are interrupted by closing the session's connection, so
+# the session must not be used afterwards. File reads and writes stop between
+# 4 MiB chunks, so a cancelled write may have written part of its data. Opening,
+# creating, syncing and closing files cannot be interrupted once they have
+# started; cancelling one only stops the task from waiting for it.
+
+cdef class _CompletionQueue:
+    cdef uintptr_t cq
+    cdef object loop  # weak reference, since the loop holds a reference to us
+    cdef dict ops     # op ID -> (future, buffers, release)
+
+    def __init__(self, loop):
+        self.loop = weakref.ref(loop)
+        self.ops = {}
+        self.cq = <uintptr_t>us_cq_init(<void*>self)
+        if not self.cq:
+            raise exception(self)
+
+        fd = us_cq_fd(<void*>self, <void*>self.cq)
+        if fd < 0:
+            raise exception(self)
+        loop.add_reader(fd, self._drain)
+
+    async def wait(self, op, buffers=None, release=None):
+        # buffers are kept alive until the operation completes. If the
+        # operation produces a handle that nobody will receive (because the
+        # task was cancelled), it is passed to release.
+        fut = self.loop().create_future()
+        self.ops[op] = (fut, buffers, release)
+        try:
+            return await fut
+        except asyncio.CancelledError:
+            if not fut.done():
+                self._cancel(op)
+            elif release is not None and not fut.cancelled() and fut.exception() is None:
+                release(fut.result())
+            raise
+
+    def _cancel(self, uint64_t op):
+        us_cq_cancel(<void*>self, <void*>self.cq, op)
+
+    def _drain(self):
+        cdef us_completion_t c
+        while True:
+            n = us_cq_poll(<void*>self, <void*>self.cq, &c)
+            if n < 0:
+                raise exception(self)
+            elif n == 0:
+                return
+
+            fut, buffers, release = self.ops.pop(c.op)
+            if c.error:
+                try:
+                    e = _exception(c.error_code, c.error.decode())
+                finally:
+                    us_free(c.error)
+                if not fut.cancelled():
+                    fut.set_exception(e)
+                continue
+
+            result = <uintptr_t>c.handle if c.handle else c.result
+            if not fut.cancelled():
+                fut.set_result(result)
+            elif release is not None:
+                release(result)
+
+    def _release_file(self, uintptr_t f):
+        us_file_close(<void*>self, <void*>f)
+
+    def _release_session(self, uintptr_t sess):
+        us_ll_session_close(<void*>self, <void*>sess)
+
+    def __dealloc__(self):
+        if self.cq:
+            us_cq_free(<void*>self, <void*>self.cq)
+        us_error_free(<void*>self)
+
+
+_queues = weakref.WeakKeyDictionary()
+
+
+def _queue():
+    loop = asyncio.get_event_loop()
+    q = _queues.get(loop)
+    if q is None:
+        q = _queues[loop] = _CompletionQueue(loop)
+    return q
 
-    def __init__(self, host='127.0.0.1', port=9980, api_password=''):
-        addr = host.encode() + b':' + str(port).encode()
-        pw = api_password.encode()
 
-        self.siad = <unsigned int>us_ll_client_init(addr, pw)
+cdef class _Limits:
+    # Holds a us_limits_t along with the strings it points to.
+    cdef us_limits_t limits
+    cdef bytes storage, upload, download, contract
+
+    def __init__(self, max_storage_price, max_upload_price, max_download_price, max_contract_price, min_collateral_ratio):
+        self.storage = (max_storage_price or '').encode()
+        self.upload = (max_upload_price or '').encode()
+        self.download = (max_download_price or '').encode()
+        self.contract = (max_contract_price or '').encode()
+        self.limits.max_storage_price = self.storage
+        self.limits.max_upload_price = self.upload
+        self.limits.max_download_price = self.download
+        self.limits.max_contract_price = self.contract
+        self.limits.min_collateral_ratio = min_collateral_ratio
+
+
+cdef class Client:
+    cdef uintptr_t siad
+
+    # By default, the client uses a siad node. Alternatively, pass the address
+    # of a shard server (e.g. 'http://127.0.0.1:8080') to resolve hosts through
+    # it; to form contracts, also pass the address of a walrus server and the
+    # 12-word seed phrase of the wallet it tracks.
+    def __init__(self, host='127.0.0.1', port=9980, api_password='', shard=None, walrus=None, seed=None):
+        if shard is None:
+            if walrus is not None or seed is not None:
+                raise InvalidArgumentError('walrus requires a shard server')
+            addr = host.encode() + b':' + str(port).encode()
+            pw = api_password.encode()
+            self.siad = <uintptr_t>us_ll_client_init(addr, pw)
+            return
+
+        shard = shard.encode()
+        walrus = (walrus or '').encode()
+        seed = (seed or '').encode()
+        cdef void* id = <void*>self
+        cdef char* shard_addr = shard
+        cdef char* walrus_addr = walrus
+        cdef char* phrase = seed
+        cdef uintptr_t siad
+        with nogil:
+            siad = <uintptr_t>us_ll_client_init_shard(id, shard_addr, walrus_addr, phrase)
+        self.siad = siad
+        if not self.siad:
+            raise exception(self)
 
     def form_contract(self, host, key, total_funds, duration):
         host = host.encode()
         total_funds = total_funds.encode()
         cdef unsigned char[:] key_view = bytearray(key)
 
-        cdef char *contract = <char*>us_ll_form_contract(<void*>self, <void*>self.siad, host, <void*>&key_view[0], total_funds, duration)
+        cdef void* id = <void*>self
+        cdef void* siad = <void*>self.siad
+        cdef char* host_addr = host
+        cdef void* key_ptr = <void*>&key_view[0]
+        cdef char* funds = total_funds
+        cdef unsigned int d = duration
+        cdef char *contract
+        with nogil:
+            contract = <char*>us_ll_form_contract(id, siad, host_addr, key_ptr, funds, d)
         if not contract:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
         c = bytearray(contract[:sizeof(contract_t)])
-        free(contract)
+        us_free(contract)
         return c
 
+    # Renews a contract formed by form_contract, returning the new contract.
+    # The renter key is unchanged, and the data stored under the old contract
+    # is carried over.
+    def renew_contract(self, contract, funds, duration):
+        if len(contract) != sizeof(contract_t):
+            raise InvalidArgumentError('contract must be 96 bytes')
+
+        funds = funds.encode()
+        cdef contract_t c
+        c.hostKey = contract[:32]
+        c.id = contract[32:64]
+        c.renterKey = contract[64:96]
+
+        cdef void* id = <void*>self
+        cdef void* siad = <void*>self.siad
+        cdef char* f = funds
+        cdef unsigned int d = duration
+        cdef char *renewed
+        with nogil:
+            renewed = <char*>us_ll_renew_contract(id, siad, &c, f, d)
+        if not renewed:
+            raise exception(self)
+
+        r = bytearray(renewed[:sizeof(contract_t)])
+        us_free(renewed)
+        return r
+
+    # Requests the settings of the host whose public key starts with host,
+    # returning them as a dict along with the host's public key and latency
+    # (in milliseconds). Currency values are strings, in hastings.
+    def scan_host(self, host, timeout=10):
+        host = host.encode()
+        cdef void* id = <void*>self
+        cdef void* siad = <void*>self.siad
+        cdef char* host_key = host
+        cdef unsigned int t = int(timeout * 1000)
+        cdef char* js
+        with nogil:
+            js = us_ll_scan_host(id, siad, host_key, t)
+        if not js:
+            raise exception(self)
+
+        try:
+            return json.loads(js.decode())
+        finally:
+            us_free(js)
+
+    # Like scan_host, but scans a list of hosts concurrently. If a host could
+    # not be scanned, its entry in the returned list is the exception that
+    # scan_host would have raised.
+    def scan_hosts(self, hosts, timeout=10):
+        hosts = [h.encode() for h in hosts]
+        cdef char** host_keys = <char**>malloc(max(len(hosts), 1) * sizeof(char*))
+        if not host_keys:
+            raise MemoryError()
+        for i, h in enumerate(hosts):
+            host_keys[i] = h
+
+        cdef void* id = <void*>self
+        cdef void* siad = <void*>self.siad
+        cdef size_t n = len(hosts)
+        cdef unsigned int t = int(timeout * 1000)
+        cdef char* js
+        try:
+            with nogil:
+                js = us_ll_scan_hosts(id, siad, host_keys, n, t)
+        finally:
+            free(host_keys)
+        if not js:
+            raise exception(self)
+
+        try:
+            scans = json.loads(js.decode())
+        finally:
+            us_free(js)
+        return [_exception(s['errorCode'], s['error']) if 'error' in s else s for s in scans]
+
+    # Sets limits on the prices the client will pay. Forming or renewing a
+    # contract, or creating a session, with a host whose settings violate them
+    # raises PriceExceededError before any money is spent. Prices are strings
+    # such as '100H' or '1SC'; storage price is per byte per block, and upload
+    # and download prices are per byte. None means no limit.
+    def set_limits(self, max_storage_price=None, max_upload_price=None, max_download_price=None,
+                   max_contract_price=None, min_collateral_ratio=0):
+        cdef _Limits l = _Limits(max_storage_price, max_upload_price, max_download_price,
+                                 max_contract_price, min_collateral_ratio)
+        cdef void* id = <void*>self
+        cdef void* siad = <void*>self.siad
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_ll_client_set_limits(id, siad, &l.limits)
+        if not ok:
+            raise exception(self)
+
     def new_session(self, pubkey, contract):
         return Session(self.siad, pubkey, contract)
 
+    def _start_session(self, _CompletionQueue q, pubkey, contract):
+        host = pubkey.encode()
+        cdef contract_t c
+        c.hostKey = contract[:32]
+        c.id = contract[32:64]
+        c.renterKey = contract[64:96]
+        cdef uint64_t op = us_ll_new_session_async(<void*>self, <void*>q.cq, <void*>self.siad, host, &c, NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def new_async_session(self, pubkey, contract):
+        q = _queue()
+        sess = await q.wait(self._start_session(q, pubkey, contract), release=q._release_session)
+        return AsyncSession(self.siad, sess)
+
+    def close(self):
+        cdef void* id = <void*>self
+        cdef void* siad = <void*>self.siad
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_ll_client_close(id, siad)
+        if not ok:
+            raise exception(self)
+
+        self.siad = 0
+        return ok
+
+    def __dealloc__(self):
+        cdef void* id = <void*>self
+        cdef void* siad = <void*>self.siad
+        with nogil:
+            if siad:
+                us_ll_client_close(id, siad)
+            us_error_free(id)
+
+
+cdef us_section_t* _make_sections(sections, list bufs) except NULL:
+    # Allocates an array describing sections, a list of (root, offset, length)
+    # tuples, and appends the buffer for each section to bufs. The caller must
+    # free the array.
+    sections = list(sections)
+    cdef us_section_t* secs = <us_section_t*>malloc(max(len(sections), 1) * sizeof(us_section_t))
+    if not secs:
+        raise MemoryError()
+
+    cdef unsigned char[:] view
+    try:
+        for i, (root, offset, length) in enumerate(sections):
+            data = bytearray(length)
+            secs[i].root = bytes(root)
+            secs[i].offset = offset
+            secs[i].length = length
+            secs[i].buf = NULL
+            if length:
+                view = data
+                secs[i].buf = <void*>&view[0]
+            bufs.append(data)
+    except:
+        free(secs)
+        raise
+
+    return secs
+
+
+cdef void* _data(bytearray buf):
+    # Returns a pointer to the contents of buf, or NULL if it is empty. buf
+    # must not be resized while the pointer is in use.
+    cdef unsigned char[:] view = buf
+    if not len(buf):
+        return NULL
+    return <void*>&view[0]
+
+
+def _pack_sectors(sectors):
+    # Concatenates sectors, padding each to SECTOR_SIZE.
+    data = bytearray()
+    for sector in sectors:
+        if len(sector) > SECTOR_SIZE:
+            raise ValueError('sector is larger than SECTOR_SIZE')
+        data.extend(sector)
+        data.extend((SECTOR_SIZE - len(sector)) * b'\x00')
+    return data
+
+
+def _split_roots(roots):
+    return [roots[i:i+HASH_LEN] for i in range(0, len(roots), HASH_LEN)]
+
+
+cdef uint64_t* _make_pairs(pairs, size_t* n) except NULL:
+    # Allocates an array of sector indices from pairs, a list of (a, b)
+    # tuples. The caller must free the array.
+    pairs = list(pairs)
+    cdef uint64_t* indices = <uint64_t*>malloc(max(len(pairs), 1) * 2 * sizeof(uint64_t))
+    if not indices:
+        raise MemoryError()
+
+    try:
+        for i, (a, b) in enumerate(pairs):
+            indices[i*2] = a
+            indices[i*2+1] = b
+    except:
+        free(indices)
+        raise
+
+    n[0] = len(pairs)
+    return indices
+
 
 cdef class Session:
-    cdef unsigned int sess
-    cdef unsigned int siad
+    cdef uintptr_t sess
+    cdef uintptr_t siad
 
     def __init__(self, siad, pubkey, contract):
         host = pubkey.encode()
@@ -89,9 +759,14 @@ cdef class Session:
         c.renterKey = contract[64:96]
 
         self.siad = siad
-        session = <unsigned int>us_ll_new_session(<void*>self, <void*>self.siad, host, &c)
+        cdef void* id = <void*>self
+        cdef void* client = <void*>self.siad
+        cdef char* host_key = host
+        cdef uintptr_t session
+        with nogil:
+            session = <uintptr_t>us_ll_new_session(id, client, host_key, &c)
         if not session:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
         self.sess = session
 
@@ -108,10 +783,10 @@ cdef class Session:
             with nogil:
                 root = <char*>us_ll_upload(<void*>self, <void*>self.sess, <void*>&sector_view[0])
         if not root:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
         h = bytearray(root[:HASH_LEN])
-        free(root)
+        us_free(root)
         return h
 
     def download(self, root, offset=0, length=SECTOR_SIZE):
@@ -119,51 +794,273 @@ cdef class Session:
         cdef unsigned char[:] root_view = bytearray(root)
         cdef unsigned int o = offset
         cdef unsigned int l = length
+        cdef ssize_t ret
 
         with cython.boundscheck(False):
             with nogil:
                 ret = us_ll_download(<void*>self, <void*>self.sess, <void*>&root_view[0], <void*>&data[0], o, l)
         if ret < 0:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
         return bytearray(data)
 
-    def __dealloc__(self):
-        if self.sess:
-            us_ll_session_close(<void*>self, <void*>self.sess)
+    def download_many(self, sections):
+        """Downloads a list of (root, offset, length) sections, which may
+        belong to different sectors, in a single round-trip. Returns a list
+        containing the data of each section."""
+        bufs = []
+        cdef us_section_t* secs = _make_sections(sections, bufs)
+        cdef size_t n = len(bufs)
+        cdef ssize_t ret
 
+        try:
+            with nogil:
+                ret = us_ll_download_many(<void*>self, <void*>self.sess, secs, n)
+        finally:
+            free(secs)
+        if ret < 0:
+            raise exception(self)
 
-cdef class HostSet:
-    cdef unsigned int _hs
+        return bufs
 
-    def __init__(self, host='127.0.0.1', port=9980, api_password=''):
-        addr = host.encode() + b':' + str(port).encode()
-        pw = api_password.encode()
+    @property
+    def settings(self):
+        """The host's settings, as reported when the session was created.
+        These are the prices that the session pays. Currency values are
+        strings, in hastings."""
+        cdef char* js = us_ll_session_settings(<void*>self, <void*>self.sess)
+        if not js:
+            raise exception(self)
+
+        try:
+            return json.loads(js.decode())
+        finally:
+            us_free(js)
+
+    @property
+    def revision(self):
+        """The latest revision of the contract, including its size, the
+        renter's remaining funds, and its end height. Currency values are
+        strings, in hastings."""
+        cdef char* js
+        with nogil:
+            js = us_ll_session_revision(<void*>self, <void*>self.sess)
+        if not js:
+            raise exception(self)
+
+        try:
+            return json.loads(js.decode())
+        finally:
+            us_free(js)
+
+    # The methods below modify the sectors stored under the contract with a
+    # single round-trip. Each returns the new size of the contract in bytes,
+    # along with either the Merkle roots of the uploaded sectors or the new
+    # Merkle root of the contract.
+
+    def upload_many(self, sectors):
+        """Uploads a list of sectors, padding each to SECTOR_SIZE. Returns
+        the Merkle root of each sector and the new size of the contract."""
+        data = _pack_sectors(sectors)
+        cdef size_t n = len(data) // SECTOR_SIZE
+        roots = bytearray(n * HASH_LEN)
+        cdef void* buf = _data(data)
+        cdef void* roots_buf = _data(roots)
+        cdef int64_t size
+
+        with nogil:
+            size = us_ll_upload_many(<void*>self, <void*>self.sess, buf, n, roots_buf, NULL)
+        if size < 0:
+            raise exception(self)
+
+        return _split_roots(roots), size
+
+    def swap_sectors(self, pairs):
+        """Swaps the sectors at each (a, b) pair of indices. Returns the new
+        Merkle root and size of the contract."""
+        cdef size_t n
+        cdef uint64_t* indices = _make_pairs(pairs, &n)
+        root = bytearray(HASH_LEN)
+        cdef void* root_buf = _data(root)
+        cdef int64_t size
+
+        try:
+            with nogil:
+                size = us_ll_swap_sectors(<void*>self, <void*>self.sess, indices, n, root_buf)
+        finally:
+            free(indices)
+        if size < 0:
+            raise exception(self)
+
+        return root, size
+
+    def trim(self, n):
+        """Removes the last n sectors of the contract. Returns the new Merkle
+        root and size of the contract."""
+        cdef uint64_t count = n
+        root = bytearray(HASH_LEN)
+        cdef void* root_buf = _data(root)
+        cdef int64_t size
+
+        with nogil:
+            size = us_ll_trim_sectors(<void*>self, <void*>self.sess, count, root_buf)
+        if size < 0:
+            raise exception(self)
+
+        return root, size
+
+    def delete_sectors(self, roots):
+        """Deletes the sectors with the given Merkle roots, ignoring any that
+        are not in the contract. Returns the new Merkle root and size of the
+        contract."""
+        data = bytearray(b''.join(bytes(r) for r in roots))
+        cdef size_t n = len(data) // HASH_LEN
+        cdef void* roots_buf = _data(data)
+        root = bytearray(HASH_LEN)
+        cdef void* root_buf = _data(root)
+        cdef int64_t size
+
+        with nogil:
+            size = us_ll_delete_sectors(<void*>self, <void*>self.sess, roots_buf, n, root_buf)
+        if size < 0:
+            raise exception(self)
+
+        return root, size
+
+    def close(self):
+        cdef void* id = <void*>self
+        cdef void* sess = <void*>self.sess
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_ll_session_close(id, sess)
+        if not ok:
+            raise exception(self)
+
+        self.sess = 0
+        return ok
 
-        self._hs = <unsigned int>us_hostset_init(<void*>self, addr, pw)
+    def __dealloc__(self):
+        cdef void* id = <void*>self
+        cdef void* sess = <void*>self.sess
+        with nogil:
+            if sess:
+                us_ll_session_close(id, sess)
+            us_error_free(id)
+
+
+cdef class HostSet:
+    cdef uintptr_t _hs
+
+    # As with Client, pass the address of a shard server to use it instead of
+    # siad.
+    def __init__(self, host='127.0.0.1', port=9980, api_password='', shard=None):
+        cdef void* id = <void*>self
+        cdef char* a
+        cdef char* p
+        cdef uintptr_t hs
+        if shard is None:
+            addr = host.encode() + b':' + str(port).encode()
+            pw = api_password.encode()
+            a = addr
+            p = pw
+            with nogil:
+                hs = <uintptr_t>us_hostset_init(id, a, p)
+        else:
+            shard = shard.encode()
+            a = shard
+            with nogil:
+                hs = <uintptr_t>us_hostset_init_shard(id, a)
+        self._hs = hs
         if not self._hs:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
     def add_host(self, contract):
+        if isinstance(contract, str):
+            contract = bytes.fromhex(contract)
+        if len(contract) != sizeof(contract_t):
+            raise InvalidArgumentError('contract must be 96 bytes')
+
         cdef contract_t c
         c.hostKey = contract[:32]
         c.id = contract[32:64]
         c.renterKey = contract[64:96]
-        us_hostset_add(<void*>self, <void*>self._hs, &c)
+        cdef void* id = <void*>self
+        cdef void* hs = <void*>self._hs
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_hostset_add(id, hs, &c)
+        if not ok:
+            raise exception(self)
+
+    def add_dir(self, path):
+        path = path.encode()
+        cdef void* id = <void*>self
+        cdef void* hs = <void*>self._hs
+        cdef char* d = path
+        cdef int n
+        with nogil:
+            n = us_hostset_add_dir(id, hs, d)
+        if n < 0:
+            raise exception(self)
+
+        return n
+
+    # Sets limits on the prices paid to the hosts in the set, as with
+    # Client.set_limits. Each host is scanned before the set connects to it.
+    def set_limits(self, max_storage_price=None, max_upload_price=None, max_download_price=None,
+                   max_contract_price=None, min_collateral_ratio=0):
+        cdef _Limits l = _Limits(max_storage_price, max_upload_price, max_download_price,
+                                 max_contract_price, min_collateral_ratio)
+        cdef void* id = <void*>self
+        cdef void* hs = <void*>self._hs
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_hostset_set_limits(id, hs, &l.limits)
+        if not ok:
+            raise exception(self)
 
     @property
     def hs(self):
         return self._hs
 
+    def free(self):
+        cdef void* id = <void*>self
+        cdef void* hs = <void*>self._hs
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_hostset_free(id, hs)
+        if not ok:
+            raise exception(self)
+
+        self._hs = 0
+        return ok
+
+    def __dealloc__(self):
+        cdef void* id = <void*>self
+        cdef void* hs = <void*>self._hs
+        with nogil:
+            if hs:
+                us_hostset_free(id, hs)
+            us_error_free(id)
+
 
 cdef class FileSystem:
-    cdef unsigned int fs
+    cdef uintptr_t fs
+    cdef object hostset  # keeps the HostSet alive while the filesystem is open
 
     def __init__(self, root, hostset):
         root = root.encode()
-
-        cdef unsigned int hs = hostset.hs
-        self.fs = <unsigned int>us_fs_init(<void*>self, root, <void*>hs)
+        self.hostset = hostset
+
+        cdef uintptr_t hs = hostset.hs
+        cdef void* id = <void*>self
+        cdef char* r = root
+        cdef uintptr_t fs
+        with nogil:
+            fs = <uintptr_t>us_fs_init(id, r, <void*>hs)
+        self.fs = fs
+        if not self.fs:
+            raise exception(self)
 
     def __enter__(self):
         return self
@@ -171,79 +1068,473 @@ cdef class FileSystem:
     def create(self, filename, min_hosts):
         filename = filename.encode()
 
-        cdef unsigned int f
+        cdef void* id = <void*>self
+        cdef void* fs = <void*>self.fs
+        cdef char* name = filename
+        cdef GoInt m = min_hosts
+        cdef uintptr_t f
 
-        f = <unsigned int>us_fs_create(<void*>self, <void*>self.fs, filename, min_hosts)
+        with nogil:
+            f = <uintptr_t>us_fs_create(id, fs, name, m)
         if not f:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
-        return File(f)
+        return File(f, self)
 
     def open(self, filename):
         filename = filename.encode()
 
-        cdef unsigned int f
+        cdef void* id = <void*>self
+        cdef void* fs = <void*>self.fs
+        cdef char* name = filename
+        cdef uintptr_t f
 
-        f = <unsigned int>us_fs_open(<void*>self, <void*>self.fs, filename)
+        with nogil:
+            f = <uintptr_t>us_fs_open(id, fs, name)
         if not f:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
-        return File(f)
+        return File(f, self)
 
     def close(self):
-        ok = us_fs_close(<void*>self, <void*>self.fs)
+        cdef void* id = <void*>self
+        cdef void* fs = <void*>self.fs
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_fs_close(id, fs)
         if not ok:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
+        self.fs = 0
         return ok
 
     def __exit__(self, type, value, traceback):
         self.close()
 
+    def __dealloc__(self):
+        cdef void* id = <void*>self
+        cdef void* fs = <void*>self.fs
+        with nogil:
+            if fs:
+                us_fs_close(id, fs)
+            us_error_free(id)
+
 
 cdef class File:
-    cdef unsigned int f
+    cdef uintptr_t f
+    cdef object fs  # keeps the FileSystem alive while the file is open
 
-    def __init__(self, f):
+    def __init__(self, f, fs):
         self.f = f
+        self.fs = fs
 
     def __enter__(self):
         return self
 
     def read(self, length):
         cdef unsigned char[:] data = bytearray(length)
-
-        n = us_file_read(<void*>self, <void*><unsigned int>self.f, <void*>&data[0], length)
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef void* buf = NULL
+        cdef size_t count = length
+        cdef ssize_t n
+        if count:
+            buf = <void*>&data[0]
+
+        with nogil:
+            n = us_file_read(id, f, buf, count)
         if n < 0:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
         return bytearray(data[:n])
 
     def write(self, data):
-        length = len(data)
-
         cdef unsigned char[:] view = bytearray(data)
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef void* buf = NULL
+        cdef size_t count = len(view)
+        cdef ssize_t n
+        if count:
+            buf = <void*>&view[0]
+
+        with nogil:
+            n = us_file_write(id, f, buf, count)
+        if n < 0:
+            raise exception(self)
 
-        n = us_file_write(<void*>self, <void*><unsigned int>self.f, <void*>&view[0], length)
+        return n
+
+    def pread(self, length, offset):
+        cdef unsigned char[:] data = bytearray(length)
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef void* buf = NULL
+        cdef size_t count = length
+        cdef int64_t off = offset
+        cdef ssize_t n
+        if count:
+            buf = <void*>&data[0]
+
+        with nogil:
+            n = us_file_read_at(id, f, buf, count, off)
         if n < 0:
-            raise RuntimeError(error(self))
+            raise exception(self)
+
+        return bytearray(data[:n])
+
+    def pwrite(self, data, offset):
+        cdef unsigned char[:] view = bytearray(data)
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef void* buf = NULL
+        cdef size_t count = len(view)
+        cdef int64_t off = offset
+        cdef ssize_t n
+        if count:
+            buf = <void*>&view[0]
+
+        with nogil:
+            n = us_file_write_at(id, f, buf, count, off)
+        if n < 0:
+            raise exception(self)
 
         return n
 
     def seek(self, offset, whence=0):
-        n = us_file_seek(<void*>self, <void*><unsigned int>self.f, offset, whence)
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef int64_t off = offset
+        cdef int w = whence
+        cdef int64_t n
+        with nogil:
+            n = us_file_seek(id, f, off, w)
         if n < 0:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
         return n
 
+    def size(self):
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef int64_t n
+        with nogil:
+            n = us_file_size(id, f)
+        if n < 0:
+            raise exception(self)
+
+        return n
+
+    def truncate(self, size):
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef int64_t sz = size
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_file_truncate(id, f, sz)
+        if not ok:
+            raise exception(self)
+
+    def sync(self):
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_file_sync(id, f)
+        if not ok:
+            raise exception(self)
+
     def close(self):
-        ok = us_file_close(<void*>self, <void*><unsigned int>self.f)
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        cdef GoUint8 ok
+        with nogil:
+            ok = us_file_close(id, f)
         if not ok:
-            raise RuntimeError(error(self))
+            raise exception(self)
 
+        self.f = 0
         return ok
 
     def __exit__(self, type, value, traceback):
         self.close()
 
+    def __dealloc__(self):
+        cdef void* id = <void*>self
+        cdef void* f = <void*>self.f
+        with nogil:
+            if f:
+                us_file_close(id, f)
+            us_error_free(id)
+
+
+
+# asyncio versions of the blocking classes
+
+class _Opener:
+    # The result of AsyncFileSystem.create and AsyncFileSystem.open, which can
+    # either be awaited or used in an 'async with' block.
+
+    def __init__(self, coro):
+        self._coro = coro
+
+    def __await__(self):
+        return self._coro.__await__()
+
+    async def __aenter__(self):
+        self._f = await self._coro
+        return self._f
+
+    async def __aexit__(self, type, value, traceback):
+        await self._f.close()
+
+
+cdef class AsyncFileSystem(FileSystem):
+    """A FileSystem whose blocking methods are coroutines."""
+
+    def _start_open(self, _CompletionQueue q, filename, min_hosts):
+        filename = filename.encode()
+        cdef uint64_t op
+        if min_hosts is None:
+            op = us_fs_open_async(<void*>self, <void*>q.cq, <void*>self.fs, filename, NULL)
+        else:
+            op = us_fs_create_async(<void*>self, <void*>q.cq, <void*>self.fs, filename, min_hosts, NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def _open(self, filename, min_hosts):
+        q = _queue()
+        f = await q.wait(self._start_open(q, filename, min_hosts), release=q._release_file)
+        return AsyncFile(f, self)
+
+    def create(self, filename, min_hosts):
+        return _Opener(self._open(filename, min_hosts))
+
+    def open(self, filename):
+        return _Opener(self._open(filename, None))
+
+    def _start_close(self, _CompletionQueue q):
+        cdef uint64_t op = us_fs_close_async(<void*>self, <void*>q.cq, <void*>self.fs, NULL)
+        if not op:
+            raise exception(self)
+
+        self.fs = 0
+        return op
+
+    async def close(self):
+        if self.fs:
+            q = _queue()
+            await q.wait(self._start_close(q))
+        return True
+
+    async def __aenter__(self):
+        return self
+
+    async def __aexit__(self, type, value, traceback):
+        await self.close()
+
+
+cdef class AsyncFile(File):
+    """A File whose blocking methods are coroutines. seek, size and truncate
+    remain synchronous."""
+
+    def _start_io(self, _CompletionQueue q, data, offset, write):
+        cdef unsigned char[:] view = data
+        cdef void* buf = NULL
+        cdef size_t count = len(data)
+        cdef uint64_t op
+        if count:
+            buf = <void*>&view[0]
+
+        if offset is None and write:
+            op = us_file_write_async(<void*>self, <void*>q.cq, <void*>self.f, buf, count, NULL)
+        elif offset is None:
+            op = us_file_read_async(<void*>self, <void*>q.cq, <void*>self.f, buf, count, NULL)
+        elif write:
+            op = us_file_write_at_async(<void*>self, <void*>q.cq, <void*>self.f, buf, count, offset, NULL)
+        else:
+            op = us_file_read_at_async(<void*>self, <void*>q.cq, <void*>self.f, buf, count, offset, NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def read(self, length):
+        data = bytearray(length)
+        q = _queue()
+        n = await q.wait(self._start_io(q, data, None, False), data)
+        return data[:n]
+
+    async def write(self, data):
+        data = bytearray(data)
+        q = _queue()
+        return await q.wait(self._start_io(q, data, None, True), data)
+
+    async def pread(self, length, offset):
+        data = bytearray(length)
+        q = _queue()
+        n = await q.wait(self._start_io(q, data, offset, False), data)
+        return data[:n]
+
+    async def pwrite(self, data, offset):
+        data = bytearray(data)
+        q = _queue()
+        return await q.wait(self._start_io(q, data, offset, True), data)
+
+    def _start_sync(self, _CompletionQueue q):
+        cdef uint64_t op = us_file_sync_async(<void*>self, <void*>q.cq, <void*>self.f, NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def sync(self):
+        q = _queue()
+        await q.wait(self._start_sync(q))
+
+    def _start_close(self, _CompletionQueue q):
+        cdef uint64_t op = us_file_close_async(<void*>self, <void*>q.cq, <void*>self.f, NULL)
+        if not op:
+            raise exception(self)
+
+        self.f = 0
+        return op
+
+    async def close(self):
+        if self.f:
+            q = _queue()
+            await q.wait(self._start_close(q))
+        return True
+
+    async def __aenter__(self):
+        return self
+
+    async def __aexit__(self, type, value, traceback):
+        await self.close()
+
+
+cdef class AsyncSession(Session):
+    """A Session whose upload and download methods are coroutines. Create one
+    with Client.new_async_session."""
+
+    def __init__(self, siad, sess):
+        self.siad = siad
+        self.sess = sess
+
+    def _start_upload(self, _CompletionQueue q, sector, root):
+        cdef unsigned char[:] sector_view = sector
+        cdef unsigned char[:] root_view = root
+        cdef uint64_t op = us_ll_upload_async(<void*>self, <void*>q.cq, <void*>self.sess, <void*>&sector_view[0], <void*>&root_view[0], NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def upload(self, sector):
+        sector = bytearray(sector)
+        sector.extend((SECTOR_SIZE - len(sector)) * b'\x00')
+        root = bytearray(HASH_LEN)
+        q = _queue()
+        await q.wait(self._start_upload(q, sector, root), (sector, root))
+        return root
+
+    def _start_download(self, _CompletionQueue q, root, data, unsigned int offset):
+        cdef unsigned char[:] root_view = root
+        cdef unsigned char[:] view = data
+        cdef void* buf = NULL
+        cdef unsigned int length = len(data)
+        if length:
+            buf = <void*>&view[0]
+
+        cdef uint64_t op = us_ll_download_async(<void*>self, <void*>q.cq, <void*>self.sess, <void*>&root_view[0], buf, offset, length, NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def download(self, root, offset=0, length=SECTOR_SIZE):
+        root = bytearray(root)
+        data = bytearray(length)
+        q = _queue()
+        await q.wait(self._start_download(q, root, data, offset), (root, data))
+        return data
+
+    def _start_download_many(self, _CompletionQueue q, sections, list bufs):
+        cdef us_section_t* secs = _make_sections(sections, bufs)
+        cdef uint64_t op
+        try:
+            op = us_ll_download_many_async(<void*>self, <void*>q.cq, <void*>self.sess, secs, len(bufs), NULL)
+        finally:
+            free(secs)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def download_many(self, sections):
+        bufs = []
+        q = _queue()
+        await q.wait(self._start_download_many(q, sections, bufs), bufs)
+        return bufs
+
+    def _start_upload_many(self, _CompletionQueue q, data, roots):
+        cdef uint64_t op = us_ll_upload_many_async(<void*>self, <void*>q.cq, <void*>self.sess, _data(data), len(data) // SECTOR_SIZE, _data(roots), NULL, NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def upload_many(self, sectors):
+        data = _pack_sectors(sectors)
+        roots = bytearray(len(data) // SECTOR_SIZE * HASH_LEN)
+        q = _queue()
+        size = await q.wait(self._start_upload_many(q, data, roots), roots)
+        return _split_roots(roots), size
+
+    def _start_swap_sectors(self, _CompletionQueue q, pairs, root):
+        cdef size_t n
+        cdef uint64_t* indices = _make_pairs(pairs, &n)
+        cdef uint64_t op
+        try:
+            op = us_ll_swap_sectors_async(<void*>self, <void*>q.cq, <void*>self.sess, indices, n, _data(root), NULL)
+        finally:
+            free(indices)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def swap_sectors(self, pairs):
+        root = bytearray(HASH_LEN)
+        q = _queue()
+        size = await q.wait(self._start_swap_sectors(q, pairs, root), root)
+        return root, size
+
+    def _start_trim(self, _CompletionQueue q, uint64_t n, root):
+        cdef uint64_t op = us_ll_trim_sectors_async(<void*>self, <void*>q.cq, <void*>self.sess, n, _data(root), NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def trim(self, n):
+        root = bytearray(HASH_LEN)
+        q = _queue()
+        size = await q.wait(self._start_trim(q, n, root), root)
+        return root, size
+
+    def _start_delete_sectors(self, _CompletionQueue q, data, root):
+        cdef uint64_t op = us_ll_delete_sectors_async(<void*>self, <void*>q.cq, <void*>self.sess, _data(data), len(data) // HASH_LEN, _data(root), NULL)
+        if not op:
+            raise exception(self)
+
+        return op
+
+    async def delete_sectors(self, roots):
+        data = bytearray(b''.join(bytes(r) for r in roots))
+        root = bytearray(HASH_LEN)
+        q = _queue()
+        size = await q.wait(self._start_delete_sectors(q, data, root), root)
+        return root, size
@@ -12,7 +12,7 @@ us_extension = Extension(
     sources=["pyus.pyx"],
     libraries=["us"],
     library_dirs=["."],
-    include_dirs=["."]
+    include_dirs=[".", "../include"]
 )
 setup(
     name="pyus",
@@ -5,11 +5,10 @@ hs = Us::HostSet.new("<shard server address>")
 
 # Load a contract into the host set.
 #
-# Fill in this string with a hex-encoded contract. It should be 192 bytes.
-# You can turn an existing contract into a hex string with the following
-# command:
-#     xxd -ps -s 12 -l 96 my.contract | tr -d '\n'
-hs.add_host(Us::Contract.new("<hex contract string>"))
+# Fill in this string with the path of a contract formed by user. (You can
+# also pass a hex-encoded contract to Us::Contract.new, or use hs.add_dir to
+# load every contract in a directory.)
+hs.add_host(Us::Contract.load("<path to .contract file>"))
 
 # create a filesystem rooted at "meta". The filesystem will be closed
 # automatically at the end of the block.
@@ -27,3 +26,6 @@ Us::FileSystem.new("meta", hs) do |fs|
         puts "Downloaded: " + f.read(16)
     end
 end
+
+# Free the host set now that the filesystem is closed.
+hs.free
@@ -5,40 +5,149 @@ module Us
 
     ffi_lib './us.so'
     attach_function :us_error, [], :string
-    attach_function :us_contract_init, [:pointer, :pointer], :void
+    attach_function :us_error_code, [], :int
+    attach_function :us_contract_init, [:pointer, :pointer], :bool
+    attach_function :us_contract_init_hex, [:pointer, :string], :bool
+    attach_function :us_contract_load, [:pointer, :string], :bool
     attach_function :us_hostset_init, [:string], :pointer
+    attach_function :us_hostset_free, [:pointer], :bool
     attach_function :us_hostset_add, [:pointer, :pointer], :bool
+    attach_function :us_hostset_add_dir, [:pointer, :string], :int
+    attach_function :us_hostset_set_limits, [:pointer, :pointer], :bool
     attach_function :us_fs_init, [:string, :pointer], :pointer
     attach_function :us_fs_create, [:pointer, :string, :int], :pointer
     attach_function :us_fs_open, [:pointer, :string], :pointer
     attach_function :us_fs_close, [:pointer], :bool
+    attach_function :us_fs_mkdir, [:pointer, :string, :uint32], :bool
+    attach_function :us_fs_mkdirall, [:pointer, :string, :uint32], :bool
+    attach_function :us_fs_remove, [:pointer, :string], :bool
+    attach_function :us_fs_removeall, [:pointer, :string], :bool
+    attach_function :us_fs_rename, [:pointer, :string, :string], :bool
+    attach_function :us_fs_stat, [:pointer, :string, :pointer], :bool
+    attach_function :us_fileinfo_free, [:pointer], :void
+    attach_function :us_fs_opendir, [:pointer, :string], :pointer
+    attach_function :us_dir_next, [:pointer, :pointer], :int
+    attach_function :us_dir_close, [:pointer], :bool
     attach_function :us_file_read, [:pointer, :pointer, :int], :int
     attach_function :us_file_write, [:pointer, :pointer, :int], :int
+    attach_function :us_file_seek, [:pointer, :int64, :int], :int64
+    attach_function :us_file_size, [:pointer], :int64
+    attach_function :us_file_truncate, [:pointer, :int64], :bool
+    attach_function :us_file_sync, [:pointer], :bool
     attach_function :us_file_close, [:pointer], :bool
 
+    # Error is raised when a call into the library fails. code is the
+    # corresponding us_errcode_t value.
+    class Error < StandardError
+        attr_reader :code
+
+        def initialize(msg = Us.us_error(), code = Us.us_error_code())
+            super(msg)
+            @code = code
+        end
+    end
+
     class Contract < FFI::Struct
         layout :hostKey,   :pointer,
                :id,        :pointer,
                :renterKey, :pointer
 
-        def initialize(hex)
-            bin = hex.scan(/../).map { |x| x.hex.chr }.join # decode hex
-            raise 'contract hex string must be 192 bytes' unless bin.length == 96
+        # Either a hex-encoded contract or the path of a contract file must be
+        # supplied.
+        def initialize(hex = nil, path: nil)
             contract = FFI::MemoryPointer.new(:char, 96)
-            Us.us_contract_init(contract, bin)
+            if path
+                raise Us::Error unless Us.us_contract_load(contract, path)
+            else
+                raise Us::Error unless Us.us_contract_init_hex(contract, hex)
+            end
             super(contract)
         end
+
+        def self.load(path)
+            new(path: path)
+        end
+    end
+
+    class FileInfo < FFI::Struct
+        layout :name,      :string,
+               :size,      :int64,
+               :mode,      :uint32,
+               :mod_time,  :int64,
+               :is_dir,    :uint8,
+               :min_hosts, :int,
+               :num_hosts, :int,
+               :hosts,     :pointer
+
+        # to_h copies the info into a Hash; the struct itself must still be
+        # released with us_fileinfo_free.
+        def to_h
+            hosts = (0...self[:num_hosts]).map do |i|
+                (self[:hosts] + i*32).read_bytes(32).unpack1('H*')
+            end
+            {
+                name:      self[:name],
+                size:      self[:size],
+                mode:      self[:mode],
+                mod_time:  Time.at(self[:mod_time]),
+                dir:       self[:is_dir] != 0,
+                min_hosts: self[:min_hosts],
+                hosts:     hosts,
+            }
+        end
+    end
+
+    class Limits < FFI::Struct
+        layout :max_storage_price,    :pointer,
+               :max_upload_price,     :pointer,
+               :max_download_price,   :pointer,
+               :max_contract_price,   :pointer,
+               :min_collateral_ratio, :double
     end
 
     class HostSet < FFI::Pointer
         def add_host(contract)
             ok = Us.us_hostset_add(self, contract)
-            raise Us.us_error() if !ok
+            raise Us::Error if !ok
+        end
+
+        # add_dir adds every .contract file in dir, returning the number of
+        # contracts added.
+        def add_dir(dir)
+            n = Us.us_hostset_add_dir(self, dir)
+            raise Us::Error if n == -1
+            n
+        end
+
+        # set_limits restricts the prices paid to the hosts in the set. Prices
+        # are strings such as '100H' or '1SC'; storage price is per byte per
+        # block, and upload and download prices are per byte. Operations that
+        # would use a host violating the limits raise an error with code
+        # US_ERR_PRICE_EXCEEDED.
+        def set_limits(max_storage_price: nil, max_upload_price: nil, max_download_price: nil,
+                       max_contract_price: nil, min_collateral_ratio: 0)
+            limits = Us::Limits.new
+            strs = {
+                max_storage_price:  max_storage_price,
+                max_upload_price:   max_upload_price,
+                max_download_price: max_download_price,
+                max_contract_price: max_contract_price,
+            }.map do |field, price|
+                limits[field] = price ? FFI::MemoryPointer.from_string(price) : nil
+            end
+            limits[:min_collateral_ratio] = min_collateral_ratio
+            ok = Us.us_hostset_set_limits(self, limits)
+            raise Us::Error if !ok
+        end
+
+        def free()
+            ok = Us.us_hostset_free(self)
+            raise Us::Error if !ok
         end
 
         def initialize(shard_addr)
             hs = Us.us_hostset_init(shard_addr)
-            raise Us.us_error() if hs.nil?
+            raise Us::Error if hs.null?
             super(hs)
         end
     end
@@ -46,24 +155,66 @@ module Us
     class FileSystem < FFI::Pointer
         def create(name, minHosts:)
             f = Us::File.new(Us.us_fs_create(self, name, minHosts))
-            raise Us.us_error() if f.nil?
+            raise Us::Error if f.null?
             return f unless block_given?
             yield(f)
             f.close
         end
         def open(name)
             f = Us::File.new(Us.us_fs_open(self, name))
-            raise Us.us_error() if f.nil?
+            raise Us::Error if f.null?
             return f unless block_given?
             yield(f)
             f.close
         end
+        def mkdir(name, perm = 0755)
+            raise Us::Error if !Us.us_fs_mkdir(self, name, perm)
+        end
+        def mkdir_all(path, perm = 0755)
+            raise Us::Error if !Us.us_fs_mkdirall(self, path, perm)
+        end
+        def remove(name)
+            raise Us::Error if !Us.us_fs_remove(self, name)
+        end
+        def remove_all(path)
+            raise Us::Error if !Us.us_fs_removeall(self, path)
+        end
+        def rename(oldname, newname)
+            raise Us::Error if !Us.us_fs_rename(self, oldname, newname)
+        end
+        def stat(name)
+            info = FileInfo.new
+            raise Us::Error if !Us.us_fs_stat(self, name, info)
+            h = info.to_h
+            Us.us_fileinfo_free(info)
+            h
+        end
+        def readdir(name)
+            d = Us.us_fs_opendir(self, name)
+            raise Us::Error if d.null?
+            entries = []
+            info = FileInfo.new
+            begin
+                loop do
+                    r = Us.us_dir_next(d, info)
+                    raise Us::Error if r == -1
+                    break if r == 0
+                    entries << info.to_h
+                    Us.us_fileinfo_free(info)
+                end
+            ensure
+                Us.us_dir_close(d)
+            end
+            entries
+        end
         def close()
             ok = Us.us_fs_close(self)
-            raise Us.us_error() if !ok
+            raise Us::Error if !ok
         end
         def initialize(root, hostset)
-            fs = super(Us.us_fs_init(root, hostset))
+            p = Us.us_fs_init(root, hostset)
+            raise Us::Error if p.null?
+            fs = super(p)
             return fs unless block_given?
             yield(fs)
             fs.close
@@ -75,18 +226,34 @@ module Us
             str = ""
             FFI::MemoryPointer.new(:char, n) do |buf|
                 bytes_read = Us.us_file_read(self, buf, n)
-                raise Us.us_error() if bytes_read == -1
+                raise Us::Error if bytes_read == -1
                 str = buf.read_string_to_null
             end
             str
         end
         def write(str)
             bytes_written = Us.us_file_write(self, str, str.length)
-            raise Us.us_error() if bytes_written == -1
+            raise Us::Error if bytes_written == -1
+        end
+        def seek(offset, whence = IO::SEEK_SET)
+            pos = Us.us_file_seek(self, offset, whence)
+            raise Us::Error if pos == -1
+            pos
+        end
+        def size()
+            n = Us.us_file_size(self)
+            raise Us::Error if n == -1
+            n
+        end
+        def truncate(size)
+            raise Us::Error if !Us.us_file_truncate(self, size)
+        end
+        def sync()
+            raise Us::Error if !Us.us_file_sync(self)
         end
         def close()
             ok = Us.us_file_close(self)
-            raise Us.us_error() if !ok
+            raise Us::Error if !ok
         end
     end
 end